@@ -0,0 +1,59 @@
+package go_faceid_pipeline
+
+import (
+	"context"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+)
+
+// AdmissionStats holds the admission counters of a pipeline: Pipeline counts its ExtractFaceFeatures calls and
+// Models the requests of every model with admission limits, keyed by model name. Shed calls and requests return
+// an error wrapping inference.ErrOverloaded.
+type AdmissionStats struct {
+	Pipeline inference.AdmissionStats
+	Models   map[string]inference.AdmissionStats
+}
+
+// admission limits the calls of a pipeline and the requests of its models. A nil limiter or backend admits
+// everything.
+type admission struct {
+	pipeline *inference.Limiter
+	models   *inference.AdmissionBackend
+}
+
+// newAdmission creates the admission control of a pipeline whose model requests go through models.
+func newAdmission(cfg *config.PipelineParams, models *inference.AdmissionBackend) (admission, error) {
+	a := admission{models: models}
+	if cfg.PipelineAdmission != nil {
+		limiter, err := inference.NewLimiter(cfg.PipelineAdmission)
+		if err != nil {
+			return a, fmt.Errorf("pipeline admission: %w", err)
+		}
+		a.pipeline = limiter
+	}
+	return a, nil
+}
+
+// acquire waits until a call is admitted and returns the function ending it.
+func (a admission) acquire(ctx context.Context) (func(), error) {
+	if a.pipeline == nil {
+		return func() {}, nil
+	}
+	err := a.pipeline.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline: %w", err)
+	}
+	return a.pipeline.Release, nil
+}
+
+func (a admission) stats() AdmissionStats {
+	var stats AdmissionStats
+	if a.pipeline != nil {
+		stats.Pipeline = a.pipeline.Stats()
+	}
+	if a.models != nil {
+		stats.Models = a.models.Stats()
+	}
+	return stats
+}
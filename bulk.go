@@ -0,0 +1,182 @@
+package go_faceid_pipeline
+
+import (
+	"context"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"gocv.io/x/gocv"
+	"iter"
+	"sync"
+	"time"
+)
+
+// BulkItem is an image to process in bulk. The image stays owned by the caller, it must remain valid until the
+// result of the item is received and is not closed by the pipeline.
+type BulkItem struct {
+	ID    string
+	Image gocv.Mat
+}
+
+// BulkResult is the outcome of a BulkItem. Err is set instead of Result when the item failed.
+type BulkResult[T any] struct {
+	ID string
+	// Index is the position of the item in the input.
+	Index  int
+	Result T
+	Err    error
+}
+
+// BulkProgress counts the results emitted so far.
+type BulkProgress struct {
+	Processed int
+	Failed    int
+	Elapsed   time.Duration
+}
+
+// BulkProgressFunc is called after every emitted result, from the goroutine emitting results.
+type BulkProgressFunc func(progress BulkProgress)
+
+// ChannelItems returns an iterator over the items received from items until it is closed or ctx is done.
+func ChannelItems(ctx context.Context, items <-chan BulkItem) iter.Seq[BulkItem] {
+	return func(yield func(BulkItem) bool) {
+		for {
+			select {
+			case item, ok := <-items:
+				if !ok || !yield(item) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// ExtractFaceFeaturesBulk runs ExtractFaceFeatures on every item of items, see runBulk.
+func (c *GeneralExtractPipeline) ExtractFaceFeaturesBulk(ctx context.Context, items iter.Seq[BulkItem], isEnroll bool, cfg *config.BulkExtractionParams, progress BulkProgressFunc) <-chan BulkResult[*GeneralExtractionResult] {
+	return runBulk(ctx, items, cfg, progress, func(ctx context.Context, img gocv.Mat) (*GeneralExtractionResult, error) {
+		return c.ExtractFaceFeatures(ctx, img, isEnroll)
+	})
+}
+
+// ExtractFaceFeaturesBulk runs ExtractFaceFeatures on every item of items, see runBulk.
+func (c *AntiSpoofingExtractPipeline) ExtractFaceFeaturesBulk(ctx context.Context, items iter.Seq[BulkItem], isEnroll, spoofingControl bool, cfg *config.BulkExtractionParams, progress BulkProgressFunc) <-chan BulkResult[*AntiSpoofingExtractionResult] {
+	return runBulk(ctx, items, cfg, progress, func(ctx context.Context, img gocv.Mat) (*AntiSpoofingExtractionResult, error) {
+		return c.ExtractFaceFeatures(ctx, img, isEnroll, spoofingControl)
+	})
+}
+
+type bulkJob struct {
+	index int
+	item  BulkItem
+}
+
+// runBulk pulls items as workers become available and processes them with cfg.Workers concurrent calls to extract.
+// It emits one result per item on the returned channel, in input order when cfg.Ordered is set, and closes it once
+// every item pulled is done. The channel must be drained. At most twice as many items as workers are pulled but not
+// emitted yet, so a slow item in ordered mode holds back the input rather than buffering results without bound.
+//
+// When ctx is done, no more items are pulled, the items in progress fail with the error of ctx and the channel is
+// closed even if the iterator is blocked. An item the iterator already returned but not yet handed to a worker is
+// dropped without a result. The iterator must return once ctx is done, like ChannelItems, for its goroutine to end.
+func runBulk[T any](ctx context.Context, items iter.Seq[BulkItem], cfg *config.BulkExtractionParams, progress BulkProgressFunc, extract func(ctx context.Context, img gocv.Mat) (T, error)) <-chan BulkResult[T] {
+	if cfg == nil {
+		cfg = config.DefaultBulkExtractionParams
+	}
+	workers := max(cfg.Workers, 1)
+
+	window := make(chan struct{}, 2*workers)
+	jobs := make(chan bulkJob)
+	results := make(chan BulkResult[T], workers)
+	out := make(chan BulkResult[T], workers)
+
+	// The items are pulled by their own goroutine so that the input stops as soon as ctx is done, even while the
+	// iterator is blocked waiting for its next item.
+	pulled := make(chan BulkItem)
+	go func() {
+		defer close(pulled)
+		for item := range items {
+			select {
+			case pulled <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(jobs)
+		for index := 0; ; index++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			var item BulkItem
+			var ok bool
+			select {
+			case item, ok = <-pulled:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+			jobs <- bulkJob{index: index, item: item}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				result, err := extract(ctx, job.item.Image)
+				results <- BulkResult[T]{ID: job.item.ID, Index: job.index, Result: result, Err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	go func() {
+		defer close(out)
+		start := time.Now()
+		var counts BulkProgress
+		emit := func(result BulkResult[T]) {
+			out <- result
+			<-window
+			counts.Processed++
+			if result.Err != nil {
+				counts.Failed++
+			}
+			if progress != nil {
+				counts.Elapsed = time.Since(start)
+				progress(counts)
+			}
+		}
+
+		pending := make(map[int]BulkResult[T])
+		next := 0
+		for result := range results {
+			if !cfg.Ordered {
+				emit(result)
+				continue
+			}
+			pending[result.Index] = result
+			for {
+				result, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				emit(result)
+				next++
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,195 @@
+package go_faceid_pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/tritontest"
+	"github.com/stretchr/testify/assert"
+	"gocv.io/x/gocv"
+	"image"
+	"iter"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func bulkItems(n int) iter.Seq[BulkItem] {
+	return func(yield func(BulkItem) bool) {
+		for i := range n {
+			if !yield(BulkItem{ID: fmt.Sprintf("item-%d", i)}) {
+				return
+			}
+		}
+	}
+}
+
+func TestRunBulk(t *testing.T) {
+	const n = 50
+	var running, maxRunning atomic.Int32
+	extract := func(ctx context.Context, img gocv.Mat) (int, error) {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for {
+			previous := maxRunning.Load()
+			if current <= previous || maxRunning.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return 1, nil
+	}
+
+	var progress []BulkProgress
+	results := runBulk(context.Background(), bulkItems(n), config.NewBulkExtractionParams(4, false), func(p BulkProgress) {
+		progress = append(progress, p)
+	}, extract)
+
+	seen := make(map[int]bool)
+	for result := range results {
+		assert.NoError(t, result.Err)
+		assert.Equal(t, fmt.Sprintf("item-%d", result.Index), result.ID)
+		seen[result.Index] = true
+	}
+	assert.Len(t, seen, n)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(4))
+	assert.Len(t, progress, n)
+	assert.Equal(t, n, progress[n-1].Processed)
+	assert.Zero(t, progress[n-1].Failed)
+}
+
+func TestRunBulk_Ordered(t *testing.T) {
+	const n = 20
+	var started atomic.Int32
+	results := runBulk(context.Background(), bulkItems(n), config.NewBulkExtractionParams(8, true), nil, func(ctx context.Context, img gocv.Mat) (int, error) {
+		// Later items finish first.
+		time.Sleep(time.Duration(n-started.Add(1)) * time.Millisecond)
+		return 0, nil
+	})
+
+	next := 0
+	for result := range results {
+		assert.Equal(t, next, result.Index)
+		assert.Equal(t, fmt.Sprintf("item-%d", next), result.ID)
+		next++
+	}
+	assert.Equal(t, n, next)
+}
+
+func TestRunBulk_Errors(t *testing.T) {
+	var progress BulkProgress
+	results := runBulk(context.Background(), bulkItems(10), config.NewBulkExtractionParams(3, true), func(p BulkProgress) {
+		progress = p
+	}, func(ctx context.Context, img gocv.Mat) (int, error) {
+		return 0, errors.New("failed")
+	})
+
+	count := 0
+	for result := range results {
+		assert.EqualError(t, result.Err, "failed")
+		count++
+	}
+	assert.Equal(t, 10, count)
+	assert.Equal(t, BulkProgress{Processed: 10, Failed: 10, Elapsed: progress.Elapsed}, progress)
+}
+
+func TestRunBulk_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The items never run out, canceling ctx stops pulling them.
+	items := func(yield func(BulkItem) bool) {
+		for {
+			if !yield(BulkItem{}) {
+				return
+			}
+		}
+	}
+
+	results := runBulk(ctx, items, config.NewBulkExtractionParams(2, false), nil, func(ctx context.Context, img gocv.Mat) (int, error) {
+		return 0, ctx.Err()
+	})
+
+	count := 0
+	for range results {
+		count++
+		if count == 5 {
+			cancel()
+		}
+	}
+	assert.GreaterOrEqual(t, count, 5)
+}
+
+func TestRunBulk_CanceledWaitingForItems(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The channel is never closed, the iterator blocks once the items sent are pulled.
+	items := make(chan BulkItem)
+	go func() {
+		for i := range 3 {
+			items <- BulkItem{ID: fmt.Sprint(i)}
+		}
+	}()
+	iterated := make(chan struct{})
+	channelItems := func(yield func(BulkItem) bool) {
+		defer close(iterated)
+		ChannelItems(ctx, items)(yield)
+	}
+
+	results := runBulk(ctx, channelItems, config.NewBulkExtractionParams(2, true), nil, func(ctx context.Context, img gocv.Mat) (int, error) {
+		return 1, nil
+	})
+
+	done := make(chan int)
+	go func() {
+		count := 0
+		for range results {
+			count++
+			if count == 3 {
+				cancel()
+			}
+		}
+		done <- count
+	}()
+
+	select {
+	case count := <-done:
+		assert.Equal(t, 3, count)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the results were not closed after ctx was canceled")
+	}
+	select {
+	case <-iterated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the iterator did not return after ctx was canceled")
+	}
+}
+
+func TestGeneralExtractPipeline_ExtractFaceFeaturesBulk(t *testing.T) {
+	_, backend := newTestBackend(t, tritontest.FaceIDModels(image.Pt(10, 10)))
+
+	client, err := NewGeneralExtractPipeline(backend, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	items := make(chan BulkItem)
+	go func() {
+		defer close(items)
+		for i := range 6 {
+			items <- BulkItem{ID: fmt.Sprint(i), Image: img}
+		}
+	}()
+
+	next := 0
+	for result := range client.ExtractFaceFeaturesBulk(context.Background(), ChannelItems(context.Background(), items), false, config.NewBulkExtractionParams(3, true), nil) {
+		assert.NoError(t, result.Err)
+		assert.Equal(t, fmt.Sprint(next), result.ID)
+		assert.Equal(t, 1, result.Result.FaceCount)
+		assert.Equal(t, 512, result.Result.FacialFeatures.DataSize())
+		next++
+	}
+	assert.Equal(t, 6, next)
+}
@@ -33,12 +33,17 @@ var FaceQualityClassMapper = map[FaceQualityClass]string{
 }
 
 type RetinaFaceDetectionParams struct {
-	ModelName           string        `json:"model_name"`
-	Timeout             time.Duration `json:"timeout"`
-	ImageSize           [2]int        `json:"image_size"`
-	MaxBatchSize        int           `json:"max_batch_size"`
-	ConfidenceThreshold float32       `json:"confidence_threshold"`
-	IOUThreshold        float32       `json:"iou_threshold"`
+	ModelName    string        `json:"model_name"`
+	ModelVersion string        `json:"model_version"`
+	Timeout      time.Duration `json:"timeout"`
+	ImageSize    [2]int        `json:"image_size"`
+	// MaxBatchSize is the largest number of images sent in one detection request, by FaceDetectionClient.InferBatch
+	// or by the micro-batching dispatcher. InferBatch uses the batch size of models with a fixed batch dimension.
+	MaxBatchSize        int     `json:"max_batch_size"`
+	ConfidenceThreshold float32 `json:"confidence_threshold"`
+	IOUThreshold        float32 `json:"iou_threshold"`
+	// Network holds the anchors and normalization of the checkpoint. Nil uses RetinaFaceR50Network.
+	Network *RetinaFaceNetworkParams `json:"network"`
 }
 
 var DefaultRetinaFaceDetectionParams = &RetinaFaceDetectionParams{
@@ -48,6 +53,7 @@ var DefaultRetinaFaceDetectionParams = &RetinaFaceDetectionParams{
 	MaxBatchSize:        1,
 	ConfidenceThreshold: 0.7,
 	IOUThreshold:        0.45,
+	Network:             RetinaFaceR50Network,
 }
 
 func NewRetinaFaceDetectionParams(modelName string, timeout time.Duration, imgSize [2]int, maxBatchSize int, confidenceThreshold, iouThreshold float32) *RetinaFaceDetectionParams {
@@ -58,6 +64,214 @@ func NewRetinaFaceDetectionParams(modelName string, timeout time.Duration, imgSi
 		MaxBatchSize:        maxBatchSize,
 		ConfidenceThreshold: confidenceThreshold,
 		IOUThreshold:        iouThreshold,
+		Network:             RetinaFaceR50Network,
+	}
+}
+
+// RetinaFaceAnchorParams holds the anchors of one FPN stride. Every ratio of Ratios and scale of Scales gives an
+// anchor of BaseSize*scale pixels, ratio-major like the channels of the model outputs.
+type RetinaFaceAnchorParams struct {
+	Stride   int       `json:"stride"`
+	BaseSize int       `json:"base_size"`
+	Ratios   []float32 `json:"ratios"`
+	Scales   []float32 `json:"scales"`
+}
+
+func NewRetinaFaceAnchorParams(stride, baseSize int, ratios, scales []float32) RetinaFaceAnchorParams {
+	return RetinaFaceAnchorParams{
+		Stride:   stride,
+		BaseSize: baseSize,
+		Ratios:   ratios,
+		Scales:   scales,
+	}
+}
+
+// RetinaFaceNetworkParams describes a RetinaFace checkpoint: the anchors of its outputs, the normalization of its
+// input and the scaling of its regressed deltas.
+type RetinaFaceNetworkParams struct {
+	// Anchors lists the strides from the largest to the smallest, in the order of the score, bbox and landmark
+	// outputs of the model.
+	Anchors []RetinaFaceAnchorParams `json:"anchors"`
+	// PixelMeans and PixelStds are in BGR order, each input channel is (pixel/PixelScale - mean) / std.
+	PixelMeans [3]float32 `json:"pixel_means"`
+	PixelStds  [3]float32 `json:"pixel_stds"`
+	PixelScale float32    `json:"pixel_scale"`
+	// BBoxStds and LandmarkStd multiply the regressed box and landmark deltas before they are decoded.
+	BBoxStds    [4]float32 `json:"bbox_stds"`
+	LandmarkStd float32    `json:"landmark_std"`
+}
+
+// RetinaFaceR50Network is the insightface retinaface_r50_v1 checkpoint: strides 32, 16 and 8 with two square
+// anchors each and unnormalized input.
+var RetinaFaceR50Network = &RetinaFaceNetworkParams{
+	Anchors:     retinaFaceNet3Anchors(),
+	PixelMeans:  [3]float32{0, 0, 0},
+	PixelStds:   [3]float32{1, 1, 1},
+	PixelScale:  1,
+	BBoxStds:    [4]float32{1, 1, 1, 1},
+	LandmarkStd: 1,
+}
+
+// RetinaFaceMobileNet025V1Network is the insightface retinaface_mnet025_v1 checkpoint, which shares the anchors
+// and normalization of RetinaFaceR50Network.
+var RetinaFaceMobileNet025V1Network = &RetinaFaceNetworkParams{
+	Anchors:     retinaFaceNet3Anchors(),
+	PixelMeans:  [3]float32{0, 0, 0},
+	PixelStds:   [3]float32{1, 1, 1},
+	PixelScale:  1,
+	BBoxStds:    [4]float32{1, 1, 1, 1},
+	LandmarkStd: 1,
+}
+
+// RetinaFaceMobileNet025V2Network is the insightface retinaface_mnet025_v2 checkpoint, whose landmark deltas are
+// scaled by 0.2.
+var RetinaFaceMobileNet025V2Network = &RetinaFaceNetworkParams{
+	Anchors:     retinaFaceNet3Anchors(),
+	PixelMeans:  [3]float32{0, 0, 0},
+	PixelStds:   [3]float32{1, 1, 1},
+	PixelScale:  1,
+	BBoxStds:    [4]float32{1, 1, 1, 1},
+	LandmarkStd: 0.2,
+}
+
+func NewRetinaFaceNetworkParams(anchors []RetinaFaceAnchorParams, pixelMeans, pixelStds [3]float32, pixelScale float32, bboxStds [4]float32, landmarkStd float32) *RetinaFaceNetworkParams {
+	return &RetinaFaceNetworkParams{
+		Anchors:     anchors,
+		PixelMeans:  pixelMeans,
+		PixelStds:   pixelStds,
+		PixelScale:  pixelScale,
+		BBoxStds:    bboxStds,
+		LandmarkStd: landmarkStd,
+	}
+}
+
+// retinaFaceNet3Anchors returns the anchors of the three stride insightface networks.
+func retinaFaceNet3Anchors() []RetinaFaceAnchorParams {
+	return []RetinaFaceAnchorParams{
+		NewRetinaFaceAnchorParams(32, 16, []float32{1}, []float32{32, 16}),
+		NewRetinaFaceAnchorParams(16, 16, []float32{1}, []float32{8, 4}),
+		NewRetinaFaceAnchorParams(8, 16, []float32{1}, []float32{2, 1}),
+	}
+}
+
+// SCRFDDetectionParams configures an SCRFD face detector exported with five keypoints, such as the insightface
+// scrfd_10g_bnkps checkpoint. SCRFD regresses the distances from the anchor centers of every feature map to the
+// box sides and landmarks.
+type SCRFDDetectionParams struct {
+	ModelName    string        `json:"model_name"`
+	ModelVersion string        `json:"model_version"`
+	Timeout      time.Duration `json:"timeout"`
+	ImageSize    [2]int        `json:"image_size"`
+	// MaxBatchSize is the largest number of images sent in one detection request, like
+	// RetinaFaceDetectionParams.MaxBatchSize.
+	MaxBatchSize        int     `json:"max_batch_size"`
+	ConfidenceThreshold float32 `json:"confidence_threshold"`
+	IOUThreshold        float32 `json:"iou_threshold"`
+	// Strides lists the strides of the feature maps in the order of the score, bbox and keypoint outputs.
+	Strides []int `json:"strides"`
+	// NumAnchors is the number of anchors centered on every feature map cell.
+	NumAnchors int `json:"num_anchors"`
+	// InputMean and InputStd normalize every RGB input channel as (pixel - InputMean) / InputStd.
+	InputMean float32 `json:"input_mean"`
+	InputStd  float32 `json:"input_std"`
+}
+
+var DefaultSCRFDDetectionParams = &SCRFDDetectionParams{
+	ModelName:           "face_detection_scrfd",
+	Timeout:             20 * time.Second,
+	ImageSize:           [2]int{640, 640},
+	MaxBatchSize:        1,
+	ConfidenceThreshold: 0.5,
+	IOUThreshold:        0.4,
+	Strides:             []int{8, 16, 32},
+	NumAnchors:          2,
+	InputMean:           127.5,
+	InputStd:            128,
+}
+
+func NewSCRFDDetectionParams(modelName string, timeout time.Duration, imgSize [2]int, maxBatchSize int, confidenceThreshold, iouThreshold float32, strides []int, numAnchors int, inputMean, inputStd float32) *SCRFDDetectionParams {
+	return &SCRFDDetectionParams{
+		ModelName:           modelName,
+		Timeout:             timeout,
+		ImageSize:           imgSize,
+		MaxBatchSize:        maxBatchSize,
+		ConfidenceThreshold: confidenceThreshold,
+		IOUThreshold:        iouThreshold,
+		Strides:             strides,
+		NumAnchors:          numAnchors,
+		InputMean:           inputMean,
+		InputStd:            inputStd,
+	}
+}
+
+// YOLOFaceDetectionParams configures a YOLOv8-face style detector with five keypoints. The model returns a single
+// dense prediction tensor holding, for every prediction, the box center and size in model input pixels, the face
+// confidence and the keypoints, which only need confidence filtering and NMS.
+type YOLOFaceDetectionParams struct {
+	ModelName    string        `json:"model_name"`
+	ModelVersion string        `json:"model_version"`
+	Timeout      time.Duration `json:"timeout"`
+	ImageSize    [2]int        `json:"image_size"`
+	// MaxBatchSize is the largest number of images sent in one detection request, like
+	// RetinaFaceDetectionParams.MaxBatchSize.
+	MaxBatchSize        int     `json:"max_batch_size"`
+	ConfidenceThreshold float32 `json:"confidence_threshold"`
+	IOUThreshold        float32 `json:"iou_threshold"`
+	// KeypointDims is the number of values of each keypoint: 3 for (x, y, visibility) as exported by ultralytics,
+	// or 2 for (x, y).
+	KeypointDims int `json:"keypoint_dims"`
+}
+
+var DefaultYOLOFaceDetectionParams = &YOLOFaceDetectionParams{
+	ModelName:           "face_detection_yolo",
+	Timeout:             20 * time.Second,
+	ImageSize:           [2]int{640, 640},
+	MaxBatchSize:        1,
+	ConfidenceThreshold: 0.5,
+	IOUThreshold:        0.45,
+	KeypointDims:        3,
+}
+
+func NewYOLOFaceDetectionParams(modelName string, timeout time.Duration, imgSize [2]int, maxBatchSize int, confidenceThreshold, iouThreshold float32, keypointDims int) *YOLOFaceDetectionParams {
+	return &YOLOFaceDetectionParams{
+		ModelName:           modelName,
+		Timeout:             timeout,
+		ImageSize:           imgSize,
+		MaxBatchSize:        maxBatchSize,
+		ConfidenceThreshold: confidenceThreshold,
+		IOUThreshold:        iouThreshold,
+		KeypointDims:        keypointDims,
+	}
+}
+
+// TilingParams configures the tiled detection of large images. The detector runs on overlapping tiles of the image
+// at full resolution, instead of on the whole image shrunk into its input, so that small faces are not lost.
+type TilingParams struct {
+	// TileSize is the width and height of the tiles, usually the image size of the detector so that the tiles are
+	// not resized. Images fitting in a single tile are detected as a whole.
+	TileSize [2]int `json:"tile_size"`
+	// Overlap is the number of pixels shared by neighboring tiles. Faces up to Overlap pixels wide and high are
+	// entirely inside at least one tile, the detections cut by a tile seam are discarded.
+	Overlap int `json:"overlap"`
+	// GlobalPass also runs the detector on the whole image, which finds the faces too large for the tiles.
+	GlobalPass bool `json:"global_pass"`
+	// IOUThreshold is the NMS threshold merging the detections of overlapping tiles and of the global pass.
+	IOUThreshold float32 `json:"iou_threshold"`
+}
+
+var DefaultTilingParams = &TilingParams{
+	TileSize:     [2]int{640, 640},
+	Overlap:      160,
+	GlobalPass:   true,
+	IOUThreshold: 0.45,
+}
+
+func NewTilingParams(tileSize [2]int, overlap int, globalPass bool, iouThreshold float32) *TilingParams {
+	return &TilingParams{
+		TileSize:     tileSize,
+		Overlap:      overlap,
+		GlobalPass:   globalPass,
+		IOUThreshold: iouThreshold,
 	}
 }
 
@@ -89,10 +303,11 @@ func NewFaceAlignParams(imgSize [2]int, standardLandmarks *tensor.Dense) *FaceAl
 }
 
 type ArcFaceRecognitionParams struct {
-	ModelName string        `json:"model_name"`
-	Timeout   time.Duration `json:"timeout"`
-	ImageSize [2]int        `json:"image_size"`
-	BatchSize int           `json:"batch_size"`
+	ModelName    string        `json:"model_name"`
+	ModelVersion string        `json:"model_version"`
+	Timeout      time.Duration `json:"timeout"`
+	ImageSize    [2]int        `json:"image_size"`
+	BatchSize    int           `json:"batch_size"`
 }
 
 var DefaultArcFaceRecognitionParams = &ArcFaceRecognitionParams{
@@ -112,11 +327,12 @@ func NewArcFaceRecognitionParams(modelName string, timeout time.Duration, imgSiz
 }
 
 type FaceQualityParams struct {
-	ModelName string        `json:"model_name"`
-	Timeout   time.Duration `json:"timeout"`
-	ImageSize [2]int        `json:"image_size"`
-	BatchSize int           `json:"batch_size"`
-	Threshold float32       `json:"threshold"`
+	ModelName    string        `json:"model_name"`
+	ModelVersion string        `json:"model_version"`
+	Timeout      time.Duration `json:"timeout"`
+	ImageSize    [2]int        `json:"image_size"`
+	BatchSize    int           `json:"batch_size"`
+	Threshold    float32       `json:"threshold"`
 }
 
 var DefaultFaceQualityParams = &FaceQualityParams{
@@ -168,11 +384,13 @@ func NewFaceSelectionParams(marginCenterLeftRatio, marginCenterRightRatio, margi
 
 type FaceAntiSpoofingParam struct {
 	ModelNames []string
-	Scales     []float32
-	ImageSizes [][2]int
-	Threshold  float32
-	Timeout    time.Duration
-	BatchSize  int
+	// ModelVersions pins the version of each model in ModelNames, missing or empty entries use the server version policy.
+	ModelVersions []string
+	Scales        []float32
+	ImageSizes    [][2]int
+	Threshold     float32
+	Timeout       time.Duration
+	BatchSize     int
 }
 
 var DefaultFaceAntiSpoofingParam = &FaceAntiSpoofingParam{
@@ -208,11 +426,12 @@ func NewFaceAntiSpoofingParam(ModelNames []string, timeout time.Duration, Scales
 }
 
 type FaceQualityAssessmentParams struct {
-	ModelName string
-	Timeout   time.Duration
-	ImageSize [2]int
-	BatchSize int
-	Threshold float32
+	ModelName    string
+	ModelVersion string
+	Timeout      time.Duration
+	ImageSize    [2]int
+	BatchSize    int
+	Threshold    float32
 }
 
 var DefaultFaceQualityAssessmentParams = &FaceQualityAssessmentParams{
@@ -232,3 +451,265 @@ func NewFaceQualityAssessmentParams(ModelName string, timeout time.Duration, img
 		Threshold: threshold,
 	}
 }
+
+type ONNXRuntimeParams struct {
+	ModelRepository   string `json:"model_repository"`
+	SharedLibraryPath string `json:"shared_library_path"`
+	IntraOpNumThreads int    `json:"intra_op_num_threads"`
+	InterOpNumThreads int    `json:"inter_op_num_threads"`
+}
+
+var DefaultONNXRuntimeParams = &ONNXRuntimeParams{
+	ModelRepository:   "./models",
+	SharedLibraryPath: "libonnxruntime.so",
+	IntraOpNumThreads: 0,
+	InterOpNumThreads: 0,
+}
+
+func NewONNXRuntimeParams(modelRepository, sharedLibraryPath string, intraOpNumThreads, interOpNumThreads int) *ONNXRuntimeParams {
+	return &ONNXRuntimeParams{
+		ModelRepository:   modelRepository,
+		SharedLibraryPath: sharedLibraryPath,
+		IntraOpNumThreads: intraOpNumThreads,
+		InterOpNumThreads: interOpNumThreads,
+	}
+}
+
+type TritonProtocol string
+
+const (
+	TritonProtocolGRPC TritonProtocol = "grpc"
+	TritonProtocolHTTP TritonProtocol = "http"
+)
+
+type TritonBackendParams struct {
+	ServerURL string         `json:"server_url"`
+	Protocol  TritonProtocol `json:"protocol"`
+}
+
+var DefaultTritonBackendParams = &TritonBackendParams{
+	ServerURL: "localhost:8001",
+	Protocol:  TritonProtocolGRPC,
+}
+
+func NewTritonBackendParams(serverURL string, protocol TritonProtocol) *TritonBackendParams {
+	return &TritonBackendParams{
+		ServerURL: serverURL,
+		Protocol:  protocol,
+	}
+}
+
+type LoadBalancingPolicy string
+
+const (
+	LoadBalancingRoundRobin  LoadBalancingPolicy = "round_robin"
+	LoadBalancingLeastLoaded LoadBalancingPolicy = "least_loaded"
+)
+
+type ResilientBackendParams struct {
+	Policy LoadBalancingPolicy `json:"policy"`
+	// MaxAttempts bounds the attempts of a call across all endpoints, including the first one.
+	MaxAttempts    int           `json:"max_attempts"`
+	InitialBackoff time.Duration `json:"initial_backoff"`
+	MaxBackoff     time.Duration `json:"max_backoff"`
+	// AttemptTimeout bounds a single attempt so a slow endpoint leaves time to retry on another one.
+	// When zero each attempt may use the whole remaining call timeout.
+	AttemptTimeout time.Duration `json:"attempt_timeout"`
+	// FailureThreshold consecutive failures open the circuit breaker of an endpoint for OpenTimeout,
+	// after which a single probe request decides whether it closes again.
+	FailureThreshold int           `json:"failure_threshold"`
+	OpenTimeout      time.Duration `json:"open_timeout"`
+}
+
+var DefaultResilientBackendParams = &ResilientBackendParams{
+	Policy:           LoadBalancingRoundRobin,
+	MaxAttempts:      3,
+	InitialBackoff:   50 * time.Millisecond,
+	MaxBackoff:       time.Second,
+	AttemptTimeout:   0,
+	FailureThreshold: 5,
+	OpenTimeout:      10 * time.Second,
+}
+
+func NewResilientBackendParams(policy LoadBalancingPolicy, maxAttempts int, initialBackoff, maxBackoff, attemptTimeout time.Duration, failureThreshold int, openTimeout time.Duration) *ResilientBackendParams {
+	return &ResilientBackendParams{
+		Policy:           policy,
+		MaxAttempts:      maxAttempts,
+		InitialBackoff:   initialBackoff,
+		MaxBackoff:       maxBackoff,
+		AttemptTimeout:   attemptTimeout,
+		FailureThreshold: failureThreshold,
+		OpenTimeout:      openTimeout,
+	}
+}
+
+type SharedMemoryParams struct {
+	RegionName        string        `json:"region_name"`
+	Key               string        `json:"key"`
+	SlotByteSize      int           `json:"slot_byte_size"`
+	NumSlots          int           `json:"num_slots"`
+	MinTensorByteSize int           `json:"min_tensor_byte_size"`
+	Timeout           time.Duration `json:"timeout"`
+}
+
+var DefaultSharedMemoryParams = &SharedMemoryParams{
+	RegionName:        "faceid_pipeline_input",
+	Key:               "/faceid_pipeline_input",
+	SlotByteSize:      8 << 20,
+	NumSlots:          4,
+	MinTensorByteSize: 64 << 10,
+	Timeout:           20 * time.Second,
+}
+
+func NewSharedMemoryParams(regionName, key string, slotByteSize, numSlots, minTensorByteSize int, timeout time.Duration) *SharedMemoryParams {
+	return &SharedMemoryParams{
+		RegionName:        regionName,
+		Key:               key,
+		SlotByteSize:      slotByteSize,
+		NumSlots:          numSlots,
+		MinTensorByteSize: minTensorByteSize,
+		Timeout:           timeout,
+	}
+}
+
+// DeadlineBudgetParams splits the deadline of an ExtractFaceFeatures call across the pipeline stages. Each stage
+// gets the share of the remaining time given by its weight relative to the weights of the stages left, so time
+// left over by a fast stage goes to the following ones.
+type DeadlineBudgetParams struct {
+	// Timeout is the overall deadline of a call. When zero only the deadline of the caller's context is split.
+	Timeout            time.Duration `json:"timeout"`
+	DetectionWeight    float64       `json:"detection_weight"`
+	QualityWeight      float64       `json:"quality_weight"`
+	AntiSpoofingWeight float64       `json:"anti_spoofing_weight"`
+	ExtractionWeight   float64       `json:"extraction_weight"`
+}
+
+var DefaultDeadlineBudgetParams = &DeadlineBudgetParams{
+	Timeout:            5 * time.Second,
+	DetectionWeight:    0.4,
+	QualityWeight:      0.2,
+	AntiSpoofingWeight: 0.2,
+	ExtractionWeight:   0.2,
+}
+
+func NewDeadlineBudgetParams(timeout time.Duration, detectionWeight, qualityWeight, antiSpoofingWeight, extractionWeight float64) *DeadlineBudgetParams {
+	return &DeadlineBudgetParams{
+		Timeout:            timeout,
+		DetectionWeight:    detectionWeight,
+		QualityWeight:      qualityWeight,
+		AntiSpoofingWeight: antiSpoofingWeight,
+		ExtractionWeight:   extractionWeight,
+	}
+}
+
+// MicroBatchingParams controls the merging of concurrent requests for the same model into one batched request.
+type MicroBatchingParams struct {
+	// MaxWait is how long the first queued request waits for others before its batch is sent.
+	MaxWait time.Duration `json:"max_wait"`
+}
+
+var DefaultMicroBatchingParams = &MicroBatchingParams{
+	MaxWait: 5 * time.Millisecond,
+}
+
+func NewMicroBatchingParams(maxWait time.Duration) *MicroBatchingParams {
+	return &MicroBatchingParams{
+		MaxWait: maxWait,
+	}
+}
+
+// BulkExtractionParams controls the processing of a stream of images by the bulk extraction methods of the pipelines.
+type BulkExtractionParams struct {
+	// Workers is the number of images processed concurrently.
+	Workers int `json:"workers"`
+	// Ordered emits the results in input order instead of completion order.
+	Ordered bool `json:"ordered"`
+}
+
+var DefaultBulkExtractionParams = &BulkExtractionParams{
+	Workers: 4,
+	Ordered: false,
+}
+
+func NewBulkExtractionParams(workers int, ordered bool) *BulkExtractionParams {
+	return &BulkExtractionParams{
+		Workers: workers,
+		Ordered: ordered,
+	}
+}
+
+// AdmissionParams bounds the requests admitted concurrently. Requests beyond MaxInFlight wait in a queue of at
+// most MaxQueued requests for up to QueueTimeout, the requests finding the queue full or still waiting after
+// QueueTimeout are shed.
+type AdmissionParams struct {
+	MaxInFlight  int           `json:"max_in_flight"`
+	MaxQueued    int           `json:"max_queued"`
+	QueueTimeout time.Duration `json:"queue_timeout"`
+}
+
+var DefaultAdmissionParams = &AdmissionParams{
+	MaxInFlight:  16,
+	MaxQueued:    64,
+	QueueTimeout: 100 * time.Millisecond,
+}
+
+func NewAdmissionParams(maxInFlight, maxQueued int, queueTimeout time.Duration) *AdmissionParams {
+	return &AdmissionParams{
+		MaxInFlight:  maxInFlight,
+		MaxQueued:    maxQueued,
+		QueueTimeout: queueTimeout,
+	}
+}
+
+type PipelineParams struct {
+	RetinaFaceDetection   *RetinaFaceDetectionParams   `json:"retina_face_detection"`
+	FaceSelection         *FaceSelectionParams         `json:"face_selection"`
+	FaceAlign             *FaceAlignParams             `json:"face_align"`
+	FaceQuality           *FaceQualityParams           `json:"face_quality"`
+	ArcFaceRecognition    *ArcFaceRecognitionParams    `json:"arc_face_recognition"`
+	FaceAntiSpoofing      *FaceAntiSpoofingParam       `json:"face_anti_spoofing"`
+	FaceQualityAssessment *FaceQualityAssessmentParams `json:"face_quality_assessment"`
+	// SharedMemory enables the Triton system shared-memory transport for large input tensors when set.
+	SharedMemory *SharedMemoryParams `json:"shared_memory"`
+	// ShadowArcFaceRecognition runs a second recognition model, usually another version of ArcFaceRecognition,
+	// on the same aligned faces when set. Its outputs are only reported to the pipeline shadow handler.
+	ShadowArcFaceRecognition *ArcFaceRecognitionParams `json:"shadow_arc_face_recognition"`
+	// MaxShadowEvaluations is the number of shadow evaluations run at a time, the faces extracted while they are all
+	// running are not evaluated. Zero uses DefaultMaxShadowEvaluations.
+	MaxShadowEvaluations int `json:"max_shadow_evaluations"`
+	// DeadlineBudget splits the deadline of each call across the stages when set.
+	DeadlineBudget *DeadlineBudgetParams `json:"deadline_budget"`
+	// MicroBatching merges the detection and recognition requests of concurrent calls into batches of up to
+	// the MaxBatchSize of the detector and ArcFaceRecognition.BatchSize when set. The models must accept a
+	// dynamic batch dimension.
+	MicroBatching *MicroBatchingParams `json:"micro_batching"`
+	// ParallelStages runs the anti-spoofing, quality, quality assessment and extraction stages of
+	// AntiSpoofingExtractPipeline concurrently instead of one after another. Results and gating are unchanged.
+	ParallelStages bool `json:"parallel_stages"`
+	// ModelAdmission limits the concurrent requests to each model named in the map, across every call of the
+	// pipeline. Models without an entry are not limited.
+	ModelAdmission map[string]*AdmissionParams `json:"model_admission"`
+	// PipelineAdmission limits the concurrent ExtractFaceFeatures calls of the pipeline when set.
+	PipelineAdmission *AdmissionParams `json:"pipeline_admission"`
+	// SCRFDDetection detects the faces with an SCRFD model instead of RetinaFaceDetection when set.
+	SCRFDDetection *SCRFDDetectionParams `json:"scrfd_detection"`
+	// YOLOFaceDetection detects the faces with a YOLO face model instead of RetinaFaceDetection when set. It cannot
+	// be set together with SCRFDDetection.
+	YOLOFaceDetection *YOLOFaceDetectionParams `json:"yolo_face_detection"`
+	// Tiling runs the face detector on overlapping tiles of large images when set.
+	Tiling *TilingParams `json:"tiling"`
+}
+
+// DefaultMaxShadowEvaluations is the number of shadow evaluations run at a time when
+// PipelineParams.MaxShadowEvaluations is zero.
+const DefaultMaxShadowEvaluations = 4
+
+var DefaultPipelineParams = &PipelineParams{
+	RetinaFaceDetection:   DefaultRetinaFaceDetectionParams,
+	FaceSelection:         DefaultFaceSelectionParams,
+	FaceAlign:             DefaultFaceAlignParams,
+	FaceQuality:           DefaultFaceQualityParams,
+	ArcFaceRecognition:    DefaultArcFaceRecognitionParams,
+	FaceAntiSpoofing:      DefaultFaceAntiSpoofingParam,
+	FaceQualityAssessment: DefaultFaceQualityAssessmentParams,
+}
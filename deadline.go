@@ -0,0 +1,47 @@
+package go_faceid_pipeline
+
+import (
+	"context"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"time"
+)
+
+// deadlineBudget splits the deadline of a single ExtractFaceFeatures call across its stages.
+type deadlineBudget struct {
+	weights []float64
+	next    int
+}
+
+// newDeadlineBudget applies the overall timeout of cfg to ctx and returns the budget of the stages that will run,
+// given by their weights in call order. A nil cfg leaves ctx unchanged and gives a nil budget.
+func newDeadlineBudget(ctx context.Context, cfg *config.DeadlineBudgetParams, weights ...float64) (context.Context, context.CancelFunc, *deadlineBudget) {
+	if cfg == nil {
+		return ctx, func() {}, nil
+	}
+	cancel := context.CancelFunc(func() {})
+	if cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+	}
+	return ctx, cancel, &deadlineBudget{weights: weights}
+}
+
+// stage returns the context of the next stage, whose deadline is its share of the time left before the deadline
+// of ctx. It is a no-op on a nil budget or when ctx has no deadline.
+func (b *deadlineBudget) stage(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b == nil || b.next >= len(b.weights) {
+		return ctx, func() {}
+	}
+	weight := b.weights[b.next]
+	remainingWeight := 0.0
+	for _, w := range b.weights[b.next:] {
+		remainingWeight += w
+	}
+	b.next++
+
+	deadline, ok := ctx.Deadline()
+	if !ok || weight <= 0 || remainingWeight <= 0 {
+		return ctx, func() {}
+	}
+	share := time.Duration(float64(time.Until(deadline)) * weight / remainingWeight)
+	return context.WithTimeout(ctx, share)
+}
@@ -0,0 +1,48 @@
+package go_faceid_pipeline
+
+import (
+	"context"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDeadlineBudget_Stage(t *testing.T) {
+	ctx, cancel, budget := newDeadlineBudget(context.Background(), config.NewDeadlineBudgetParams(time.Second, 2, 1, 0, 1), 2, 1, 1)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 50*time.Millisecond)
+
+	stageCtx, stageCancel := budget.stage(ctx)
+	stageDeadline, ok := stageCtx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(500*time.Millisecond), stageDeadline, 50*time.Millisecond)
+	stageCancel()
+
+	// The first stage returned early, the time it left is shared by the remaining stages.
+	stageCtx, stageCancel = budget.stage(ctx)
+	stageDeadline, _ = stageCtx.Deadline()
+	assert.WithinDuration(t, time.Now().Add(500*time.Millisecond), stageDeadline, 50*time.Millisecond)
+	stageCancel()
+
+	stageCtx, stageCancel = budget.stage(ctx)
+	stageDeadline, _ = stageCtx.Deadline()
+	assert.Equal(t, deadline, stageDeadline)
+	stageCancel()
+}
+
+func TestDeadlineBudget_Disabled(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	defer cancelParent()
+
+	ctx, cancel, budget := newDeadlineBudget(parent, nil)
+	defer cancel()
+	assert.Nil(t, budget)
+
+	stageCtx, stageCancel := budget.stage(ctx)
+	defer stageCancel()
+	assert.Equal(t, parent, stageCtx)
+}
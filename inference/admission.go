@@ -0,0 +1,186 @@
+package inference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOverloaded is returned when admission control sheds a request, because the wait queue is full or no slot freed
+// up within the queue timeout. The request was not sent and can be retried later, e.g. after an HTTP 429 response.
+var ErrOverloaded = errors.New("overloaded")
+
+// AdmissionStats is a snapshot of the requests of a Limiter.
+type AdmissionStats struct {
+	InFlight int
+	Queued   int
+	Admitted uint64
+	// ShedQueueFull counts the requests shed because the wait queue was full.
+	ShedQueueFull uint64
+	// ShedTimeout counts the requests shed because they were still waiting after the queue timeout.
+	ShedTimeout uint64
+}
+
+// Shed returns the number of requests shed for any reason.
+func (s AdmissionStats) Shed() uint64 {
+	return s.ShedQueueFull + s.ShedTimeout
+}
+
+// Limiter admits at most MaxInFlight requests at a time. The requests beyond it wait for a slot in a queue bounded
+// by MaxQueued and are shed with ErrOverloaded when the queue is full or when QueueTimeout elapses first.
+type Limiter struct {
+	cfg           *config.AdmissionParams
+	slots         chan struct{}
+	queued        atomic.Int64
+	admitted      atomic.Uint64
+	shedQueueFull atomic.Uint64
+	shedTimeout   atomic.Uint64
+}
+
+// NewLimiter creates a limiter with the limits of cfg.
+func NewLimiter(cfg *config.AdmissionParams) (*Limiter, error) {
+	if cfg.MaxInFlight <= 0 {
+		return nil, errors.New("max in flight must be positive")
+	}
+	if cfg.MaxQueued < 0 || cfg.QueueTimeout < 0 {
+		return nil, errors.New("max queued and queue timeout must not be negative")
+	}
+	return &Limiter{
+		cfg:   cfg,
+		slots: make(chan struct{}, cfg.MaxInFlight),
+	}, nil
+}
+
+// Acquire waits for a slot, which must be given back with Release once the request is done. It returns an error
+// wrapping ErrOverloaded when the request is shed, and the error of ctx when ctx is done before a slot frees up.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	select {
+	case l.slots <- struct{}{}:
+		l.admitted.Add(1)
+		return nil
+	default:
+	}
+
+	if l.queued.Add(1) > int64(l.cfg.MaxQueued) {
+		l.queued.Add(-1)
+		l.shedQueueFull.Add(1)
+		return fmt.Errorf("%w: %d requests in flight and %d queued", ErrOverloaded, l.cfg.MaxInFlight, l.cfg.MaxQueued)
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.admitted.Add(1)
+		return nil
+	case <-timer.C:
+		l.shedTimeout.Add(1)
+		return fmt.Errorf("%w: no slot freed up within %v", ErrOverloaded, l.cfg.QueueTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release gives back a slot taken by Acquire.
+func (l *Limiter) Release() {
+	<-l.slots
+}
+
+// Stats returns the current counters of the limiter.
+func (l *Limiter) Stats() AdmissionStats {
+	return AdmissionStats{
+		InFlight:      len(l.slots),
+		Queued:        int(l.queued.Load()),
+		Admitted:      l.admitted.Load(),
+		ShedQueueFull: l.shedQueueFull.Load(),
+		ShedTimeout:   l.shedTimeout.Load(),
+	}
+}
+
+// AdmissionBackend wraps a backend and limits the concurrent inference requests of each model with a Limiter.
+// The wait for a slot counts against the timeout of the call. Requests for models without limits pass straight
+// through.
+type AdmissionBackend struct {
+	next     Backend
+	limiters map[string]*Limiter
+}
+
+var (
+	_ Backend       = (*AdmissionBackend)(nil)
+	_ HealthChecker = (*AdmissionBackend)(nil)
+)
+
+// NewAdmissionBackend limits the requests of every model of models, keyed by model name, on backend.
+func NewAdmissionBackend(backend Backend, models map[string]*config.AdmissionParams) (*AdmissionBackend, error) {
+	b := &AdmissionBackend{
+		next:     backend,
+		limiters: make(map[string]*Limiter, len(models)),
+	}
+	for modelName, cfg := range models {
+		limiter, err := NewLimiter(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("model %s: %w", modelName, err)
+		}
+		b.limiters[modelName] = limiter
+	}
+	return b, nil
+}
+
+// GetModelConfiguration delegates to the wrapped backend.
+func (b *AdmissionBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	return b.next.GetModelConfiguration(timeout, modelName, modelVersion)
+}
+
+// ServerLive delegates to the wrapped backend.
+func (b *AdmissionBackend) ServerLive(timeout time.Duration) (bool, error) {
+	checker, ok := b.next.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.ServerLive(timeout)
+}
+
+// ModelReady delegates to the wrapped backend.
+func (b *AdmissionBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	checker, ok := b.next.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.ModelReady(timeout, modelName, modelVersion)
+}
+
+// ModelInfer waits for a slot of the model of request and runs it on the wrapped backend with the time left.
+func (b *AdmissionBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	limiter, ok := b.limiters[request.ModelName]
+	if !ok {
+		return b.next.ModelInfer(timeout, request)
+	}
+
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	err := limiter.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("model %s: %w", request.ModelName, err)
+	}
+	defer limiter.Release()
+	return b.next.ModelInfer(time.Until(deadline), request)
+}
+
+// Stats returns the counters of every limited model, keyed by model name.
+func (b *AdmissionBackend) Stats() map[string]AdmissionStats {
+	stats := make(map[string]AdmissionStats, len(b.limiters))
+	for modelName, limiter := range b.limiters {
+		stats[modelName] = limiter.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,96 @@
+package inference
+
+import (
+	"context"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter, err := NewLimiter(config.NewAdmissionParams(2, 1, 50*time.Millisecond))
+	assert.NoError(t, err)
+
+	assert.NoError(t, limiter.Acquire(context.Background()))
+	assert.NoError(t, limiter.Acquire(context.Background()))
+
+	queued := make(chan error, 1)
+	go func() {
+		queued <- limiter.Acquire(context.Background())
+	}()
+	assert.Eventually(t, func() bool { return limiter.Stats().Queued == 1 }, time.Second, time.Millisecond)
+
+	// The queue is full.
+	err = limiter.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrOverloaded)
+	assert.ErrorContains(t, err, "2 requests in flight and 1 queued")
+
+	limiter.Release()
+	assert.NoError(t, <-queued)
+
+	// No slot frees up within the queue timeout.
+	start := time.Now()
+	err = limiter.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrOverloaded)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, limiter.Acquire(ctx), context.Canceled)
+
+	assert.Equal(t, AdmissionStats{InFlight: 2, Admitted: 3, ShedQueueFull: 1, ShedTimeout: 1}, limiter.Stats())
+	assert.Equal(t, uint64(2), limiter.Stats().Shed())
+
+	_, err = NewLimiter(config.NewAdmissionParams(0, 1, time.Second))
+	assert.Error(t, err)
+}
+
+func TestAdmissionBackend(t *testing.T) {
+	next := &scriptedBackend{block: make(chan struct{})}
+	backend, err := NewAdmissionBackend(next, map[string]*config.AdmissionParams{
+		"limited": config.NewAdmissionParams(1, 0, time.Second),
+	})
+	assert.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{ModelName: "limited"})
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { return backend.Stats()["limited"].InFlight == 1 }, time.Second, time.Millisecond)
+
+	_, err = backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{ModelName: "limited"})
+	assert.ErrorIs(t, err, ErrOverloaded)
+	assert.ErrorContains(t, err, "model limited")
+
+	close(next.block)
+	assert.NoError(t, <-done)
+
+	// Other models are not limited.
+	_, err = backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{ModelName: "other"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, next.callCount())
+	assert.Equal(t, map[string]AdmissionStats{"limited": {Admitted: 1, ShedQueueFull: 1}}, backend.Stats())
+}
+
+func TestAdmissionBackend_CallTimeout(t *testing.T) {
+	next := &scriptedBackend{block: make(chan struct{})}
+	defer close(next.block)
+	backend, err := NewAdmissionBackend(next, map[string]*config.AdmissionParams{
+		"limited": config.NewAdmissionParams(1, 1, time.Second),
+	})
+	assert.NoError(t, err)
+
+	go func() {
+		_, _ = backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{ModelName: "limited"})
+	}()
+	assert.Eventually(t, func() bool { return backend.Stats()["limited"].InFlight == 1 }, time.Second, time.Millisecond)
+
+	// The wait for a slot counts against the timeout of the call, which is not an overload.
+	_, err = backend.ModelInfer(20*time.Millisecond, &triton_proto.ModelInferRequest{ModelName: "limited"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, ErrOverloaded)
+	assert.Zero(t, backend.Stats()["limited"].Shed())
+}
@@ -0,0 +1,17 @@
+package inference
+
+import (
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"time"
+)
+
+// Backend is the minimal set of operations the pipeline modules need from a model server:
+// fetching a model configuration and running inference on named tensors.
+type Backend interface {
+	// GetModelConfiguration returns the configuration of the given model version.
+	// An empty modelVersion selects the version chosen by the server policy.
+	GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error)
+
+	// ModelInfer runs a single inference request.
+	ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error)
+}
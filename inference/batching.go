@@ -0,0 +1,346 @@
+package inference
+
+import (
+	"context"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"slices"
+	"sync"
+	"time"
+)
+
+// BatchedModel is a model whose requests are merged by a BatchingBackend into batches of up to MaxBatchSize
+// elements along the first dimension of its inputs and outputs.
+type BatchedModel struct {
+	ModelName    string
+	ModelVersion string
+	MaxBatchSize int
+}
+
+// BatchingBackend wraps a backend and merges the requests of concurrent callers for the same model into a
+// single batched request. A request is queued until the queue holds MaxBatchSize batch elements or MaxWait has
+// passed since the first request of the batch was queued; the outputs of the batched response are then split
+// along their first dimension and returned to each caller. Requests for other models, requests already holding
+// a full batch and requests with parameters pass straight through.
+type BatchingBackend struct {
+	next     Backend
+	cfg      *config.MicroBatchingParams
+	batchers map[batchKey]*batcher
+}
+
+var (
+	_ Backend       = (*BatchingBackend)(nil)
+	_ HealthChecker = (*BatchingBackend)(nil)
+)
+
+type batchKey struct {
+	modelName    string
+	modelVersion string
+}
+
+// NewBatchingBackend batches the requests of models on backend. Models with a MaxBatchSize below 2 are not batched.
+func NewBatchingBackend(backend Backend, cfg *config.MicroBatchingParams, models ...BatchedModel) *BatchingBackend {
+	b := &BatchingBackend{
+		next:     backend,
+		cfg:      cfg,
+		batchers: make(map[batchKey]*batcher),
+	}
+	for _, model := range models {
+		if model.MaxBatchSize < 2 {
+			continue
+		}
+		b.batchers[batchKey{modelName: model.ModelName, modelVersion: model.ModelVersion}] = &batcher{
+			next:         backend,
+			maxWait:      cfg.MaxWait,
+			maxBatchSize: model.MaxBatchSize,
+		}
+	}
+	return b
+}
+
+// GetModelConfiguration delegates to the wrapped backend.
+func (b *BatchingBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	return b.next.GetModelConfiguration(timeout, modelName, modelVersion)
+}
+
+// ServerLive delegates to the wrapped backend.
+func (b *BatchingBackend) ServerLive(timeout time.Duration) (bool, error) {
+	checker, ok := b.next.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.ServerLive(timeout)
+}
+
+// ModelReady delegates to the wrapped backend.
+func (b *BatchingBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	checker, ok := b.next.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.ModelReady(timeout, modelName, modelVersion)
+}
+
+// ModelInfer queues request with the concurrent requests for the same model and waits for the response of its batch.
+func (b *BatchingBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	batcher, ok := b.batchers[batchKey{modelName: request.ModelName, modelVersion: request.ModelVersion}]
+	if !ok {
+		return b.next.ModelInfer(timeout, request)
+	}
+	size, ok := batchSize(request)
+	if !ok || size >= batcher.maxBatchSize {
+		return b.next.ModelInfer(timeout, request)
+	}
+	inputs, err := requestInputData(request)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &batchItem{
+		request:  request,
+		inputs:   inputs,
+		size:     size,
+		deadline: time.Now().Add(timeout),
+		done:     make(chan batchResult, 1),
+	}
+	batcher.add(item)
+	result := <-item.done
+	return result.resp, result.err
+}
+
+// batchSize returns the size of the first dimension shared by all inputs of request and whether the request
+// can be merged with others.
+func batchSize(request *triton_proto.ModelInferRequest) (int, bool) {
+	if len(request.Inputs) == 0 || len(request.Parameters) > 0 {
+		return 0, false
+	}
+	for _, output := range request.Outputs {
+		if len(output.Parameters) > 0 {
+			return 0, false
+		}
+	}
+	size := int64(-1)
+	for _, input := range request.Inputs {
+		if len(input.Shape) == 0 || input.Shape[0] <= 0 || len(input.Parameters) > 0 {
+			return 0, false
+		}
+		if size >= 0 && input.Shape[0] != size {
+			return 0, false
+		}
+		size = input.Shape[0]
+	}
+	return int(size), true
+}
+
+type batchResult struct {
+	resp *triton_proto.ModelInferResponse
+	err  error
+}
+
+type batchItem struct {
+	request  *triton_proto.ModelInferRequest
+	inputs   [][]byte
+	size     int
+	deadline time.Time
+	done     chan batchResult
+}
+
+// batcher queues the requests of a single model.
+type batcher struct {
+	next         Backend
+	maxWait      time.Duration
+	maxBatchSize int
+
+	mu      sync.Mutex
+	pending []*batchItem
+	size    int
+	timer   *time.Timer
+}
+
+// add queues item and sends the batches it completes. The queued batch is sent first when item cannot join it.
+func (b *batcher) add(item *batchItem) {
+	b.mu.Lock()
+	var ready [][]*batchItem
+	if len(b.pending) > 0 && (b.size+item.size > b.maxBatchSize || !mergeable(b.pending[0].request, item.request)) {
+		ready = append(ready, b.take())
+	}
+	b.pending = append(b.pending, item)
+	b.size += item.size
+	if b.size >= b.maxBatchSize {
+		ready = append(ready, b.take())
+	} else if len(b.pending) == 1 {
+		b.timer = time.AfterFunc(b.maxWait, func() { b.expire(item) })
+	}
+	b.mu.Unlock()
+
+	for _, items := range ready {
+		go b.send(items)
+	}
+}
+
+// expire sends the queued batch when it still starts with first.
+func (b *batcher) expire(first *batchItem) {
+	b.mu.Lock()
+	if len(b.pending) == 0 || b.pending[0] != first {
+		b.mu.Unlock()
+		return
+	}
+	items := b.take()
+	b.mu.Unlock()
+
+	b.send(items)
+}
+
+// take removes the queued batch. b.mu must be held.
+func (b *batcher) take() []*batchItem {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	items := b.pending
+	b.pending = nil
+	b.size = 0
+	return items
+}
+
+// send runs the batch of items and returns its share of the response to each item. Items whose deadline has
+// already passed fail without being sent, the batch gets the timeout of the earliest remaining deadline.
+func (b *batcher) send(items []*batchItem) {
+	now := time.Now()
+	live := items[:0]
+	for _, item := range items {
+		if !item.deadline.After(now) {
+			item.done <- batchResult{err: fmt.Errorf("model %s: %w", item.request.ModelName, context.DeadlineExceeded)}
+			continue
+		}
+		live = append(live, item)
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	timeout := time.Until(live[0].deadline)
+	for _, item := range live[1:] {
+		timeout = min(timeout, time.Until(item.deadline))
+	}
+
+	if len(live) == 1 {
+		resp, err := b.next.ModelInfer(timeout, live[0].request)
+		live[0].done <- batchResult{resp: resp, err: err}
+		return
+	}
+
+	resp, err := b.next.ModelInfer(timeout, mergeRequests(live))
+	if err == nil {
+		err = splitResponse(resp, live)
+	}
+	if err != nil {
+		for _, item := range live {
+			item.done <- batchResult{err: err}
+		}
+	}
+}
+
+// mergeable reports whether a and b have the same inputs apart from their batch size and request the same outputs.
+func mergeable(a, b *triton_proto.ModelInferRequest) bool {
+	if len(a.Inputs) != len(b.Inputs) || len(a.Outputs) != len(b.Outputs) {
+		return false
+	}
+	for idx, input := range a.Inputs {
+		other := b.Inputs[idx]
+		if input.Name != other.Name || input.Datatype != other.Datatype || !slices.Equal(input.Shape[1:], other.Shape[1:]) {
+			return false
+		}
+	}
+	for idx, output := range a.Outputs {
+		if output.Name != b.Outputs[idx].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeRequests concatenates the inputs of items along their first dimension.
+func mergeRequests(items []*batchItem) *triton_proto.ModelInferRequest {
+	first := items[0].request
+	total := 0
+	for _, item := range items {
+		total += item.size
+	}
+
+	merged := &triton_proto.ModelInferRequest{
+		ModelName:    first.ModelName,
+		ModelVersion: first.ModelVersion,
+		Outputs:      first.Outputs,
+	}
+	for idx, input := range first.Inputs {
+		shape := slices.Clone(input.Shape)
+		shape[0] = int64(total)
+		merged.Inputs = append(merged.Inputs, &triton_proto.ModelInferRequest_InferInputTensor{
+			Name:     input.Name,
+			Datatype: input.Datatype,
+			Shape:    shape,
+		})
+
+		byteSize := 0
+		for _, item := range items {
+			byteSize += len(item.inputs[idx])
+		}
+		raw := make([]byte, 0, byteSize)
+		for _, item := range items {
+			raw = append(raw, item.inputs[idx]...)
+		}
+		merged.RawInputContents = append(merged.RawInputContents, raw)
+	}
+	return merged
+}
+
+// splitResponse splits the outputs of the batched response along their first dimension and returns each item
+// its rows. Nothing is returned when an output cannot be split.
+func splitResponse(resp *triton_proto.ModelInferResponse, items []*batchItem) error {
+	total := 0
+	for _, item := range items {
+		total += item.size
+	}
+	if len(resp.RawOutputContents) != len(resp.Outputs) {
+		return fmt.Errorf("model %s: batched response has raw contents for %d of %d outputs", resp.ModelName, len(resp.RawOutputContents), len(resp.Outputs))
+	}
+	for idx, output := range resp.Outputs {
+		if len(output.Shape) == 0 || output.Shape[0] != int64(total) || len(resp.RawOutputContents[idx])%total != 0 {
+			return fmt.Errorf("model %s: cannot split output %s with shape %v into a batch of %d", resp.ModelName, output.Name, output.Shape, total)
+		}
+	}
+
+	responses := make([]*triton_proto.ModelInferResponse, len(items))
+	for i, item := range items {
+		responses[i] = &triton_proto.ModelInferResponse{
+			ModelName:    resp.ModelName,
+			ModelVersion: resp.ModelVersion,
+			Id:           item.request.Id,
+			Parameters:   resp.Parameters,
+		}
+	}
+	for idx, output := range resp.Outputs {
+		raw := resp.RawOutputContents[idx]
+		rowBytes := len(raw) / total
+		offset := 0
+		for i, item := range items {
+			shape := slices.Clone(output.Shape)
+			shape[0] = int64(item.size)
+			responses[i].Outputs = append(responses[i].Outputs, &triton_proto.ModelInferResponse_InferOutputTensor{
+				Name:       output.Name,
+				Datatype:   output.Datatype,
+				Shape:      shape,
+				Parameters: output.Parameters,
+			})
+			responses[i].RawOutputContents = append(responses[i].RawOutputContents, raw[offset*rowBytes:(offset+item.size)*rowBytes])
+			offset += item.size
+		}
+	}
+
+	for i, item := range items {
+		item.done <- batchResult{resp: responses[i]}
+	}
+	return nil
+}
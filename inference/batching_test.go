@@ -0,0 +1,166 @@
+package inference
+
+import (
+	"errors"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rowSumBackend returns the sum of each row of a [N, 2] FP32 input and records the batch size of every call.
+type rowSumBackend struct {
+	mu      sync.Mutex
+	batches []int64
+	err     error
+}
+
+func (b *rowSumBackend) GetModelConfiguration(time.Duration, string, string) (*triton_proto.ModelConfigResponse, error) {
+	return &triton_proto.ModelConfigResponse{}, nil
+}
+
+func (b *rowSumBackend) ModelInfer(_ time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	b.mu.Lock()
+	b.batches = append(b.batches, request.Inputs[0].Shape[0])
+	b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	data := utils.BytesToT32[float32](request.RawInputContents[0])
+	sums := make([]float32, 0, len(data)/2)
+	for i := 0; i < len(data); i += 2 {
+		sums = append(sums, data[i]+data[i+1])
+	}
+	return &triton_proto.ModelInferResponse{
+		ModelName: request.ModelName,
+		Outputs: []*triton_proto.ModelInferResponse_InferOutputTensor{
+			{Name: "sum", Datatype: "FP32", Shape: []int64{int64(len(sums)), 1}},
+		},
+		RawOutputContents: [][]byte{append([]byte(nil), utils.TToBytes(sums)...)},
+	}, nil
+}
+
+func (b *rowSumBackend) batchSizes() []int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]int64(nil), b.batches...)
+}
+
+func rowSumRequest(modelName string, rows ...[2]float32) *triton_proto.ModelInferRequest {
+	data := make([]float32, 0, 2*len(rows))
+	for _, row := range rows {
+		data = append(data, row[0], row[1])
+	}
+	return &triton_proto.ModelInferRequest{
+		ModelName: modelName,
+		Inputs: []*triton_proto.ModelInferRequest_InferInputTensor{
+			{Name: "input", Datatype: "FP32", Shape: []int64{int64(len(rows)), 2}},
+		},
+		RawInputContents: [][]byte{append([]byte(nil), utils.TToBytes(data)...)},
+	}
+}
+
+// inferConcurrently sends the requests at the same time and returns the responses in request order.
+func inferConcurrently(backend Backend, requests ...*triton_proto.ModelInferRequest) ([]*triton_proto.ModelInferResponse, []error) {
+	responses := make([]*triton_proto.ModelInferResponse, len(requests))
+	errs := make([]error, len(requests))
+	var wg sync.WaitGroup
+	for idx, request := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[idx], errs[idx] = backend.ModelInfer(time.Second, request)
+		}()
+	}
+	wg.Wait()
+	return responses, errs
+}
+
+func TestBatchingBackend_FullBatch(t *testing.T) {
+	next := &rowSumBackend{}
+	backend := NewBatchingBackend(next, config.NewMicroBatchingParams(time.Minute), BatchedModel{ModelName: "sum", MaxBatchSize: 4})
+
+	responses, errs := inferConcurrently(backend,
+		rowSumRequest("sum", [2]float32{1, 2}),
+		rowSumRequest("sum", [2]float32{3, 4}, [2]float32{5, 6}),
+		rowSumRequest("sum", [2]float32{7, 8}),
+	)
+	// The batch is sent as soon as it is full, long before MaxWait.
+	assert.Equal(t, []int64{4}, next.batchSizes())
+
+	expected := [][]float32{{3}, {7, 11}, {15}}
+	for idx, resp := range responses {
+		assert.NoError(t, errs[idx])
+		assert.Equal(t, []int64{int64(len(expected[idx])), 1}, resp.Outputs[0].Shape)
+		assert.Equal(t, expected[idx], utils.BytesToT32[float32](resp.RawOutputContents[0]))
+	}
+}
+
+func TestBatchingBackend_MaxWait(t *testing.T) {
+	next := &rowSumBackend{}
+	backend := NewBatchingBackend(next, config.NewMicroBatchingParams(50*time.Millisecond), BatchedModel{ModelName: "sum", MaxBatchSize: 8})
+
+	start := time.Now()
+	responses, errs := inferConcurrently(backend,
+		rowSumRequest("sum", [2]float32{1, 1}),
+		rowSumRequest("sum", [2]float32{2, 2}),
+	)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, []int64{2}, next.batchSizes())
+	for idx, resp := range responses {
+		assert.NoError(t, errs[idx])
+		assert.Equal(t, []float32{float32(2 * (idx + 1))}, utils.BytesToT32[float32](resp.RawOutputContents[0]))
+	}
+}
+
+func TestBatchingBackend_PassThrough(t *testing.T) {
+	next := &rowSumBackend{}
+	backend := NewBatchingBackend(next, config.NewMicroBatchingParams(time.Minute), BatchedModel{ModelName: "sum", MaxBatchSize: 2})
+
+	// Other models and full batches are not queued.
+	resp, err := backend.ModelInfer(time.Second, rowSumRequest("other", [2]float32{1, 2}))
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{3}, utils.BytesToT32[float32](resp.RawOutputContents[0]))
+	_, err = backend.ModelInfer(time.Second, rowSumRequest("sum", [2]float32{1, 2}, [2]float32{3, 4}))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, next.batchSizes())
+
+	// A request that cannot join the queued one sends the queued one first.
+	backend = NewBatchingBackend(next, config.NewMicroBatchingParams(20*time.Millisecond), BatchedModel{ModelName: "sum", MaxBatchSize: 2})
+	queued := make(chan error, 1)
+	go func() {
+		_, err := backend.ModelInfer(time.Second, rowSumRequest("sum", [2]float32{1, 2}))
+		queued <- err
+	}()
+	batcher := backend.batchers[batchKey{modelName: "sum"}]
+	for {
+		batcher.mu.Lock()
+		pending := len(batcher.pending)
+		batcher.mu.Unlock()
+		if pending > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mismatched := rowSumRequest("sum", [2]float32{1, 2})
+	mismatched.Inputs[0].Shape = []int64{1, 1, 2}
+	_, err = backend.ModelInfer(time.Second, mismatched)
+	assert.NoError(t, err)
+	assert.NoError(t, <-queued)
+	assert.Equal(t, []int64{1, 2, 1, 1}, next.batchSizes())
+}
+
+func TestBatchingBackend_Error(t *testing.T) {
+	next := &rowSumBackend{err: errors.New("model unavailable")}
+	backend := NewBatchingBackend(next, config.NewMicroBatchingParams(time.Minute), BatchedModel{ModelName: "sum", MaxBatchSize: 2})
+
+	_, errs := inferConcurrently(backend, rowSumRequest("sum", [2]float32{1, 2}), rowSumRequest("sum", [2]float32{3, 4}))
+	for _, err := range errs {
+		assert.EqualError(t, err, "model unavailable")
+	}
+	assert.Equal(t, []int64{2}, next.batchSizes())
+}
@@ -0,0 +1,66 @@
+package inference
+
+import (
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+)
+
+func contentsToBytes(dataType triton_proto.DataType, contents *triton_proto.InferTensorContents) ([]byte, error) {
+	switch dataType {
+	case triton_proto.DataType_TYPE_FP32:
+		return utils.TToBytes(contents.Fp32Contents), nil
+	case triton_proto.DataType_TYPE_FP64:
+		return utils.TToBytes(contents.Fp64Contents), nil
+	case triton_proto.DataType_TYPE_INT32:
+		return utils.TToBytes(contents.IntContents), nil
+	case triton_proto.DataType_TYPE_INT64:
+		return utils.TToBytes(contents.Int64Contents), nil
+	case triton_proto.DataType_TYPE_UINT32:
+		return utils.TToBytes(contents.UintContents), nil
+	case triton_proto.DataType_TYPE_UINT64:
+		return utils.TToBytes(contents.Uint64Contents), nil
+	default:
+		return nil, fmt.Errorf("typed contents are not supported for %s, use raw contents", dataType.String())
+	}
+}
+
+func dataTypeSize(dataType triton_proto.DataType) int {
+	switch dataType {
+	case triton_proto.DataType_TYPE_BOOL, triton_proto.DataType_TYPE_UINT8, triton_proto.DataType_TYPE_INT8:
+		return 1
+	case triton_proto.DataType_TYPE_UINT16, triton_proto.DataType_TYPE_INT16, triton_proto.DataType_TYPE_FP16, triton_proto.DataType_TYPE_BF16:
+		return 2
+	case triton_proto.DataType_TYPE_UINT64, triton_proto.DataType_TYPE_INT64, triton_proto.DataType_TYPE_FP64:
+		return 8
+	default:
+		return 4
+	}
+}
+
+// requestInputData returns the data of every input in request order. Inputs placed in shared memory get nil data;
+// raw input contents are consumed in order by the remaining inputs, as the Triton server does.
+func requestInputData(request *triton_proto.ModelInferRequest) ([][]byte, error) {
+	data := make([][]byte, len(request.Inputs))
+	rawIdx := 0
+	for idx, input := range request.Inputs {
+		switch {
+		case isSharedMemoryInput(input):
+			continue
+		case input.Contents != nil:
+			dataType, ok := triton_proto.DataType_value["TYPE_"+input.Datatype]
+			if !ok {
+				return nil, fmt.Errorf("unknown data type %s for input %s", input.Datatype, input.Name)
+			}
+			raw, err := contentsToBytes(triton_proto.DataType(dataType), input.Contents)
+			if err != nil {
+				return nil, err
+			}
+			data[idx] = raw
+		case rawIdx < len(request.RawInputContents):
+			data[idx] = request.RawInputContents[rawIdx]
+			rawIdx++
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,13 @@
+package inference
+
+import "time"
+
+// HealthChecker is implemented by backends that can report server liveness and model readiness.
+type HealthChecker interface {
+	// ServerLive reports whether the server is live.
+	ServerLive(timeout time.Duration) (bool, error)
+
+	// ModelReady reports whether the given model version is ready for inference.
+	// An empty modelVersion accepts any ready version.
+	ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error)
+}
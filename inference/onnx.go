@@ -0,0 +1,473 @@
+package inference
+
+import (
+	"errors"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	ort "github.com/yalue/onnxruntime_go"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const onnxModelFileName = "model.onnx"
+
+var onnxDataTypes = map[triton_proto.DataType]ort.TensorElementDataType{
+	triton_proto.DataType_TYPE_BOOL:   ort.TensorElementDataTypeBool,
+	triton_proto.DataType_TYPE_UINT8:  ort.TensorElementDataTypeUint8,
+	triton_proto.DataType_TYPE_UINT16: ort.TensorElementDataTypeUint16,
+	triton_proto.DataType_TYPE_UINT32: ort.TensorElementDataTypeUint32,
+	triton_proto.DataType_TYPE_UINT64: ort.TensorElementDataTypeUint64,
+	triton_proto.DataType_TYPE_INT8:   ort.TensorElementDataTypeInt8,
+	triton_proto.DataType_TYPE_INT16:  ort.TensorElementDataTypeInt16,
+	triton_proto.DataType_TYPE_INT32:  ort.TensorElementDataTypeInt32,
+	triton_proto.DataType_TYPE_INT64:  ort.TensorElementDataTypeInt64,
+	triton_proto.DataType_TYPE_FP16:   ort.TensorElementDataTypeFloat16,
+	triton_proto.DataType_TYPE_FP32:   ort.TensorElementDataTypeFloat,
+	triton_proto.DataType_TYPE_FP64:   ort.TensorElementDataTypeDouble,
+}
+
+// onnxSession runs a loaded model, it is implemented by *ort.DynamicAdvancedSession.
+type onnxSession interface {
+	Run(inputs, outputs []ort.Value) error
+	Destroy() error
+}
+
+type onnxModel struct {
+	session onnxSession
+	config  *triton_proto.ModelConfigResponse
+	version string
+}
+
+// ONNXBackend implements Backend with an in-process ONNX Runtime CPU session per model.
+// Models are read from a Triton-style repository: <ModelRepository>/<ModelName>/<version>/model.onnx.
+type ONNXBackend struct {
+	params     *config.ONNXRuntimeParams
+	options    *ort.SessionOptions
+	ownsEnv    bool
+	mu         sync.Mutex
+	models     map[string]*onnxModel
+	isShutdown bool
+	// inFlight counts the ModelInfer calls using a session, Close waits for them before destroying the sessions.
+	inFlight sync.WaitGroup
+}
+
+var (
+	_ Backend       = (*ONNXBackend)(nil)
+	_ HealthChecker = (*ONNXBackend)(nil)
+)
+
+// NewONNXBackend initializes the ONNX Runtime environment and returns a backend serving models from cfg.ModelRepository.
+// Sessions are created lazily on first use of each model.
+func NewONNXBackend(cfg *config.ONNXRuntimeParams) (*ONNXBackend, error) {
+	info, err := os.Stat(cfg.ModelRepository)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("model repository %s is not a directory", cfg.ModelRepository)
+	}
+
+	backend := &ONNXBackend{
+		params: cfg,
+		models: make(map[string]*onnxModel),
+	}
+
+	if !ort.IsInitialized() {
+		ort.SetSharedLibraryPath(cfg.SharedLibraryPath)
+		err = ort.InitializeEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		backend.ownsEnv = true
+	}
+
+	options, err := ort.NewSessionOptions()
+	if err != nil {
+		backend.destroyEnvironment()
+		return nil, err
+	}
+	if cfg.IntraOpNumThreads > 0 {
+		err = options.SetIntraOpNumThreads(cfg.IntraOpNumThreads)
+		if err != nil {
+			_ = options.Destroy()
+			backend.destroyEnvironment()
+			return nil, err
+		}
+	}
+	if cfg.InterOpNumThreads > 0 {
+		err = options.SetInterOpNumThreads(cfg.InterOpNumThreads)
+		if err != nil {
+			_ = options.Destroy()
+			backend.destroyEnvironment()
+			return nil, err
+		}
+	}
+	backend.options = options
+
+	return backend, nil
+}
+
+// GetModelConfiguration returns a configuration synthesized from the ONNX graph inputs and outputs.
+// Dims include the batch dimension and dynamic axes are reported as -1.
+func (b *ONNXBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	model, err := b.model(modelName, modelVersion)
+	if err != nil {
+		return nil, err
+	}
+	return model.config, nil
+}
+
+// ServerLive reports whether the backend has not been closed.
+func (b *ONNXBackend) ServerLive(timeout time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.isShutdown, nil
+}
+
+// ModelReady loads the model session if needed and reports whether it succeeded.
+func (b *ONNXBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	_, err := b.model(modelName, modelVersion)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ModelInfer runs the request synchronously on the CPU. The timeout is not enforced since
+// ONNX Runtime cannot interrupt a running session.
+func (b *ONNXBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	model, err := b.model(request.ModelName, request.ModelVersion)
+	if err != nil {
+		return nil, err
+	}
+	// The session stays alive until the call is done, Close may have started since the model was returned.
+	b.mu.Lock()
+	if b.isShutdown {
+		b.mu.Unlock()
+		return nil, errors.New("onnx backend is closed")
+	}
+	b.inFlight.Add(1)
+	b.mu.Unlock()
+	defer b.inFlight.Done()
+
+	if len(request.Inputs) != len(model.config.Config.Input) {
+		return nil, fmt.Errorf("model %s expects %d inputs, got %d", request.ModelName, len(model.config.Config.Input), len(request.Inputs))
+	}
+
+	inputData, err := requestInputData(request)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make([]ort.Value, len(model.config.Config.Input))
+	defer destroyValues(inputs)
+
+	for idx, inputCfg := range model.config.Config.Input {
+		var input *triton_proto.ModelInferRequest_InferInputTensor
+		var raw []byte
+		for i, in := range request.Inputs {
+			if in.Name == inputCfg.Name {
+				input = in
+				raw = inputData[i]
+				break
+			}
+		}
+		if input == nil {
+			return nil, fmt.Errorf("missing input %s for model %s", inputCfg.Name, request.ModelName)
+		}
+		if isSharedMemoryInput(input) {
+			return nil, fmt.Errorf("input %s: shared memory is not supported by the onnx backend", inputCfg.Name)
+		}
+
+		dataType, ok := onnxDataTypes[inputCfg.DataType]
+		if !ok {
+			return nil, fmt.Errorf("unsupported data type %s for input %s", inputCfg.DataType.String(), inputCfg.Name)
+		}
+
+		shape, err := resolveShape(input.Shape, len(raw)/dataTypeSize(inputCfg.DataType))
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %w", inputCfg.Name, err)
+		}
+
+		value, err := ort.NewCustomDataTensor(ort.NewShape(shape...), raw, dataType)
+		if err != nil {
+			return nil, err
+		}
+		inputs[idx] = value
+	}
+
+	outputs := make([]ort.Value, len(model.config.Config.Output))
+	defer destroyValues(outputs)
+
+	err = model.session.Run(inputs, outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &triton_proto.ModelInferResponse{
+		ModelName:         request.ModelName,
+		ModelVersion:      model.version,
+		Id:                request.Id,
+		Outputs:           make([]*triton_proto.ModelInferResponse_InferOutputTensor, 0, len(outputs)),
+		RawOutputContents: make([][]byte, 0, len(outputs)),
+	}
+
+	for idx, outputCfg := range model.config.Config.Output {
+		if !isRequestedOutput(request, outputCfg.Name) {
+			continue
+		}
+		raw, err := valueToBytes(outputs[idx])
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %w", outputCfg.Name, err)
+		}
+		resp.Outputs = append(resp.Outputs, &triton_proto.ModelInferResponse_InferOutputTensor{
+			Name:     outputCfg.Name,
+			Datatype: outputCfg.DataType.String()[5:],
+			Shape:    outputs[idx].GetShape(),
+		})
+		resp.RawOutputContents = append(resp.RawOutputContents, raw)
+	}
+
+	return resp, nil
+}
+
+// Close waits for the running ModelInfer calls, then releases every loaded session and, if this backend initialized
+// it, the ONNX Runtime environment. Calls made after Close fail.
+func (b *ONNXBackend) Close() error {
+	b.mu.Lock()
+	if b.isShutdown {
+		b.mu.Unlock()
+		return nil
+	}
+	b.isShutdown = true
+	models := b.models
+	b.models = nil
+	b.mu.Unlock()
+
+	b.inFlight.Wait()
+
+	var errs []error
+	for _, model := range models {
+		errs = append(errs, model.session.Destroy())
+	}
+	if b.options != nil {
+		errs = append(errs, b.options.Destroy())
+	}
+	if b.ownsEnv {
+		errs = append(errs, ort.DestroyEnvironment())
+	}
+	return errors.Join(errs...)
+}
+
+func (b *ONNXBackend) destroyEnvironment() {
+	if b.ownsEnv {
+		_ = ort.DestroyEnvironment()
+	}
+}
+
+func (b *ONNXBackend) model(modelName, modelVersion string) (*onnxModel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.isShutdown {
+		return nil, errors.New("onnx backend is closed")
+	}
+
+	version, err := b.resolveVersion(modelName, modelVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	key := modelName + "/" + version
+	if model, ok := b.models[key]; ok {
+		return model, nil
+	}
+
+	modelPath := filepath.Join(b.params.ModelRepository, modelName, version, onnxModelFileName)
+	inputInfos, outputInfos, err := ort.GetInputOutputInfo(modelPath)
+	if err != nil {
+		return nil, err
+	}
+
+	modelConfig := &triton_proto.ModelConfig{
+		Name:     modelName,
+		Platform: "onnxruntime_onnx",
+		Input:    make([]*triton_proto.ModelInput, 0, len(inputInfos)),
+		Output:   make([]*triton_proto.ModelOutput, 0, len(outputInfos)),
+	}
+
+	inputNames := make([]string, 0, len(inputInfos))
+	for _, info := range inputInfos {
+		dataType, err := tritonDataType(info)
+		if err != nil {
+			return nil, err
+		}
+		modelConfig.Input = append(modelConfig.Input, &triton_proto.ModelInput{
+			Name:     info.Name,
+			DataType: dataType,
+			Dims:     info.Dimensions.Clone(),
+		})
+		inputNames = append(inputNames, info.Name)
+	}
+
+	outputNames := make([]string, 0, len(outputInfos))
+	for _, info := range outputInfos {
+		dataType, err := tritonDataType(info)
+		if err != nil {
+			return nil, err
+		}
+		modelConfig.Output = append(modelConfig.Output, &triton_proto.ModelOutput{
+			Name:     info.Name,
+			DataType: dataType,
+			Dims:     info.Dimensions.Clone(),
+		})
+		outputNames = append(outputNames, info.Name)
+	}
+
+	session, err := ort.NewDynamicAdvancedSession(modelPath, inputNames, outputNames, b.options)
+	if err != nil {
+		return nil, err
+	}
+
+	model := &onnxModel{
+		session: session,
+		config:  &triton_proto.ModelConfigResponse{Config: modelConfig},
+		version: version,
+	}
+	b.models[key] = model
+
+	return model, nil
+}
+
+// resolveVersion returns modelVersion if given, otherwise the highest numeric version directory of the model.
+func (b *ONNXBackend) resolveVersion(modelName, modelVersion string) (string, error) {
+	if modelVersion != "" {
+		return modelVersion, nil
+	}
+
+	entries, err := os.ReadDir(filepath.Join(b.params.ModelRepository, modelName))
+	if err != nil {
+		return "", err
+	}
+
+	versions := make([]int, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		v, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no version found for model %s", modelName)
+	}
+	sort.Ints(versions)
+
+	return strconv.Itoa(versions[len(versions)-1]), nil
+}
+
+func tritonDataType(info ort.InputOutputInfo) (triton_proto.DataType, error) {
+	if info.OrtValueType != ort.ONNXTypeTensor {
+		return triton_proto.DataType_TYPE_INVALID, fmt.Errorf("%s is not a tensor", info.Name)
+	}
+	for tritonType, ortType := range onnxDataTypes {
+		if ortType == info.DataType {
+			return tritonType, nil
+		}
+	}
+	return triton_proto.DataType_TYPE_INVALID, fmt.Errorf("unsupported data type %s for %s", info.DataType.String(), info.Name)
+}
+
+// resolveShape replaces at most one dynamic (-1) dimension using the number of elements actually sent.
+func resolveShape(shape []int64, numElements int) ([]int64, error) {
+	resolved := make([]int64, len(shape))
+	copy(resolved, shape)
+
+	known := int64(1)
+	dynamicIdx := -1
+	for idx, dim := range resolved {
+		if dim < 0 {
+			if dynamicIdx >= 0 {
+				return nil, fmt.Errorf("shape %v has more than one dynamic dimension", shape)
+			}
+			dynamicIdx = idx
+			continue
+		}
+		known *= dim
+	}
+
+	if dynamicIdx >= 0 {
+		if known == 0 || int64(numElements)%known != 0 {
+			return nil, fmt.Errorf("cannot resolve shape %v from %d elements", shape, numElements)
+		}
+		resolved[dynamicIdx] = int64(numElements) / known
+	} else if known != int64(numElements) {
+		return nil, fmt.Errorf("shape %v does not match %d elements", shape, numElements)
+	}
+
+	return resolved, nil
+}
+
+func valueToBytes(value ort.Value) ([]byte, error) {
+	var raw []byte
+	switch v := value.(type) {
+	case *ort.Tensor[float32]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.Tensor[float64]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.Tensor[uint8]:
+		raw = v.GetData()
+	case *ort.Tensor[int8]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.Tensor[uint16]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.Tensor[int16]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.Tensor[int32]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.Tensor[uint32]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.Tensor[int64]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.Tensor[uint64]:
+		raw = utils.TToBytes(v.GetData())
+	case *ort.CustomDataTensor:
+		raw = v.GetData()
+	default:
+		return nil, fmt.Errorf("unsupported output value %T", value)
+	}
+
+	// The tensor memory is released together with the value, hand out a copy.
+	out := make([]byte, len(raw))
+	copy(out, raw)
+	return out, nil
+}
+
+func isRequestedOutput(request *triton_proto.ModelInferRequest, name string) bool {
+	if len(request.Outputs) == 0 {
+		return true
+	}
+	for _, out := range request.Outputs {
+		if out.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func destroyValues(values []ort.Value) {
+	for _, v := range values {
+		if v != nil {
+			_ = v.Destroy()
+		}
+	}
+}
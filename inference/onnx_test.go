@@ -0,0 +1,95 @@
+package inference
+
+import (
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	ort "github.com/yalue/onnxruntime_go"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolveShape(t *testing.T) {
+	shape, err := resolveShape([]int64{-1, 3, 112, 112}, 2*3*112*112)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 3, 112, 112}, shape)
+
+	shape, err = resolveShape([]int64{1, 3, 640, 640}, 3*640*640)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 3, 640, 640}, shape)
+
+	_, err = resolveShape([]int64{1, 3, 640, 640}, 3*640)
+	assert.Error(t, err)
+
+	_, err = resolveShape([]int64{-1, 3, -1, -1}, 3*640*640)
+	assert.Error(t, err)
+}
+
+func TestNewONNXBackend_MissingRepository(t *testing.T) {
+	_, err := NewONNXBackend(config.NewONNXRuntimeParams("./does-not-exist", "libonnxruntime.so", 1, 1))
+	assert.Error(t, err)
+}
+
+// blockingSession is an onnxSession whose runs wait for release to be closed.
+type blockingSession struct {
+	started   chan struct{}
+	release   chan struct{}
+	running   atomic.Bool
+	destroyed atomic.Bool
+}
+
+func (s *blockingSession) Run(inputs, outputs []ort.Value) error {
+	s.running.Store(true)
+	close(s.started)
+	<-s.release
+	s.running.Store(false)
+	return nil
+}
+
+func (s *blockingSession) Destroy() error {
+	s.destroyed.Store(true)
+	return nil
+}
+
+func TestONNXBackend_CloseWaitsForInference(t *testing.T) {
+	session := &blockingSession{started: make(chan struct{}), release: make(chan struct{})}
+	backend := &ONNXBackend{
+		models: map[string]*onnxModel{
+			"face_quality/1": {
+				session: session,
+				config:  &triton_proto.ModelConfigResponse{Config: &triton_proto.ModelConfig{Name: "face_quality"}},
+				version: "1",
+			},
+		},
+	}
+
+	inferred := make(chan error)
+	go func() {
+		_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{ModelName: "face_quality", ModelVersion: "1"})
+		inferred <- err
+	}()
+	<-session.started
+
+	closed := make(chan error)
+	go func() {
+		closed <- backend.Close()
+	}()
+
+	// The session is not destroyed under the running inference.
+	select {
+	case <-closed:
+		t.Fatal("Close returned while an inference was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.False(t, session.destroyed.Load())
+
+	close(session.release)
+	assert.NoError(t, <-inferred)
+	assert.NoError(t, <-closed)
+	assert.True(t, session.destroyed.Load())
+	assert.False(t, session.running.Load())
+
+	_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{ModelName: "face_quality", ModelVersion: "1"})
+	assert.ErrorContains(t, err, "closed")
+}
@@ -0,0 +1,253 @@
+package inference
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fixture holds the model configurations and inference exchanges captured by a RecordingBackend.
+type Fixture struct {
+	ModelConfigs []*RecordedModelConfig `json:"model_configs"`
+	Infers       []*RecordedInfer       `json:"infers"`
+}
+
+// RecordedModelConfig is a GetModelConfiguration call and its response.
+type RecordedModelConfig struct {
+	ModelName    string
+	ModelVersion string
+	Response     *triton_proto.ModelConfigResponse
+}
+
+// RecordedInfer is a ModelInfer request and its response.
+type RecordedInfer struct {
+	Request  *triton_proto.ModelInferRequest
+	Response *triton_proto.ModelInferResponse
+}
+
+type recordedModelConfigJSON struct {
+	ModelName    string          `json:"model_name"`
+	ModelVersion string          `json:"model_version"`
+	Response     json.RawMessage `json:"response"`
+}
+
+type recordedInferJSON struct {
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response"`
+}
+
+// MarshalJSON encodes the response with the protobuf JSON mapping.
+func (r *RecordedModelConfig) MarshalJSON() ([]byte, error) {
+	response, err := protojson.Marshal(r.Response)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(recordedModelConfigJSON{ModelName: r.ModelName, ModelVersion: r.ModelVersion, Response: response})
+}
+
+// UnmarshalJSON decodes a RecordedModelConfig encoded by MarshalJSON.
+func (r *RecordedModelConfig) UnmarshalJSON(data []byte) error {
+	var raw recordedModelConfigJSON
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	r.ModelName, r.ModelVersion = raw.ModelName, raw.ModelVersion
+	r.Response = &triton_proto.ModelConfigResponse{}
+	return protojson.Unmarshal(raw.Response, r.Response)
+}
+
+// MarshalJSON encodes the request and response with the protobuf JSON mapping.
+func (r *RecordedInfer) MarshalJSON() ([]byte, error) {
+	request, err := protojson.Marshal(r.Request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := protojson.Marshal(r.Response)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(recordedInferJSON{Request: request, Response: response})
+}
+
+// UnmarshalJSON decodes a RecordedInfer encoded by MarshalJSON.
+func (r *RecordedInfer) UnmarshalJSON(data []byte) error {
+	var raw recordedInferJSON
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	r.Request = &triton_proto.ModelInferRequest{}
+	err = protojson.Unmarshal(raw.Request, r.Request)
+	if err != nil {
+		return err
+	}
+	r.Response = &triton_proto.ModelInferResponse{}
+	return protojson.Unmarshal(raw.Response, r.Response)
+}
+
+// WriteTo writes the fixture as JSON.
+func (f *Fixture) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// Save writes the fixture to path, gzip compressed when path ends with ".gz".
+func (f *Fixture) Save(path string) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cErr := file.Close()
+		if err == nil {
+			err = cErr
+		}
+	}()
+
+	if !strings.HasSuffix(path, ".gz") {
+		_, err = f.WriteTo(file)
+		return err
+	}
+
+	zw := gzip.NewWriter(file)
+	_, err = f.WriteTo(zw)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadFixture reads a fixture written by WriteTo.
+func ReadFixture(r io.Reader) (*Fixture, error) {
+	fixture := &Fixture{}
+	err := json.NewDecoder(r).Decode(fixture)
+	if err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+// LoadFixture reads a fixture written by Save.
+func LoadFixture(path string) (*Fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if !strings.HasSuffix(path, ".gz") {
+		return ReadFixture(file)
+	}
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ReadFixture(zr)
+}
+
+// RecordingBackend wraps a backend and records every successful call so it can be replayed by a ReplayBackend.
+// It does not support system shared memory: wrap the SharedMemoryBackend instead, so the recorded requests
+// keep their raw input contents.
+type RecordingBackend struct {
+	next    Backend
+	mu      sync.Mutex
+	fixture Fixture
+}
+
+var (
+	_ Backend       = (*RecordingBackend)(nil)
+	_ HealthChecker = (*RecordingBackend)(nil)
+)
+
+// NewRecordingBackend wraps backend.
+func NewRecordingBackend(backend Backend) *RecordingBackend {
+	return &RecordingBackend{
+		next: backend,
+	}
+}
+
+// GetModelConfiguration delegates to the wrapped backend and records the response.
+func (b *RecordingBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	resp, err := b.next.GetModelConfiguration(timeout, modelName, modelVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, recorded := range b.fixture.ModelConfigs {
+		if recorded.ModelName == modelName && recorded.ModelVersion == modelVersion {
+			return resp, nil
+		}
+	}
+	b.fixture.ModelConfigs = append(b.fixture.ModelConfigs, &RecordedModelConfig{
+		ModelName:    modelName,
+		ModelVersion: modelVersion,
+		Response:     proto.Clone(resp).(*triton_proto.ModelConfigResponse),
+	})
+	return resp, nil
+}
+
+// ModelInfer delegates to the wrapped backend and records the request and response.
+func (b *RecordingBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	recorded := proto.Clone(request).(*triton_proto.ModelInferRequest)
+	resp, err := b.next.ModelInfer(timeout, request)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fixture.Infers = append(b.fixture.Infers, &RecordedInfer{
+		Request:  recorded,
+		Response: proto.Clone(resp).(*triton_proto.ModelInferResponse),
+	})
+	return resp, nil
+}
+
+// ServerLive delegates to the wrapped backend.
+func (b *RecordingBackend) ServerLive(timeout time.Duration) (bool, error) {
+	checker, ok := b.next.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.ServerLive(timeout)
+}
+
+// ModelReady delegates to the wrapped backend.
+func (b *RecordingBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	checker, ok := b.next.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.ModelReady(timeout, modelName, modelVersion)
+}
+
+// Fixture returns the calls recorded so far.
+func (b *RecordingBackend) Fixture() *Fixture {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &Fixture{
+		ModelConfigs: append([]*RecordedModelConfig(nil), b.fixture.ModelConfigs...),
+		Infers:       append([]*RecordedInfer(nil), b.fixture.Infers...),
+	}
+}
+
+// Save writes the calls recorded so far to path, see Fixture.Save.
+func (b *RecordingBackend) Save(path string) error {
+	return b.Fixture().Save(path)
+}
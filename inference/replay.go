@@ -0,0 +1,193 @@
+package inference
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"google.golang.org/protobuf/proto"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ReplayBackend serves the responses of a recorded Fixture without a model server. Each request is answered with
+// the response of the first recorded request of the same model whose inputs have the same names, datatypes and
+// shapes and whose data matches within the tolerance. Recorded exchanges are consumed in order, a request that
+// matches only exchanges that were already replayed is answered with the first of them.
+type ReplayBackend struct {
+	fixture   *Fixture
+	tolerance float64
+	inputData [][][]byte
+
+	mu       sync.Mutex
+	replayed []bool
+}
+
+var (
+	_ Backend       = (*ReplayBackend)(nil)
+	_ HealthChecker = (*ReplayBackend)(nil)
+)
+
+// NewReplayBackend creates a backend replaying fixture. With a tolerance of 0 the input data must match byte for
+// byte, otherwise FP32, FP16, FP64 and UINT8 elements may differ by up to tolerance.
+func NewReplayBackend(fixture *Fixture, tolerance float64) (*ReplayBackend, error) {
+	inputData := make([][][]byte, len(fixture.Infers))
+	for idx, recorded := range fixture.Infers {
+		data, err := requestInputData(recorded.Request)
+		if err != nil {
+			return nil, fmt.Errorf("recorded request %d: %w", idx, err)
+		}
+		inputData[idx] = data
+	}
+
+	return &ReplayBackend{
+		fixture:   fixture,
+		tolerance: tolerance,
+		inputData: inputData,
+		replayed:  make([]bool, len(fixture.Infers)),
+	}, nil
+}
+
+// GetModelConfiguration returns the recorded configuration of the model version, or of any recorded version of
+// the model when the version itself was not recorded.
+func (b *ReplayBackend) GetModelConfiguration(_ time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	var found *RecordedModelConfig
+	for _, recorded := range b.fixture.ModelConfigs {
+		if recorded.ModelName != modelName {
+			continue
+		}
+		if recorded.ModelVersion == modelVersion {
+			found = recorded
+			break
+		}
+		if found == nil {
+			found = recorded
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no recorded configuration for model %s version %q", modelName, modelVersion)
+	}
+	return proto.Clone(found.Response).(*triton_proto.ModelConfigResponse), nil
+}
+
+// ModelInfer returns the recorded response of the matching request.
+func (b *ReplayBackend) ModelInfer(_ time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	data, err := requestInputData(request)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var mismatch error
+	replayed := -1
+	for idx, recorded := range b.fixture.Infers {
+		if recorded.Request.ModelName != request.ModelName || recorded.Request.ModelVersion != request.ModelVersion {
+			continue
+		}
+		err = b.match(recorded.Request, b.inputData[idx], request, data)
+		if err != nil {
+			if mismatch == nil {
+				mismatch = err
+			}
+			continue
+		}
+		if !b.replayed[idx] {
+			b.replayed[idx] = true
+			return proto.Clone(recorded.Response).(*triton_proto.ModelInferResponse), nil
+		}
+		if replayed < 0 {
+			replayed = idx
+		}
+	}
+
+	if replayed >= 0 {
+		return proto.Clone(b.fixture.Infers[replayed].Response).(*triton_proto.ModelInferResponse), nil
+	}
+	if mismatch != nil {
+		return nil, fmt.Errorf("no recorded request of model %s version %q matches: %w", request.ModelName, request.ModelVersion, mismatch)
+	}
+	return nil, fmt.Errorf("no recorded request of model %s version %q", request.ModelName, request.ModelVersion)
+}
+
+// ServerLive always reports the replayed server as live.
+func (b *ReplayBackend) ServerLive(time.Duration) (bool, error) {
+	return true, nil
+}
+
+// ModelReady reports whether a configuration of the model was recorded.
+func (b *ReplayBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	_, err := b.GetModelConfiguration(timeout, modelName, modelVersion)
+	return err == nil, nil
+}
+
+// Pending returns the number of recorded exchanges that have not been replayed yet.
+func (b *ReplayBackend) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := 0
+	for _, replayed := range b.replayed {
+		if !replayed {
+			pending++
+		}
+	}
+	return pending
+}
+
+func (b *ReplayBackend) match(recorded *triton_proto.ModelInferRequest, recordedData [][]byte, request *triton_proto.ModelInferRequest, data [][]byte) error {
+	if len(recorded.Inputs) != len(request.Inputs) {
+		return fmt.Errorf("expected %d inputs, got %d", len(recorded.Inputs), len(request.Inputs))
+	}
+
+	for idx, input := range request.Inputs {
+		expected := recorded.Inputs[idx]
+		if input.Name != expected.Name || input.Datatype != expected.Datatype || !slices.Equal(input.Shape, expected.Shape) {
+			return fmt.Errorf("input %d: expected %s %s %v, got %s %s %v",
+				idx, expected.Name, expected.Datatype, expected.Shape, input.Name, input.Datatype, input.Shape)
+		}
+		if !b.dataMatch(input.Datatype, recordedData[idx], data[idx]) {
+			return fmt.Errorf("input %s: data differs", input.Name)
+		}
+	}
+	return nil
+}
+
+func (b *ReplayBackend) dataMatch(dataType string, expected, actual []byte) bool {
+	if bytes.Equal(expected, actual) {
+		return true
+	}
+	if b.tolerance == 0 || len(expected) != len(actual) {
+		return false
+	}
+
+	var elementSize int
+	var value func(raw []byte) float64
+	switch dataType {
+	case "FP32":
+		elementSize = 4
+		value = func(raw []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(raw))) }
+	case "FP64":
+		elementSize = 8
+		value = func(raw []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(raw)) }
+	case "FP16":
+		elementSize = 2
+		value = func(raw []byte) float64 { return float64(utils.Float16ToFloat32(binary.LittleEndian.Uint16(raw))) }
+	case "UINT8":
+		elementSize = 1
+		value = func(raw []byte) float64 { return float64(raw[0]) }
+	default:
+		return false
+	}
+
+	for i := 0; i+elementSize <= len(expected); i += elementSize {
+		if math.Abs(value(expected[i:i+elementSize])-value(actual[i:i+elementSize])) > b.tolerance {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package inference
+
+import (
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// doublingBackend answers every request with its FP32 input doubled.
+type doublingBackend struct {
+	calls int
+}
+
+func (b *doublingBackend) GetModelConfiguration(_ time.Duration, modelName, _ string) (*triton_proto.ModelConfigResponse, error) {
+	return &triton_proto.ModelConfigResponse{Config: &triton_proto.ModelConfig{Name: modelName}}, nil
+}
+
+func (b *doublingBackend) ModelInfer(_ time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	b.calls++
+	values := make([]float32, 0, len(request.RawInputContents[0])/4)
+	for _, v := range utils.BytesToT32[float32](request.RawInputContents[0]) {
+		values = append(values, 2*v)
+	}
+	return &triton_proto.ModelInferResponse{
+		ModelName:         request.ModelName,
+		Outputs:           []*triton_proto.ModelInferResponse_InferOutputTensor{{Name: "output", Datatype: "FP32", Shape: request.Inputs[0].Shape}},
+		RawOutputContents: [][]byte{utils.TToBytes(values)},
+	}, nil
+}
+
+func replayTestRequest(modelName string, values ...float32) *triton_proto.ModelInferRequest {
+	return &triton_proto.ModelInferRequest{
+		ModelName:        modelName,
+		Inputs:           []*triton_proto.ModelInferRequest_InferInputTensor{{Name: "data", Datatype: "FP32", Shape: []int64{1, int64(len(values))}}},
+		RawInputContents: [][]byte{utils.TToBytes(values)},
+	}
+}
+
+func TestReplayBackend_ModelInfer(t *testing.T) {
+	next := &doublingBackend{}
+	recorder := NewRecordingBackend(next)
+
+	_, err := recorder.GetModelConfiguration(time.Second, "model", "")
+	assert.NoError(t, err)
+	for _, values := range [][]float32{{1, 2}, {3, 4}, {1, 2}} {
+		_, err = recorder.ModelInfer(time.Second, replayTestRequest("model", values...))
+		assert.NoError(t, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "fixture.json.gz")
+	assert.NoError(t, recorder.Save(path))
+	fixture, err := LoadFixture(path)
+	assert.NoError(t, err)
+	assert.Len(t, fixture.ModelConfigs, 1)
+	assert.Len(t, fixture.Infers, 3)
+
+	replay, err := NewReplayBackend(fixture, 1e-3)
+	assert.NoError(t, err)
+
+	cfg, err := replay.GetModelConfiguration(time.Second, "model", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "model", cfg.Config.Name)
+
+	resp, err := replay.ModelInfer(time.Second, replayTestRequest("model", 3.0001, 4))
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{6, 8}, utils.BytesToT32[float32](resp.RawOutputContents[0]))
+	assert.Equal(t, 2, replay.Pending())
+
+	for range 3 {
+		resp, err = replay.ModelInfer(time.Second, replayTestRequest("model", 1, 2))
+		assert.NoError(t, err)
+		assert.Equal(t, []float32{2, 4}, utils.BytesToT32[float32](resp.RawOutputContents[0]))
+	}
+	assert.Equal(t, 0, replay.Pending())
+	assert.Equal(t, 3, next.calls)
+
+	_, err = replay.ModelInfer(time.Second, replayTestRequest("model", 1, 3))
+	assert.ErrorContains(t, err, "input data: data differs")
+
+	_, err = replay.ModelInfer(time.Second, replayTestRequest("model", 1, 2, 3))
+	assert.ErrorContains(t, err, "expected data FP32 [1 2]")
+
+	_, err = replay.ModelInfer(time.Second, replayTestRequest("other", 1, 2))
+	assert.ErrorContains(t, err, "no recorded request of model other")
+
+	ready, err := replay.ModelReady(time.Second, "other", "")
+	assert.NoError(t, err)
+	assert.False(t, ready)
+}
+
+func TestReplayBackend_ExactMatch(t *testing.T) {
+	recorder := NewRecordingBackend(&doublingBackend{})
+	_, err := recorder.ModelInfer(time.Second, replayTestRequest("model", 1, 2))
+	assert.NoError(t, err)
+
+	replay, err := NewReplayBackend(recorder.Fixture(), 0)
+	assert.NoError(t, err)
+
+	_, err = replay.ModelInfer(time.Second, replayTestRequest("model", 1.0001, 2))
+	assert.Error(t, err)
+	_, err = replay.ModelInfer(time.Second, replayTestRequest("model", 1, 2))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,338 @@
+package inference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrEndpointsUnavailable is returned by ResilientBackend when every endpoint is down or its circuit breaker is open.
+var ErrEndpointsUnavailable = errors.New("no inference endpoint available")
+
+// Endpoint is a named backend served by a ResilientBackend, the name only appears in errors.
+type Endpoint struct {
+	Name    string
+	Backend Backend
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type endpointState struct {
+	Endpoint
+	inflight atomic.Int64
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	lastErr  error
+}
+
+// acquire reports whether the circuit breaker lets a request through. Once the open timeout has elapsed a
+// single probe request is let through, which is reserved by acquire.
+func (e *endpointState) acquire(openTimeout time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch e.state {
+	case breakerOpen:
+		if time.Since(e.openedAt) < openTimeout {
+			return false
+		}
+		e.state = breakerHalfOpen
+		e.probing = true
+		return true
+	case breakerHalfOpen:
+		if e.probing {
+			return false
+		}
+		e.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (e *endpointState) succeeded() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.state = breakerClosed
+	e.failures = 0
+	e.probing = false
+}
+
+func (e *endpointState) failed(err error, threshold int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastErr = err
+	e.failures++
+	e.probing = false
+	if e.state == breakerHalfOpen || e.failures >= threshold {
+		e.state = breakerOpen
+		e.openedAt = time.Now()
+	}
+}
+
+func (e *endpointState) open() (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state != breakerClosed, e.lastErr
+}
+
+// ResilientBackend spreads calls over several endpoints serving the same models. Calls failing with a transient
+// error (unavailable server, timeout, overload) are retried with exponential backoff on another endpoint, and an
+// endpoint failing repeatedly is skipped by its circuit breaker until a probe request succeeds again. Other errors,
+// such as invalid arguments, are returned as is.
+type ResilientBackend struct {
+	endpoints []*endpointState
+	cfg       *config.ResilientBackendParams
+	next      atomic.Uint64
+}
+
+var (
+	_ Backend       = (*ResilientBackend)(nil)
+	_ HealthChecker = (*ResilientBackend)(nil)
+)
+
+// NewResilientBackend balances calls over endpoints as configured by cfg.
+func NewResilientBackend(endpoints []Endpoint, cfg *config.ResilientBackendParams) (*ResilientBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("at least one endpoint is required")
+	}
+	if cfg.MaxAttempts <= 0 || cfg.FailureThreshold <= 0 {
+		return nil, errors.New("max attempts and failure threshold must be positive")
+	}
+	switch cfg.Policy {
+	case config.LoadBalancingRoundRobin, config.LoadBalancingLeastLoaded:
+	default:
+		return nil, fmt.Errorf("unsupported load balancing policy: %s", cfg.Policy)
+	}
+
+	states := make([]*endpointState, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		states = append(states, &endpointState{Endpoint: endpoint})
+	}
+	return &ResilientBackend{
+		endpoints: states,
+		cfg:       cfg,
+	}, nil
+}
+
+// NewResilientTritonBackend creates a Triton backend per server URL, see NewTritonBackend, and balances calls over them.
+func NewResilientTritonBackend(serverURLs []string, protocol config.TritonProtocol, cfg *config.ResilientBackendParams) (*ResilientBackend, error) {
+	endpoints := make([]Endpoint, 0, len(serverURLs))
+	for _, serverURL := range serverURLs {
+		backend, err := NewTritonBackend(config.NewTritonBackendParams(serverURL, protocol))
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", serverURL, err)
+		}
+		endpoints = append(endpoints, Endpoint{Name: serverURL, Backend: backend})
+	}
+	return NewResilientBackend(endpoints, cfg)
+}
+
+// GetModelConfiguration fetches the model configuration from the first endpoint that answers.
+func (b *ResilientBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	return call(b, timeout, "get model configuration", func(backend Backend, timeout time.Duration) (*triton_proto.ModelConfigResponse, error) {
+		return backend.GetModelConfiguration(timeout, modelName, modelVersion)
+	})
+}
+
+// ModelInfer runs the request on the selected endpoint, retrying transient failures. The timeout bounds the
+// whole call, retries and backoff included.
+func (b *ResilientBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	return call(b, timeout, "model infer", func(backend Backend, timeout time.Duration) (*triton_proto.ModelInferResponse, error) {
+		return backend.ModelInfer(timeout, request)
+	})
+}
+
+// ServerLive reports whether at least one endpoint is live.
+func (b *ResilientBackend) ServerLive(timeout time.Duration) (bool, error) {
+	var errs []error
+	for _, e := range b.endpoints {
+		checker, ok := e.Backend.(HealthChecker)
+		if !ok {
+			return true, nil
+		}
+		live, err := checker.ServerLive(timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("endpoint %s: %w", e.Name, err))
+			continue
+		}
+		if live {
+			return true, nil
+		}
+	}
+	if len(errs) == len(b.endpoints) {
+		return false, errors.Join(errs...)
+	}
+	return false, nil
+}
+
+// ModelReady reports whether the model is ready on at least one endpoint whose circuit breaker is closed.
+func (b *ResilientBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	var errs []error
+	for _, e := range b.endpoints {
+		if open, _ := e.open(); open {
+			continue
+		}
+		checker, ok := e.Backend.(HealthChecker)
+		if !ok {
+			return true, nil
+		}
+		ready, err := checker.ModelReady(timeout, modelName, modelVersion)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("endpoint %s: %w", e.Name, err))
+			continue
+		}
+		if ready {
+			return true, nil
+		}
+	}
+	if len(errs) > 0 {
+		return false, errors.Join(errs...)
+	}
+	return false, nil
+}
+
+// pick selects the endpoint for the next attempt, preferring endpoints not tried yet by the call.
+func (b *ResilientBackend) pick(tried []bool) int {
+	n := len(b.endpoints)
+	start := int(b.next.Add(1) % uint64(n))
+	order := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, (start+i)%n)
+	}
+	if b.cfg.Policy == config.LoadBalancingLeastLoaded {
+		slices.SortStableFunc(order, func(i, j int) int {
+			return int(b.endpoints[i].inflight.Load() - b.endpoints[j].inflight.Load())
+		})
+	}
+
+	for _, retry := range []bool{false, true} {
+		for _, idx := range order {
+			if tried[idx] != retry {
+				continue
+			}
+			if b.endpoints[idx].acquire(b.cfg.OpenTimeout) {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+// unavailable describes why no endpoint can serve the call: the errors of the attempts and the open circuit
+// breakers of the endpoints that were not tried.
+func (b *ResilientBackend) unavailable(op string, tried []bool, errs []error) error {
+	for idx, e := range b.endpoints {
+		if open, lastErr := e.open(); open && !tried[idx] {
+			errs = append(errs, fmt.Errorf("endpoint %s: circuit open: %w", e.Name, lastErr))
+		}
+	}
+	return fmt.Errorf("%s: %w: %w", op, ErrEndpointsUnavailable, errors.Join(errs...))
+}
+
+func call[T any](b *ResilientBackend, timeout time.Duration, op string, fn func(backend Backend, timeout time.Duration) (T, error)) (T, error) {
+	var zero T
+	deadline := time.Now().Add(timeout)
+	tried := make([]bool, len(b.endpoints))
+	backoff := b.cfg.InitialBackoff
+	var errs []error
+
+	for attempt := 0; attempt < b.cfg.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			sleep := backoff
+			if sleep > 0 {
+				sleep = backoff/2 + rand.N(backoff/2+1)
+			}
+			if remaining := time.Until(deadline); sleep > remaining {
+				sleep = remaining
+			}
+			time.Sleep(sleep)
+			backoff = min(2*backoff, b.cfg.MaxBackoff)
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			errs = append(errs, fmt.Errorf("%w after %d attempts", context.DeadlineExceeded, attempt))
+			break
+		}
+		attemptTimeout := remaining
+		if b.cfg.AttemptTimeout > 0 && b.cfg.AttemptTimeout < remaining {
+			attemptTimeout = b.cfg.AttemptTimeout
+		}
+
+		idx := b.pick(tried)
+		if idx < 0 {
+			return zero, b.unavailable(op, tried, errs)
+		}
+		tried[idx] = true
+		e := b.endpoints[idx]
+
+		e.inflight.Add(1)
+		resp, err := fn(e.Backend, attemptTimeout)
+		e.inflight.Add(-1)
+		if err == nil {
+			e.succeeded()
+			return resp, nil
+		}
+		if !IsRetryable(err) {
+			// The endpoint answered, the request itself is at fault.
+			e.succeeded()
+			return zero, fmt.Errorf("%s: endpoint %s: %w", op, e.Name, err)
+		}
+		e.failed(err, b.cfg.FailureThreshold)
+		errs = append(errs, fmt.Errorf("endpoint %s: %w", e.Name, err))
+	}
+
+	if !slices.Contains(tried, false) {
+		return zero, b.unavailable(op, tried, errs)
+	}
+	return zero, fmt.Errorf("%s failed after %d attempts: %w", op, len(errs), errors.Join(errs...))
+}
+
+// IsRetryable reports whether err is a transient failure of the endpoint, after which the call may be retried:
+// connection errors, timeouts, and the gRPC and HTTP statuses of an unavailable or overloaded server.
+func IsRetryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			return true
+		}
+	}
+	return false
+}
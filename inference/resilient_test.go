@@ -0,0 +1,168 @@
+package inference
+
+import (
+	"errors"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedBackend fails with err until it has failed failures times, a negative count fails forever.
+type scriptedBackend struct {
+	mu       sync.Mutex
+	err      error
+	failures int
+	calls    int
+	block    chan struct{}
+}
+
+func (b *scriptedBackend) GetModelConfiguration(time.Duration, string, string) (*triton_proto.ModelConfigResponse, error) {
+	return &triton_proto.ModelConfigResponse{}, nil
+}
+
+func (b *scriptedBackend) ModelInfer(time.Duration, *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	if b.block != nil {
+		<-b.block
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	if b.failures != 0 {
+		b.failures--
+		return nil, b.err
+	}
+	return &triton_proto.ModelInferResponse{}, nil
+}
+
+func (b *scriptedBackend) callCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls
+}
+
+func newTestResilientBackend(t *testing.T, policy config.LoadBalancingPolicy, backends ...*scriptedBackend) *ResilientBackend {
+	endpoints := make([]Endpoint, 0, len(backends))
+	for idx, backend := range backends {
+		endpoints = append(endpoints, Endpoint{Name: string(rune('a' + idx)), Backend: backend})
+	}
+	b, err := NewResilientBackend(endpoints, config.NewResilientBackendParams(policy, 3, time.Millisecond, 5*time.Millisecond, 0, 2, 50*time.Millisecond))
+	assert.NoError(t, err)
+	return b
+}
+
+func TestResilientBackend_RoundRobin(t *testing.T) {
+	a, b := &scriptedBackend{}, &scriptedBackend{}
+	backend := newTestResilientBackend(t, config.LoadBalancingRoundRobin, a, b)
+
+	for range 4 {
+		_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, a.callCount())
+	assert.Equal(t, 2, b.callCount())
+}
+
+func TestResilientBackend_Failover(t *testing.T) {
+	down := &scriptedBackend{err: status.Error(codes.Unavailable, "connection refused"), failures: -1}
+	up := &scriptedBackend{}
+	backend := newTestResilientBackend(t, config.LoadBalancingRoundRobin, down, up)
+
+	for range 6 {
+		_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{})
+		assert.NoError(t, err)
+	}
+	// The breaker of the failing endpoint opens after 2 failures.
+	assert.Equal(t, 2, down.callCount())
+	assert.Equal(t, 6, up.callCount())
+
+	// After the open timeout a probe is let through and closes the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	down.mu.Lock()
+	down.failures = 0
+	down.mu.Unlock()
+	for range 4 {
+		_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 4, down.callCount())
+}
+
+func TestResilientBackend_NotRetryable(t *testing.T) {
+	a := &scriptedBackend{err: status.Error(codes.InvalidArgument, "unexpected shape"), failures: -1}
+	b := &scriptedBackend{err: &HTTPStatusError{StatusCode: http.StatusBadRequest, Message: "unexpected shape"}, failures: -1}
+	backend := newTestResilientBackend(t, config.LoadBalancingRoundRobin, a, b)
+
+	for range 2 {
+		_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{})
+		assert.ErrorContains(t, err, "unexpected shape")
+		assert.False(t, errors.Is(err, ErrEndpointsUnavailable))
+	}
+	assert.Equal(t, 1, a.callCount())
+	assert.Equal(t, 1, b.callCount())
+}
+
+func TestResilientBackend_AllDown(t *testing.T) {
+	a := &scriptedBackend{err: status.Error(codes.Unavailable, "connection refused"), failures: -1}
+	b := &scriptedBackend{err: &HTTPStatusError{StatusCode: http.StatusServiceUnavailable, Message: "shutting down"}, failures: -1}
+	backend := newTestResilientBackend(t, config.LoadBalancingRoundRobin, a, b)
+
+	_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{})
+	assert.ErrorIs(t, err, ErrEndpointsUnavailable)
+	assert.ErrorContains(t, err, "endpoint a: rpc error: code = Unavailable desc = connection refused")
+	assert.ErrorContains(t, err, "endpoint b: triton http status 503: shutting down")
+	assert.Equal(t, 3, a.callCount()+b.callCount())
+
+	// Both breakers are open now, calls fail fast.
+	_, err = backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{})
+	assert.ErrorIs(t, err, ErrEndpointsUnavailable)
+	assert.ErrorContains(t, err, "circuit open")
+	assert.Equal(t, 4, a.callCount()+b.callCount())
+}
+
+func TestResilientBackend_LeastLoaded(t *testing.T) {
+	busy := &scriptedBackend{block: make(chan struct{})}
+	idle := &scriptedBackend{}
+	backend := newTestResilientBackend(t, config.LoadBalancingLeastLoaded, busy, idle)
+
+	var started atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for !started.Load() {
+			_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{})
+			assert.NoError(t, err)
+		}
+	}()
+	// Wait until a request is stuck on the busy endpoint.
+	for backend.endpoints[0].inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	before := idle.callCount()
+	for range 4 {
+		_, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, before+4, idle.callCount())
+
+	started.Store(true)
+	close(busy.block)
+	<-done
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, IsRetryable(status.Error(codes.Unavailable, "")))
+	assert.True(t, IsRetryable(status.Error(codes.DeadlineExceeded, "")))
+	assert.False(t, IsRetryable(status.Error(codes.NotFound, "")))
+	assert.True(t, IsRetryable(&HTTPStatusError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, IsRetryable(&HTTPStatusError{StatusCode: http.StatusInternalServerError}))
+	assert.False(t, IsRetryable(errors.New("decode output")))
+}
@@ -0,0 +1,206 @@
+package inference
+
+import (
+	"errors"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"sync"
+	"time"
+)
+
+const (
+	sharedMemoryRegionParameter   = "shared_memory_region"
+	sharedMemoryByteSizeParameter = "shared_memory_byte_size"
+	sharedMemoryOffsetParameter   = "shared_memory_offset"
+
+	sharedMemoryAlignment = 64
+)
+
+// SystemSharedMemoryRegistrar is implemented by backends that can register system shared-memory regions with the server.
+type SystemSharedMemoryRegistrar interface {
+	// RegisterSystemSharedMemory registers the region called name backed by the shared-memory object key.
+	RegisterSystemSharedMemory(timeout time.Duration, name, key string, byteSize, offset uint64) error
+
+	// UnregisterSystemSharedMemory unregisters the region called name.
+	UnregisterSystemSharedMemory(timeout time.Duration, name string) error
+}
+
+// SharedMemoryBackend wraps a Triton backend and passes large input tensors through a registered
+// system shared-memory region instead of the request body. The region is split into equal slots so
+// concurrent requests never share memory; inputs that do not fit into a slot are sent inline.
+type SharedMemoryBackend struct {
+	next      Backend
+	registrar SystemSharedMemoryRegistrar
+	cfg       *config.SharedMemoryParams
+	region    []byte
+	slots     chan int
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var (
+	_ Backend       = (*SharedMemoryBackend)(nil)
+	_ HealthChecker = (*SharedMemoryBackend)(nil)
+)
+
+// NewSharedMemoryBackend creates the shared-memory region described by cfg and registers it through backend,
+// which must implement SystemSharedMemoryRegistrar. Close unregisters and removes the region.
+func NewSharedMemoryBackend(backend Backend, cfg *config.SharedMemoryParams) (*SharedMemoryBackend, error) {
+	registrar, ok := backend.(SystemSharedMemoryRegistrar)
+	if !ok {
+		return nil, fmt.Errorf("backend %T does not support system shared memory", backend)
+	}
+	if cfg.SlotByteSize <= 0 || cfg.NumSlots <= 0 {
+		return nil, errors.New("shared memory slot size and slot count must be positive")
+	}
+
+	byteSize := cfg.SlotByteSize * cfg.NumSlots
+	region, err := createSystemSharedMemory(cfg.Key, byteSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = registrar.RegisterSystemSharedMemory(cfg.Timeout, cfg.RegionName, cfg.Key, uint64(byteSize), 0)
+	if err != nil {
+		_ = destroySystemSharedMemory(cfg.Key, region)
+		return nil, err
+	}
+
+	slots := make(chan int, cfg.NumSlots)
+	for i := 0; i < cfg.NumSlots; i++ {
+		slots <- i
+	}
+
+	return &SharedMemoryBackend{
+		next:      backend,
+		registrar: registrar,
+		cfg:       cfg,
+		region:    region,
+		slots:     slots,
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+// GetModelConfiguration delegates to the wrapped backend.
+func (b *SharedMemoryBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	return b.next.GetModelConfiguration(timeout, modelName, modelVersion)
+}
+
+// ServerLive delegates to the wrapped backend.
+func (b *SharedMemoryBackend) ServerLive(timeout time.Duration) (bool, error) {
+	checker, ok := b.next.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.ServerLive(timeout)
+}
+
+// ModelReady delegates to the wrapped backend.
+func (b *SharedMemoryBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	checker, ok := b.next.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.ModelReady(timeout, modelName, modelVersion)
+}
+
+// ModelInfer copies the raw input contents of at least MinTensorByteSize bytes into a free slot of the region and
+// references them from the request. The caller's request is not modified. The wait for a free slot counts against
+// timeout, the request gets the time left. It returns an error once the backend is closed.
+func (b *SharedMemoryBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	inputData, err := requestInputData(request)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	var slot int
+	select {
+	case slot = <-b.slots:
+		timer.Stop()
+	case <-timer.C:
+		return nil, errors.New("timed out waiting for a free shared memory slot")
+	case <-b.closed:
+		timer.Stop()
+		return nil, errors.New("shared memory backend is closed")
+	}
+	defer func() { b.slots <- slot }()
+	// A free slot and the close may both be ready, the region is only written while the backend is open.
+	select {
+	case <-b.closed:
+		return nil, errors.New("shared memory backend is closed")
+	default:
+	}
+	timeout -= time.Since(start)
+	if timeout <= 0 {
+		return nil, errors.New("timed out waiting for a free shared memory slot")
+	}
+
+	shmRequest := &triton_proto.ModelInferRequest{
+		ModelName:    request.ModelName,
+		ModelVersion: request.ModelVersion,
+		Id:           request.Id,
+		Parameters:   request.Parameters,
+		Inputs:       make([]*triton_proto.ModelInferRequest_InferInputTensor, 0, len(request.Inputs)),
+		Outputs:      request.Outputs,
+	}
+
+	base := slot * b.cfg.SlotByteSize
+	used := 0
+	for idx, input := range request.Inputs {
+		raw := inputData[idx]
+		if isSharedMemoryInput(input) || input.Contents != nil || len(raw) < b.cfg.MinTensorByteSize || used+len(raw) > b.cfg.SlotByteSize {
+			shmRequest.Inputs = append(shmRequest.Inputs, input)
+			if raw != nil && input.Contents == nil {
+				shmRequest.RawInputContents = append(shmRequest.RawInputContents, raw)
+			}
+			continue
+		}
+
+		offset := base + used
+		copy(b.region[offset:], raw)
+		used += (len(raw) + sharedMemoryAlignment - 1) / sharedMemoryAlignment * sharedMemoryAlignment
+
+		shmRequest.Inputs = append(shmRequest.Inputs, &triton_proto.ModelInferRequest_InferInputTensor{
+			Name:     input.Name,
+			Datatype: input.Datatype,
+			Shape:    input.Shape,
+			Parameters: map[string]*triton_proto.InferParameter{
+				sharedMemoryRegionParameter: {
+					ParameterChoice: &triton_proto.InferParameter_StringParam{StringParam: b.cfg.RegionName},
+				},
+				sharedMemoryByteSizeParameter: {
+					ParameterChoice: &triton_proto.InferParameter_Int64Param{Int64Param: int64(len(raw))},
+				},
+				sharedMemoryOffsetParameter: {
+					ParameterChoice: &triton_proto.InferParameter_Int64Param{Int64Param: int64(offset)},
+				},
+			},
+		})
+	}
+
+	return b.next.ModelInfer(timeout, shmRequest)
+}
+
+// Close rejects new requests, waits for the running ones to release their slots, then unregisters the region from the
+// server and removes the shared-memory object. It is safe to call more than once.
+func (b *SharedMemoryBackend) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		for range b.cfg.NumSlots {
+			<-b.slots
+		}
+		err := b.registrar.UnregisterSystemSharedMemory(b.cfg.Timeout, b.cfg.RegionName)
+		dErr := destroySystemSharedMemory(b.cfg.Key, b.region)
+		b.closeErr = errors.Join(err, dErr)
+	})
+	return b.closeErr
+}
+
+func isSharedMemoryInput(input *triton_proto.ModelInferRequest_InferInputTensor) bool {
+	_, ok := input.Parameters[sharedMemoryRegionParameter]
+	return ok
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package inference
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const systemSharedMemoryDir = "/dev/shm"
+
+// createSystemSharedMemory creates and maps a POSIX shared-memory object, equivalent to shm_open + ftruncate + mmap.
+func createSystemSharedMemory(key string, byteSize int) ([]byte, error) {
+	path := filepath.Join(systemSharedMemoryDir, strings.TrimPrefix(key, "/"))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = f.Truncate(int64(byteSize))
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, byteSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return data, nil
+}
+
+// destroySystemSharedMemory unmaps and unlinks the shared-memory object.
+func destroySystemSharedMemory(key string, data []byte) error {
+	err := syscall.Munmap(data)
+	rErr := os.Remove(filepath.Join(systemSharedMemoryDir, strings.TrimPrefix(key, "/")))
+	if err != nil {
+		return err
+	}
+	return rErr
+}
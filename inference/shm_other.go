@@ -0,0 +1,13 @@
+//go:build !linux
+
+package inference
+
+import "errors"
+
+func createSystemSharedMemory(key string, byteSize int) ([]byte, error) {
+	return nil, errors.New("system shared memory is only supported on linux")
+}
+
+func destroySystemSharedMemory(key string, data []byte) error {
+	return errors.New("system shared memory is only supported on linux")
+}
@@ -0,0 +1,248 @@
+//go:build linux
+
+package inference
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeSharedMemoryServer struct {
+	t       *testing.T
+	regions map[string]string
+}
+
+// newFakeSharedMemoryServer fakes the Triton shared-memory and infer endpoints. Inputs placed in shared memory
+// are read back from the registered segment and every input is echoed doubled as FP32.
+func newFakeSharedMemoryServer(t *testing.T) (*httptest.Server, *fakeSharedMemoryServer) {
+	fake := &fakeSharedMemoryServer{t: t, regions: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/systemsharedmemory/region/{name}/register", func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		fake.regions[r.PathValue("name")] = req["key"].(string)
+	})
+	mux.HandleFunc("/v2/systemsharedmemory/region/{name}/unregister", func(w http.ResponseWriter, r *http.Request) {
+		delete(fake.regions, r.PathValue("name"))
+	})
+	mux.HandleFunc("/v2/models/{name}/infer", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		headerLength, err := strconv.Atoi(r.Header.Get(inferenceHeaderContentLength))
+		assert.NoError(t, err)
+
+		req := &httpInferRequest{}
+		assert.NoError(t, json.Unmarshal(body[:headerLength], req))
+
+		offset := headerLength
+		outputs := make([]map[string]any, 0, len(req.Inputs))
+		var raw []byte
+		for _, input := range req.Inputs {
+			var data []byte
+			if region, ok := input.Parameters[sharedMemoryRegionParameter]; ok {
+				key, ok := fake.regions[region.(string)]
+				if !ok {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = fmt.Fprintf(w, `{"error": "unregistered region %s"}`, region)
+					return
+				}
+				segment, err := os.ReadFile(filepath.Join(systemSharedMemoryDir, strings.TrimPrefix(key, "/")))
+				assert.NoError(t, err)
+				start := int(input.Parameters[sharedMemoryOffsetParameter].(float64))
+				size := int(input.Parameters[sharedMemoryByteSizeParameter].(float64))
+				data = segment[start : start+size]
+			} else {
+				size := int(input.Parameters["binary_data_size"].(float64))
+				data = body[offset : offset+size]
+				offset += size
+			}
+
+			values := utils.BytesToT32[float32](data)
+			for i := range values {
+				values[i] *= 2
+			}
+			out := utils.TToBytes(values)
+			outputs = append(outputs, map[string]any{
+				"name":       input.Name,
+				"datatype":   "FP32",
+				"shape":      input.Shape,
+				"parameters": map[string]any{"binary_data_size": len(out)},
+			})
+			raw = append(raw, out...)
+		}
+
+		header, _ := json.Marshal(map[string]any{"model_name": r.PathValue("name"), "outputs": outputs})
+		w.Header().Set(inferenceHeaderContentLength, strconv.Itoa(len(header)))
+		_, _ = w.Write(header)
+		_, _ = w.Write(raw)
+	})
+	return httptest.NewServer(mux), fake
+}
+
+func TestSharedMemoryBackend_ModelInfer(t *testing.T) {
+	server, fake := newFakeSharedMemoryServer(t)
+	defer server.Close()
+
+	httpBackend, err := NewTritonHTTPBackend(server.URL, nil)
+	assert.NoError(t, err)
+
+	cfg := config.NewSharedMemoryParams("test_region", fmt.Sprintf("/faceid_test_%d", os.Getpid()), 1024, 2, 64, time.Second)
+	backend, err := NewSharedMemoryBackend(httpBackend, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.Key, fake.regions[cfg.RegionName])
+
+	large := make([]float32, 32)
+	for i := range large {
+		large[i] = float32(i)
+	}
+	small := []float32{1, 2}
+
+	request := &triton_proto.ModelInferRequest{
+		ModelName: "face_quality",
+		Inputs: []*triton_proto.ModelInferRequest_InferInputTensor{
+			{Name: "small", Datatype: "FP32", Shape: []int64{1, 2}},
+			{Name: "large", Datatype: "FP32", Shape: []int64{1, 32}},
+		},
+		RawInputContents: [][]byte{utils.TToBytes(small), utils.TToBytes(large)},
+	}
+	resp, err := backend.ModelInfer(time.Second, request)
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{2, 4}, utils.BytesToT32[float32](resp.RawOutputContents[0]))
+	assert.Equal(t, float32(62), utils.BytesToT32[float32](resp.RawOutputContents[1])[31])
+
+	// The caller's request is left untouched
+	assert.Len(t, request.RawInputContents, 2)
+	assert.Nil(t, request.Inputs[1].Parameters)
+
+	assert.NoError(t, backend.Close())
+	assert.NoError(t, backend.Close())
+	assert.Empty(t, fake.regions)
+	_, err = os.Stat(filepath.Join(systemSharedMemoryDir, strings.TrimPrefix(cfg.Key, "/")))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSharedMemoryBackend_Unsupported(t *testing.T) {
+	_, err := NewSharedMemoryBackend(&ONNXBackend{}, config.DefaultSharedMemoryParams)
+	assert.ErrorContains(t, err, "does not support system shared memory")
+}
+
+// slotBackend records the timeouts of its inference requests, which wait for release to be closed when it is set.
+type slotBackend struct {
+	release  chan struct{}
+	timeouts chan time.Duration
+}
+
+func (b *slotBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	return &triton_proto.ModelConfigResponse{}, nil
+}
+
+func (b *slotBackend) RegisterSystemSharedMemory(timeout time.Duration, name, key string, byteSize, offset uint64) error {
+	return nil
+}
+
+func (b *slotBackend) UnregisterSystemSharedMemory(timeout time.Duration, name string) error {
+	return nil
+}
+
+func (b *slotBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	b.timeouts <- timeout
+	if b.release != nil {
+		<-b.release
+	}
+	return &triton_proto.ModelInferResponse{}, nil
+}
+
+func TestSharedMemoryBackend_SlotWait(t *testing.T) {
+	next := &slotBackend{release: make(chan struct{}), timeouts: make(chan time.Duration, 2)}
+	cfg := config.NewSharedMemoryParams("test_region", fmt.Sprintf("/faceid_test_slots_%d", os.Getpid()), 1024, 1, 64, time.Second)
+	backend, err := NewSharedMemoryBackend(next, cfg)
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	request := &triton_proto.ModelInferRequest{
+		ModelName:        "face_quality",
+		Inputs:           []*triton_proto.ModelInferRequest_InferInputTensor{{Name: "data", Datatype: "FP32", Shape: []int64{1, 32}}},
+		RawInputContents: [][]byte{utils.TToBytes(make([]float32, 32))},
+	}
+
+	// The first request holds the only slot until it is released.
+	done := make(chan error)
+	go func() {
+		_, err := backend.ModelInfer(time.Second, request)
+		done <- err
+	}()
+	assert.Equal(t, time.Second, <-next.timeouts)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		close(next.release)
+	}()
+	_, err = backend.ModelInfer(time.Second, request)
+	assert.NoError(t, err)
+	assert.NoError(t, <-done)
+	// The second request only gets the time left after waiting for the slot.
+	assert.LessOrEqual(t, <-next.timeouts, 800*time.Millisecond)
+
+	// A request whose timeout runs out while waiting for a slot is not sent.
+	next.release = make(chan struct{})
+	go func() {
+		_, err := backend.ModelInfer(time.Second, request)
+		done <- err
+	}()
+	<-next.timeouts
+	_, err = backend.ModelInfer(50*time.Millisecond, request)
+	assert.ErrorContains(t, err, "timed out waiting for a free shared memory slot")
+	close(next.release)
+	assert.NoError(t, <-done)
+}
+
+func TestSharedMemoryBackend_Close(t *testing.T) {
+	next := &slotBackend{release: make(chan struct{}), timeouts: make(chan time.Duration, 1)}
+	cfg := config.NewSharedMemoryParams("test_region", fmt.Sprintf("/faceid_test_close_%d", os.Getpid()), 1024, 2, 64, time.Second)
+	backend, err := NewSharedMemoryBackend(next, cfg)
+	assert.NoError(t, err)
+
+	request := &triton_proto.ModelInferRequest{
+		ModelName:        "face_quality",
+		Inputs:           []*triton_proto.ModelInferRequest_InferInputTensor{{Name: "data", Datatype: "FP32", Shape: []int64{1, 32}}},
+		RawInputContents: [][]byte{utils.TToBytes(make([]float32, 32))},
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := backend.ModelInfer(time.Second, request)
+		done <- err
+	}()
+	<-next.timeouts
+
+	// The region is kept until the running request releases its slot.
+	closed := make(chan error)
+	go func() {
+		closed <- backend.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a request was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(next.release)
+	assert.NoError(t, <-done)
+	assert.NoError(t, <-closed)
+
+	_, err = backend.ModelInfer(time.Second, request)
+	assert.ErrorContains(t, err, "shared memory backend is closed")
+}
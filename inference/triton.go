@@ -0,0 +1,32 @@
+package inference
+
+import (
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	gotritonclient "github.com/okieraised/go-triton-client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+// NewTritonBackend returns a Triton backend using the transport selected by cfg.Protocol.
+// The gRPC transport uses an insecure connection, construct the client yourself and use
+// NewTritonGRPCBackend for custom dial options.
+func NewTritonBackend(cfg *config.TritonBackendParams) (Backend, error) {
+	switch cfg.Protocol {
+	case config.TritonProtocolGRPC, "":
+		tritonClient, err := gotritonclient.NewTritonGRPCClient(
+			cfg.ServerURL,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{PermitWithoutStream: true}),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return NewTritonGRPCBackend(tritonClient), nil
+	case config.TritonProtocolHTTP:
+		return NewTritonHTTPBackend(cfg.ServerURL, nil)
+	default:
+		return nil, fmt.Errorf("unsupported triton protocol: %s", cfg.Protocol)
+	}
+}
@@ -0,0 +1,71 @@
+package inference
+
+import (
+	gotritonclient "github.com/okieraised/go-triton-client"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"time"
+)
+
+// TritonGRPCBackend implements Backend on top of a Triton gRPC client.
+type TritonGRPCBackend struct {
+	tritonClient *gotritonclient.TritonGRPCClient
+}
+
+var (
+	_ Backend                     = (*TritonGRPCBackend)(nil)
+	_ SystemSharedMemoryRegistrar = (*TritonGRPCBackend)(nil)
+	_ HealthChecker               = (*TritonGRPCBackend)(nil)
+)
+
+// NewTritonGRPCBackend wraps an existing Triton gRPC client.
+func NewTritonGRPCBackend(tritonClient *gotritonclient.TritonGRPCClient) *TritonGRPCBackend {
+	return &TritonGRPCBackend{
+		tritonClient: tritonClient,
+	}
+}
+
+// Client returns the underlying Triton gRPC client.
+func (b *TritonGRPCBackend) Client() *gotritonclient.TritonGRPCClient {
+	return b.tritonClient
+}
+
+// GetModelConfiguration fetches the model configuration from Triton.
+func (b *TritonGRPCBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	return b.tritonClient.GetModelConfiguration(timeout, modelName, modelVersion)
+}
+
+// ModelInfer calls Triton ModelInfer over gRPC.
+func (b *TritonGRPCBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	return b.tritonClient.ModelGRPCInfer(timeout, request)
+}
+
+// RegisterSystemSharedMemory registers a system shared-memory region with Triton.
+func (b *TritonGRPCBackend) RegisterSystemSharedMemory(timeout time.Duration, name, key string, byteSize, offset uint64) error {
+	_, err := b.tritonClient.ShareSystemMemoryRegister(timeout, name, key, byteSize, offset)
+	return err
+}
+
+// UnregisterSystemSharedMemory unregisters a system shared-memory region from Triton.
+func (b *TritonGRPCBackend) UnregisterSystemSharedMemory(timeout time.Duration, name string) error {
+	_, err := b.tritonClient.ShareSystemMemoryUnRegister(timeout, name)
+	return err
+}
+
+// ServerLive calls the Triton ServerLive endpoint.
+func (b *TritonGRPCBackend) ServerLive(timeout time.Duration) (bool, error) {
+	return b.tritonClient.ServerAlive(timeout)
+}
+
+// ModelReady looks the model up in the index of ready models of the Triton repository.
+func (b *TritonGRPCBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	index, err := b.tritonClient.ModelRepositoryIndex(timeout, "", true)
+	if err != nil {
+		return false, err
+	}
+	for _, model := range index.GetModels() {
+		if model.Name == modelName && (modelVersion == "" || model.Version == modelVersion) && model.State == "READY" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
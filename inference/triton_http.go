@@ -0,0 +1,438 @@
+package inference
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	inferenceHeaderContentLength = "Inference-Header-Content-Length"
+)
+
+type httpInferParameters map[string]any
+
+type httpInferInputTensor struct {
+	Name       string              `json:"name"`
+	Shape      []int64             `json:"shape"`
+	Datatype   string              `json:"datatype"`
+	Parameters httpInferParameters `json:"parameters,omitempty"`
+}
+
+type httpInferRequestedOutputTensor struct {
+	Name       string              `json:"name"`
+	Parameters httpInferParameters `json:"parameters,omitempty"`
+}
+
+type httpInferRequest struct {
+	ID         string                           `json:"id,omitempty"`
+	Parameters httpInferParameters              `json:"parameters,omitempty"`
+	Inputs     []httpInferInputTensor           `json:"inputs"`
+	Outputs    []httpInferRequestedOutputTensor `json:"outputs,omitempty"`
+}
+
+type httpInferOutputTensor struct {
+	Name       string              `json:"name"`
+	Shape      []int64             `json:"shape"`
+	Datatype   string              `json:"datatype"`
+	Parameters httpInferParameters `json:"parameters,omitempty"`
+	Data       []json.Number       `json:"data,omitempty"`
+}
+
+type httpInferResponse struct {
+	ModelName    string                  `json:"model_name"`
+	ModelVersion string                  `json:"model_version"`
+	ID           string                  `json:"id"`
+	Outputs      []httpInferOutputTensor `json:"outputs"`
+}
+
+type httpErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// TritonHTTPBackend implements Backend using the KServe v2 HTTP/REST protocol
+// with the Triton binary tensor data extension.
+type TritonHTTPBackend struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+var (
+	_ Backend                     = (*TritonHTTPBackend)(nil)
+	_ SystemSharedMemoryRegistrar = (*TritonHTTPBackend)(nil)
+	_ HealthChecker               = (*TritonHTTPBackend)(nil)
+)
+
+// NewTritonHTTPBackend returns a backend talking to the Triton HTTP endpoint at serverURL (e.g. "localhost:8000" or "https://triton:8000").
+// A nil httpClient uses http.DefaultClient.
+func NewTritonHTTPBackend(serverURL string, httpClient *http.Client) (*TritonHTTPBackend, error) {
+	if !strings.HasPrefix(serverURL, "http://") && !strings.HasPrefix(serverURL, "https://") {
+		serverURL = "http://" + serverURL
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &TritonHTTPBackend{
+		baseURL:    strings.TrimRight(u.String(), "/"),
+		httpClient: httpClient,
+	}, nil
+}
+
+// GetModelConfiguration fetches the model configuration from GET v2/models/{name}[/versions/{version}]/config.
+func (b *TritonHTTPBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.modelURL(modelName, modelVersion)+"/config", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError(resp.StatusCode, body)
+	}
+
+	modelConfig := &triton_proto.ModelConfig{}
+	err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, modelConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &triton_proto.ModelConfigResponse{Config: modelConfig}, nil
+}
+
+// ModelInfer sends the request to POST v2/models/{name}[/versions/{version}]/infer. Input tensors are sent
+// as binary data unless they reference a shared-memory region, and all outputs are requested as binary data.
+func (b *TritonHTTPBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	inferReq := httpInferRequest{
+		ID:         request.Id,
+		Parameters: httpInferParameters{"binary_data_output": true},
+		Inputs:     make([]httpInferInputTensor, 0, len(request.Inputs)),
+	}
+
+	inputData, err := requestInputData(request)
+	if err != nil {
+		return nil, err
+	}
+
+	tensorData := make([][]byte, 0, len(request.Inputs))
+	for idx, input := range request.Inputs {
+		if isSharedMemoryInput(input) {
+			inferReq.Inputs = append(inferReq.Inputs, httpInferInputTensor{
+				Name:       input.Name,
+				Shape:      input.Shape,
+				Datatype:   input.Datatype,
+				Parameters: httpParameters(input.Parameters),
+			})
+			continue
+		}
+		raw := inputData[idx]
+		inferReq.Inputs = append(inferReq.Inputs, httpInferInputTensor{
+			Name:       input.Name,
+			Shape:      input.Shape,
+			Datatype:   input.Datatype,
+			Parameters: httpInferParameters{"binary_data_size": len(raw)},
+		})
+		tensorData = append(tensorData, raw)
+	}
+
+	for _, output := range request.Outputs {
+		inferReq.Outputs = append(inferReq.Outputs, httpInferRequestedOutputTensor{
+			Name:       output.Name,
+			Parameters: httpInferParameters{"binary_data": true},
+		})
+	}
+
+	header, err := json.Marshal(inferReq)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.NewBuffer(make([]byte, 0, len(header)+totalLength(tensorData)))
+	body.Write(header)
+	for _, raw := range tensorData {
+		body.Write(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.modelURL(request.ModelName, request.ModelVersion)+"/infer", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(inferenceHeaderContentLength, strconv.Itoa(len(header)))
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError(resp.StatusCode, respBody)
+	}
+
+	return decodeHTTPInferResponse(resp.Header.Get(inferenceHeaderContentLength), respBody)
+}
+
+// ServerLive calls GET v2/health/live.
+func (b *TritonHTTPBackend) ServerLive(timeout time.Duration) (bool, error) {
+	return b.healthy(timeout, b.baseURL+"/v2/health/live")
+}
+
+// ModelReady calls GET v2/models/{name}[/versions/{version}]/ready.
+func (b *TritonHTTPBackend) ModelReady(timeout time.Duration, modelName, modelVersion string) (bool, error) {
+	return b.healthy(timeout, b.modelURL(modelName, modelVersion)+"/ready")
+}
+
+func (b *TritonHTTPBackend) healthy(timeout time.Duration, u string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// RegisterSystemSharedMemory registers a system shared-memory region through POST v2/systemsharedmemory/region/{name}/register.
+func (b *TritonHTTPBackend) RegisterSystemSharedMemory(timeout time.Duration, name, key string, byteSize, offset uint64) error {
+	body, err := json.Marshal(map[string]any{"key": key, "offset": offset, "byte_size": byteSize})
+	if err != nil {
+		return err
+	}
+	return b.post(timeout, b.baseURL+"/v2/systemsharedmemory/region/"+url.PathEscape(name)+"/register", body)
+}
+
+// UnregisterSystemSharedMemory unregisters a system shared-memory region through POST v2/systemsharedmemory/region/{name}/unregister.
+func (b *TritonHTTPBackend) UnregisterSystemSharedMemory(timeout time.Duration, name string) error {
+	return b.post(timeout, b.baseURL+"/v2/systemsharedmemory/region/"+url.PathEscape(name)+"/unregister", nil)
+}
+
+func (b *TritonHTTPBackend) post(timeout time.Duration, u string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return httpStatusError(resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+func (b *TritonHTTPBackend) modelURL(modelName, modelVersion string) string {
+	u := b.baseURL + "/v2/models/" + url.PathEscape(modelName)
+	if modelVersion != "" {
+		u += "/versions/" + url.PathEscape(modelVersion)
+	}
+	return u
+}
+
+func decodeHTTPInferResponse(headerLength string, body []byte) (*triton_proto.ModelInferResponse, error) {
+	jsonLength := len(body)
+	if headerLength != "" {
+		l, err := strconv.Atoi(headerLength)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", inferenceHeaderContentLength, err)
+		}
+		if l > len(body) {
+			return nil, fmt.Errorf("%s %d exceeds body size %d", inferenceHeaderContentLength, l, len(body))
+		}
+		jsonLength = l
+	}
+
+	inferResp := &httpInferResponse{}
+	decoder := json.NewDecoder(bytes.NewReader(body[:jsonLength]))
+	decoder.UseNumber()
+	err := decoder.Decode(inferResp)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &triton_proto.ModelInferResponse{
+		ModelName:         inferResp.ModelName,
+		ModelVersion:      inferResp.ModelVersion,
+		Id:                inferResp.ID,
+		Outputs:           make([]*triton_proto.ModelInferResponse_InferOutputTensor, 0, len(inferResp.Outputs)),
+		RawOutputContents: make([][]byte, 0, len(inferResp.Outputs)),
+	}
+
+	offset := jsonLength
+	for _, out := range inferResp.Outputs {
+		var raw []byte
+		if size, ok := out.Parameters["binary_data_size"]; ok {
+			n, err := parameterInt(size)
+			if err != nil {
+				return nil, fmt.Errorf("output %s: %w", out.Name, err)
+			}
+			if offset+n > len(body) {
+				return nil, fmt.Errorf("output %s: binary data out of range", out.Name)
+			}
+			raw = body[offset : offset+n]
+			offset += n
+		} else {
+			raw, err = jsonDataToBytes(out.Datatype, out.Data)
+			if err != nil {
+				return nil, fmt.Errorf("output %s: %w", out.Name, err)
+			}
+		}
+
+		resp.Outputs = append(resp.Outputs, &triton_proto.ModelInferResponse_InferOutputTensor{
+			Name:     out.Name,
+			Datatype: out.Datatype,
+			Shape:    out.Shape,
+		})
+		resp.RawOutputContents = append(resp.RawOutputContents, raw)
+	}
+
+	return resp, nil
+}
+
+func httpParameters(params map[string]*triton_proto.InferParameter) httpInferParameters {
+	res := make(httpInferParameters, len(params))
+	for k, v := range params {
+		switch p := v.GetParameterChoice().(type) {
+		case *triton_proto.InferParameter_BoolParam:
+			res[k] = p.BoolParam
+		case *triton_proto.InferParameter_Int64Param:
+			res[k] = p.Int64Param
+		case *triton_proto.InferParameter_StringParam:
+			res[k] = p.StringParam
+		case *triton_proto.InferParameter_DoubleParam:
+			res[k] = p.DoubleParam
+		case *triton_proto.InferParameter_Uint64Param:
+			res[k] = p.Uint64Param
+		}
+	}
+	return res
+}
+
+func parameterInt(v any) (int, error) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err
+	case float64:
+		return int(n), nil
+	default:
+		return 0, fmt.Errorf("unexpected parameter value %v", v)
+	}
+}
+
+// jsonDataToBytes converts outputs returned as JSON numbers into the little-endian raw layout used by gRPC.
+func jsonDataToBytes(datatype string, data []json.Number) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, d := range data {
+		var err error
+		switch datatype {
+		case "FP32":
+			var f float64
+			f, err = d.Float64()
+			_ = binary.Write(buf, binary.LittleEndian, math.Float32bits(float32(f)))
+		case "FP64":
+			var f float64
+			f, err = d.Float64()
+			_ = binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+		case "INT32":
+			var i int64
+			i, err = d.Int64()
+			_ = binary.Write(buf, binary.LittleEndian, int32(i))
+		case "INT64":
+			var i int64
+			i, err = d.Int64()
+			_ = binary.Write(buf, binary.LittleEndian, i)
+		case "UINT8":
+			var i int64
+			i, err = d.Int64()
+			buf.WriteByte(uint8(i))
+		default:
+			return nil, fmt.Errorf("unsupported JSON data type %s", datatype)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// HTTPStatusError is returned by TritonHTTPBackend when the server answers with a non-200 status.
+type HTTPStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("triton http status %d: %s", e.StatusCode, e.Message)
+}
+
+func httpStatusError(statusCode int, body []byte) error {
+	errResp := &httpErrorResponse{}
+	if err := json.Unmarshal(body, errResp); err == nil && errResp.Error != "" {
+		return &HTTPStatusError{StatusCode: statusCode, Message: errResp.Error}
+	}
+	return &HTTPStatusError{StatusCode: statusCode, Message: strings.TrimSpace(string(body))}
+}
+
+func totalLength(data [][]byte) int {
+	n := 0
+	for _, d := range data {
+		n += len(d)
+	}
+	return n
+}
@@ -0,0 +1,143 @@
+package inference
+
+import (
+	"encoding/json"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newFakeKServeServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/models/face_quality/config", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{
+			"name": "face_quality",
+			"platform": "onnxruntime_onnx",
+			"max_batch_size": 0,
+			"input": [{"name": "input", "data_type": "TYPE_FP32", "dims": ["1", "3", "112", "112"]}],
+			"output": [{"name": "output", "data_type": "TYPE_FP32", "dims": [1, 4]}],
+			"instance_group": [{"kind": "KIND_CPU", "count": 1}]
+		}`))
+	})
+	mux.HandleFunc("/v2/models/face_quality/versions/2/infer", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		headerLength, err := strconv.Atoi(r.Header.Get(inferenceHeaderContentLength))
+		assert.NoError(t, err)
+
+		req := &httpInferRequest{}
+		assert.NoError(t, json.Unmarshal(body[:headerLength], req))
+		assert.Equal(t, "FP32", req.Inputs[0].Datatype)
+		assert.Equal(t, []int64{1, 4}, req.Inputs[0].Shape)
+
+		inputs := utils.BytesToT32[float32](body[headerLength:])
+		outputs := make([]float32, len(inputs))
+		for i, v := range inputs {
+			outputs[i] = v * 2
+		}
+		raw := utils.TToBytes(outputs)
+
+		header, _ := json.Marshal(map[string]any{
+			"model_name":    "face_quality",
+			"model_version": "2",
+			"outputs": []map[string]any{
+				{
+					"name":       "output",
+					"datatype":   "FP32",
+					"shape":      []int{1, 4},
+					"parameters": map[string]any{"binary_data_size": len(raw)},
+				},
+				{
+					"name":     "label",
+					"datatype": "INT64",
+					"shape":    []int{1},
+					"data":     []int{3},
+				},
+			},
+		})
+		w.Header().Set(inferenceHeaderContentLength, strconv.Itoa(len(header)))
+		_, _ = w.Write(header)
+		_, _ = w.Write(raw)
+	})
+	mux.HandleFunc("/v2/health/live", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/v2/models/face_quality/ready", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/v2/models/missing/ready", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	mux.HandleFunc("/v2/models/missing/config", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "Request for unknown model: 'missing' is not found"}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestTritonHTTPBackend_GetModelConfiguration(t *testing.T) {
+	server := newFakeKServeServer(t)
+	defer server.Close()
+
+	backend, err := NewTritonHTTPBackend(server.URL, nil)
+	assert.NoError(t, err)
+
+	cfg, err := backend.GetModelConfiguration(time.Second, "face_quality", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "input", cfg.Config.Input[0].Name)
+	assert.Equal(t, triton_proto.DataType_TYPE_FP32, cfg.Config.Input[0].DataType)
+	assert.Equal(t, []int64{1, 3, 112, 112}, cfg.Config.Input[0].Dims)
+
+	_, err = backend.GetModelConfiguration(time.Second, "missing", "")
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestTritonHTTPBackend_ModelInfer(t *testing.T) {
+	server := newFakeKServeServer(t)
+	defer server.Close()
+
+	backend, err := NewTritonHTTPBackend(server.URL, nil)
+	assert.NoError(t, err)
+
+	resp, err := backend.ModelInfer(time.Second, &triton_proto.ModelInferRequest{
+		ModelName:    "face_quality",
+		ModelVersion: "2",
+		Inputs: []*triton_proto.ModelInferRequest_InferInputTensor{
+			{
+				Name:     "input",
+				Datatype: "FP32",
+				Shape:    []int64{1, 4},
+				Contents: &triton_proto.InferTensorContents{
+					Fp32Contents: []float32{1, 2, 3, 4},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", resp.ModelVersion)
+	assert.Equal(t, []float32{2, 4, 6, 8}, utils.BytesToT32[float32](resp.RawOutputContents[0]))
+	assert.Equal(t, []int64{3}, utils.BytesToT64[int64](resp.RawOutputContents[1]))
+}
+
+func TestTritonHTTPBackend_Health(t *testing.T) {
+	server := newFakeKServeServer(t)
+	defer server.Close()
+
+	backend, err := NewTritonHTTPBackend(server.URL, nil)
+	assert.NoError(t, err)
+
+	live, err := backend.ServerLive(time.Second)
+	assert.NoError(t, err)
+	assert.True(t, live)
+
+	ready, err := backend.ModelReady(time.Second, "face_quality", "")
+	assert.NoError(t, err)
+	assert.True(t, ready)
+
+	ready, err = backend.ModelReady(time.Second, "missing", "")
+	assert.NoError(t, err)
+	assert.False(t, ready)
+}
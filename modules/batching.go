@@ -0,0 +1,85 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"time"
+)
+
+// batchedModel describes a model that takes a batch of images as its single input.
+type batchedModel struct {
+	backend      inference.Backend
+	timeout      time.Duration
+	modelName    string
+	modelVersion string
+	input        *triton_proto.ModelInput
+	batchSize    int
+	// buffers holds the padded inputs and the decoded outputs, the returned rows are valid until it is released.
+	buffers *scratch
+}
+
+// infer runs the n rows of data through the model in batches of at most batchSize rows and returns the rows of
+// its first output in input order. When the batch dimension of the model is fixed, the batches have that size
+// instead, the last batch is padded with zero rows and the outputs of the padding are dropped.
+func (m *batchedModel) infer(ctx context.Context, data []float32, n int) ([][]float32, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	if len(data)%n != 0 {
+		return nil, fmt.Errorf("model %s: %d input values do not split into %d rows", m.modelName, len(data), n)
+	}
+	rowSize := len(data) / n
+	batchSize := max(m.batchSize, 1)
+	fixed := len(m.input.Dims) > 0 && m.input.Dims[0] != -1
+	if fixed {
+		batchSize = int(m.input.Dims[0])
+	}
+
+	rows := make([][]float32, 0, n)
+	for start := 0; start < n; start += batchSize {
+		end := min(start+batchSize, n)
+		batch := data[start*rowSize : end*rowSize]
+		batchRows := end - start
+		if fixed && batchRows < batchSize {
+			padded := m.buffers.float32Buffer(batchSize * rowSize)
+			clear(padded[copy(padded, batch):])
+			batch = padded
+			batchRows = batchSize
+		}
+
+		modelInput, rawInput, err := encodeInput(m.input, batchShape(m.input.Dims, batchRows), batch, m.buffers)
+		if err != nil {
+			return nil, err
+		}
+		modelRequest := &triton_proto.ModelInferRequest{
+			ModelName:        m.modelName,
+			ModelVersion:     m.modelVersion,
+			Inputs:           []*triton_proto.ModelInferRequest_InferInputTensor{modelInput},
+			RawInputContents: [][]byte{rawInput},
+		}
+		inferResp, err := modelInfer(ctx, m.backend, m.timeout, modelRequest)
+		if err != nil {
+			return nil, err
+		}
+		if len(inferResp.Outputs) == 0 || len(inferResp.RawOutputContents) == 0 {
+			return nil, fmt.Errorf("model %s: response has no outputs", m.modelName)
+		}
+
+		output := inferResp.Outputs[0]
+		out, err := decodeOutput(output, inferResp.RawOutputContents[0], m.buffers)
+		if err != nil {
+			return nil, err
+		}
+		values := out.Float32s()
+		if len(output.Shape) == 0 || output.Shape[0] != int64(batchRows) || len(values)%batchRows != 0 {
+			return nil, fmt.Errorf("model %s: output %s has shape %v for a batch of %d", m.modelName, output.Name, output.Shape, batchRows)
+		}
+		outSize := len(values) / batchRows
+		for i := range end - start {
+			rows = append(rows, values[i*outSize:(i+1)*outSize])
+		}
+	}
+	return rows, nil
+}
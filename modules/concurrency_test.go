@@ -0,0 +1,142 @@
+package modules
+
+import (
+	"context"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/stretchr/testify/assert"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+	"image"
+	"sync"
+	"testing"
+)
+
+const (
+	stressGoroutines = 16
+	stressIterations = 4
+)
+
+type moduleClients struct {
+	detection         *FaceDetectionClient
+	selection         *FaceSelectionClient
+	alignment         *FaceAlignmentClient
+	quality           *FaceQualityClient
+	qualityAssessment *FaceQualityAssessmentClient
+	extraction        *FaceExtractionClient
+	antiSpoofing      *FaceAntiSpoofingClient
+}
+
+// moduleOutputs holds the outputs of every module for one image.
+type moduleOutputs struct {
+	detections        []float32
+	keyPoints         []float32
+	selectedFaceBox   []float32
+	alignedFace       []byte
+	qualityScore      float32
+	qualityClass      int
+	qualityAssessment float32
+	features          []float32
+	spoofing          int
+}
+
+// run runs every module on img the way the pipelines chain them.
+func (c *moduleClients) run(img gocv.Mat) (*moduleOutputs, error) {
+	ctx := context.Background()
+	out := &moduleOutputs{}
+
+	det, kpss, err := c.detection.Infer(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	out.detections, out.keyPoints = det.Float32s(), kpss.Float32s()
+
+	faceBox, facePoint, err := c.selection.Infer(img, det, kpss, utils.RefPointer(false))
+	if err != nil {
+		return nil, err
+	}
+	out.selectedFaceBox = faceBox.Float32s()
+
+	aligned, err := c.alignment.Infer(img, faceBox, facePoint)
+	if err != nil {
+		return nil, err
+	}
+	defer aligned.Close()
+	out.alignedFace = aligned.ToBytes()
+
+	scores, classes, err := c.quality.Infer(ctx, []gocv.Mat{*aligned})
+	if err != nil {
+		return nil, err
+	}
+	out.qualityScore, out.qualityClass = scores[0], classes[0]
+
+	assessments, _, err := c.qualityAssessment.Infer(ctx, []gocv.Mat{*aligned})
+	if err != nil {
+		return nil, err
+	}
+	out.qualityAssessment = assessments[0]
+
+	features, err := c.extraction.Infer(ctx, []gocv.Mat{*aligned})
+	if err != nil {
+		return nil, err
+	}
+	out.features = features[0].Float32s()
+
+	box := tensor.New(tensor.WithShape(4), tensor.WithBacking(append([]float32(nil), out.selectedFaceBox[:4]...)))
+	spoofing, err := c.antiSpoofing.Infer(ctx, []gocv.Mat{img}, []*tensor.Dense{box})
+	if err != nil {
+		return nil, err
+	}
+	out.spoofing = spoofing[0].Ints()[0]
+	return out, nil
+}
+
+// TestClients_Concurrent shares one client of every module across goroutines and checks that each call returns
+// the result of a serial call. Run it with -race.
+func TestClients_Concurrent(t *testing.T) {
+	_, backend := newTestBackend(t, image.Pt(10, 10), image.Pt(14, 12))
+
+	var clients moduleClients
+	var err error
+	clients.detection, err = NewFaceDetectionClient(backend, config.DefaultRetinaFaceDetectionParams)
+	assert.NoError(t, err)
+	clients.selection = NewFaceSelectionClient(config.DefaultFaceSelectionParams)
+	clients.alignment = NewFaceAlignmentClient(config.DefaultFaceAlignParams)
+	clients.quality, err = NewFaceQualityClient(backend, config.DefaultFaceQualityParams)
+	assert.NoError(t, err)
+	clients.qualityAssessment, err = NewFaceQualityAssessmentClient(backend, config.DefaultFaceQualityAssessmentParams)
+	assert.NoError(t, err)
+	clients.extraction, err = NewFaceExtractionClient(backend, config.DefaultArcFaceRecognitionParams)
+	assert.NoError(t, err)
+	clients.antiSpoofing, err = NewFaceAntiSpoofingClient(backend, config.DefaultFaceAntiSpoofingParam)
+	assert.NoError(t, err)
+
+	// Images of different sizes exercise different feature map and crop shapes.
+	imgs := []gocv.Mat{newTestImage(640, 640), newTestImage(800, 600), newTestImage(480, 640)}
+	expected := make([]*moduleOutputs, len(imgs))
+	for idx, img := range imgs {
+		defer img.Close()
+		expected[idx], err = clients.run(img)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := range stressGoroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range stressIterations {
+				idx := (g + i) % len(imgs)
+				actual, err := clients.run(imgs[idx])
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, expected[idx], actual)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Zero(t, matPool.Outstanding())
+}
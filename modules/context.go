@@ -0,0 +1,51 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// callTimeout caps the timeout of a backend call by the deadline of ctx. It returns the error of ctx when ctx is done.
+func callTimeout(ctx context.Context, timeout time.Duration) (time.Duration, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return min(timeout, remaining), nil
+}
+
+// modelInfer runs request on backend within the deadline of ctx. Backends take a timeout rather than a context,
+// so a cancellation of ctx is noticed before and after the call but does not abort a call in flight.
+func modelInfer(ctx context.Context, backend inference.Backend, timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	budget, err := callTimeout(ctx, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("model %s: %w", request.ModelName, err)
+	}
+	resp, err := backend.ModelInfer(budget, request)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, fmt.Errorf("model %s: %w", request.ModelName, ctxErr)
+	}
+	// The call may time out just before ctx does when its timeout was capped by the deadline of ctx.
+	if err != nil && budget < timeout && isDeadlineExceeded(err) {
+		return nil, fmt.Errorf("model %s: %w", request.ModelName, context.DeadlineExceeded)
+	}
+	return resp, err
+}
+
+func isDeadlineExceeded(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded
+}
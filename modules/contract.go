@@ -0,0 +1,81 @@
+package modules
+
+import (
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"time"
+)
+
+// modelReady returns an error unless the backend reports the model as ready.
+// Backends that do not implement inference.HealthChecker are assumed ready.
+func modelReady(backend inference.Backend, timeout time.Duration, modelName, modelVersion string) error {
+	checker, ok := backend.(inference.HealthChecker)
+	if !ok {
+		return nil
+	}
+	ready, err := checker.ModelReady(timeout, modelName, modelVersion)
+	if err != nil {
+		return fmt.Errorf("model %s: %w", modelName, err)
+	}
+	if !ready {
+		return fmt.Errorf("model %s version %q is not ready", modelName, modelVersion)
+	}
+	return nil
+}
+
+// validateImageInput checks that the model has a single NCHW image input with 3 channels of the given size
+// (width, height) and a datatype supported by encodeInput. Dynamic dims (-1) match any size.
+func validateImageInput(modelConfig *triton_proto.ModelConfigResponse, batchSize int, imageSize [2]int) error {
+	cfg := modelConfig.GetConfig()
+	if len(cfg.GetInput()) != 1 {
+		return fmt.Errorf("model %s: expected 1 input, got %d", cfg.GetName(), len(cfg.GetInput()))
+	}
+
+	input := cfg.Input[0]
+	switch input.DataType {
+	case triton_proto.DataType_TYPE_FP32, triton_proto.DataType_TYPE_FP16, triton_proto.DataType_TYPE_UINT8:
+	default:
+		return fmt.Errorf("model %s: unsupported input data type %s for %s", cfg.Name, input.DataType.String(), input.Name)
+	}
+
+	expected := []int64{int64(batchSize), 3, int64(imageSize[1]), int64(imageSize[0])}
+	if !dimsMatch(input.Dims, expected) {
+		return fmt.Errorf("model %s: input %s has dims %v, expected %v", cfg.Name, input.Name, input.Dims, expected)
+	}
+	return nil
+}
+
+// validateOutputs checks that the model has count outputs of rank rank, or at least count outputs when exact
+// is false, all of a datatype supported by decodeOutput. A rank of 0 skips the rank check.
+func validateOutputs(modelConfig *triton_proto.ModelConfigResponse, count, rank int, exact bool) error {
+	cfg := modelConfig.GetConfig()
+	outputs := cfg.GetOutput()
+	if (exact && len(outputs) != count) || len(outputs) < count {
+		return fmt.Errorf("model %s: expected %d outputs, got %d", cfg.GetName(), count, len(outputs))
+	}
+
+	for _, output := range outputs {
+		switch output.DataType {
+		case triton_proto.DataType_TYPE_FP32, triton_proto.DataType_TYPE_FP16, triton_proto.DataType_TYPE_FP64:
+		default:
+			return fmt.Errorf("model %s: unsupported output data type %s for %s", cfg.Name, output.DataType.String(), output.Name)
+		}
+		if rank > 0 && len(output.Dims) != rank {
+			return fmt.Errorf("model %s: output %s has dims %v, expected rank %d", cfg.Name, output.Name, output.Dims, rank)
+		}
+	}
+	return nil
+}
+
+func dimsMatch(dims, expected []int64) bool {
+	if len(dims) != len(expected) {
+		return false
+	}
+	for i := range dims {
+		if dims[i] != -1 && dims[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package modules
+
+import (
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidateImageInput(t *testing.T) {
+	modelConfig := &triton_proto.ModelConfigResponse{
+		Config: &triton_proto.ModelConfig{
+			Name:  "face_identification",
+			Input: []*triton_proto.ModelInput{{Name: "data", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{-1, 3, 112, 112}}},
+		},
+	}
+	assert.NoError(t, validateImageInput(modelConfig, 4, [2]int{112, 112}))
+	assert.ErrorContains(t, validateImageInput(modelConfig, 1, [2]int{128, 128}), "expected [1 3 128 128]")
+
+	modelConfig.Config.Input[0].DataType = triton_proto.DataType_TYPE_INT64
+	assert.ErrorContains(t, validateImageInput(modelConfig, 1, [2]int{112, 112}), "unsupported input data type")
+
+	modelConfig.Config.Input = nil
+	assert.ErrorContains(t, validateImageInput(modelConfig, 1, [2]int{112, 112}), "expected 1 input")
+}
+
+func TestValidateOutputs(t *testing.T) {
+	modelConfig := &triton_proto.ModelConfigResponse{
+		Config: &triton_proto.ModelConfig{
+			Name: "face_detection_retina",
+			Output: []*triton_proto.ModelOutput{
+				{Name: "face_rpn_cls_prob_reshape_stride32", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 4, 20, 20}},
+				{Name: "face_rpn_bbox_pred_stride32", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 8, 20, 20}},
+			},
+		},
+	}
+	assert.NoError(t, validateOutputs(modelConfig, 2, 4, true))
+	assert.NoError(t, validateOutputs(modelConfig, 1, 0, false))
+	assert.ErrorContains(t, validateOutputs(modelConfig, 9, 4, true), "expected 9 outputs, got 2")
+	assert.ErrorContains(t, validateOutputs(modelConfig, 1, 2, false), "expected rank 2")
+}
@@ -0,0 +1,227 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/processing"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+	"image"
+	"time"
+)
+
+// FaceDetector detects the faces of images. The detections of an image are returned as a (n, 5) tensor of
+// (x1, y1, x2, y2, score) rows sorted by score and their landmarks as a (n, 5, 2) tensor, in the coordinates of the
+// image, which is what FaceSelectionClient and FaceAlignmentClient take. Implementations are safe for concurrent use.
+type FaceDetector interface {
+	// Infer detects the faces of img.
+	Infer(ctx context.Context, img gocv.Mat) (*tensor.Dense, *tensor.Dense, error)
+	// InferBatch detects the faces of every image of imgs and returns their detections and landmarks in input order.
+	InferBatch(ctx context.Context, imgs []gocv.Mat) ([]*tensor.Dense, []*tensor.Dense, error)
+	// Ready returns an error unless the detection model is ready on the backend.
+	Ready() error
+	// Validate checks that the inputs and outputs of the model match what the detector expects.
+	Validate() error
+}
+
+var (
+	_ FaceDetector = (*FaceDetectionClient)(nil)
+	_ FaceDetector = (*SCRFDDetectionClient)(nil)
+	_ FaceDetector = (*YOLOFaceDetectionClient)(nil)
+)
+
+// detectionModel runs a detection model on letterboxed images.
+type detectionModel struct {
+	backend      inference.Backend
+	modelConfig  *triton_proto.ModelConfigResponse
+	modelName    string
+	modelVersion string
+	timeout      time.Duration
+	imageSize    [2]int
+	maxBatchSize int
+	blobParams   processing.BlobParams
+}
+
+// decodeFunc decodes the detections of the image at batchIdx from the outputs of a request, which are in the order
+// of the model configuration. detScale is the letterbox scale of the image.
+type decodeFunc func(netOut []*tensor.Dense, batchIdx int, detScale float64) (*tensor.Dense, *tensor.Dense, error)
+
+// infer sends the letterboxed images in batches of up to maxBatchSize images, or of the batch size of the model when
+// it is fixed, in which case the last batch is padded with blank images, and returns the detections decoded by
+// decode in input order.
+func (m *detectionModel) infer(ctx context.Context, imgs []gocv.Mat, decode decodeFunc) ([]*tensor.Dense, []*tensor.Dense, error) {
+	dets := make([]*tensor.Dense, 0, len(imgs))
+	kpss := make([]*tensor.Dense, 0, len(imgs))
+	inputs := m.modelConfig.GetConfig().GetInput()
+	if len(inputs) == 0 {
+		return nil, nil, fmt.Errorf("model %s has no inputs", m.modelName)
+	}
+
+	batchSize := max(m.maxBatchSize, 1)
+	fixed := len(inputs[0].Dims) > 0 && inputs[0].Dims[0] != -1
+	if fixed {
+		batchSize = int(inputs[0].Dims[0])
+	}
+
+	for start := 0; start < len(imgs); start += batchSize {
+		end := min(start+batchSize, len(imgs))
+		rows := end - start
+		if fixed {
+			rows = batchSize
+		}
+		batchDets, batchKpss, err := m.inferBatch(ctx, imgs[start:end], rows, decode)
+		if err != nil {
+			return nil, nil, err
+		}
+		dets = append(dets, batchDets...)
+		kpss = append(kpss, batchKpss...)
+	}
+	return dets, kpss, nil
+}
+
+// inferBatch sends imgs in a single request of rows images, the rows beyond imgs being blank, and decodes the
+// outputs of each image with its own letterbox scale.
+func (m *detectionModel) inferBatch(ctx context.Context, imgs []gocv.Mat, rows int, decode decodeFunc) ([]*tensor.Dense, []*tensor.Dense, error) {
+	buffers := newScratch()
+	defer buffers.release()
+
+	imageValues := 3 * m.imageSize[0] * m.imageSize[1]
+	imgTensors := buffers.float32Buffer(rows * imageValues)
+	clear(imgTensors[len(imgs)*imageValues:])
+
+	detScales := make([]float64, len(imgs))
+	for idx, img := range imgs {
+		err := ctx.Err()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		detScales[idx], err = m.preprocess(img, imgTensors[idx*imageValues:(idx+1)*imageValues], buffers)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	modelRequest := &triton_proto.ModelInferRequest{
+		ModelName:    m.modelName,
+		ModelVersion: m.modelVersion,
+	}
+
+	for _, inputCfg := range m.modelConfig.Config.Input {
+		modelInput, rawInput, err := encodeInput(inputCfg, batchShape(inputCfg.Dims, rows), imgTensors, buffers)
+		if err != nil {
+			return nil, nil, err
+		}
+		modelRequest.Inputs = append(modelRequest.Inputs, modelInput)
+		modelRequest.RawInputContents = append(modelRequest.RawInputContents, rawInput)
+	}
+
+	inferResp, err := modelInfer(ctx, m.backend, m.timeout, modelRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	netOut := make([]*tensor.Dense, len(m.modelConfig.Config.Output))
+	for idx, out := range inferResp.Outputs {
+		// The detections are copied out of the outputs, which can therefore be pooled.
+		outTensors, err := decodeOutput(out, inferResp.RawOutputContents[idx], buffers)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for subIdx, cfg := range m.modelConfig.Config.Output {
+			if out.Name == cfg.Name {
+				netOut[subIdx] = outTensors
+			}
+		}
+	}
+
+	dets := make([]*tensor.Dense, len(imgs))
+	kpss := make([]*tensor.Dense, len(imgs))
+	for idx := range imgs {
+		dets[idx], kpss[idx], err = decode(netOut, idx, detScales[idx])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return dets, kpss, nil
+}
+
+// preprocess letterboxes img and writes it into dst, the input values of an image, and returns the letterbox scale.
+func (m *detectionModel) preprocess(img gocv.Mat, dst []float32, buffers *scratch) (float64, error) {
+	preprocessedImg, detScale := letterbox(img, m.imageSize, buffers)
+	return detScale, processing.BlobFromImage(preprocessedImg, dst, m.blobParams)
+}
+
+// letterbox resizes img to fit imageSize, keeping its aspect ratio, into the top left corner of a black Mat of
+// imageSize taken from buffers. It returns the Mat and the scale of the resize.
+func letterbox(img gocv.Mat, imageSize [2]int, buffers *scratch) (gocv.Mat, float64) {
+
+	imgShape := img.Size()
+	imRatio := float64(imgShape[0]) / float64(imgShape[1])
+	modelRatio := float64(imageSize[1]) / float64(imageSize[0])
+
+	var newWidth, newHeight int
+
+	if imRatio > modelRatio {
+		newHeight = imageSize[1]
+		newWidth = int(float64(newHeight) / imRatio)
+	} else {
+		newWidth = imageSize[0]
+		newHeight = int(float64(newWidth) * imRatio)
+	}
+	detScale := float64(newHeight) / float64(imgShape[0])
+
+	resizedImg := buffers.mat(newHeight, newWidth, gocv.MatTypeCV8UC3)
+	gocv.Resize(img, &resizedImg, image.Point{X: newWidth, Y: newHeight}, 0.0, 0.0, gocv.InterpolationLinear)
+
+	detImg := buffers.mat(imageSize[1], imageSize[0], gocv.MatTypeCV8UC3)
+	detImg.SetTo(gocv.NewScalar(0, 0, 0, 0))
+	roi := detImg.Region(image.Rect(0, 0, newWidth, newHeight))
+	defer roi.Close()
+	gocv.Resize(resizedImg, &roi, image.Point{X: roi.Size()[1], Y: roi.Size()[0]}, 0, 0, gocv.InterpolationLinear)
+
+	return detImg, detScale
+}
+
+// selectDetections sorts the candidate boxes of proposals, (x1, y1, x2, y2) rows in the letterboxed image, by their
+// scores, removes the overlapping ones with NMS and rescales the remaining boxes and their landmarks, rows of 10
+// values, by detScale. The landmark tensor is nil when withLandmarks is false.
+func selectDetections(proposals, scores, landmarks []float32, iouThreshold float32, detScale float64, withLandmarks bool) (*tensor.Dense, *tensor.Dense) {
+	if len(scores) == 0 {
+		var landmarkTensor *tensor.Dense
+		if withLandmarks {
+			landmarkTensor = tensor.New(tensor.Of(tensor.Float32), tensor.WithShape(0, 5, 2))
+		}
+		return tensor.New(tensor.Of(tensor.Float32), tensor.WithShape(0, 5)), landmarkTensor
+	}
+
+	order := utils.ArgSortDescendingFloat32s(scores)
+	preDet := make([]float32, 0, 5*len(order))
+	for _, idx := range order {
+		preDet = append(preDet, proposals[4*idx:4*idx+4]...)
+		preDet = append(preDet, scores[idx])
+	}
+	keep := processing.NMSFloat32s(preDet, iouThreshold)
+
+	scale := float32(detScale)
+	det := make([]float32, 0, 5*len(keep))
+	kpss := make([]float32, 0, 10*len(keep))
+	for _, idx := range keep {
+		row := preDet[5*idx : 5*idx+5]
+		det = append(det, row[0]/scale, row[1]/scale, row[2]/scale, row[3]/scale, row[4])
+		if withLandmarks {
+			for _, v := range landmarks[10*order[idx] : 10*order[idx]+10] {
+				kpss = append(kpss, v/scale)
+			}
+		}
+	}
+
+	var landmarkTensor *tensor.Dense
+	if withLandmarks {
+		landmarkTensor = tensor.New(tensor.WithShape(len(keep), 5, 2), tensor.WithBacking(kpss))
+	}
+	return tensor.New(tensor.WithShape(len(keep), 5), tensor.WithBacking(det)), landmarkTensor
+}
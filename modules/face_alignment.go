@@ -9,6 +9,7 @@ import (
 	"math"
 )
 
+// FaceAlignmentClient warps faces onto the standard landmarks. It is safe for concurrent use.
 type FaceAlignmentClient struct {
 	imageSize         [2]int
 	standardLandmarks *tensor.Dense
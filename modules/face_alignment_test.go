@@ -1,7 +1,9 @@
 package modules
 
 import (
+	"context"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
 	"github.com/okieraised/go-faceid-pipeline/utils"
 	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/stretchr/testify/assert"
@@ -9,10 +11,13 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
+	"image"
 	"testing"
 )
 
 func TestNewFaceAlignmentClient_Single(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -23,10 +28,10 @@ func TestNewFaceAlignmentClient_Single(t *testing.T) {
 	img, err := genTestDataSingleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -43,6 +48,8 @@ func TestNewFaceAlignmentClient_Single(t *testing.T) {
 }
 
 func TestNewFaceAlignmentClient_Multiple(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -53,10 +60,10 @@ func TestNewFaceAlignmentClient_Multiple(t *testing.T) {
 	img, err := genTestDataMultipleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -72,3 +79,26 @@ func TestNewFaceAlignmentClient_Multiple(t *testing.T) {
 	alignedImg.Close()
 
 }
+
+func TestFaceAlignmentClient_Infer(t *testing.T) {
+	_, backend := newTestBackend(t, image.Pt(10, 10))
+
+	detClient, err := NewFaceDetectionClient(backend, config.DefaultRetinaFaceDetectionParams)
+	assert.NoError(t, err)
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	det, kpss, err := detClient.Infer(context.Background(), img)
+	assert.NoError(t, err)
+
+	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
+	selectedFaceBox, selectedFacePoint, err := selectionClient.Infer(img, det, kpss, utils.RefPointer(false))
+	assert.NoError(t, err)
+
+	alignClient := NewFaceAlignmentClient(config.DefaultFaceAlignParams)
+	alignedImg, err := alignClient.Infer(img, selectedFaceBox, selectedFacePoint)
+	assert.NoError(t, err)
+	defer alignedImg.Close()
+	assert.Equal(t, []int{112, 112}, alignedImg.Size()[:2])
+}
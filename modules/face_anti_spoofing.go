@@ -1,11 +1,12 @@
 package modules
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/okieraised/go-faceid-pipeline/config"
-	"github.com/okieraised/go-faceid-pipeline/utils"
-	gotritonclient "github.com/okieraised/go-triton-client"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/processing"
 	"github.com/okieraised/go-triton-client/triton_proto"
 	"gocv.io/x/gocv"
 	"gorgonia.org/tensor"
@@ -14,9 +15,12 @@ import (
 	"time"
 )
 
+// FaceAntiSpoofingClient scores faces with an ensemble of anti-spoofing models. It is safe for concurrent use: the
+// crops and buffers of a call are its own, taken from pools shared by every client.
 type FaceAntiSpoofingClient struct {
-	tritonClient *gotritonclient.TritonGRPCClient
+	backend      inference.Backend
 	ModelParams  *config.FaceAntiSpoofingParam
+	ModelConfigs []*triton_proto.ModelConfigResponse
 	timeout      time.Duration
 	modelNames   []string
 	scales       []float32
@@ -34,10 +38,20 @@ type scaleParam struct {
 	crop   bool
 }
 
-func NewFaceAntiSpoofingClient(tritonClient *gotritonclient.TritonGRPCClient, cfg *config.FaceAntiSpoofingParam) *FaceAntiSpoofingClient {
+func NewFaceAntiSpoofingClient(backend inference.Backend, cfg *config.FaceAntiSpoofingParam) (*FaceAntiSpoofingClient, error) {
 	client := &FaceAntiSpoofingClient{}
 	client.ModelParams = cfg
-	client.tritonClient = tritonClient
+	client.backend = backend
+	if len(cfg.Scales) != len(cfg.ModelNames) || len(cfg.ImageSizes) != len(cfg.ModelNames) {
+		return nil, fmt.Errorf("expected one scale and image size per model, got %d models, %d scales and %d image sizes", len(cfg.ModelNames), len(cfg.Scales), len(cfg.ImageSizes))
+	}
+	for idx, modelName := range cfg.ModelNames {
+		inferenceConfig, err := backend.GetModelConfiguration(cfg.Timeout, modelName, client.modelVersion(idx))
+		if err != nil {
+			return nil, err
+		}
+		client.ModelConfigs = append(client.ModelConfigs, inferenceConfig)
+	}
 	client.timeout = cfg.Timeout
 	client.modelNames = cfg.ModelNames
 	client.scales = cfg.Scales
@@ -45,10 +59,12 @@ func NewFaceAntiSpoofingClient(tritonClient *gotritonclient.TritonGRPCClient, cf
 	client.imageSize = cfg.ImageSizes
 	client.batchSize = cfg.BatchSize
 
-	return client
+	return client, nil
 }
 
-func (c *FaceAntiSpoofingClient) Infer(imgs []gocv.Mat, faceBoxes []*tensor.Dense) ([]*tensor.Dense, error) {
+// Infer returns the liveness (1 for a real face) of the face in faceBoxes[i] of each image imgs[i], in input order.
+// The crops of each scale are sent to its model in batches of BatchSize.
+func (c *FaceAntiSpoofingClient) Infer(ctx context.Context, imgs []gocv.Mat, faceBoxes []*tensor.Dense) ([]*tensor.Dense, error) {
 
 	listImageScales := make([][]gocv.Mat, len(c.scales))
 	listWeightScales := make([][]float64, len(c.scales))
@@ -56,11 +72,22 @@ func (c *FaceAntiSpoofingClient) Infer(imgs []gocv.Mat, faceBoxes []*tensor.Dens
 	if len(imgs) != len(faceBoxes) {
 		return nil, errors.New("number of images and face boxes must be equal")
 	}
+	if len(imgs) == 0 {
+		return []*tensor.Dense{}, nil
+	}
+
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	buffers := newScratch()
+	defer buffers.release()
 
 	for idx := range len(imgs) {
-		bgrImg := gocv.NewMat()
+		bgrImg := buffers.mat(imgs[idx].Rows(), imgs[idx].Cols(), imgs[idx].Type())
 		gocv.CvtColor(imgs[idx], &bgrImg, gocv.ColorRGBToBGR)
-		tmps, weights, err := c.getScaleImage(bgrImg, faceBoxes[idx])
+		tmps, weights, err := c.getScaleImage(bgrImg, faceBoxes[idx], buffers)
 		if err != nil {
 			return nil, err
 		}
@@ -70,129 +97,57 @@ func (c *FaceAntiSpoofingClient) Infer(imgs []gocv.Mat, faceBoxes []*tensor.Dens
 		}
 	}
 
-	outputs := make([][]*tensor.Dense, 0)
+	// scores holds the class scores of every image for each scale.
+	scores := make([][][]float32, 0, len(c.scales))
 	for idx := range c.scales {
-		preprocessedImages, err := c.preprocess(listImageScales[idx], idx)
+		err = ctx.Err()
 		if err != nil {
 			return nil, err
 		}
 
-		for i := 0; i < preprocessedImages.Shape()[0]; i += c.batchSize {
-			tensorS, err := preprocessedImages.Slice(tensor.S(i, i+c.batchSize), nil, nil, nil)
-			if err != nil {
-				return nil, err
-			}
-
-			inputTensor := tensor.New(tensor.Of(tensor.Float32), tensor.WithShape(tensorS.(*tensor.Dense).Shape()...))
-			err = tensor.Copy(inputTensor, tensorS)
-			if err != nil {
-				return nil, err
-			}
-
-			inferenceConfig, err := c.tritonClient.GetModelConfiguration(c.ModelParams.Timeout, c.ModelParams.ModelNames[idx], "")
-			if err != nil {
-				return nil, err
-			}
-
-			modelRequest := &triton_proto.ModelInferRequest{
-				ModelName: c.ModelParams.ModelNames[idx],
-			}
-
-			modelInputs := make([]*triton_proto.ModelInferRequest_InferInputTensor, 0)
-			modelInput := &triton_proto.ModelInferRequest_InferInputTensor{
-				Name:     inferenceConfig.Config.Input[0].Name,
-				Datatype: inferenceConfig.Config.Input[0].DataType.String()[5:],
-				Shape:    inferenceConfig.Config.Input[0].Dims,
-				Contents: &triton_proto.InferTensorContents{
-					Fp32Contents: inputTensor.Float32s(),
-				},
-			}
-			modelInputs = append(modelInputs, modelInput)
-
-			modelRequest.Inputs = modelInputs
-			inferResp, err := c.tritonClient.ModelGRPCInfer(c.ModelParams.Timeout, modelRequest)
-			if err != nil {
-				return nil, err
-			}
-
-			netOut := make([]*tensor.Dense, 0)
-			for sIdx, out := range inferResp.Outputs {
-				outShape := make([]int, 0)
-				for _, shape := range out.Shape {
-					outShape = append(outShape, int(shape))
-				}
-				outTensors := tensor.New(
-					tensor.Of(tensor.Float32),
-					tensor.WithShape(outShape...),
-					tensor.WithBacking(utils.BytesToT32[float32](inferResp.RawOutputContents[sIdx])),
-				)
-				netOut = append(netOut, outTensors)
-			}
-			outputs = append(outputs, netOut)
+		preprocessedImages, err := c.preprocess(listImageScales[idx], idx, buffers)
+		if err != nil {
+			return nil, err
 		}
-	}
-
-	results, err := c.postprocess(outputs, listWeightScales)
-	if err != nil {
-		return nil, err
-	}
-	return results, nil
-}
 
-func (c *FaceAntiSpoofingClient) postprocess(outputs [][]*tensor.Dense, listWeightScales [][]float64) ([]*tensor.Dense, error) {
-	score, err := c.liveScore(outputs, listWeightScales)
-	if err != nil {
-		return nil, err
+		inputs := c.ModelConfigs[idx].GetConfig().GetInput()
+		if len(inputs) == 0 {
+			return nil, fmt.Errorf("model %s has no inputs", c.ModelParams.ModelNames[idx])
+		}
+		// The miniFAS models take raw BGR pixels, so UINT8 inputs need no special handling.
+		model := &batchedModel{
+			backend:      c.backend,
+			timeout:      c.ModelParams.Timeout,
+			modelName:    c.ModelParams.ModelNames[idx],
+			modelVersion: c.modelVersion(idx),
+			input:        inputs[0],
+			batchSize:    c.batchSize,
+			buffers:      buffers,
+		}
+		scaleScores, err := model.infer(ctx, preprocessedImages.Float32s(), len(imgs))
+		if err != nil {
+			return nil, err
+		}
+		scores = append(scores, scaleScores)
 	}
 
-	return score, nil
+	return c.liveScore(scores, listWeightScales)
 }
 
-func (c *FaceAntiSpoofingClient) preprocess(imgs []gocv.Mat, idx int) (*tensor.Dense, error) {
-	batchInputSize := int(math.Ceil(math.Max(math.Ceil(float64(len(imgs)/c.batchSize)), 1) * float64(c.batchSize)))
-
+func (c *FaceAntiSpoofingClient) preprocess(imgs []gocv.Mat, idx int, buffers *scratch) (*tensor.Dense, error) {
+	imageValues := 3 * c.imageSize[idx][0] * c.imageSize[idx][1]
 	preprocessedImages := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(batchInputSize, 3, c.imageSize[idx][1], c.imageSize[idx][0]),
+		tensor.WithShape(len(imgs), 3, c.imageSize[idx][1], c.imageSize[idx][0]),
+		tensor.WithBacking(buffers.float32Buffer(len(imgs)*imageValues)),
 	)
 
-	for i, img := range imgs {
-		bgrImg := gocv.NewMat()
-		gocv.CvtColor(img, &bgrImg, gocv.ColorRGBToBGR)
-		_ = img.Close()
-
-		imgShape := bgrImg.Size()
-		imgTensors := tensor.New(
-			tensor.Of(tensor.Float32),
-			tensor.WithShape(imgShape[0], imgShape[1], 3),
-		)
-
-		for z := range 3 {
-			for y := range imgShape[0] {
-				for x := range imgShape[1] {
-					err := imgTensors.SetAt(float32(bgrImg.GetVecbAt(y, x)[z]), y, x, z)
-					if err != nil {
-						return nil, err
-					}
-				}
-			}
-		}
-		err := bgrImg.Close()
-		if err != nil {
-			return nil, err
-		}
+	// The crops are cut from the channel swapped image, swap them back.
+	blobParams := processing.RawBlobParams
+	blobParams.SwapRB = true
 
-		err = imgTensors.T(2, 0, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		preprocessedSlice, err := preprocessedImages.Slice(tensor.S(i), nil, nil, nil)
-		if err != nil {
-			return nil, err
-		}
-
-		err = tensor.Copy(preprocessedSlice, imgTensors)
+	data := preprocessedImages.Float32s()
+	for i, img := range imgs {
+		err := processing.BlobFromImage(img, data[i*imageValues:(i+1)*imageValues], blobParams)
 		if err != nil {
 			return nil, err
 		}
@@ -201,7 +156,8 @@ func (c *FaceAntiSpoofingClient) preprocess(imgs []gocv.Mat, idx int) (*tensor.D
 	return preprocessedImages, nil
 }
 
-func (c *FaceAntiSpoofingClient) getScaleImage(img gocv.Mat, faceBox *tensor.Dense) ([]gocv.Mat, []float64, error) {
+// getScaleImage returns the crops of the face in faceBox at every scale, taken from buffers, and their weights.
+func (c *FaceAntiSpoofingClient) getScaleImage(img gocv.Mat, faceBox *tensor.Dense, buffers *scratch) ([]gocv.Mat, []float64, error) {
 	detXmin, detYmin, detXmax, detYmax := faceBox.GetF32(0), faceBox.GetF32(1), faceBox.GetF32(2), faceBox.GetF32(3)
 	detHeight := detYmax - detYmin
 	cX := (detXmin + detXmax) / 2
@@ -222,7 +178,7 @@ func (c *FaceAntiSpoofingClient) getScaleImage(img gocv.Mat, faceBox *tensor.Den
 			outH:   c.imageSize[i][1],
 			crop:   true,
 		}
-		crop, weight, err := c.cropImage(params)
+		crop, weight, err := c.cropImage(params, buffers)
 		if err != nil {
 			return crops, weights, err
 		}
@@ -233,8 +189,8 @@ func (c *FaceAntiSpoofingClient) getScaleImage(img gocv.Mat, faceBox *tensor.Den
 	return crops, weights, nil
 }
 
-func (c *FaceAntiSpoofingClient) cropImage(params scaleParam) (gocv.Mat, float64, error) {
-	dstImg := gocv.NewMat()
+func (c *FaceAntiSpoofingClient) cropImage(params scaleParam, buffers *scratch) (gocv.Mat, float64, error) {
+	dstImg := buffers.mat(params.outH, params.outW, params.orgImg.Type())
 	var weight float64
 	var leftTopX, leftTopY, rightBottomX, rightBottomY int
 
@@ -293,62 +249,75 @@ func (c *FaceAntiSpoofingClient) getNewBox(srcW, srcH int, bbox []int, scaleOri
 	return int(leftTopX), int(leftTopY), int(rightBottomX), int(rightBottomY), scale / float64(scaleOri)
 }
 
-func (c *FaceAntiSpoofingClient) liveScore(outputs [][]*tensor.Dense, listWeightScales [][]float64) ([]*tensor.Dense, error) {
-	results := make([]*tensor.Dense, 0)
+// liveScore averages the real face score of each image over the scales, weighted by how much of the requested
+// crop each scale could keep, and compares it to the threshold.
+func (c *FaceAntiSpoofingClient) liveScore(scores [][][]float32, listWeightScales [][]float64) ([]*tensor.Dense, error) {
+	if len(scores) == 0 {
+		return []*tensor.Dense{}, nil
+	}
+	results := make([]*tensor.Dense, 0, len(scores[0]))
 
-	for i := 0; i < len(outputs[0]); i++ {
-		var weightedSum *tensor.Dense
+	for i := range scores[0] {
+		weightedSum := 0.0
 		weightsSum := 0.0
-		for j := 0; j < len(outputs); j++ {
-			output := outputs[j][i]
+		for j := range scores {
+			if len(scores[j][i]) < 2 {
+				return nil, fmt.Errorf("model %s: expected at least 2 class scores, got %d", c.ModelParams.ModelNames[j], len(scores[j][i]))
+			}
 			weight := listWeightScales[j][i]
 			weightsSum += weight
-			oCol1, err := output.Slice(nil, tensor.S(1))
-			if err != nil {
-				return nil, err
-			}
-			err = oCol1.Reshape(1)
-			if err != nil {
-				return nil, err
-			}
-			weightedCol1, err := oCol1.(*tensor.Dense).MulScalar(float32(weight), false)
-			if err != nil {
-				return nil, err
-			}
-			if weightedSum == nil {
-				weightedSum = weightedCol1.Clone().(*tensor.Dense)
-			} else {
-				weightedSum, err = weightedSum.Add(weightedCol1)
-				if err != nil {
-					return nil, err
-				}
-			}
+			weightedSum += float64(scores[j][i][1]) * weight
 		}
 
 		if weightsSum == 0 {
 			return nil, fmt.Errorf("sum of weights is zero")
 		}
-		result, err := weightedSum.DivScalar(float32(weightsSum), true)
-		if err != nil {
-			return nil, err
-		}
-		livenesses := make([]int, 0)
-		for _, val := range result.Float32s() {
-			var bitSetVar int
-			if val > c.threshold {
-				bitSetVar = 1
-			}
-			livenesses = append(livenesses, bitSetVar)
+		var liveness int
+		if float32(weightedSum/weightsSum) > c.threshold {
+			liveness = 1
 		}
 
-		liveness := tensor.New(
+		results = append(results, tensor.New(
 			tensor.Of(tensor.Int),
-			tensor.WithShape(result.Shape()...),
-			tensor.WithBacking(livenesses),
-		)
-
-		results = append(results, liveness)
+			tensor.WithShape(1),
+			tensor.WithBacking([]int{liveness}),
+		))
 	}
 
 	return results, nil
 }
+
+// modelVersion returns the pinned version of the idx-th model, or empty for the server version policy.
+func (c *FaceAntiSpoofingClient) modelVersion(idx int) string {
+	if idx < len(c.ModelParams.ModelVersions) {
+		return c.ModelParams.ModelVersions[idx]
+	}
+	return ""
+}
+
+// Ready returns an error unless every miniFAS model is ready on the backend.
+func (c *FaceAntiSpoofingClient) Ready() error {
+	for idx, modelName := range c.ModelParams.ModelNames {
+		err := modelReady(c.backend, c.timeout, modelName, c.modelVersion(idx))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that every miniFAS model takes a batch of 3 channel images of its scale image size and
+// returns the class scores of each image.
+func (c *FaceAntiSpoofingClient) Validate() error {
+	for idx, modelConfig := range c.ModelConfigs {
+		err := validateImageInput(modelConfig, c.batchSize, c.imageSize[idx])
+		if err != nil {
+			return err
+		}
+		err = validateOutputs(modelConfig, 1, 2, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
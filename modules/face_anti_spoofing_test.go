@@ -1,7 +1,10 @@
 package modules
 
 import (
+	"context"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/tritontest"
 	"github.com/okieraised/go-faceid-pipeline/utils"
 	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/stretchr/testify/assert"
@@ -14,6 +17,8 @@ import (
 )
 
 func TestNewFaceAntiSpoofingClient(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -24,10 +29,10 @@ func TestNewFaceAntiSpoofingClient(t *testing.T) {
 	img, err := genTestDataSingleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -43,9 +48,78 @@ func TestNewFaceAntiSpoofingClient(t *testing.T) {
 	err = tensor.Copy(faceBoxes, faceBoxesS)
 	assert.NoError(t, err)
 
-	faceAFClient := NewFaceAntiSpoofingClient(tritonClient, config.DefaultFaceAntiSpoofingParam)
+	faceAFClient, err := NewFaceAntiSpoofingClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultFaceAntiSpoofingParam)
+	assert.NoError(t, err)
+
+	_, err = faceAFClient.Infer(context.Background(), []gocv.Mat{*img}, []*tensor.Dense{faceBoxes})
+	assert.NoError(t, err)
+
+}
+
+func TestFaceAntiSpoofingClient_Infer(t *testing.T) {
+	server, backend := newTestBackend(t)
+
+	client, err := NewFaceAntiSpoofingClient(backend, config.DefaultFaceAntiSpoofingParam)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Ready())
+	assert.NoError(t, client.Validate())
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+	faceBox := tensor.New(tensor.WithShape(4), tensor.WithBacking([]float32{200, 150, 440, 450}))
+
+	spoofing, err := client.Infer(context.Background(), []gocv.Mat{img}, []*tensor.Dense{faceBox})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, spoofing[0].Ints()[0])
+	assert.Len(t, server.Requests(), len(config.DefaultFaceAntiSpoofingParam.ModelNames))
+	// Every crop and scaled image is returned to the pool.
+	assert.Zero(t, matPool.Outstanding())
+}
+
+func TestFaceAntiSpoofingClient_MissingModel(t *testing.T) {
+	server := tritontest.NewServer(tritontest.FaceIDModels()[:5]...)
+	defer server.Close()
+	backend, err := server.Backend()
+	assert.NoError(t, err)
 
-	_, err = faceAFClient.Infer([]gocv.Mat{*img}, []*tensor.Dense{faceBoxes})
+	_, err = NewFaceAntiSpoofingClient(backend, config.DefaultFaceAntiSpoofingParam)
+	assert.ErrorContains(t, err, "miniFAS_2_7")
+}
+
+func TestFaceAntiSpoofingClient_InferBatches(t *testing.T) {
+	cfg := *config.DefaultFaceAntiSpoofingParam
+	cfg.BatchSize = 2
+	models := make([]*tritontest.Model, 0, len(cfg.ModelNames))
+	for idx, modelName := range cfg.ModelNames {
+		// The score of a real face is the pixel value of the crop over 255.
+		models = append(models, rowModel(modelName, cfg.ImageSizes[idx], 2, 3, func(first float32) []float32 {
+			return []float32{1 - first/255, first / 255, 0}
+		}))
+	}
+	server := tritontest.NewServer(models...)
+	defer server.Close()
+	backend, err := server.Backend()
+	assert.NoError(t, err)
+
+	client, err := NewFaceAntiSpoofingClient(backend, &cfg)
 	assert.NoError(t, err)
+	assert.NoError(t, client.Validate())
 
+	imgs := make([]gocv.Mat, 0, 3)
+	faceBoxes := make([]*tensor.Dense, 0, 3)
+	for _, value := range []float64{250, 20, 250} {
+		img := gocv.NewMatWithSizesWithScalar([]int{640, 640}, gocv.MatTypeCV8UC3, gocv.NewScalar(value, value, value, 0))
+		defer img.Close()
+		imgs = append(imgs, img)
+		faceBoxes = append(faceBoxes, tensor.New(tensor.WithShape(4), tensor.WithBacking([]float32{200, 150, 440, 450})))
+	}
+
+	spoofing, err := client.Infer(context.Background(), imgs, faceBoxes)
+	assert.NoError(t, err)
+	assert.Len(t, spoofing, len(imgs))
+	for idx, expected := range []int{1, 0, 1} {
+		assert.Equal(t, []int{expected}, spoofing[idx].Ints())
+	}
+	// Each scale sends a full batch and a padded one.
+	assert.Len(t, server.Requests(), 2*len(cfg.ModelNames))
 }
@@ -1,22 +1,33 @@
 package modules
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/elliotchance/orderedmap/v2"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
 	"github.com/okieraised/go-faceid-pipeline/processing"
 	"github.com/okieraised/go-faceid-pipeline/rcnn"
-	"github.com/okieraised/go-faceid-pipeline/utils"
-	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/okieraised/go-triton-client/triton_proto"
 	"gocv.io/x/gocv"
 	"gorgonia.org/tensor"
-	"image"
 	"math"
+	"slices"
+	"strconv"
+	"sync"
 )
 
+type anchorKey struct {
+	height int
+	width  int
+	stride int
+}
+
+// FaceDetectionClient detects faces with a RetinaFace model. It is safe for concurrent use: each call decodes the
+// outputs of its own response, and the anchors shared by every call are never modified.
 type FaceDetectionClient struct {
-	tritonClient        *gotritonclient.TritonGRPCClient
+	backend             inference.Backend
 	ModelParams         *config.RetinaFaceDetectionParams
 	ModelConfig         *triton_proto.ModelConfigResponse
 	imageSize           [2]int
@@ -28,57 +39,65 @@ type FaceDetectionClient struct {
 	anchorConfig        *orderedmap.OrderedMap[string, processing.AnchorConfig]
 	anchorsFPN          *orderedmap.OrderedMap[string, *tensor.Dense]
 	numAnchors          *orderedmap.OrderedMap[string, int]
-	pixelMeans          []float32
-	pixelStds           []float32
-	pixelScale          float32
-	bboxStds            []float32
-	landmarksStd        float32
+	// anchors caches the read-only anchors of every feature map shape, keyed by anchorKey.
+	anchors       sync.Map
+	pixelMeans    []float32
+	pixelStds     []float32
+	pixelScale    float32
+	bboxStds      []float32
+	landmarksStd  float32
+	rawPixelInput bool
+	blobParams    processing.BlobParams
+	model         *detectionModel
 }
 
-func NewFaceDetectionClient(tritonClient *gotritonclient.TritonGRPCClient, cfg *config.RetinaFaceDetectionParams) (*FaceDetectionClient, error) {
+func NewFaceDetectionClient(backend inference.Backend, cfg *config.RetinaFaceDetectionParams) (*FaceDetectionClient, error) {
 
 	client := &FaceDetectionClient{}
 	client.ModelParams = cfg
 
-	inferenceConfig, err := tritonClient.GetModelConfiguration(cfg.Timeout, cfg.ModelName, "")
+	inferenceConfig, err := backend.GetModelConfiguration(cfg.Timeout, cfg.ModelName, cfg.ModelVersion)
 	if err != nil {
 		return nil, err
 	}
-	client.tritonClient = tritonClient
+	client.backend = backend
 	client.ModelConfig = inferenceConfig
+	client.rawPixelInput = isRawPixelInput(inferenceConfig)
 	client.imageSize = cfg.ImageSize
 	client.useLandmarks = true
 	client.confidenceThreshold = cfg.ConfidenceThreshold
 	client.iouThreshold = cfg.IOUThreshold
 
-	client.featStrideFPN = []int{32, 16, 8}
-	ratio := []float32{1.0}
+	network := cfg.Network
+	if network == nil {
+		network = config.RetinaFaceR50Network
+	}
+	err = validateNetwork(network)
+	if err != nil {
+		return nil, fmt.Errorf("model %s: %w", cfg.ModelName, err)
+	}
+	outputsPerStride := 2
+	if client.useLandmarks {
+		outputsPerStride = 3
+	}
+	numOutputs := len(inferenceConfig.GetConfig().GetOutput())
+	if numOutputs != outputsPerStride*len(network.Anchors) {
+		return nil, fmt.Errorf("model %s has %d outputs, the %d strides of its anchors need %d", cfg.ModelName, numOutputs, len(network.Anchors), outputsPerStride*len(network.Anchors))
+	}
 
+	client.featStrideFPN = make([]int, 0, len(network.Anchors))
 	anchorConfig := orderedmap.NewOrderedMap[string, processing.AnchorConfig]()
-	anchorConfig.Set(
-		"32", processing.AnchorConfig{
-			BaseSize:      16,
-			Ratios:        ratio,
-			Scales:        []float32{32, 16},
-			AllowedBorder: 9999,
-		},
-	)
-	anchorConfig.Set(
-		"16", processing.AnchorConfig{
-			BaseSize:      16,
-			Ratios:        ratio,
-			Scales:        []float32{8, 4},
-			AllowedBorder: 9999,
-		},
-	)
-	anchorConfig.Set(
-		"8", processing.AnchorConfig{
-			BaseSize:      16,
-			Ratios:        ratio,
-			Scales:        []float32{2, 1},
-			AllowedBorder: 9999,
-		},
-	)
+	for _, anchors := range network.Anchors {
+		client.featStrideFPN = append(client.featStrideFPN, anchors.Stride)
+		anchorConfig.Set(
+			strconv.Itoa(anchors.Stride), processing.AnchorConfig{
+				BaseSize:      anchors.BaseSize,
+				Ratios:        anchors.Ratios,
+				Scales:        anchors.Scales,
+				AllowedBorder: 9999,
+			},
+		)
+	}
 	client.anchorConfig = anchorConfig
 
 	client.fpnKeys = make([]string, 0)
@@ -112,820 +131,270 @@ func NewFaceDetectionClient(tritonClient *gotritonclient.TritonGRPCClient, cfg *
 
 	client.numAnchors = numAnchors
 
-	client.pixelMeans = []float32{0, 0, 0}
-	client.pixelStds = []float32{1, 1, 1}
-	client.pixelScale = 1.0
-	client.bboxStds = []float32{1, 1, 1, 1}
-	client.landmarksStd = 1.0
-
-	return client, nil
-}
-
-func (c *FaceDetectionClient) preprocess(img gocv.Mat) (gocv.Mat, float64, error) {
-
-	imgShape := img.Size()
-	imRatio := float64(imgShape[0]) / float64(imgShape[1])
-	modelRatio := float64(c.imageSize[1]) / float64(c.imageSize[0])
-
-	var newWidth, newHeight int
-
-	if imRatio > modelRatio {
-		newHeight = c.imageSize[1]
-		newWidth = int(float64(newHeight) / imRatio)
-	} else {
-		newWidth = c.imageSize[0]
-		newHeight = int(float64(newWidth) * imRatio)
+	client.pixelMeans = network.PixelMeans[:]
+	client.pixelStds = network.PixelStds[:]
+	client.pixelScale = network.PixelScale
+	client.bboxStds = network.BBoxStds[:]
+	client.landmarksStd = network.LandmarkStd
+	client.blobParams = client.newBlobParams()
+	client.model = &detectionModel{
+		backend:      backend,
+		modelConfig:  inferenceConfig,
+		modelName:    cfg.ModelName,
+		modelVersion: cfg.ModelVersion,
+		timeout:      cfg.Timeout,
+		imageSize:    cfg.ImageSize,
+		maxBatchSize: cfg.MaxBatchSize,
+		blobParams:   client.blobParams,
 	}
-	detScale := float64(newHeight) / float64(imgShape[0])
-
-	resizedImg := gocv.NewMat()
-	defer resizedImg.Close()
-	gocv.Resize(img, &resizedImg, image.Point{X: newWidth, Y: newHeight}, 0.0, 0.0, gocv.InterpolationLinear)
 
-	detImg := gocv.NewMatWithSizesWithScalar([]int{c.imageSize[1], c.imageSize[0]}, gocv.MatTypeCV8UC3, gocv.NewScalar(0, 0, 0, 0))
-	roi := detImg.Region(image.Rect(0, 0, newWidth, newHeight))
-	gocv.Resize(resizedImg, &roi, image.Point{X: roi.Size()[1], Y: roi.Size()[0]}, 0, 0, gocv.InterpolationLinear)
-
-	return detImg, detScale, nil
+	return client, nil
 }
 
-func (c *FaceDetectionClient) Infer(img gocv.Mat) (*tensor.Dense, *tensor.Dense, error) {
-
-	proposalsList := make([]*tensor.Dense, 0)
-	scoresList := make([]*tensor.Dense, 0)
-	landmarksList := make([]*tensor.Dense, 0)
-
-	preprocessedImg, preprocessedParam, err := c.preprocess(img)
-	if err != nil {
-		return nil, nil, err
+// validateNetwork checks that the anchors of network are listed from the largest stride to the smallest, as the
+// anchors are generated in that order, and that its normalization and deltas are not zeroed.
+func validateNetwork(network *config.RetinaFaceNetworkParams) error {
+	if len(network.Anchors) == 0 {
+		return errors.New("no anchors configured")
 	}
-
-	imgShape := preprocessedImg.Size()
-	imgTensors := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(1, 3, imgShape[0], imgShape[1]),
-	)
-	imgInfo := []int{imgShape[0], imgShape[1]}
-
-	for z := range 3 {
-		for y := range imgShape[0] {
-			for x := range imgShape[1] {
-				err := imgTensors.SetAt((float32(preprocessedImg.GetVecbAt(y, x)[2-z])/c.pixelScale-c.pixelMeans[2-z])/c.pixelStds[2-z], 0, z, y, x)
-				if err != nil {
-					return nil, nil, err
-				}
-			}
+	for idx, anchors := range network.Anchors {
+		if anchors.Stride <= 0 || anchors.BaseSize <= 0 || len(anchors.Ratios) == 0 || len(anchors.Scales) == 0 {
+			return fmt.Errorf("anchors %d: stride and base size must be positive and ratios and scales set", idx)
+		}
+		if idx > 0 && anchors.Stride >= network.Anchors[idx-1].Stride {
+			return fmt.Errorf("anchors %d: stride %d must be smaller than the stride %d before it", idx, anchors.Stride, network.Anchors[idx-1].Stride)
 		}
 	}
-
-	modelRequest := &triton_proto.ModelInferRequest{
-		ModelName: c.ModelParams.ModelName,
+	if network.PixelScale == 0 || slices.Contains(network.PixelStds[:], 0) {
+		return errors.New("pixel scale and pixel stds must not be zero")
 	}
-
-	modelInputs := make([]*triton_proto.ModelInferRequest_InferInputTensor, 0)
-	for _, inputCfg := range c.ModelConfig.Config.Input {
-		modelInput := &triton_proto.ModelInferRequest_InferInputTensor{
-			Name:     inputCfg.Name,
-			Datatype: inputCfg.DataType.String()[5:],
-			Shape:    inputCfg.Dims,
-			Contents: &triton_proto.InferTensorContents{
-				Fp32Contents: imgTensors.Float32s(),
-			},
-		}
-		modelInputs = append(modelInputs, modelInput)
+	if slices.Contains(network.BBoxStds[:], 0) || network.LandmarkStd == 0 {
+		return errors.New("bbox stds and landmark std must not be zero")
 	}
+	return nil
+}
 
-	cfgOutputs := make([]*triton_proto.ModelInferRequest_InferRequestedOutputTensor, len(c.ModelConfig.Config.Output))
-	for idx, outCfg := range c.ModelConfig.Config.Output {
-		cfgOutputs[idx] = &triton_proto.ModelInferRequest_InferRequestedOutputTensor{
-			Name: outCfg.Name,
-		}
+// newBlobParams converts the BGR input image into RGB planes normalized as (pixel/pixelScale - mean) / std.
+func (c *FaceDetectionClient) newBlobParams() processing.BlobParams {
+	if c.rawPixelInput {
+		params := processing.RawBlobParams
+		params.SwapRB = true
+		return params
+	}
+	params := processing.BlobParams{SwapRB: true}
+	for z := range 3 {
+		params.Mean[z] = c.pixelMeans[2-z] * c.pixelScale
+		params.Scale[z] = 1 / (c.pixelScale * c.pixelStds[2-z])
 	}
+	return params
+}
 
-	modelRequest.Inputs = modelInputs
-	inferResp, err := c.tritonClient.ModelGRPCInfer(c.ModelParams.Timeout, modelRequest)
+// Infer detects the faces of img and returns their (x1, y1, x2, y2, score) rows sorted by score and their
+// landmarks, in the coordinates of img.
+func (c *FaceDetectionClient) Infer(ctx context.Context, img gocv.Mat) (*tensor.Dense, *tensor.Dense, error) {
+	dets, kpss, err := c.InferBatch(ctx, []gocv.Mat{img})
 	if err != nil {
 		return nil, nil, err
 	}
-	netOut := make([]*tensor.Dense, len(cfgOutputs))
-	for idx, out := range inferResp.Outputs {
-		outShape := make([]int, 0)
-		for _, shape := range out.Shape {
-			outShape = append(outShape, int(shape))
-		}
-		outTensors := tensor.New(
-			tensor.Of(tensor.Float32),
-			tensor.WithShape(outShape...),
-			tensor.WithBacking(utils.BytesToT32[float32](inferResp.RawOutputContents[idx])),
-		)
-
-		for subIdx, cfg := range cfgOutputs {
-			if out.Name == cfg.Name {
-				netOut[subIdx] = outTensors
-			}
-		}
-	}
-
-	symIdx := 0
-	for _, s := range c.featStrideFPN {
-		anchorIdx, _ := c.numAnchors.Get(fmt.Sprintf("stride%d", s))
-		scores, err := netOut[symIdx].Slice(nil, tensor.S(anchorIdx, netOut[symIdx].Shape()[2]), nil, nil)
-		if err != nil {
-			return nil, nil, err
-		}
-		bboxDeltas := netOut[symIdx+1]
-		height, width := bboxDeltas.Shape()[2], bboxDeltas.Shape()[3]
-		A, _ := c.numAnchors.Get(fmt.Sprintf("stride%d", s))
-		K := height * width
-		anchorsFPN, _ := c.anchorsFPN.Get(fmt.Sprintf("stride%d", s))
-		anchors, err := rcnn.Anchors(height, width, s, anchorsFPN)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		err = anchors.Reshape(K*A, 4)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		err = scores.T(0, 2, 3, 1)
-		if err != nil {
-			return nil, nil, err
-		}
+	return dets[0], kpss[0], nil
+}
 
-		resizedScores := scores.Clone()
-		err = resizedScores.(*tensor.Dense).Reshape(scores.DataSize(), 1)
+// InferBatch detects the faces of every image of imgs, like Infer, and returns the detections and landmarks of each
+// image in input order. The letterboxed images are sent in batches of up to MaxBatchSize images, or of the batch
+// size of the model when it is fixed, in which case the last batch is padded with blank images.
+func (c *FaceDetectionClient) InferBatch(ctx context.Context, imgs []gocv.Mat) ([]*tensor.Dense, []*tensor.Dense, error) {
+	imgInfo := []int{c.imageSize[1], c.imageSize[0]}
+	return c.model.infer(ctx, imgs, func(netOut []*tensor.Dense, batchIdx int, detScale float64) (*tensor.Dense, *tensor.Dense, error) {
+		outputs, err := c.strideOutputs(netOut, batchIdx)
 		if err != nil {
 			return nil, nil, err
 		}
+		return c.decode(outputs, imgInfo, detScale)
+	})
+}
 
-		err = bboxDeltas.T(0, 2, 3, 1)
-		if err != nil {
-			return nil, nil, err
-		}
+// strideOutput holds the maps of one stride for one image, each laid out as (channels, height, width): the
+// background then foreground score of every anchor, and the bbox and landmark deltas of every anchor.
+type strideOutput struct {
+	stride         int
+	scores         []float32
+	bboxDeltas     []float32
+	landmarkDeltas []float32
+	height         int
+	width          int
+}
 
-		bboxPredLen := int(math.Floor(float64(bboxDeltas.Shape()[3] / A)))
-		err = bboxDeltas.Reshape(bboxDeltas.DataSize()/bboxPredLen, bboxPredLen)
-		if err != nil {
-			return nil, nil, err
-		}
+// strideOutputs splits the model outputs of the batch element batchIdx by stride, checking that the maps of each
+// stride have the channels of its anchors and the same size.
+func (c *FaceDetectionClient) strideOutputs(netOut []*tensor.Dense, batchIdx int) ([]strideOutput, error) {
+	outputsPerStride := 2
+	if c.useLandmarks {
+		outputsPerStride = 3
+	}
+	if len(netOut) != outputsPerStride*len(c.featStrideFPN) {
+		return nil, fmt.Errorf("expected %d outputs, got %d", outputsPerStride*len(c.featStrideFPN), len(netOut))
+	}
 
-		for i := 0; i < 4; i++ {
-			slice, err := bboxDeltas.Slice(nil, tensor.S(i, 4))
-			if err != nil {
-				return nil, nil, err
-			}
-			scaled, err := slice.(*tensor.Dense).MulScalar(c.bboxStds[i], true)
-			if err != nil {
-				return nil, nil, err
-			}
-			err = tensor.Copy(slice, scaled)
-			if err != nil {
-				return nil, nil, err
+	outputs := make([]strideOutput, len(c.featStrideFPN))
+	for idx, s := range c.featStrideFPN {
+		A, _ := c.numAnchors.Get(fmt.Sprintf("stride%d", s))
+		maps := netOut[idx*outputsPerStride : (idx+1)*outputsPerStride]
+		channels := []int{2 * A, 4 * A, 10 * A}
+		for mapIdx, m := range maps {
+			if m == nil {
+				return nil, fmt.Errorf("stride %d: missing output %d", s, mapIdx)
 			}
-		}
-		proposals, err := c.bboxPred(anchors, bboxDeltas)
-		if err != nil {
-			return nil, nil, err
-		}
-		proposals, err = processing.ClipBoxes(proposals, imgInfo)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		scoreRavel := resizedScores.(*tensor.Dense).Clone().(*tensor.Dense)
-		err = scoreRavel.Reshape(scoreRavel.Shape()[0])
-		if err != nil {
-			return nil, nil, err
-		}
-
-		order := make([]int, 0)
-		for i, v := range scoreRavel.Float32s() {
-			if v >= c.confidenceThreshold {
-				order = append(order, i)
+			shape := m.Shape()
+			if len(shape) != 4 || shape[0] <= batchIdx || shape[1] != channels[mapIdx] || shape[2] != maps[0].Shape()[2] || shape[3] != maps[0].Shape()[3] {
+				return nil, fmt.Errorf("stride %d: output %d has shape %v, expected (%d or more, %d, height, width)", s, mapIdx, shape, batchIdx+1, channels[mapIdx])
 			}
 		}
 
-		proposals, err = utils.SelectRows2D(proposals, order)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		scores, err = utils.SelectRows2D(resizedScores.(*tensor.Dense), order)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		proposalsList = append(proposalsList, proposals)
-		scoresList = append(scoresList, scores.(*tensor.Dense))
-
-		if c.useLandmarks {
-			landmarkDeltas := netOut[symIdx+2]
-			landmarkPredLen := float32(math.Floor(float64(landmarkDeltas.Shape()[1]) / float64(A)))
-
-			err = landmarkDeltas.T(0, 2, 3, 1)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			err = landmarkDeltas.Reshape(
-				landmarkDeltas.DataSize()/(5*int(math.Floor(float64(landmarkPredLen)/float64(5)))),
-				5,
-				int(math.Floor(float64(landmarkPredLen)/float64(5))),
-			)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			landmarkDeltas, err = landmarkDeltas.MulScalar(c.landmarksStd, true)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			landmarks, err := c.landmarkPred(anchors, landmarkDeltas)
-			if err != nil {
-				return nil, nil, err
-			}
-			landmarks, err = utils.SelectRows3D(landmarks, order)
-			if err != nil {
-				return nil, nil, err
-			}
-			landmarksList = append(landmarksList, landmarks)
+		height, width := maps[0].Shape()[2], maps[0].Shape()[3]
+		element := func(m *tensor.Dense) []float32 {
+			size := m.Shape()[1] * height * width
+			return m.Float32s()[batchIdx*size : (batchIdx+1)*size]
 		}
-
-		if c.useLandmarks {
-			symIdx += 3
-		} else {
-			symIdx += 2
+		outputs[idx] = strideOutput{
+			stride:     s,
+			scores:     element(maps[0]),
+			bboxDeltas: element(maps[1]),
+			height:     height,
+			width:      width,
 		}
-	}
-
-	proposals, err := utils.VStack(proposalsList)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var landmarks, det *tensor.Dense
-	if proposals.Shape()[0] == 0 {
 		if c.useLandmarks {
-			landmarks = tensor.New(
-				tensor.Of(tensor.Float32),
-				tensor.WithShape(0, 5, 2),
-			)
-			det = tensor.New(
-				tensor.Of(tensor.Float32),
-				tensor.WithShape(0, 5),
-			)
+			outputs[idx].landmarkDeltas = element(maps[2])
 		}
-		return det, landmarks, nil
-	}
-
-	scores, err := utils.VStack(scoresList)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	scoresRavel := scores.Clone().(*tensor.Dense)
-	err = scoresRavel.Reshape(scoresRavel.Shape()[0])
-	if err != nil {
-		return nil, nil, err
-	}
-
-	order, err := utils.ArgSortDescending(scoresRavel)
-	if err != nil {
-		return nil, nil, err
 	}
+	return outputs, nil
+}
 
-	proposals, err = utils.SelectRows2D(proposals, order)
-	if err != nil {
-		return nil, nil, err
-	}
+// decode turns the maps of every stride into the detections, as (x1, y1, x2, y2, score) rows sorted by score,
+// and their landmarks, scaled back to the original image. imgInfo is the (height, width) of the model input.
+// It works on the flat maps, which are not modified, and on the shared anchors.
+func (c *FaceDetectionClient) decode(outputs []strideOutput, imgInfo []int, detScale float64) (*tensor.Dense, *tensor.Dense, error) {
+	maxX, maxY := float64(imgInfo[1]-1), float64(imgInfo[0]-1)
 
-	scores, err = utils.SelectRows2D(scores, order)
-	if err != nil {
-		return nil, nil, err
-	}
+	// The candidates above the confidence threshold, in stride then anchor order.
+	proposals := make([]float32, 0)
+	scores := make([]float32, 0)
+	landmarks := make([]float32, 0)
 
-	if c.useLandmarks {
-		landmarks, err = utils.VStack(landmarksList)
+	for _, out := range outputs {
+		A, _ := c.numAnchors.Get(fmt.Sprintf("stride%d", out.stride))
+		anchors, err := c.shiftedAnchors(out.height, out.width, out.stride)
 		if err != nil {
 			return nil, nil, err
 		}
-		landmarks, err = utils.SelectRows3D(landmarks, order)
-		if err != nil {
-			return nil, nil, err
-		}
-	}
+		anchorData := anchors.Float32s()
+		plane := out.height * out.width
 
-	proposalSlice, err := proposals.Slice(nil, tensor.S(0, 4, 1))
-	if err != nil {
-		return nil, nil, err
-	}
-	preDet, err := utils.HStack([]*tensor.Dense{proposalSlice.(*tensor.Dense), scores})
-	if err != nil {
-		return nil, nil, err
-	}
-
-	keep, err := processing.NMS(preDet, c.iouThreshold)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	if proposals.Shape()[1] > 4 {
-		pSliceRemaining, err := proposals.Slice(nil, tensor.S(4, proposals.Shape()[1]))
-		if err != nil {
-			return nil, nil, err
-		}
-		det, err = preDet.Hstack(pSliceRemaining.(*tensor.Dense))
-		if err != nil {
-			return nil, nil, err
+		// Anchor k = (y*width + x)*A + a sits on the cell at position y*width + x of every map.
+		for pos := range plane {
+			for a := range A {
+				score := out.scores[(A+a)*plane+pos]
+				if !(score >= c.confidenceThreshold) {
+					continue
+				}
+				k := pos*A + a
+				anchor := anchorData[4*k : 4*k+4]
+
+				// The products are rounded by conversions so that they are not fused with the following addition.
+				widths := anchor[2] - anchor[0] + 1
+				heights := anchor[3] - anchor[1] + 1
+				centerX := anchor[0] + float32(0.5*(widths-1))
+				centerY := anchor[1] + float32(0.5*(heights-1))
+
+				dx := out.bboxDeltas[(4*a)*plane+pos] * c.bboxStds[0]
+				dy := out.bboxDeltas[(4*a+1)*plane+pos] * c.bboxStds[1]
+				dw := out.bboxDeltas[(4*a+2)*plane+pos] * c.bboxStds[2]
+				dh := out.bboxDeltas[(4*a+3)*plane+pos] * c.bboxStds[3]
+
+				predCenterX := float32(widths*dx) + centerX
+				predCenterY := float32(heights*dy) + centerY
+				predW := float32(float32(math.Exp(float64(dw))) * widths)
+				predH := float32(float32(math.Exp(float64(dh))) * heights)
+				halfW := float32((predW - 1) * 0.5)
+				halfH := float32((predH - 1) * 0.5)
+
+				proposals = append(proposals,
+					clip(predCenterX-halfW, maxX),
+					clip(predCenterY-halfH, maxY),
+					clip(predCenterX+halfW, maxX),
+					clip(predCenterY+halfH, maxY),
+				)
+				scores = append(scores, score)
+
+				if c.useLandmarks {
+					for p := range 5 {
+						lx := out.landmarkDeltas[(10*a+2*p)*plane+pos] * c.landmarksStd
+						ly := out.landmarkDeltas[(10*a+2*p+1)*plane+pos] * c.landmarksStd
+						landmarks = append(landmarks, float32(lx*widths)+centerX, float32(ly*heights)+centerY)
+					}
+				}
+			}
 		}
-	} else {
-		det = preDet
-	}
-
-	det, err = utils.SelectRows2D(det, keep)
-	if err != nil {
-		return nil, nil, err
 	}
 
-	if c.useLandmarks {
-		landmarks, err = utils.SelectRows3D(landmarks, keep)
-		if err != nil {
-			return nil, nil, err
-		}
-	}
-	return c.postprocess(det, landmarks, preprocessedParam)
+	det, kpss := selectDetections(proposals, scores, landmarks, c.iouThreshold, detScale, c.useLandmarks)
+	return det, kpss, nil
 }
 
-func (c *FaceDetectionClient) postprocess(det, landmark *tensor.Dense, preprocessedParam float64) (*tensor.Dense, *tensor.Dense, error) {
-	detSlice, err := det.Slice(nil, tensor.S(0, 4))
-	if err != nil {
-		return nil, nil, err
-	}
-
-	detSliceOwned := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(detSlice.Shape()...),
-	)
-
-	err = tensor.Copy(detSliceOwned, detSlice)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	scaledDet, err := detSliceOwned.DivScalar(float32(preprocessedParam), true)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	err = tensor.Copy(detSlice, scaledDet)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	if landmark != nil {
-		landmark, err = landmark.DivScalar(float32(preprocessedParam), true)
-		if err != nil {
-			return nil, nil, err
-		}
-	}
-
-	return det, landmark, nil
+// clip clamps a coordinate into [0, maxValue].
+func clip(v float32, maxValue float64) float32 {
+	return float32(math.Max(math.Min(float64(v), maxValue), 0))
 }
 
-func (c *FaceDetectionClient) landmarkPred(boxes, landmarkDeltas *tensor.Dense) (*tensor.Dense, error) {
-	if boxes.Shape()[0] == 0 {
-		return tensor.New(
-			tensor.Of(tensor.Float32), tensor.WithShape(0, landmarkDeltas.Shape()[1]),
-		), nil
-	}
-
-	boxes0, err := boxes.Slice(nil, tensor.S(0))
-	if err != nil {
-		return nil, err
-	}
-	boxes00 := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(boxes0.Shape()...),
-	)
-	err = tensor.Copy(boxes00, boxes0)
-	if err != nil {
-		return nil, err
-	}
-
-	boxes1, err := boxes.Slice(nil, tensor.S(1))
-	if err != nil {
-		return nil, err
-	}
-	boxes11 := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(boxes1.Shape()...),
-	)
-	err = tensor.Copy(boxes11, boxes1)
-	if err != nil {
-		return nil, err
-	}
-
-	boxes2, err := boxes.Slice(nil, tensor.S(2))
-	if err != nil {
-		return nil, err
-	}
-	boxes22 := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(boxes2.Shape()...),
-	)
-	err = tensor.Copy(boxes22, boxes2)
-	if err != nil {
-		return nil, err
-	}
-
-	boxes3, err := boxes.Slice(nil, tensor.S(3))
-	if err != nil {
-		return nil, err
-	}
-	boxes33 := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(boxes3.Shape()...),
-	)
-	err = tensor.Copy(boxes33, boxes3)
-	if err != nil {
-		return nil, err
-	}
-
-	// widths
-	widths, err := boxes22.Sub(boxes00)
-	if err != nil {
-		return nil, err
-	}
-	widths, err = widths.AddScalar(float32(1.0), true)
-	if err != nil {
-		return nil, err
-	}
-
-	// heights
-	heights, err := boxes33.Sub(boxes11)
-	if err != nil {
-		return nil, err
-	}
-	heights, err = heights.AddScalar(float32(1.0), true)
-	if err != nil {
-		return nil, err
-	}
-
-	// centerX
-	scaledWidth, err := widths.Apply(func(x float32) float32 {
-		return 0.5 * (x - 1)
-	})
-
-	centerX, err := boxes00.Add(scaledWidth.(*tensor.Dense))
-	if err != nil {
-		return nil, err
+// shiftedAnchors returns the anchors of a height x width feature map of the given stride, as a (K*A, 4) tensor.
+// They only depend on the shape, so they are computed once and shared by every call: callers must not modify them.
+func (c *FaceDetectionClient) shiftedAnchors(height, width, stride int) (*tensor.Dense, error) {
+	key := anchorKey{height: height, width: width, stride: stride}
+	cached, ok := c.anchors.Load(key)
+	if ok {
+		return cached.(*tensor.Dense), nil
 	}
 
-	// centerY
-	scaledHeight, err := heights.Apply(func(x float32) float32 {
-		return 0.5 * (x - 1)
-	})
+	anchorsFPN, _ := c.anchorsFPN.Get(fmt.Sprintf("stride%d", stride))
+	anchors, err := rcnn.Anchors(height, width, stride, anchorsFPN)
 	if err != nil {
 		return nil, err
 	}
-	centerY, err := boxes11.Add(scaledHeight.(*tensor.Dense))
+	err = anchors.Reshape(height*width*anchorsFPN.Shape()[0], 4)
 	if err != nil {
 		return nil, err
 	}
-
-	pred := landmarkDeltas.Clone().(*tensor.Dense)
-
-	for i := range 5 {
-		lmkSlices0, err := landmarkDeltas.Slice(nil, tensor.S(i), tensor.S(0))
-		if err != nil {
-			return nil, err
-		}
-
-		scaledLmk0, err := lmkSlices0.(*tensor.Dense).Mul(widths)
-		if err != nil {
-			return nil, err
-		}
-		newPred0, err := scaledLmk0.Add(centerX)
-		if err != nil {
-			return nil, err
-		}
-
-		predSlice0, err := pred.Slice(nil, tensor.S(i), tensor.S(0))
-		if err != nil {
-			return nil, err
-		}
-
-		err = tensor.Copy(predSlice0, newPred0)
-		if err != nil {
-			return nil, err
-		}
-
-		lmkSlices1, err := landmarkDeltas.Slice(nil, tensor.S(i), tensor.S(1))
-		if err != nil {
-			return nil, err
-		}
-
-		scaledLmk1, err := lmkSlices1.(*tensor.Dense).Mul(heights)
-		if err != nil {
-			return nil, err
-		}
-		newPred1, err := scaledLmk1.Add(centerY)
-		if err != nil {
-			return nil, err
-		}
-
-		predSlice1, err := pred.Slice(nil, tensor.S(i), tensor.S(1))
-		if err != nil {
-			return nil, err
-		}
-
-		err = tensor.Copy(predSlice1, newPred1)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return pred, nil
+	cached, _ = c.anchors.LoadOrStore(key, anchors)
+	return cached.(*tensor.Dense), nil
 }
 
-func (c *FaceDetectionClient) bboxPred(boxes, bboxDelta *tensor.Dense) (*tensor.Dense, error) {
-	if boxes.Shape()[0] == 0 {
-		return tensor.New(
-			tensor.Of(tensor.Float32), tensor.WithShape(0, bboxDelta.Shape()[1]),
-		), nil
-	}
-
-	boxes0, err := boxes.Slice(nil, tensor.S(0))
-	if err != nil {
-		return nil, err
-	}
-	boxes00 := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(boxes0.Shape()...),
-	)
-	err = tensor.Copy(boxes00, boxes0)
-	if err != nil {
-		return nil, err
-	}
-
-	boxes1, err := boxes.Slice(nil, tensor.S(1))
-	if err != nil {
-		return nil, err
-	}
-	boxes11 := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(boxes1.Shape()...),
-	)
-	err = tensor.Copy(boxes11, boxes1)
-	if err != nil {
-		return nil, err
-	}
-
-	boxes2, err := boxes.Slice(nil, tensor.S(2))
-	if err != nil {
-		return nil, err
-	}
-	boxes22 := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(boxes2.Shape()...),
-	)
-	err = tensor.Copy(boxes22, boxes2)
-	if err != nil {
-		return nil, err
-	}
-
-	boxes3, err := boxes.Slice(nil, tensor.S(3))
-	if err != nil {
-		return nil, err
-	}
-	boxes33 := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(boxes3.Shape()...),
-	)
-	err = tensor.Copy(boxes33, boxes3)
-	if err != nil {
-		return nil, err
-	}
-
-	// widths
-	widths, err := boxes22.Sub(boxes00)
-	if err != nil {
-		return nil, err
-	}
-	widths, err = widths.AddScalar(float32(1.0), true)
-	if err != nil {
-		return nil, err
-	}
-
-	// heights
-	heights, err := boxes33.Sub(boxes11)
-	if err != nil {
-		return nil, err
-	}
-	heights, err = heights.AddScalar(float32(1.0), true)
-	if err != nil {
-		return nil, err
-	}
-
-	// centerX
-	scaledWidth, err := widths.Apply(func(x float32) float32 {
-		return 0.5 * (x - 1)
-	})
-
-	centerX, err := boxes00.Add(scaledWidth.(*tensor.Dense))
-	if err != nil {
-		return nil, err
-	}
-
-	// centerY
-	scaledHeight, err := heights.Apply(func(x float32) float32 {
-		return 0.5 * (x - 1)
-	})
-	if err != nil {
-		return nil, err
-	}
-	centerY, err := boxes11.Add(scaledHeight.(*tensor.Dense))
-	if err != nil {
-		return nil, err
-	}
-
-	dx, err := bboxDelta.Slice(nil, tensor.S(0, 1))
-	if err != nil {
-		return nil, err
-	}
-	dy, err := bboxDelta.Slice(nil, tensor.S(1, 2))
-	if err != nil {
-		return nil, err
-	}
-	dw, err := bboxDelta.Slice(nil, tensor.S(2, 3))
-	if err != nil {
-		return nil, err
-	}
-	dh, err := bboxDelta.Slice(nil, tensor.S(3, 4))
-	if err != nil {
-		return nil, err
-	}
-
-	newWidthShape := []int{widths.Shape()[0], 1}
-	err = widths.Reshape(newWidthShape...)
-	if err != nil {
-		return nil, err
-	}
-
-	newHeightShape := []int{heights.Shape()[0], 1}
-	err = heights.Reshape(newHeightShape...)
-	if err != nil {
-		return nil, err
-	}
-
-	newCenterXShape := []int{centerX.Shape()[0], 1}
-	err = centerX.Reshape(newCenterXShape...)
-	if err != nil {
-		return nil, err
-	}
-
-	newCenterYShape := []int{centerY.Shape()[0], 1}
-	err = centerY.Reshape(newCenterYShape...)
-	if err != nil {
-		return nil, err
-	}
-
-	scaledWidths, err := widths.Mul(dx.(*tensor.Dense))
-	if err != nil {
-		return nil, err
-	}
-	predCenterX, err := scaledWidths.Add(centerX)
-	if err != nil {
-		return nil, err
-	}
-
-	scaledHeighs, err := heights.Mul(dy.(*tensor.Dense))
-	if err != nil {
-		return nil, err
-	}
-	predCenterY, err := scaledHeighs.Add(centerY)
-	if err != nil {
-		return nil, err
-	}
-
-	expDw, err := dw.(*tensor.Dense).Apply(func(x float32) float32 {
-		return float32(math.Exp(float64(x)))
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	expDh, err := dh.(*tensor.Dense).Apply(func(x float32) float32 {
-		return float32(math.Exp(float64(x)))
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	predW, err := expDw.(*tensor.Dense).Mul(widths)
-	if err != nil {
-		return nil, err
-	}
-
-	predH, err := expDh.(*tensor.Dense).Mul(heights)
-	if err != nil {
-		return nil, err
-	}
-
-	predBoxes := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(bboxDelta.Shape()...),
-	)
-
-	predBox01, err := predBoxes.Slice(nil, tensor.S(0))
-	if err != nil {
-		return nil, err
-	}
-
-	subPredW, err := predW.Apply(func(x float32) float32 {
-		return (x - 1) * 0.5
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	subPredH, err := predH.Apply(func(x float32) float32 {
-		return (x - 1) * 0.5
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	newPredBox01, err := predCenterX.Sub(subPredW.(*tensor.Dense))
-	if err != nil {
-		return nil, err
-	}
-
-	err = tensor.Copy(predBox01, newPredBox01)
-	if err != nil {
-		return nil, err
-	}
-
-	predBox12, err := predBoxes.Slice(nil, tensor.S(1))
-	if err != nil {
-		return nil, err
-	}
-	newPredBox12, err := predCenterY.Sub(subPredH.(*tensor.Dense))
-	if err != nil {
-		return nil, err
-	}
-
-	err = tensor.Copy(predBox12, newPredBox12)
-	if err != nil {
-		return nil, err
-	}
-
-	predBox23, err := predBoxes.Slice(nil, tensor.S(2))
-	if err != nil {
-		return nil, err
-	}
-	newPredBox23, err := predCenterX.Add(subPredW.(*tensor.Dense))
-	if err != nil {
-		return nil, err
-	}
-
-	err = tensor.Copy(predBox23, newPredBox23)
-	if err != nil {
-		return nil, err
-	}
+// Ready returns an error unless the detection model is ready on the backend.
+func (c *FaceDetectionClient) Ready() error {
+	return modelReady(c.backend, c.ModelParams.Timeout, c.ModelParams.ModelName, c.ModelParams.ModelVersion)
+}
 
-	predBox34, err := predBoxes.Slice(nil, tensor.S(3))
+// Validate checks that the model takes batches of MaxBatchSize 3 channel images of ImageSize and returns the score,
+// bbox and landmark maps of every FPN stride, with the channels of the anchors of the stride.
+func (c *FaceDetectionClient) Validate() error {
+	err := validateImageInput(c.ModelConfig, max(c.ModelParams.MaxBatchSize, 1), c.imageSize)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	newPredBox34, err := predCenterY.Add(subPredH.(*tensor.Dense))
-	if err != nil {
-		return nil, err
+	outputsPerStride := 2
+	if c.useLandmarks {
+		outputsPerStride = 3
 	}
-
-	err = tensor.Copy(predBox34, newPredBox34)
+	err = validateOutputs(c.ModelConfig, outputsPerStride*len(c.featStrideFPN), 4, true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if bboxDelta.Shape()[1] > 4 {
-		slicedPredBoxes, err := predBoxes.Slice(nil, tensor.S(4, predBoxes.Shape()[1]-1))
-		if err != nil {
-			return nil, err
-		}
-
-		slicedBBoxDelta, err := bboxDelta.Slice(nil, tensor.S(4, bboxDelta.Shape()[1]-1))
-		if err != nil {
-			return nil, err
-		}
-		err = tensor.Copy(slicedPredBoxes, slicedBBoxDelta)
-		if err != nil {
-			return nil, err
+	for idx, output := range c.ModelConfig.Config.Output {
+		stride := c.featStrideFPN[idx/outputsPerStride]
+		A, _ := c.numAnchors.Get(fmt.Sprintf("stride%d", stride))
+		channels := []int64{2 * int64(A), 4 * int64(A), 10 * int64(A)}[idx%outputsPerStride]
+		if output.Dims[1] != -1 && output.Dims[1] != channels {
+			return fmt.Errorf("model %s: output %s has %d channels, the %d anchors of stride %d need %d", c.ModelConfig.Config.Name, output.Name, output.Dims[1], A, stride, channels)
 		}
 	}
-
-	return predBoxes, nil
+	return nil
 }
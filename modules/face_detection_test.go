@@ -1,8 +1,12 @@
 package modules
 
 import (
+	"context"
 	"fmt"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/processing"
+	"github.com/okieraised/go-faceid-pipeline/tritontest"
 	"github.com/okieraised/go-faceid-pipeline/utils"
 	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/stretchr/testify/assert"
@@ -10,14 +14,24 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
+	"gorgonia.org/tensor"
+	"image"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	"testing"
 )
 
-const (
-	tritonTestURL = "10.124.68.173:8603"
-)
+// tritonTestURL points the integration tests at a live Triton server. They are skipped when TRITON_TEST_URL is unset,
+// the hermetic tests use the in-process tritontest server instead.
+var tritonTestURL = os.Getenv("TRITON_TEST_URL")
+
+func skipWithoutTriton(t *testing.T) {
+	if tritonTestURL == "" {
+		t.Skip("TRITON_TEST_URL is not set")
+	}
+}
 
 func genTestDataSingleFace() (*gocv.Mat, error) {
 	f, err := os.Open("../test_data/single.jpg")
@@ -77,6 +91,8 @@ func genTestDataNoFace() (*gocv.Mat, error) {
 }
 
 func TestNewFaceDetectionClient_Single(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -87,10 +103,10 @@ func TestNewFaceDetectionClient_Single(t *testing.T) {
 	img, err := genTestDataSingleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	client, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	client, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := client.Infer(*img)
+	det, kpss, err := client.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	fmt.Println("det", det)
@@ -98,6 +114,8 @@ func TestNewFaceDetectionClient_Single(t *testing.T) {
 }
 
 func TestNewFaceDetectionClient_Multiple(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -108,10 +126,10 @@ func TestNewFaceDetectionClient_Multiple(t *testing.T) {
 	img, err := genTestDataMultipleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	client, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	client, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := client.Infer(*img)
+	det, kpss, err := client.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	fmt.Println("det", det.Shape()[0])
@@ -119,6 +137,8 @@ func TestNewFaceDetectionClient_Multiple(t *testing.T) {
 }
 
 func TestNewFaceDetectionClient_NoFace(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -129,11 +149,1050 @@ func TestNewFaceDetectionClient_NoFace(t *testing.T) {
 	img, err := genTestDataNoFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	client, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	client, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := client.Infer(*img)
+	det, kpss, err := client.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 	fmt.Println(det.Shape())
 	fmt.Println(kpss.Shape())
 }
+
+// newTestBackend starts an in-process Triton server serving every pipeline model, detecting the given faces.
+func newTestBackend(t testing.TB, faces ...image.Point) (*tritontest.Server, inference.Backend) {
+	server := tritontest.NewServer(tritontest.FaceIDModels(faces...)...)
+	t.Cleanup(server.Close)
+
+	backend, err := server.Backend()
+	assert.NoError(t, err)
+	return server, backend
+}
+
+func newTestImage(width, height int) gocv.Mat {
+	return gocv.NewMatWithSizesWithScalar([]int{height, width}, gocv.MatTypeCV8UC3, gocv.NewScalar(0, 0, 0, 0))
+}
+
+func TestFaceDetectionClient_Infer(t *testing.T) {
+	server, backend := newTestBackend(t, image.Pt(10, 10))
+
+	client, err := NewFaceDetectionClient(backend, config.DefaultRetinaFaceDetectionParams)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Ready())
+	assert.NoError(t, client.Validate())
+
+	img := newTestImage(1280, 1280)
+	defer img.Close()
+
+	det, kpss, err := client.Infer(context.Background(), img)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, det.Shape()[0])
+	assert.InDeltaSlice(t, []float32{144, 144, 1166, 1166, 0.99}, det.Float32s(), 1e-3)
+	assert.Equal(t, 10, kpss.DataSize())
+
+	requests := server.Requests()
+	assert.Len(t, requests, 1)
+	assert.Equal(t, config.DefaultRetinaFaceDetectionParams.ModelName, requests[0].ModelName)
+	assert.Equal(t, []int64{1, 3, 640, 640}, requests[0].Inputs[0].Shape)
+	assert.Zero(t, matPool.Outstanding())
+}
+
+func TestFaceDetectionClient_InferNoFace(t *testing.T) {
+	_, backend := newTestBackend(t)
+
+	client, err := NewFaceDetectionClient(backend, config.DefaultRetinaFaceDetectionParams)
+	assert.NoError(t, err)
+
+	img := newTestImage(640, 480)
+	defer img.Close()
+
+	det, _, err := client.Infer(context.Background(), img)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, det.Shape()[0])
+}
+
+func TestFaceDetectionClient_InferBatch(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		batchDim int64
+		batches  []int64
+	}{
+		{name: "fixed batch", batchDim: 2, batches: []int64{2, 2}},
+		{name: "dynamic batch", batchDim: -1, batches: []int64{2, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			model := tritontest.RetinaFaceModel(image.Pt(10, 10))
+			for _, input := range model.Config.Input {
+				input.Dims[0] = tc.batchDim
+			}
+			for _, output := range model.Config.Output {
+				output.Dims[0] = tc.batchDim
+				if tc.batchDim > 1 {
+					model.Outputs[output.Name] = append(model.Outputs[output.Name], model.Outputs[output.Name]...)
+				}
+			}
+			server := tritontest.NewServer(model)
+			defer server.Close()
+			backend, err := server.Backend()
+			assert.NoError(t, err)
+
+			cfg := *config.DefaultRetinaFaceDetectionParams
+			cfg.MaxBatchSize = 2
+			client, err := NewFaceDetectionClient(backend, &cfg)
+			assert.NoError(t, err)
+			assert.NoError(t, client.Validate())
+
+			imgs := []gocv.Mat{newTestImage(1280, 1280), newTestImage(640, 640), newTestImage(800, 600)}
+			for _, img := range imgs {
+				defer img.Close()
+			}
+
+			dets, kpss, err := client.InferBatch(context.Background(), imgs)
+			assert.NoError(t, err)
+			assert.Len(t, dets, len(imgs))
+			assert.Len(t, kpss, len(imgs))
+
+			// The canned outputs are the same for every image, each is rescaled with the scale of its image.
+			for idx, scale := range []float32{0.5, 1, 0.8} {
+				assert.Equal(t, 1, dets[idx].Shape()[0])
+				assert.InDeltaSlice(t, []float32{72 / scale, 72 / scale, 583 / scale, 583 / scale, 0.99}, dets[idx].Float32s(), 1e-3)
+				assert.Equal(t, []int{1, 5, 2}, []int(kpss[idx].Shape()))
+			}
+
+			batches := make([]int64, 0)
+			for _, req := range server.Requests() {
+				batches = append(batches, req.Inputs[0].Shape[0])
+			}
+			assert.Equal(t, tc.batches, batches)
+			assert.Zero(t, matPool.Outstanding())
+
+			if tc.batchDim == -1 {
+				// A batch of one image gives the same detections as Infer.
+				det, kps, err := client.Infer(context.Background(), imgs[2])
+				assert.NoError(t, err)
+				assert.Equal(t, dets[2].Float32s(), det.Float32s())
+				assert.Equal(t, kpss[2].Float32s(), kps.Float32s())
+			}
+		})
+	}
+}
+
+func TestFaceDetectionClient_Network(t *testing.T) {
+	_, backend := newTestBackend(t, image.Pt(10, 10))
+
+	img := newTestImage(1280, 1280)
+	defer img.Close()
+
+	infer := func(network *config.RetinaFaceNetworkParams) (*tensor.Dense, *tensor.Dense) {
+		cfg := *config.DefaultRetinaFaceDetectionParams
+		cfg.Network = network
+		client, err := NewFaceDetectionClient(backend, &cfg)
+		assert.NoError(t, err)
+		assert.NoError(t, client.Validate())
+		det, kpss, err := client.Infer(context.Background(), img)
+		assert.NoError(t, err)
+		return det, kpss
+	}
+
+	det, kpss := infer(nil)
+	r50Det, r50Kpss := infer(config.RetinaFaceR50Network)
+	assert.Equal(t, det.Float32s(), r50Det.Float32s())
+	assert.Equal(t, kpss.Float32s(), r50Kpss.Float32s())
+
+	// The landmark deltas of mnet025_v2 are scaled down, its boxes are unchanged.
+	v2Det, v2Kpss := infer(config.RetinaFaceMobileNet025V2Network)
+	assert.Equal(t, det.Float32s(), v2Det.Float32s())
+	assert.NotEqual(t, kpss.Float32s(), v2Kpss.Float32s())
+
+	for _, tc := range []struct {
+		name    string
+		anchors []config.RetinaFaceAnchorParams
+		err     string
+	}{
+		{
+			name:    "no anchors",
+			anchors: nil,
+			err:     "no anchors configured",
+		},
+		{
+			name: "increasing strides",
+			anchors: []config.RetinaFaceAnchorParams{
+				config.NewRetinaFaceAnchorParams(8, 16, []float32{1}, []float32{2, 1}),
+				config.NewRetinaFaceAnchorParams(16, 16, []float32{1}, []float32{8, 4}),
+				config.NewRetinaFaceAnchorParams(32, 16, []float32{1}, []float32{32, 16}),
+			},
+			err: "stride 16 must be smaller than the stride 8 before it",
+		},
+		{
+			name: "more strides than outputs",
+			anchors: []config.RetinaFaceAnchorParams{
+				config.NewRetinaFaceAnchorParams(64, 16, []float32{1}, []float32{32, 16}),
+				config.NewRetinaFaceAnchorParams(32, 16, []float32{1}, []float32{32, 16}),
+				config.NewRetinaFaceAnchorParams(16, 16, []float32{1}, []float32{8, 4}),
+				config.NewRetinaFaceAnchorParams(8, 16, []float32{1}, []float32{2, 1}),
+			},
+			err: "has 9 outputs, the 4 strides of its anchors need 12",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := *config.DefaultRetinaFaceDetectionParams
+			cfg.Network = config.NewRetinaFaceNetworkParams(tc.anchors, [3]float32{0, 0, 0}, [3]float32{1, 1, 1}, 1, [4]float32{1, 1, 1, 1}, 1)
+			_, err := NewFaceDetectionClient(backend, &cfg)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+
+	// Two ratios per stride need twice the channels of the model outputs.
+	cfg := *config.DefaultRetinaFaceDetectionParams
+	cfg.Network = config.NewRetinaFaceNetworkParams(
+		[]config.RetinaFaceAnchorParams{
+			config.NewRetinaFaceAnchorParams(32, 16, []float32{1, 1.5}, []float32{32, 16}),
+			config.NewRetinaFaceAnchorParams(16, 16, []float32{1, 1.5}, []float32{8, 4}),
+			config.NewRetinaFaceAnchorParams(8, 16, []float32{1, 1.5}, []float32{2, 1}),
+		},
+		[3]float32{0, 0, 0}, [3]float32{1, 1, 1}, 1, [4]float32{1, 1, 1, 1}, 1,
+	)
+	client, err := NewFaceDetectionClient(backend, &cfg)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, client.Validate(), "has 4 channels, the 4 anchors of stride 32 need 8")
+}
+
+func TestFaceDetectionClient_ModelVersion(t *testing.T) {
+	_, backend := newTestBackend(t)
+
+	cfg := *config.DefaultRetinaFaceDetectionParams
+	cfg.ModelVersion = "2"
+	_, err := NewFaceDetectionClient(backend, &cfg)
+	assert.ErrorContains(t, err, "version 2 is not found")
+}
+
+// randomDetectionOutputs returns the outputs of a RetinaFace model on a 640x640 input with the given fraction of
+// anchors above the default confidence threshold. Anchors fire in pairs of neighboring cells like real detections.
+func randomDetectionOutputs(rng *rand.Rand, fraction float64) []*tensor.Dense {
+	const numAnchors = 2
+	imageSize := config.DefaultRetinaFaceDetectionParams.ImageSize
+
+	netOut := make([]*tensor.Dense, 0)
+	for _, stride := range []int{32, 16, 8} {
+		h, w := imageSize[1]/stride, imageSize[0]/stride
+		scores := make([]float32, 2*numAnchors*h*w)
+		for i := range scores {
+			scores[i] = rng.Float32() * 0.5
+		}
+		for i := numAnchors * h * w; i < len(scores)-1; i++ {
+			if rng.Float64() < fraction/2 {
+				scores[i] = 0.7 + rng.Float32()*0.3
+				scores[i+1] = 0.7 + rng.Float32()*0.3
+			}
+		}
+		bboxDeltas := make([]float32, 4*numAnchors*h*w)
+		for i := range bboxDeltas {
+			bboxDeltas[i] = float32(rng.NormFloat64() * 0.2)
+		}
+		landmarkDeltas := make([]float32, 10*numAnchors*h*w)
+		for i := range landmarkDeltas {
+			landmarkDeltas[i] = float32(rng.NormFloat64() * 0.3)
+		}
+		netOut = append(netOut,
+			tensor.New(tensor.WithShape(1, 2*numAnchors, h, w), tensor.WithBacking(scores)),
+			tensor.New(tensor.WithShape(1, 4*numAnchors, h, w), tensor.WithBacking(bboxDeltas)),
+			tensor.New(tensor.WithShape(1, 10*numAnchors, h, w), tensor.WithBacking(landmarkDeltas)),
+		)
+	}
+	return netOut
+}
+
+func cloneOutputs(netOut []*tensor.Dense) []*tensor.Dense {
+	clones := make([]*tensor.Dense, len(netOut))
+	for idx, out := range netOut {
+		clones[idx] = out.Clone().(*tensor.Dense)
+	}
+	return clones
+}
+
+func TestFaceDetectionClient_Decode(t *testing.T) {
+	_, backend := newTestBackend(t)
+
+	client, err := NewFaceDetectionClient(backend, config.DefaultRetinaFaceDetectionParams)
+	assert.NoError(t, err)
+
+	imageSize := client.imageSize
+	imgInfo := []int{imageSize[1], imageSize[0]}
+	rng := rand.New(rand.NewSource(1))
+	for _, fraction := range []float64{0, 0.001, 0.01, 0.1, 0.5} {
+		netOut := randomDetectionOutputs(rng, fraction)
+
+		outputs, err := client.strideOutputs(netOut, 0)
+		assert.NoError(t, err)
+		det, kpss, err := client.decode(outputs, imgInfo, 0.625)
+		assert.NoError(t, err)
+
+		expectedDet, expectedKpss, err := naiveDecode(client, cloneOutputs(netOut), imgInfo, 0.625)
+		assert.NoError(t, err)
+
+		assert.Equal(t, expectedDet.Shape(), det.Shape(), "fraction %v", fraction)
+		assert.Equal(t, expectedDet.Float32s(), det.Float32s(), "fraction %v", fraction)
+		assert.Equal(t, expectedKpss.Shape(), kpss.Shape(), "fraction %v", fraction)
+		assert.Equal(t, expectedKpss.Float32s(), kpss.Float32s(), "fraction %v", fraction)
+	}
+
+	// The maps of a stride must match its anchors.
+	netOut := randomDetectionOutputs(rng, 0)
+	netOut[1] = tensor.New(tensor.WithShape(1, 4, 20, 20), tensor.WithBacking(make([]float32, 4*20*20)))
+	_, err = client.strideOutputs(netOut, 0)
+	assert.ErrorContains(t, err, "stride 32: output 1 has shape (1, 4, 20, 20)")
+}
+
+// BenchmarkFaceDetectionClient_Decode compares the postprocessing of crowded and sparse outputs to the tensor
+// based one.
+func BenchmarkFaceDetectionClient_Decode(b *testing.B) {
+	server := tritontest.NewServer(tritontest.FaceIDModels()...)
+	defer server.Close()
+	backend, err := server.Backend()
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err := NewFaceDetectionClient(backend, config.DefaultRetinaFaceDetectionParams)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	imgInfo := []int{client.imageSize[1], client.imageSize[0]}
+	rng := rand.New(rand.NewSource(1))
+	for _, bm := range []struct {
+		name     string
+		fraction float64
+	}{
+		{name: "sparse", fraction: 0.001},
+		{name: "crowded", fraction: 0.05},
+	} {
+		netOut := randomDetectionOutputs(rng, bm.fraction)
+
+		b.Run(bm.name+"/tensor", func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				clones := cloneOutputs(netOut)
+				b.StartTimer()
+				_, _, err := naiveDecode(client, clones, imgInfo, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(bm.name+"/flat", func(b *testing.B) {
+			for range b.N {
+				outputs, err := client.strideOutputs(netOut, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, _, err = client.decode(outputs, imgInfo, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// naiveDecode is the tensor based postprocessing that decode replaced, kept as a reference. It reshapes and
+// transposes netOut in place.
+func naiveDecode(c *FaceDetectionClient, netOut []*tensor.Dense, imgInfo []int, preprocessedParam float64) (*tensor.Dense, *tensor.Dense, error) {
+	proposalsList := make([]*tensor.Dense, 0)
+	scoresList := make([]*tensor.Dense, 0)
+	landmarksList := make([]*tensor.Dense, 0)
+
+	symIdx := 0
+	for _, s := range c.featStrideFPN {
+		anchorIdx, _ := c.numAnchors.Get(fmt.Sprintf("stride%d", s))
+		scores, err := netOut[symIdx].Slice(nil, tensor.S(anchorIdx, netOut[symIdx].Shape()[2]), nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		bboxDeltas := netOut[symIdx+1]
+		height, width := bboxDeltas.Shape()[2], bboxDeltas.Shape()[3]
+		A, _ := c.numAnchors.Get(fmt.Sprintf("stride%d", s))
+		anchors, err := c.shiftedAnchors(height, width, s)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = scores.T(0, 2, 3, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resizedScores := scores.Clone()
+		err = resizedScores.(*tensor.Dense).Reshape(scores.DataSize(), 1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = bboxDeltas.T(0, 2, 3, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		bboxPredLen := int(math.Floor(float64(bboxDeltas.Shape()[3] / A)))
+		err = bboxDeltas.Reshape(bboxDeltas.DataSize()/bboxPredLen, bboxPredLen)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i := 0; i < 4; i++ {
+			slice, err := bboxDeltas.Slice(nil, tensor.S(i, 4))
+			if err != nil {
+				return nil, nil, err
+			}
+			scaled, err := slice.(*tensor.Dense).MulScalar(c.bboxStds[i], true)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = tensor.Copy(slice, scaled)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		proposals, err := naiveBboxPred(anchors, bboxDeltas)
+		if err != nil {
+			return nil, nil, err
+		}
+		proposals, err = processing.ClipBoxes(proposals, imgInfo)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		scoreRavel := resizedScores.(*tensor.Dense).Clone().(*tensor.Dense)
+		err = scoreRavel.Reshape(scoreRavel.Shape()[0])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		order := make([]int, 0)
+		for i, v := range scoreRavel.Float32s() {
+			if v >= c.confidenceThreshold {
+				order = append(order, i)
+			}
+		}
+
+		proposals, err = utils.SelectRows2D(proposals, order)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		scores, err = utils.SelectRows2D(resizedScores.(*tensor.Dense), order)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		proposalsList = append(proposalsList, proposals)
+		scoresList = append(scoresList, scores.(*tensor.Dense))
+
+		if c.useLandmarks {
+			landmarkDeltas := netOut[symIdx+2]
+			landmarkPredLen := float32(math.Floor(float64(landmarkDeltas.Shape()[1]) / float64(A)))
+
+			err = landmarkDeltas.T(0, 2, 3, 1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			err = landmarkDeltas.Reshape(
+				landmarkDeltas.DataSize()/(5*int(math.Floor(float64(landmarkPredLen)/float64(5)))),
+				5,
+				int(math.Floor(float64(landmarkPredLen)/float64(5))),
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			landmarkDeltas, err = landmarkDeltas.MulScalar(c.landmarksStd, true)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			landmarks, err := naiveLandmarkPred(anchors, landmarkDeltas)
+			if err != nil {
+				return nil, nil, err
+			}
+			landmarks, err = utils.SelectRows3D(landmarks, order)
+			if err != nil {
+				return nil, nil, err
+			}
+			landmarksList = append(landmarksList, landmarks)
+		}
+
+		if c.useLandmarks {
+			symIdx += 3
+		} else {
+			symIdx += 2
+		}
+	}
+
+	proposals, err := utils.VStack(proposalsList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var landmarks, det *tensor.Dense
+	if proposals.Shape()[0] == 0 {
+		if c.useLandmarks {
+			landmarks = tensor.New(
+				tensor.Of(tensor.Float32),
+				tensor.WithShape(0, 5, 2),
+			)
+			det = tensor.New(
+				tensor.Of(tensor.Float32),
+				tensor.WithShape(0, 5),
+			)
+		}
+		return det, landmarks, nil
+	}
+
+	scores, err := utils.VStack(scoresList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scoresRavel := scores.Clone().(*tensor.Dense)
+	err = scoresRavel.Reshape(scoresRavel.Shape()[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order, err := utils.ArgSortDescending(scoresRavel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proposals, err = utils.SelectRows2D(proposals, order)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scores, err = utils.SelectRows2D(scores, order)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.useLandmarks {
+		landmarks, err = utils.VStack(landmarksList)
+		if err != nil {
+			return nil, nil, err
+		}
+		landmarks, err = utils.SelectRows3D(landmarks, order)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	proposalSlice, err := proposals.Slice(nil, tensor.S(0, 4, 1))
+	if err != nil {
+		return nil, nil, err
+	}
+	preDet, err := utils.HStack([]*tensor.Dense{proposalSlice.(*tensor.Dense), scores})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keep, err := processing.NMS(preDet, c.iouThreshold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if proposals.Shape()[1] > 4 {
+		pSliceRemaining, err := proposals.Slice(nil, tensor.S(4, proposals.Shape()[1]))
+		if err != nil {
+			return nil, nil, err
+		}
+		det, err = preDet.Hstack(pSliceRemaining.(*tensor.Dense))
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		det = preDet
+	}
+
+	det, err = utils.SelectRows2D(det, keep)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.useLandmarks {
+		landmarks, err = utils.SelectRows3D(landmarks, keep)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return naivePostprocess(det, landmarks, preprocessedParam)
+}
+
+func naivePostprocess(det, landmark *tensor.Dense, preprocessedParam float64) (*tensor.Dense, *tensor.Dense, error) {
+	detSlice, err := det.Slice(nil, tensor.S(0, 4))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	detSliceOwned := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(detSlice.Shape()...),
+	)
+
+	err = tensor.Copy(detSliceOwned, detSlice)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scaledDet, err := detSliceOwned.DivScalar(float32(preprocessedParam), true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tensor.Copy(detSlice, scaledDet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if landmark != nil {
+		landmark, err = landmark.DivScalar(float32(preprocessedParam), true)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return det, landmark, nil
+}
+
+func naiveLandmarkPred(boxes, landmarkDeltas *tensor.Dense) (*tensor.Dense, error) {
+	if boxes.Shape()[0] == 0 {
+		return tensor.New(
+			tensor.Of(tensor.Float32), tensor.WithShape(0, landmarkDeltas.Shape()[1]),
+		), nil
+	}
+
+	boxes0, err := boxes.Slice(nil, tensor.S(0))
+	if err != nil {
+		return nil, err
+	}
+	boxes00 := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(boxes0.Shape()...),
+	)
+	err = tensor.Copy(boxes00, boxes0)
+	if err != nil {
+		return nil, err
+	}
+
+	boxes1, err := boxes.Slice(nil, tensor.S(1))
+	if err != nil {
+		return nil, err
+	}
+	boxes11 := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(boxes1.Shape()...),
+	)
+	err = tensor.Copy(boxes11, boxes1)
+	if err != nil {
+		return nil, err
+	}
+
+	boxes2, err := boxes.Slice(nil, tensor.S(2))
+	if err != nil {
+		return nil, err
+	}
+	boxes22 := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(boxes2.Shape()...),
+	)
+	err = tensor.Copy(boxes22, boxes2)
+	if err != nil {
+		return nil, err
+	}
+
+	boxes3, err := boxes.Slice(nil, tensor.S(3))
+	if err != nil {
+		return nil, err
+	}
+	boxes33 := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(boxes3.Shape()...),
+	)
+	err = tensor.Copy(boxes33, boxes3)
+	if err != nil {
+		return nil, err
+	}
+
+	// widths
+	widths, err := boxes22.Sub(boxes00)
+	if err != nil {
+		return nil, err
+	}
+	widths, err = widths.AddScalar(float32(1.0), true)
+	if err != nil {
+		return nil, err
+	}
+
+	// heights
+	heights, err := boxes33.Sub(boxes11)
+	if err != nil {
+		return nil, err
+	}
+	heights, err = heights.AddScalar(float32(1.0), true)
+	if err != nil {
+		return nil, err
+	}
+
+	// centerX
+	scaledWidth, err := widths.Apply(func(x float32) float32 {
+		return 0.5 * (x - 1)
+	})
+
+	centerX, err := boxes00.Add(scaledWidth.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+
+	// centerY
+	scaledHeight, err := heights.Apply(func(x float32) float32 {
+		return 0.5 * (x - 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	centerY, err := boxes11.Add(scaledHeight.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+
+	pred := landmarkDeltas.Clone().(*tensor.Dense)
+
+	for i := range 5 {
+		lmkSlices0, err := landmarkDeltas.Slice(nil, tensor.S(i), tensor.S(0))
+		if err != nil {
+			return nil, err
+		}
+
+		scaledLmk0, err := lmkSlices0.(*tensor.Dense).Mul(widths)
+		if err != nil {
+			return nil, err
+		}
+		newPred0, err := scaledLmk0.Add(centerX)
+		if err != nil {
+			return nil, err
+		}
+
+		predSlice0, err := pred.Slice(nil, tensor.S(i), tensor.S(0))
+		if err != nil {
+			return nil, err
+		}
+
+		err = tensor.Copy(predSlice0, newPred0)
+		if err != nil {
+			return nil, err
+		}
+
+		lmkSlices1, err := landmarkDeltas.Slice(nil, tensor.S(i), tensor.S(1))
+		if err != nil {
+			return nil, err
+		}
+
+		scaledLmk1, err := lmkSlices1.(*tensor.Dense).Mul(heights)
+		if err != nil {
+			return nil, err
+		}
+		newPred1, err := scaledLmk1.Add(centerY)
+		if err != nil {
+			return nil, err
+		}
+
+		predSlice1, err := pred.Slice(nil, tensor.S(i), tensor.S(1))
+		if err != nil {
+			return nil, err
+		}
+
+		err = tensor.Copy(predSlice1, newPred1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pred, nil
+}
+
+func naiveBboxPred(boxes, bboxDelta *tensor.Dense) (*tensor.Dense, error) {
+	if boxes.Shape()[0] == 0 {
+		return tensor.New(
+			tensor.Of(tensor.Float32), tensor.WithShape(0, bboxDelta.Shape()[1]),
+		), nil
+	}
+
+	boxes0, err := boxes.Slice(nil, tensor.S(0))
+	if err != nil {
+		return nil, err
+	}
+	boxes00 := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(boxes0.Shape()...),
+	)
+	err = tensor.Copy(boxes00, boxes0)
+	if err != nil {
+		return nil, err
+	}
+
+	boxes1, err := boxes.Slice(nil, tensor.S(1))
+	if err != nil {
+		return nil, err
+	}
+	boxes11 := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(boxes1.Shape()...),
+	)
+	err = tensor.Copy(boxes11, boxes1)
+	if err != nil {
+		return nil, err
+	}
+
+	boxes2, err := boxes.Slice(nil, tensor.S(2))
+	if err != nil {
+		return nil, err
+	}
+	boxes22 := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(boxes2.Shape()...),
+	)
+	err = tensor.Copy(boxes22, boxes2)
+	if err != nil {
+		return nil, err
+	}
+
+	boxes3, err := boxes.Slice(nil, tensor.S(3))
+	if err != nil {
+		return nil, err
+	}
+	boxes33 := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(boxes3.Shape()...),
+	)
+	err = tensor.Copy(boxes33, boxes3)
+	if err != nil {
+		return nil, err
+	}
+
+	// widths
+	widths, err := boxes22.Sub(boxes00)
+	if err != nil {
+		return nil, err
+	}
+	widths, err = widths.AddScalar(float32(1.0), true)
+	if err != nil {
+		return nil, err
+	}
+
+	// heights
+	heights, err := boxes33.Sub(boxes11)
+	if err != nil {
+		return nil, err
+	}
+	heights, err = heights.AddScalar(float32(1.0), true)
+	if err != nil {
+		return nil, err
+	}
+
+	// centerX
+	scaledWidth, err := widths.Apply(func(x float32) float32 {
+		return 0.5 * (x - 1)
+	})
+
+	centerX, err := boxes00.Add(scaledWidth.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+
+	// centerY
+	scaledHeight, err := heights.Apply(func(x float32) float32 {
+		return 0.5 * (x - 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	centerY, err := boxes11.Add(scaledHeight.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+
+	dx, err := bboxDelta.Slice(nil, tensor.S(0, 1))
+	if err != nil {
+		return nil, err
+	}
+	dy, err := bboxDelta.Slice(nil, tensor.S(1, 2))
+	if err != nil {
+		return nil, err
+	}
+	dw, err := bboxDelta.Slice(nil, tensor.S(2, 3))
+	if err != nil {
+		return nil, err
+	}
+	dh, err := bboxDelta.Slice(nil, tensor.S(3, 4))
+	if err != nil {
+		return nil, err
+	}
+
+	newWidthShape := []int{widths.Shape()[0], 1}
+	err = widths.Reshape(newWidthShape...)
+	if err != nil {
+		return nil, err
+	}
+
+	newHeightShape := []int{heights.Shape()[0], 1}
+	err = heights.Reshape(newHeightShape...)
+	if err != nil {
+		return nil, err
+	}
+
+	newCenterXShape := []int{centerX.Shape()[0], 1}
+	err = centerX.Reshape(newCenterXShape...)
+	if err != nil {
+		return nil, err
+	}
+
+	newCenterYShape := []int{centerY.Shape()[0], 1}
+	err = centerY.Reshape(newCenterYShape...)
+	if err != nil {
+		return nil, err
+	}
+
+	scaledWidths, err := widths.Mul(dx.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+	predCenterX, err := scaledWidths.Add(centerX)
+	if err != nil {
+		return nil, err
+	}
+
+	scaledHeighs, err := heights.Mul(dy.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+	predCenterY, err := scaledHeighs.Add(centerY)
+	if err != nil {
+		return nil, err
+	}
+
+	expDw, err := dw.(*tensor.Dense).Apply(func(x float32) float32 {
+		return float32(math.Exp(float64(x)))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	expDh, err := dh.(*tensor.Dense).Apply(func(x float32) float32 {
+		return float32(math.Exp(float64(x)))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	predW, err := expDw.(*tensor.Dense).Mul(widths)
+	if err != nil {
+		return nil, err
+	}
+
+	predH, err := expDh.(*tensor.Dense).Mul(heights)
+	if err != nil {
+		return nil, err
+	}
+
+	predBoxes := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(bboxDelta.Shape()...),
+	)
+
+	predBox01, err := predBoxes.Slice(nil, tensor.S(0))
+	if err != nil {
+		return nil, err
+	}
+
+	subPredW, err := predW.Apply(func(x float32) float32 {
+		return (x - 1) * 0.5
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	subPredH, err := predH.Apply(func(x float32) float32 {
+		return (x - 1) * 0.5
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	newPredBox01, err := predCenterX.Sub(subPredW.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tensor.Copy(predBox01, newPredBox01)
+	if err != nil {
+		return nil, err
+	}
+
+	predBox12, err := predBoxes.Slice(nil, tensor.S(1))
+	if err != nil {
+		return nil, err
+	}
+	newPredBox12, err := predCenterY.Sub(subPredH.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tensor.Copy(predBox12, newPredBox12)
+	if err != nil {
+		return nil, err
+	}
+
+	predBox23, err := predBoxes.Slice(nil, tensor.S(2))
+	if err != nil {
+		return nil, err
+	}
+	newPredBox23, err := predCenterX.Add(subPredW.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tensor.Copy(predBox23, newPredBox23)
+	if err != nil {
+		return nil, err
+	}
+
+	predBox34, err := predBoxes.Slice(nil, tensor.S(3))
+	if err != nil {
+		return nil, err
+	}
+
+	newPredBox34, err := predCenterY.Add(subPredH.(*tensor.Dense))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tensor.Copy(predBox34, newPredBox34)
+	if err != nil {
+		return nil, err
+	}
+
+	if bboxDelta.Shape()[1] > 4 {
+		slicedPredBoxes, err := predBoxes.Slice(nil, tensor.S(4, predBoxes.Shape()[1]-1))
+		if err != nil {
+			return nil, err
+		}
+
+		slicedBBoxDelta, err := bboxDelta.Slice(nil, tensor.S(4, bboxDelta.Shape()[1]-1))
+		if err != nil {
+			return nil, err
+		}
+		err = tensor.Copy(slicedPredBoxes, slicedBBoxDelta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return predBoxes, nil
+}
@@ -1,106 +1,90 @@
 package modules
 
 import (
+	"context"
+	"fmt"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/processing"
 	"github.com/okieraised/go-faceid-pipeline/utils"
-	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/okieraised/go-triton-client/triton_proto"
 	"gocv.io/x/gocv"
 	"gorgonia.org/tensor"
 	"image"
-	"math"
 	"time"
 )
 
+// FaceExtractionClient computes the normalized embeddings of aligned faces. It is safe for concurrent use.
 type FaceExtractionClient struct {
-	tritonClient *gotritonclient.TritonGRPCClient
-	ModelParams  *config.ArcFaceRecognitionParams
-	ModelConfig  *triton_proto.ModelConfigResponse
-	imageSize    [2]int
-	timeout      time.Duration
-	batchSize    int
+	backend       inference.Backend
+	ModelParams   *config.ArcFaceRecognitionParams
+	ModelConfig   *triton_proto.ModelConfigResponse
+	imageSize     [2]int
+	timeout       time.Duration
+	batchSize     int
+	rawPixelInput bool
 }
 
-func NewFaceExtractionClient(tritonClient *gotritonclient.TritonGRPCClient, cfg *config.ArcFaceRecognitionParams) (*FaceExtractionClient, error) {
+func NewFaceExtractionClient(backend inference.Backend, cfg *config.ArcFaceRecognitionParams) (*FaceExtractionClient, error) {
 	client := &FaceExtractionClient{}
 	client.ModelParams = cfg
 
-	inferenceConfig, err := tritonClient.GetModelConfiguration(cfg.Timeout, cfg.ModelName, "")
+	inferenceConfig, err := backend.GetModelConfiguration(cfg.Timeout, cfg.ModelName, cfg.ModelVersion)
 	if err != nil {
 		return nil, err
 	}
-	client.tritonClient = tritonClient
+	client.backend = backend
 	client.ModelConfig = inferenceConfig
+	client.rawPixelInput = isRawPixelInput(inferenceConfig)
 	client.imageSize = cfg.ImageSize
 	client.batchSize = cfg.BatchSize
 
 	return client, nil
 }
 
-func (c *FaceExtractionClient) Infer(imgs []gocv.Mat) ([]*tensor.Dense, error) {
-	preprocessedImages, err := c.preprocess(imgs)
-	if err != nil {
-		return nil, err
+// Infer returns the L2 normalized embedding of each aligned face in imgs, in input order. The faces are sent in
+// batches of BatchSize.
+func (c *FaceExtractionClient) Infer(ctx context.Context, imgs []gocv.Mat) ([]*tensor.Dense, error) {
+	if len(imgs) == 0 {
+		return []*tensor.Dense{}, nil
+	}
+	inputs := c.ModelConfig.GetConfig().GetInput()
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("model %s has no inputs", c.ModelParams.ModelName)
 	}
 
-	outputs := make([][]*tensor.Dense, 0)
-
-	for i := 0; i < preprocessedImages.Shape()[0]; i += c.batchSize {
-		batch, err := preprocessedImages.Slice(tensor.S(i, i+c.batchSize), nil, nil, nil)
-		if err != nil {
-			return nil, err
-		}
-		modelRequest := &triton_proto.ModelInferRequest{
-			ModelName: c.ModelParams.ModelName,
-		}
-
-		modelInputs := make([]*triton_proto.ModelInferRequest_InferInputTensor, 0)
-		for _, inputCfg := range c.ModelConfig.Config.Input {
-			modelInput := &triton_proto.ModelInferRequest_InferInputTensor{
-				Name:     inputCfg.Name,
-				Datatype: inputCfg.DataType.String()[5:],
-				Shape:    inputCfg.Dims,
-				Contents: &triton_proto.InferTensorContents{
-					Fp32Contents: batch.(*tensor.Dense).Float32s(),
-				},
-			}
-			modelInputs = append(modelInputs, modelInput)
-		}
+	buffers := newScratch()
+	defer buffers.release()
 
-		modelRequest.Inputs = modelInputs
-		inferResp, err := c.tritonClient.ModelGRPCInfer(c.ModelParams.Timeout, modelRequest)
-		if err != nil {
-			return nil, err
-		}
+	preprocessedImages, err := c.preprocess(ctx, imgs, buffers)
+	if err != nil {
+		return nil, err
+	}
 
-		netOut := make([]*tensor.Dense, 0)
-		for idx, out := range inferResp.Outputs {
-			outShape := make([]int, 0)
-			for _, shape := range out.Shape {
-				outShape = append(outShape, int(shape))
-			}
-			outTensors := tensor.New(
-				tensor.Of(tensor.Float32),
-				tensor.WithShape(outShape...),
-				tensor.WithBacking(utils.BytesToT32[float32](inferResp.RawOutputContents[idx])),
-			)
-			netOut = append(netOut, outTensors)
-		}
-		outputs = append(outputs, netOut)
+	model := &batchedModel{
+		backend:      c.backend,
+		timeout:      c.ModelParams.Timeout,
+		modelName:    c.ModelParams.ModelName,
+		modelVersion: c.ModelParams.ModelVersion,
+		input:        inputs[0],
+		batchSize:    c.batchSize,
+		buffers:      buffers,
+	}
+	embeddings, err := model.infer(ctx, preprocessedImages.Float32s(), len(imgs))
+	if err != nil {
+		return nil, err
 	}
-	normalizedOutputs := make([]*tensor.Dense, 0)
-	for i, o := range outputs {
-		slice, err := o[0].Slice(tensor.S(i))
-		if err != nil {
-			return nil, err
-		}
 
-		norm, err := utils.L2Norm(slice.(*tensor.Dense))
+	// The embeddings are pooled, the normalized outputs are new tensors.
+	normalizedOutputs := make([]*tensor.Dense, 0, len(embeddings))
+	for _, embedding := range embeddings {
+		output := tensor.New(tensor.WithShape(len(embedding)), tensor.WithBacking(embedding))
+		norm, err := utils.L2Norm(output)
 		if err != nil {
 			return nil, err
 		}
 
-		apply, err := slice.(*tensor.Dense).Apply(func(x float32) float32 {
+		apply, err := output.Apply(func(x float32) float32 {
 			return x / float32(norm)
 		})
 		if err != nil {
@@ -112,49 +96,33 @@ func (c *FaceExtractionClient) Infer(imgs []gocv.Mat) ([]*tensor.Dense, error) {
 	return normalizedOutputs, nil
 }
 
-func (c *FaceExtractionClient) preprocess(imgs []gocv.Mat) (*tensor.Dense, error) {
-	batchInputSize := int(math.Ceil(math.Max(math.Ceil(float64(len(imgs)/c.batchSize)), 1) * float64(c.batchSize)))
-
+func (c *FaceExtractionClient) preprocess(ctx context.Context, imgs []gocv.Mat, buffers *scratch) (*tensor.Dense, error) {
+	imageValues := 3 * c.imageSize[0] * c.imageSize[1]
 	preprocessedImages := tensor.New(
-		tensor.Of(tensor.Float32),
-		tensor.WithShape(batchInputSize, 3, c.imageSize[1], c.imageSize[0]),
+		tensor.WithShape(len(imgs), 3, c.imageSize[1], c.imageSize[0]),
+		tensor.WithBacking(buffers.float32Buffer(len(imgs)*imageValues)),
 	)
 
-	for i, img := range imgs {
-		resizedImg := gocv.NewMat()
-		gocv.Resize(img, &resizedImg, image.Point{X: c.imageSize[0], Y: c.imageSize[1]}, 0, 0, gocv.InterpolationLinear)
-		rgbImg := gocv.NewMat()
-		gocv.CvtColor(resizedImg, &rgbImg, gocv.ColorBGRToRGB)
-		_ = resizedImg.Close()
-
-		imgShape := rgbImg.Size()
-		imgTensors := tensor.New(
-			tensor.Of(tensor.Float32),
-			tensor.WithShape(imgShape[0], imgShape[1], 3),
-		)
-
-		for z := range 3 {
-			for y := range imgShape[0] {
-				for x := range imgShape[1] {
-					err := imgTensors.SetAt((float32(rgbImg.GetVecbAt(y, x)[z])-127.5)*0.0078125, y, x, z)
-					if err != nil {
-						return nil, err
-					}
-				}
-			}
-		}
-		_ = rgbImg.Close()
+	blobParams := processing.BlobParams{
+		SwapRB: true,
+		Mean:   [3]float32{127.5, 127.5, 127.5},
+		Scale:  [3]float32{0.0078125, 0.0078125, 0.0078125},
+	}
+	if c.rawPixelInput {
+		blobParams = processing.RawBlobParams
+		blobParams.SwapRB = true
+	}
 
-		err := imgTensors.T(2, 0, 1)
-		if err != nil {
-			return nil, err
-		}
-		preprocessedSlice, err := preprocessedImages.Slice(tensor.S(i))
+	data := preprocessedImages.Float32s()
+	resizedImg := buffers.mat(c.imageSize[1], c.imageSize[0], gocv.MatTypeCV8UC3)
+	for i, img := range imgs {
+		err := ctx.Err()
 		if err != nil {
 			return nil, err
 		}
 
-		err = tensor.Copy(preprocessedSlice, imgTensors)
+		gocv.Resize(img, &resizedImg, image.Point{X: c.imageSize[0], Y: c.imageSize[1]}, 0, 0, gocv.InterpolationLinear)
+		err = processing.BlobFromImage(resizedImg, data[i*imageValues:(i+1)*imageValues], blobParams)
 		if err != nil {
 			return nil, err
 		}
@@ -162,3 +130,17 @@ func (c *FaceExtractionClient) preprocess(imgs []gocv.Mat) (*tensor.Dense, error
 
 	return preprocessedImages, nil
 }
+
+// Ready returns an error unless the recognition model is ready on the backend.
+func (c *FaceExtractionClient) Ready() error {
+	return modelReady(c.backend, c.ModelParams.Timeout, c.ModelParams.ModelName, c.ModelParams.ModelVersion)
+}
+
+// Validate checks that the model takes a batch of 3 channel images of ImageSize and returns one embedding per image.
+func (c *FaceExtractionClient) Validate() error {
+	err := validateImageInput(c.ModelConfig, c.batchSize, c.imageSize)
+	if err != nil {
+		return err
+	}
+	return validateOutputs(c.ModelConfig, 1, 2, false)
+}
@@ -1,19 +1,27 @@
 package modules
 
 import (
+	"context"
 	"fmt"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/tritontest"
 	"github.com/okieraised/go-faceid-pipeline/utils"
 	gotritonclient "github.com/okieraised/go-triton-client"
+	"github.com/okieraised/go-triton-client/triton_proto"
 	"github.com/stretchr/testify/assert"
 	"gocv.io/x/gocv"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
+	"math"
 	"testing"
+	"time"
 )
 
 func TestNewFaceExtractionClient_Single(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -24,10 +32,10 @@ func TestNewFaceExtractionClient_Single(t *testing.T) {
 	img, err := genTestDataSingleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -39,14 +47,14 @@ func TestNewFaceExtractionClient_Single(t *testing.T) {
 	alignedImg, err := alignClient.Infer(*img, selectedFaceBox, selectedFacePoint)
 	assert.NoError(t, err)
 
-	qualityClient, err := NewFaceQualityClient(tritonClient, config.DefaultFaceQualityParams)
+	qualityClient, err := NewFaceQualityClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultFaceQualityParams)
 	assert.NoError(t, err)
-	_, _, err = qualityClient.Infer([]gocv.Mat{*alignedImg})
+	_, _, err = qualityClient.Infer(context.Background(), []gocv.Mat{*alignedImg})
 	assert.NoError(t, err)
 
-	extractClient, err := NewFaceExtractionClient(tritonClient, config.DefaultArcFaceRecognitionParams)
+	extractClient, err := NewFaceExtractionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultArcFaceRecognitionParams)
 	assert.NoError(t, err)
-	facialFeatures, err := extractClient.Infer([]gocv.Mat{*alignedImg})
+	facialFeatures, err := extractClient.Infer(context.Background(), []gocv.Mat{*alignedImg})
 	assert.NoError(t, err)
 
 	fmt.Println("facialFeatures", facialFeatures[0].Len(), facialFeatures[0].Float32s())
@@ -55,6 +63,8 @@ func TestNewFaceExtractionClient_Single(t *testing.T) {
 }
 
 func TestNewFaceExtractionClient_Multiple(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -65,10 +75,10 @@ func TestNewFaceExtractionClient_Multiple(t *testing.T) {
 	img, err := genTestDataMultipleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -80,14 +90,14 @@ func TestNewFaceExtractionClient_Multiple(t *testing.T) {
 	alignedImg, err := alignClient.Infer(*img, selectedFaceBox, selectedFacePoint)
 	assert.NoError(t, err)
 
-	qualityClient, err := NewFaceQualityClient(tritonClient, config.DefaultFaceQualityParams)
+	qualityClient, err := NewFaceQualityClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultFaceQualityParams)
 	assert.NoError(t, err)
-	_, _, err = qualityClient.Infer([]gocv.Mat{*alignedImg})
+	_, _, err = qualityClient.Infer(context.Background(), []gocv.Mat{*alignedImg})
 	assert.NoError(t, err)
 
-	extractClient, err := NewFaceExtractionClient(tritonClient, config.DefaultArcFaceRecognitionParams)
+	extractClient, err := NewFaceExtractionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultArcFaceRecognitionParams)
 	assert.NoError(t, err)
-	facialFeatures, err := extractClient.Infer([]gocv.Mat{*alignedImg})
+	facialFeatures, err := extractClient.Infer(context.Background(), []gocv.Mat{*alignedImg})
 	assert.NoError(t, err)
 
 	fmt.Println("facialFeatures", facialFeatures)
@@ -95,3 +105,112 @@ func TestNewFaceExtractionClient_Multiple(t *testing.T) {
 	alignedImg.Close()
 
 }
+
+func TestFaceExtractionClient_Infer(t *testing.T) {
+	server, backend := newTestBackend(t)
+
+	client, err := NewFaceExtractionClient(backend, config.DefaultArcFaceRecognitionParams)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Validate())
+
+	face := newTestImage(112, 112)
+	defer face.Close()
+
+	features, err := client.Infer(context.Background(), []gocv.Mat{face})
+	assert.NoError(t, err)
+	assert.Len(t, features, 1)
+
+	expected := tritontest.ArcFaceFeatures()
+	norm := float32(0)
+	for _, v := range expected {
+		norm += v * v
+	}
+	for i := range expected {
+		expected[i] /= float32(math.Sqrt(float64(norm)))
+	}
+	assert.InDeltaSlice(t, expected, features[0].Float32s(), 1e-6)
+	assert.Equal(t, []int64{1, 3, 112, 112}, server.Requests()[0].Inputs[0].Shape)
+}
+
+// rowModel returns an image model whose output for each batch element is computed by output from the first value
+// of the element. A batchDim of -1 makes the batch dimension dynamic.
+func rowModel(name string, imageSize [2]int, batchDim int64, outputDim int64, output func(first float32) []float32) *tritontest.Model {
+	return &tritontest.Model{
+		Config: &triton_proto.ModelConfig{
+			Name: name,
+			Input: []*triton_proto.ModelInput{
+				{Name: "data", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{batchDim, 3, int64(imageSize[1]), int64(imageSize[0])}},
+			},
+			Output: []*triton_proto.ModelOutput{
+				{Name: "output", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{batchDim, outputDim}},
+			},
+		},
+		Infer: func(request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+			data := utils.BytesToT32[float32](request.RawInputContents[0])
+			rows := int(request.Inputs[0].Shape[0])
+			values := make([]float32, 0, rows*int(outputDim))
+			for i := range rows {
+				values = append(values, output(data[i*len(data)/rows])...)
+			}
+			return &triton_proto.ModelInferResponse{
+				Outputs: []*triton_proto.ModelInferResponse_InferOutputTensor{
+					{Name: "output", Datatype: "FP32", Shape: []int64{int64(rows), outputDim}},
+				},
+				RawOutputContents: [][]byte{append([]byte(nil), utils.TToBytes(values)...)},
+			}, nil
+		},
+	}
+}
+
+func TestFaceExtractionClient_InferBatches(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		batchDim  int64
+		batchSize int
+		batches   []int64
+	}{
+		{name: "fixed batch", batchDim: 2, batchSize: 2, batches: []int64{2, 2, 2}},
+		{name: "dynamic batch", batchDim: -1, batchSize: 2, batches: []int64{2, 2, 1}},
+		// The fixed batch dimension of the model wins over BatchSize.
+		{name: "fixed batch smaller than BatchSize", batchDim: 1, batchSize: 4, batches: []int64{1, 1, 1, 1, 1}},
+		{name: "fixed batch larger than BatchSize", batchDim: 8, batchSize: 4, batches: []int64{8}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.NewArcFaceRecognitionParams("face_identification", time.Second, [2]int{112, 112}, tc.batchSize)
+			server := tritontest.NewServer(rowModel(cfg.ModelName, cfg.ImageSize, tc.batchDim, 4, func(first float32) []float32 {
+				return []float32{first, 1, 0, 0}
+			}))
+			defer server.Close()
+			backend, err := server.Backend()
+			assert.NoError(t, err)
+
+			client, err := NewFaceExtractionClient(backend, cfg)
+			assert.NoError(t, err)
+			if tc.batchDim == -1 || tc.batchDim == int64(tc.batchSize) {
+				assert.NoError(t, client.Validate())
+			}
+
+			faces := make([]gocv.Mat, 0, 5)
+			for k := range 5 {
+				face := gocv.NewMatWithSizesWithScalar([]int{112, 112}, gocv.MatTypeCV8UC3, gocv.NewScalar(float64(40*k), float64(40*k), float64(40*k), 0))
+				defer face.Close()
+				faces = append(faces, face)
+			}
+
+			features, err := client.Infer(context.Background(), faces)
+			assert.NoError(t, err)
+			assert.Len(t, features, len(faces))
+			for k, feature := range features {
+				v := (float64(40*k) - 127.5) * 0.0078125
+				norm := math.Sqrt(v*v + 1)
+				assert.InDeltaSlice(t, []float32{float32(v / norm), float32(1 / norm), 0, 0}, feature.Float32s(), 1e-6)
+			}
+
+			batches := make([]int64, 0)
+			for _, req := range server.Requests() {
+				batches = append(batches, req.Inputs[0].Shape[0])
+			}
+			assert.Equal(t, tc.batches, batches)
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package modules
 
 import (
+	"context"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/processing"
 	"github.com/okieraised/go-faceid-pipeline/utils"
-	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/okieraised/go-triton-client/triton_proto"
 	"gocv.io/x/gocv"
 	"gorgonia.org/tensor"
@@ -11,26 +13,30 @@ import (
 	"time"
 )
 
+// FaceQualityClient classifies aligned faces as good, bad, wearing a mask or sunglasses. It is safe for concurrent
+// use.
 type FaceQualityClient struct {
-	tritonClient *gotritonclient.TritonGRPCClient
-	ModelParams  *config.FaceQualityParams
-	ModelConfig  *triton_proto.ModelConfigResponse
-	imageSize    [2]int
-	timeout      time.Duration
-	batchSize    int
-	threshold    float32
+	backend       inference.Backend
+	ModelParams   *config.FaceQualityParams
+	ModelConfig   *triton_proto.ModelConfigResponse
+	imageSize     [2]int
+	timeout       time.Duration
+	batchSize     int
+	threshold     float32
+	rawPixelInput bool
 }
 
-func NewFaceQualityClient(tritonClient *gotritonclient.TritonGRPCClient, cfg *config.FaceQualityParams) (*FaceQualityClient, error) {
+func NewFaceQualityClient(backend inference.Backend, cfg *config.FaceQualityParams) (*FaceQualityClient, error) {
 	client := &FaceQualityClient{}
 	client.ModelParams = cfg
 
-	inferenceConfig, err := tritonClient.GetModelConfiguration(cfg.Timeout, cfg.ModelName, "")
+	inferenceConfig, err := backend.GetModelConfiguration(cfg.Timeout, cfg.ModelName, cfg.ModelVersion)
 	if err != nil {
 		return nil, err
 	}
-	client.tritonClient = tritonClient
+	client.backend = backend
 	client.ModelConfig = inferenceConfig
+	client.rawPixelInput = isRawPixelInput(inferenceConfig)
 	client.imageSize = cfg.ImageSize
 	client.batchSize = cfg.BatchSize
 	client.threshold = cfg.Threshold
@@ -38,79 +44,50 @@ func NewFaceQualityClient(tritonClient *gotritonclient.TritonGRPCClient, cfg *co
 	return client, nil
 }
 
-func (c *FaceQualityClient) Infer(imgs []gocv.Mat) ([]float32, []int, error) {
+func (c *FaceQualityClient) Infer(ctx context.Context, imgs []gocv.Mat) ([]float32, []int, error) {
 
 	batchSize := len(imgs)
 	scores := make([]float32, 0)
 	idxs := make([]int, 0)
 
-	means := []float32{123.675, 116.28, 103.53}
-	std := []float32{0.01712475, 0.017507, 0.01742919}
+	buffers := newScratch()
+	defer buffers.release()
 
 	for i := range batchSize {
-		resizedImg := gocv.NewMat()
-		gocv.Resize(imgs[i], &resizedImg, image.Point{X: c.imageSize[0], Y: c.imageSize[1]}, 0, 0, gocv.InterpolationLinear)
-		rgbImg := gocv.NewMat()
-		gocv.CvtColor(resizedImg, &rgbImg, gocv.ColorBGRToRGB)
-		_ = resizedImg.Close()
-
-		imgShape := rgbImg.Size()
-		imgTensors := tensor.New(
-			tensor.Of(tensor.Float32),
-			tensor.WithShape(1, 3, imgShape[0], imgShape[1]),
-		)
-
-		for z := range 3 {
-			for y := range imgShape[0] {
-				for x := range imgShape[1] {
-					err := imgTensors.SetAt((float32(rgbImg.GetVecbAt(y, x)[z])-means[z])*std[z], 0, z, y, x)
-					if err != nil {
-						return scores, idxs, err
-					}
-				}
-			}
+		err := ctx.Err()
+		if err != nil {
+			return scores, idxs, err
 		}
-		_ = rgbImg.Close()
 
-		err := imgTensors.T(0, 3, 1, 2)
+		imgTensors, err := c.preprocess(imgs[i], buffers)
 		if err != nil {
 			return scores, idxs, err
 		}
 
 		modelRequest := &triton_proto.ModelInferRequest{
-			ModelName: c.ModelParams.ModelName,
+			ModelName:    c.ModelParams.ModelName,
+			ModelVersion: c.ModelParams.ModelVersion,
 		}
 
-		modelInputs := make([]*triton_proto.ModelInferRequest_InferInputTensor, 0)
 		for _, inputCfg := range c.ModelConfig.Config.Input {
-			modelInput := &triton_proto.ModelInferRequest_InferInputTensor{
-				Name:     inputCfg.Name,
-				Datatype: inputCfg.DataType.String()[5:],
-				Shape:    inputCfg.Dims,
-				Contents: &triton_proto.InferTensorContents{
-					Fp32Contents: imgTensors.Float32s(),
-				},
+			modelInput, rawInput, err := encodeInput(inputCfg, batchShape(inputCfg.Dims, 1), imgTensors.Float32s(), buffers)
+			if err != nil {
+				return scores, idxs, err
 			}
-			modelInputs = append(modelInputs, modelInput)
+			modelRequest.Inputs = append(modelRequest.Inputs, modelInput)
+			modelRequest.RawInputContents = append(modelRequest.RawInputContents, rawInput)
 		}
 
-		modelRequest.Inputs = modelInputs
-		inferResp, err := c.tritonClient.ModelGRPCInfer(c.ModelParams.Timeout, modelRequest)
+		inferResp, err := modelInfer(ctx, c.backend, c.ModelParams.Timeout, modelRequest)
 		if err != nil {
 			return scores, idxs, err
 		}
 
-		outShape := make([]int, 0)
-		for _, shape := range inferResp.Outputs[0].Shape {
-			outShape = append(outShape, int(shape))
+		outTensors, err := decodeOutput(inferResp.Outputs[0], inferResp.RawOutputContents[0], buffers)
+		if err != nil {
+			return scores, idxs, err
 		}
 
-		outTensors := tensor.New(
-			tensor.Of(tensor.Float32),
-			tensor.WithShape(outShape...),
-			tensor.WithBacking(utils.BytesToT32[float32](inferResp.RawOutputContents[0])),
-		)
-
 		predict, err := utils.ArgMax(outTensors)
 		if err != nil {
 			return scores, idxs, err
@@ -127,3 +104,44 @@ func (c *FaceQualityClient) Infer(imgs []gocv.Mat) ([]float32, []int, error) {
 
 	return scores, idxs, nil
 }
+
+// preprocess resizes img to ImageSize and converts it into a (1, 3, height, width) RGB tensor taken from buffers.
+func (c *FaceQualityClient) preprocess(img gocv.Mat, buffers *scratch) (*tensor.Dense, error) {
+	resizedImg := buffers.mat(c.imageSize[1], c.imageSize[0], gocv.MatTypeCV8UC3)
+	gocv.Resize(img, &resizedImg, image.Point{X: c.imageSize[0], Y: c.imageSize[1]}, 0, 0, gocv.InterpolationLinear)
+
+	imgShape := resizedImg.Size()
+	imgTensors := tensor.New(
+		tensor.WithShape(1, 3, imgShape[0], imgShape[1]),
+		tensor.WithBacking(buffers.float32Buffer(3*imgShape[0]*imgShape[1])),
+	)
+
+	blobParams := processing.BlobParams{
+		SwapRB: true,
+		Mean:   [3]float32{123.675, 116.28, 103.53},
+		Scale:  [3]float32{0.01712475, 0.017507, 0.01742919},
+	}
+	if c.rawPixelInput {
+		blobParams = processing.RawBlobParams
+		blobParams.SwapRB = true
+	}
+	err := processing.BlobFromImage(resizedImg, imgTensors.Float32s(), blobParams)
+	if err != nil {
+		return nil, err
+	}
+	return imgTensors, nil
+}
+
+// Ready returns an error unless the quality model is ready on the backend.
+func (c *FaceQualityClient) Ready() error {
+	return modelReady(c.backend, c.ModelParams.Timeout, c.ModelParams.ModelName, c.ModelParams.ModelVersion)
+}
+
+// Validate checks that the model takes a single 3 channel image of ImageSize and returns the class scores.
+func (c *FaceQualityClient) Validate() error {
+	err := validateImageInput(c.ModelConfig, 1, c.imageSize)
+	if err != nil {
+		return err
+	}
+	return validateOutputs(c.ModelConfig, 1, 0, false)
+}
@@ -1,9 +1,10 @@
 package modules
 
 import (
+	"context"
 	"github.com/okieraised/go-faceid-pipeline/config"
-	"github.com/okieraised/go-faceid-pipeline/utils"
-	gotritonclient "github.com/okieraised/go-triton-client"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/processing"
 	"github.com/okieraised/go-triton-client/triton_proto"
 	"gocv.io/x/gocv"
 	"gorgonia.org/tensor"
@@ -11,28 +12,31 @@ import (
 	"time"
 )
 
+// FaceQualityAssessmentClient scores the quality of aligned faces against a threshold. It is safe for concurrent use.
 type FaceQualityAssessmentClient struct {
-	tritonClient *gotritonclient.TritonGRPCClient
-	ModelParams  *config.FaceQualityAssessmentParams
-	ModelConfig  *triton_proto.ModelConfigResponse
-	timeout      time.Duration
-	modelName    string
-	threshold    float32
-	imageSize    [2]int
-	batchSize    int
+	backend       inference.Backend
+	ModelParams   *config.FaceQualityAssessmentParams
+	ModelConfig   *triton_proto.ModelConfigResponse
+	timeout       time.Duration
+	modelName     string
+	threshold     float32
+	imageSize     [2]int
+	batchSize     int
+	rawPixelInput bool
 }
 
-func NewFaceQualityAssessmentClient(tritonClient *gotritonclient.TritonGRPCClient, cfg *config.FaceQualityAssessmentParams) (*FaceQualityAssessmentClient, error) {
+func NewFaceQualityAssessmentClient(backend inference.Backend, cfg *config.FaceQualityAssessmentParams) (*FaceQualityAssessmentClient, error) {
 	client := &FaceQualityAssessmentClient{}
 
-	inferenceConfig, err := tritonClient.GetModelConfiguration(cfg.Timeout, cfg.ModelName, "")
+	inferenceConfig, err := backend.GetModelConfiguration(cfg.Timeout, cfg.ModelName, cfg.ModelVersion)
 	if err != nil {
 		return nil, err
 	}
 
 	client.ModelParams = cfg
-	client.tritonClient = tritonClient
+	client.backend = backend
 	client.ModelConfig = inferenceConfig
+	client.rawPixelInput = isRawPixelInput(inferenceConfig)
 	client.timeout = cfg.Timeout
 	client.modelName = cfg.ModelName
 	client.threshold = cfg.Threshold
@@ -42,49 +46,48 @@ func NewFaceQualityAssessmentClient(tritonClient *gotritonclient.TritonGRPCClien
 	return client, nil
 }
 
-func (c *FaceQualityAssessmentClient) Infer(imgs []gocv.Mat) ([]float32, []int, error) {
+func (c *FaceQualityAssessmentClient) Infer(ctx context.Context, imgs []gocv.Mat) ([]float32, []int, error) {
 
 	idxs := make([]int, 0)
 	scores := make([]float32, 0)
+
+	buffers := newScratch()
+	defer buffers.release()
+
 	for idx := range len(imgs) {
-		imgTensors, err := c.preprocess(imgs[idx])
+		err := ctx.Err()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		imgTensors, err := c.preprocess(imgs[idx], buffers)
 		if err != nil {
 			return nil, nil, err
 		}
 
 		modelRequest := &triton_proto.ModelInferRequest{
-			ModelName: c.ModelParams.ModelName,
+			ModelName:    c.ModelParams.ModelName,
+			ModelVersion: c.ModelParams.ModelVersion,
 		}
 
-		modelInputs := make([]*triton_proto.ModelInferRequest_InferInputTensor, 0)
 		for _, inputCfg := range c.ModelConfig.Config.Input {
-			modelInput := &triton_proto.ModelInferRequest_InferInputTensor{
-				Name:     inputCfg.Name,
-				Datatype: inputCfg.DataType.String()[5:],
-				Shape:    inputCfg.Dims,
-				Contents: &triton_proto.InferTensorContents{
-					Fp32Contents: imgTensors.Float32s(),
-				},
+			modelInput, rawInput, err := encodeInput(inputCfg, batchShape(inputCfg.Dims, 1), imgTensors.Float32s(), buffers)
+			if err != nil {
+				return nil, nil, err
 			}
-			modelInputs = append(modelInputs, modelInput)
+			modelRequest.Inputs = append(modelRequest.Inputs, modelInput)
+			modelRequest.RawInputContents = append(modelRequest.RawInputContents, rawInput)
 		}
 
-		modelRequest.Inputs = modelInputs
-		inferResp, err := c.tritonClient.ModelGRPCInfer(c.ModelParams.Timeout, modelRequest)
+		inferResp, err := modelInfer(ctx, c.backend, c.ModelParams.Timeout, modelRequest)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		outShape := make([]int, 0)
-		for _, shape := range inferResp.Outputs[0].Shape {
-			outShape = append(outShape, int(shape))
+		outTensors, err := decodeOutput(inferResp.Outputs[0], inferResp.RawOutputContents[0], buffers)
+		if err != nil {
+			return nil, nil, err
 		}
-
-		outTensors := tensor.New(
-			tensor.Of(tensor.Float32),
-			tensor.WithShape(outShape...),
-			tensor.WithBacking(utils.BytesToT32[float32](inferResp.RawOutputContents[0])),
-		)
 		score, err := outTensors.At(0, 0)
 		if err != nil {
 			return nil, nil, err
@@ -99,47 +102,43 @@ func (c *FaceQualityAssessmentClient) Infer(imgs []gocv.Mat) ([]float32, []int,
 	return scores, idxs, nil
 }
 
-func (c *FaceQualityAssessmentClient) preprocess(img gocv.Mat) (*tensor.Dense, error) {
-	var err error
-
-	resizedImg := gocv.NewMat()
-	defer func() {
-		cErr := resizedImg.Close()
-		if cErr != nil && err == nil {
-			err = cErr
-		}
-	}()
-
+// preprocess returns the normalized input tensor of img, backed by buffers.
+func (c *FaceQualityAssessmentClient) preprocess(img gocv.Mat, buffers *scratch) (*tensor.Dense, error) {
+	resizedImg := buffers.mat(c.imageSize[1], c.imageSize[0], gocv.MatTypeCV8UC3)
 	gocv.Resize(img, &resizedImg, image.Point{X: c.imageSize[0], Y: c.imageSize[1]}, 0, 0, gocv.InterpolationLinear)
-	rgbImg := gocv.NewMat()
-	gocv.CvtColor(resizedImg, &rgbImg, gocv.ColorBGRToRGB)
-	defer func() {
-		cErr := rgbImg.Close()
-		if cErr != nil && err == nil {
-			err = cErr
-		}
-	}()
 
-	imgShape := rgbImg.Size()
+	imgShape := resizedImg.Size()
 	imgTensors := tensor.New(
-		tensor.Of(tensor.Float32),
 		tensor.WithShape(1, 3, imgShape[0], imgShape[1]),
+		tensor.WithBacking(buffers.float32Buffer(3*imgShape[0]*imgShape[1])),
 	)
 
-	for z := range 3 {
-		for y := range imgShape[0] {
-			for x := range imgShape[1] {
-				err = imgTensors.SetAt((float32(rgbImg.GetVecbAt(y, x)[z])-127.5)*0.00784313725, 0, z, y, x)
-				if err != nil {
-					return nil, err
-				}
-			}
-		}
+	blobParams := processing.BlobParams{
+		SwapRB: true,
+		Mean:   [3]float32{127.5, 127.5, 127.5},
+		Scale:  [3]float32{0.00784313725, 0.00784313725, 0.00784313725},
 	}
-
-	err = imgTensors.T(0, 3, 2, 1)
+	if c.rawPixelInput {
+		blobParams = processing.RawBlobParams
+		blobParams.SwapRB = true
+	}
+	err := processing.BlobFromImage(resizedImg, imgTensors.Float32s(), blobParams)
 	if err != nil {
 		return nil, err
 	}
 	return imgTensors, nil
 }
+
+// Ready returns an error unless the quality assessment model is ready on the backend.
+func (c *FaceQualityAssessmentClient) Ready() error {
+	return modelReady(c.backend, c.ModelParams.Timeout, c.ModelParams.ModelName, c.ModelParams.ModelVersion)
+}
+
+// Validate checks that the model takes a single 3 channel image of ImageSize and returns a [1, N] score.
+func (c *FaceQualityAssessmentClient) Validate() error {
+	err := validateImageInput(c.ModelConfig, 1, c.imageSize)
+	if err != nil {
+		return err
+	}
+	return validateOutputs(c.ModelConfig, 1, 2, false)
+}
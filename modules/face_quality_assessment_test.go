@@ -1,7 +1,9 @@
 package modules
 
 import (
+	"context"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
 	"github.com/okieraised/go-faceid-pipeline/utils"
 	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/stretchr/testify/assert"
@@ -14,6 +16,8 @@ import (
 )
 
 func TestNewFaceQualityAssessmentClient(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -24,10 +28,10 @@ func TestNewFaceQualityAssessmentClient(t *testing.T) {
 	img, err := genTestDataSingleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -47,10 +51,26 @@ func TestNewFaceQualityAssessmentClient(t *testing.T) {
 	alignedImg, err := alignClient.Infer(*img, selectedFaceBox, selectedFacePoint)
 	assert.NoError(t, err)
 
-	faceQualityAssessment, err := NewFaceQualityAssessmentClient(tritonClient, config.DefaultFaceQualityAssessmentParams)
+	faceQualityAssessment, err := NewFaceQualityAssessmentClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultFaceQualityAssessmentParams)
+	assert.NoError(t, err)
+
+	_, _, err = faceQualityAssessment.Infer(context.Background(), []gocv.Mat{*alignedImg})
 	assert.NoError(t, err)
 
-	_, _, err = faceQualityAssessment.Infer([]gocv.Mat{*alignedImg})
+}
+
+func TestFaceQualityAssessmentClient_Infer(t *testing.T) {
+	_, backend := newTestBackend(t)
+
+	client, err := NewFaceQualityAssessmentClient(backend, config.DefaultFaceQualityAssessmentParams)
 	assert.NoError(t, err)
+	assert.NoError(t, client.Validate())
 
+	face := newTestImage(112, 112)
+	defer face.Close()
+
+	scores, classes, err := client.Infer(context.Background(), []gocv.Mat{face})
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{80}, scores)
+	assert.Equal(t, []int{1}, classes)
 }
@@ -1,7 +1,9 @@
 package modules
 
 import (
+	"context"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
 	"github.com/okieraised/go-faceid-pipeline/utils"
 	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/stretchr/testify/assert"
@@ -13,6 +15,8 @@ import (
 )
 
 func TestNewFaceQualityClient_Single(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -23,10 +27,10 @@ func TestNewFaceQualityClient_Single(t *testing.T) {
 	img, err := genTestDataSingleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -38,15 +42,17 @@ func TestNewFaceQualityClient_Single(t *testing.T) {
 	alignedImg, err := alignClient.Infer(*img, selectedFaceBox, selectedFacePoint)
 	assert.NoError(t, err)
 
-	qualityClient, err := NewFaceQualityClient(tritonClient, config.DefaultFaceQualityParams)
+	qualityClient, err := NewFaceQualityClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultFaceQualityParams)
 	assert.NoError(t, err)
-	_, _, err = qualityClient.Infer([]gocv.Mat{*alignedImg})
+	_, _, err = qualityClient.Infer(context.Background(), []gocv.Mat{*alignedImg})
 	assert.NoError(t, err)
 
 	alignedImg.Close()
 }
 
 func TestNewFaceQualityClient_Multiple(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -57,10 +63,10 @@ func TestNewFaceQualityClient_Multiple(t *testing.T) {
 	img, err := genTestDataMultipleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -72,11 +78,27 @@ func TestNewFaceQualityClient_Multiple(t *testing.T) {
 	alignedImg, err := alignClient.Infer(*img, selectedFaceBox, selectedFacePoint)
 	assert.NoError(t, err)
 
-	qualityClient, err := NewFaceQualityClient(tritonClient, config.DefaultFaceQualityParams)
+	qualityClient, err := NewFaceQualityClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultFaceQualityParams)
 	assert.NoError(t, err)
-	_, _, err = qualityClient.Infer([]gocv.Mat{*alignedImg})
+	_, _, err = qualityClient.Infer(context.Background(), []gocv.Mat{*alignedImg})
 	assert.NoError(t, err)
 
 	alignedImg.Close()
 
 }
+
+func TestFaceQualityClient_Infer(t *testing.T) {
+	_, backend := newTestBackend(t)
+
+	client, err := NewFaceQualityClient(backend, config.DefaultFaceQualityParams)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Validate())
+
+	face := newTestImage(112, 112)
+	defer face.Close()
+
+	scores, classes, err := client.Infer(context.Background(), []gocv.Mat{face, face})
+	assert.NoError(t, err)
+	assert.InDeltaSlice(t, []float32{0.9, 0.9}, scores, 1e-6)
+	assert.Equal(t, []int{int(config.FaceQualityClassGood), int(config.FaceQualityClassGood)}, classes)
+}
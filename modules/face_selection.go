@@ -8,6 +8,8 @@ import (
 	"math"
 )
 
+// FaceSelectionClient picks the face to process among the detections. It only reads its params and is safe for
+// concurrent use.
 type FaceSelectionClient struct {
 	*config.FaceSelectionParams
 }
@@ -1,17 +1,22 @@
 package modules
 
 import (
+	"context"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
 	"github.com/okieraised/go-faceid-pipeline/utils"
 	gotritonclient "github.com/okieraised/go-triton-client"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
+	"image"
 	"testing"
 )
 
 func TestNewFaceSelectionClient_Single(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -22,10 +27,10 @@ func TestNewFaceSelectionClient_Single(t *testing.T) {
 	img, err := genTestDataSingleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -35,6 +40,8 @@ func TestNewFaceSelectionClient_Single(t *testing.T) {
 }
 
 func TestNewFaceSelectionClient_Multiple(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -45,10 +52,10 @@ func TestNewFaceSelectionClient_Multiple(t *testing.T) {
 	img, err := genTestDataMultipleFace()
 	assert.NoError(t, err)
 	defer img.Close()
-	detClient, err := NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	detClient, err := NewFaceDetectionClient(inference.NewTritonGRPCBackend(tritonClient), config.DefaultRetinaFaceDetectionParams)
 	assert.NoError(t, err)
 
-	det, kpss, err := detClient.Infer(*img)
+	det, kpss, err := detClient.Infer(context.Background(), *img)
 	assert.NoError(t, err)
 
 	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
@@ -56,3 +63,23 @@ func TestNewFaceSelectionClient_Multiple(t *testing.T) {
 	_, _, err = selectionClient.Infer(*img, det, kpss, utils.RefPointer(false))
 	assert.NoError(t, err)
 }
+
+func TestFaceSelectionClient_Infer(t *testing.T) {
+	_, backend := newTestBackend(t, image.Pt(10, 10))
+
+	detClient, err := NewFaceDetectionClient(backend, config.DefaultRetinaFaceDetectionParams)
+	assert.NoError(t, err)
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	det, kpss, err := detClient.Infer(context.Background(), img)
+	assert.NoError(t, err)
+
+	selectionClient := NewFaceSelectionClient(config.DefaultFaceSelectionParams)
+	selectedFaceBox, selectedFacePoint, err := selectionClient.Infer(img, det, kpss, utils.RefPointer(false))
+	assert.NoError(t, err)
+	assert.NotNil(t, selectedFaceBox)
+	assert.NotNil(t, selectedFacePoint)
+	assert.InDeltaSlice(t, []float32{72, 72, 583, 583}, selectedFaceBox.Float32s()[:4], 1e-3)
+}
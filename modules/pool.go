@@ -0,0 +1,74 @@
+package modules
+
+import (
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"gocv.io/x/gocv"
+)
+
+const (
+	// maxIdleMats is the number of idle Mats kept per shape.
+	maxIdleMats = 16
+	// maxIdleMatBytes bounds the memory of the idle Mats of every shape. The fixed model input shapes are reused by
+	// every call, while the Mats sized after input images are evicted once other shapes need the room.
+	maxIdleMatBytes = 64 << 20
+)
+
+// The pools are shared by every client so that buffers of the same shape are reused across modules and calls.
+var (
+	float32Buffers = utils.NewBufferPool[float32]()
+	byteBuffers    = utils.NewBufferPool[byte]()
+	matPool        = utils.NewMatPool(maxIdleMats, maxIdleMatBytes)
+)
+
+// scratch holds the pooled buffers and Mats used by a single call and returns all of them to their pools on
+// release. Nothing taken from a scratch may outlive the call: results are copied out before release.
+// The buffers of a nil scratch are allocated instead.
+type scratch struct {
+	float32s [][]float32
+	bytes    [][]byte
+	mats     []gocv.Mat
+}
+
+func newScratch() *scratch {
+	return &scratch{}
+}
+
+// float32Buffer returns a buffer of n values with undefined contents.
+func (s *scratch) float32Buffer(n int) []float32 {
+	if s == nil {
+		return make([]float32, n)
+	}
+	buf := float32Buffers.Get(n)
+	s.float32s = append(s.float32s, buf)
+	return buf
+}
+
+// byteBuffer returns a buffer of n bytes with undefined contents.
+func (s *scratch) byteBuffer(n int) []byte {
+	if s == nil {
+		return make([]byte, n)
+	}
+	buf := byteBuffers.Get(n)
+	s.bytes = append(s.bytes, buf)
+	return buf
+}
+
+// mat returns a Mat of rows x cols of matType with undefined contents. It must not be closed by the caller.
+func (s *scratch) mat(rows, cols int, matType gocv.MatType) gocv.Mat {
+	mat := matPool.Get(rows, cols, matType)
+	s.mats = append(s.mats, mat)
+	return mat
+}
+
+func (s *scratch) release() {
+	for _, buf := range s.float32s {
+		float32Buffers.Put(buf)
+	}
+	for _, buf := range s.bytes {
+		byteBuffers.Put(buf)
+	}
+	for _, mat := range s.mats {
+		matPool.Put(mat)
+	}
+	*s = scratch{}
+}
@@ -0,0 +1,354 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/tritontest"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+	"image"
+	"testing"
+)
+
+// The legacy functions are the per-pixel preprocessing of each module before the conversion from the Mat buffer,
+// kept to benchmark the modules against it.
+
+func legacyDetectionPreprocess(c *FaceDetectionClient, img gocv.Mat) (*tensor.Dense, float64, error) {
+	imgShape := img.Size()
+	imRatio := float64(imgShape[0]) / float64(imgShape[1])
+	modelRatio := float64(c.imageSize[1]) / float64(c.imageSize[0])
+
+	var newWidth, newHeight int
+
+	if imRatio > modelRatio {
+		newHeight = c.imageSize[1]
+		newWidth = int(float64(newHeight) / imRatio)
+	} else {
+		newWidth = c.imageSize[0]
+		newHeight = int(float64(newWidth) * imRatio)
+	}
+	detScale := float64(newHeight) / float64(imgShape[0])
+
+	resizedImg := gocv.NewMat()
+	defer resizedImg.Close()
+	gocv.Resize(img, &resizedImg, image.Point{X: newWidth, Y: newHeight}, 0.0, 0.0, gocv.InterpolationLinear)
+
+	detImg := gocv.NewMatWithSizesWithScalar([]int{c.imageSize[1], c.imageSize[0]}, gocv.MatTypeCV8UC3, gocv.NewScalar(0, 0, 0, 0))
+	defer detImg.Close()
+	roi := detImg.Region(image.Rect(0, 0, newWidth, newHeight))
+	defer roi.Close()
+	gocv.Resize(resizedImg, &roi, image.Point{X: roi.Size()[1], Y: roi.Size()[0]}, 0, 0, gocv.InterpolationLinear)
+
+	detShape := detImg.Size()
+	imgTensors := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(1, 3, detShape[0], detShape[1]),
+	)
+	for z := range 3 {
+		for y := range detShape[0] {
+			for x := range detShape[1] {
+				pixel := float32(detImg.GetVecbAt(y, x)[2-z])
+				if !c.rawPixelInput {
+					pixel = (pixel/c.pixelScale - c.pixelMeans[2-z]) / c.pixelStds[2-z]
+				}
+				err := imgTensors.SetAt(pixel, 0, z, y, x)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+	}
+	return imgTensors, detScale, nil
+}
+
+func legacyQualityPreprocess(c *FaceQualityClient, img gocv.Mat) (*tensor.Dense, error) {
+	means := []float32{123.675, 116.28, 103.53}
+	std := []float32{0.01712475, 0.017507, 0.01742919}
+
+	resizedImg := gocv.NewMat()
+	gocv.Resize(img, &resizedImg, image.Point{X: c.imageSize[0], Y: c.imageSize[1]}, 0, 0, gocv.InterpolationLinear)
+	rgbImg := gocv.NewMat()
+	defer rgbImg.Close()
+	gocv.CvtColor(resizedImg, &rgbImg, gocv.ColorBGRToRGB)
+	_ = resizedImg.Close()
+
+	imgShape := rgbImg.Size()
+	imgTensors := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(1, 3, imgShape[0], imgShape[1]),
+	)
+	for z := range 3 {
+		for y := range imgShape[0] {
+			for x := range imgShape[1] {
+				pixel := float32(rgbImg.GetVecbAt(y, x)[z])
+				if !c.rawPixelInput {
+					pixel = (pixel - means[z]) * std[z]
+				}
+				err := imgTensors.SetAt(pixel, 0, z, y, x)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	err := imgTensors.T(0, 3, 1, 2)
+	if err != nil {
+		return nil, err
+	}
+	return imgTensors, nil
+}
+
+func legacyQualityAssessmentPreprocess(c *FaceQualityAssessmentClient, img gocv.Mat) (*tensor.Dense, error) {
+	resizedImg := gocv.NewMat()
+	defer resizedImg.Close()
+	gocv.Resize(img, &resizedImg, image.Point{X: c.imageSize[0], Y: c.imageSize[1]}, 0, 0, gocv.InterpolationLinear)
+	rgbImg := gocv.NewMat()
+	defer rgbImg.Close()
+	gocv.CvtColor(resizedImg, &rgbImg, gocv.ColorBGRToRGB)
+
+	imgShape := rgbImg.Size()
+	imgTensors := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(1, 3, imgShape[0], imgShape[1]),
+	)
+	for z := range 3 {
+		for y := range imgShape[0] {
+			for x := range imgShape[1] {
+				pixel := float32(rgbImg.GetVecbAt(y, x)[z])
+				if !c.rawPixelInput {
+					pixel = (pixel - 127.5) * 0.00784313725
+				}
+				err := imgTensors.SetAt(pixel, 0, z, y, x)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	err := imgTensors.T(0, 3, 2, 1)
+	if err != nil {
+		return nil, err
+	}
+	return imgTensors, nil
+}
+
+func legacyExtractionPreprocess(c *FaceExtractionClient, imgs []gocv.Mat) (*tensor.Dense, error) {
+	preprocessedImages := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(len(imgs), 3, c.imageSize[1], c.imageSize[0]),
+	)
+
+	for i, img := range imgs {
+		resizedImg := gocv.NewMat()
+		gocv.Resize(img, &resizedImg, image.Point{X: c.imageSize[0], Y: c.imageSize[1]}, 0, 0, gocv.InterpolationLinear)
+		rgbImg := gocv.NewMat()
+		gocv.CvtColor(resizedImg, &rgbImg, gocv.ColorBGRToRGB)
+		_ = resizedImg.Close()
+
+		imgShape := rgbImg.Size()
+		imgTensors := tensor.New(
+			tensor.Of(tensor.Float32),
+			tensor.WithShape(imgShape[0], imgShape[1], 3),
+		)
+		for z := range 3 {
+			for y := range imgShape[0] {
+				for x := range imgShape[1] {
+					pixel := float32(rgbImg.GetVecbAt(y, x)[z])
+					if !c.rawPixelInput {
+						pixel = (pixel - 127.5) * 0.0078125
+					}
+					err := imgTensors.SetAt(pixel, y, x, z)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		_ = rgbImg.Close()
+
+		err := imgTensors.T(2, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		preprocessedSlice, err := preprocessedImages.Slice(tensor.S(i))
+		if err != nil {
+			return nil, err
+		}
+		err = tensor.Copy(preprocessedSlice, imgTensors)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return preprocessedImages, nil
+}
+
+// legacyAntiSpoofingPreprocess swaps the channels of each crop back with CvtColor. Unlike the original, it does not
+// close the crops, which now come from a pool.
+func legacyAntiSpoofingPreprocess(c *FaceAntiSpoofingClient, imgs []gocv.Mat, idx int) (*tensor.Dense, error) {
+	preprocessedImages := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(len(imgs), 3, c.imageSize[idx][1], c.imageSize[idx][0]),
+	)
+
+	for i, img := range imgs {
+		bgrImg := gocv.NewMat()
+		gocv.CvtColor(img, &bgrImg, gocv.ColorRGBToBGR)
+
+		imgShape := bgrImg.Size()
+		imgTensors := tensor.New(
+			tensor.Of(tensor.Float32),
+			tensor.WithShape(imgShape[0], imgShape[1], 3),
+		)
+		for z := range 3 {
+			for y := range imgShape[0] {
+				for x := range imgShape[1] {
+					err := imgTensors.SetAt(float32(bgrImg.GetVecbAt(y, x)[z]), y, x, z)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		_ = bgrImg.Close()
+
+		err := imgTensors.T(2, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		preprocessedSlice, err := preprocessedImages.Slice(tensor.S(i), nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = tensor.Copy(preprocessedSlice, imgTensors)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return preprocessedImages, nil
+}
+
+func newBenchmarkImage(width, height int) gocv.Mat {
+	img := gocv.NewMatWithSize(height, width, gocv.MatTypeCV8UC3)
+	gocv.RandU(&img, gocv.NewScalar(0, 0, 0, 0), gocv.NewScalar(255, 255, 255, 0))
+	return img
+}
+
+// benchmarkPreprocess runs the per-pixel preprocessing of a module and its current preprocessing as sub-benchmarks.
+func benchmarkPreprocess(b *testing.B, module string, perPixel func() error, blob func(buffers *scratch) error) {
+	b.Run(module+"/per_pixel", func(b *testing.B) {
+		for range b.N {
+			err := perPixel()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run(module+"/blob", func(b *testing.B) {
+		for range b.N {
+			buffers := newScratch()
+			err := blob(buffers)
+			buffers.release()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPreprocess compares the preprocessing of each module, with the input parameters of its default model, to
+// its per-pixel preprocessing. Detection is also measured with a raw pixel (UINT8) model input.
+func BenchmarkPreprocess(b *testing.B) {
+	_, backend := newTestBackend(b)
+
+	photo := newBenchmarkImage(1280, 960)
+	defer photo.Close()
+	face := newBenchmarkImage(160, 160)
+	defer face.Close()
+
+	rawDetectionModel := tritontest.RetinaFaceModel()
+	rawDetectionModel.Config.Input[0].DataType = triton_proto.DataType_TYPE_UINT8
+	rawServer := tritontest.NewServer(rawDetectionModel)
+	defer rawServer.Close()
+	rawBackend, err := rawServer.Backend()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for module, detectionBackend := range map[string]inference.Backend{"detection": backend, "detection_raw": rawBackend} {
+		detection, err := NewFaceDetectionClient(detectionBackend, config.DefaultRetinaFaceDetectionParams)
+		if err != nil {
+			b.Fatal(err)
+		}
+		imageValues := 3 * detection.imageSize[0] * detection.imageSize[1]
+		benchmarkPreprocess(b, module, func() error {
+			_, _, err := legacyDetectionPreprocess(detection, photo)
+			return err
+		}, func(buffers *scratch) error {
+			_, err := detection.model.preprocess(photo, buffers.float32Buffer(imageValues), buffers)
+			return err
+		})
+	}
+
+	quality, err := NewFaceQualityClient(backend, config.DefaultFaceQualityParams)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkPreprocess(b, "quality", func() error {
+		_, err := legacyQualityPreprocess(quality, face)
+		return err
+	}, func(buffers *scratch) error {
+		_, err := quality.preprocess(face, buffers)
+		return err
+	})
+
+	qualityAssessment, err := NewFaceQualityAssessmentClient(backend, config.DefaultFaceQualityAssessmentParams)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkPreprocess(b, "quality_assessment", func() error {
+		_, err := legacyQualityAssessmentPreprocess(qualityAssessment, face)
+		return err
+	}, func(buffers *scratch) error {
+		_, err := qualityAssessment.preprocess(face, buffers)
+		return err
+	})
+
+	extraction, err := NewFaceExtractionClient(backend, config.DefaultArcFaceRecognitionParams)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkPreprocess(b, "extraction", func() error {
+		_, err := legacyExtractionPreprocess(extraction, []gocv.Mat{face})
+		return err
+	}, func(buffers *scratch) error {
+		_, err := extraction.preprocess(context.Background(), []gocv.Mat{face}, buffers)
+		return err
+	})
+
+	// The anti-spoofing crops are cut from the channel swapped photo, as in Infer.
+	antiSpoofing, err := NewFaceAntiSpoofingClient(backend, config.DefaultFaceAntiSpoofingParam)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cropBuffers := newScratch()
+	defer cropBuffers.release()
+	bgrPhoto := cropBuffers.mat(photo.Rows(), photo.Cols(), photo.Type())
+	gocv.CvtColor(photo, &bgrPhoto, gocv.ColorRGBToBGR)
+	faceBox := tensor.New(tensor.WithShape(4), tensor.WithBacking([]float32{400, 300, 800, 760}))
+	crops, _, err := antiSpoofing.getScaleImage(bgrPhoto, faceBox, cropBuffers)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for idx, crop := range crops {
+		benchmarkPreprocess(b, fmt.Sprintf("anti_spoofing_%d", idx), func() error {
+			_, err := legacyAntiSpoofingPreprocess(antiSpoofing, []gocv.Mat{crop}, idx)
+			return err
+		}, func(buffers *scratch) error {
+			_, err := antiSpoofing.preprocess([]gocv.Mat{crop}, idx, buffers)
+			return err
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/processing"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+)
+
+// SCRFDDetectionClient detects faces with an SCRFD model. Its detections and landmarks have the same shapes as those
+// of FaceDetectionClient. It is safe for concurrent use.
+type SCRFDDetectionClient struct {
+	backend     inference.Backend
+	ModelParams *config.SCRFDDetectionParams
+	ModelConfig *triton_proto.ModelConfigResponse
+	model       *detectionModel
+}
+
+func NewSCRFDDetectionClient(backend inference.Backend, cfg *config.SCRFDDetectionParams) (*SCRFDDetectionClient, error) {
+	if len(cfg.Strides) == 0 || cfg.NumAnchors <= 0 || cfg.InputStd == 0 {
+		return nil, fmt.Errorf("model %s: strides, a positive number of anchors and a non-zero input std are required", cfg.ModelName)
+	}
+	for _, stride := range cfg.Strides {
+		if stride <= 0 {
+			return nil, fmt.Errorf("model %s: stride %d is not positive", cfg.ModelName, stride)
+		}
+	}
+
+	client := &SCRFDDetectionClient{}
+	client.ModelParams = cfg
+
+	inferenceConfig, err := backend.GetModelConfiguration(cfg.Timeout, cfg.ModelName, cfg.ModelVersion)
+	if err != nil {
+		return nil, err
+	}
+	numOutputs := len(inferenceConfig.GetConfig().GetOutput())
+	if numOutputs != 3*len(cfg.Strides) {
+		return nil, fmt.Errorf("model %s has %d outputs, the score, bbox and keypoint outputs of %d strides need %d", cfg.ModelName, numOutputs, len(cfg.Strides), 3*len(cfg.Strides))
+	}
+	client.backend = backend
+	client.ModelConfig = inferenceConfig
+
+	blobParams := processing.BlobParams{
+		SwapRB: true,
+		Mean:   [3]float32{cfg.InputMean, cfg.InputMean, cfg.InputMean},
+		Scale:  [3]float32{1 / cfg.InputStd, 1 / cfg.InputStd, 1 / cfg.InputStd},
+	}
+	if isRawPixelInput(inferenceConfig) {
+		blobParams = processing.RawBlobParams
+		blobParams.SwapRB = true
+	}
+	client.model = &detectionModel{
+		backend:      backend,
+		modelConfig:  inferenceConfig,
+		modelName:    cfg.ModelName,
+		modelVersion: cfg.ModelVersion,
+		timeout:      cfg.Timeout,
+		imageSize:    cfg.ImageSize,
+		maxBatchSize: cfg.MaxBatchSize,
+		blobParams:   blobParams,
+	}
+
+	return client, nil
+}
+
+// Infer detects the faces of img and returns their (x1, y1, x2, y2, score) rows sorted by score and their
+// landmarks, in the coordinates of img.
+func (c *SCRFDDetectionClient) Infer(ctx context.Context, img gocv.Mat) (*tensor.Dense, *tensor.Dense, error) {
+	dets, kpss, err := c.InferBatch(ctx, []gocv.Mat{img})
+	if err != nil {
+		return nil, nil, err
+	}
+	return dets[0], kpss[0], nil
+}
+
+// InferBatch detects the faces of every image of imgs, like Infer, and returns the detections and landmarks of each
+// image in input order. The images are batched like FaceDetectionClient.InferBatch.
+func (c *SCRFDDetectionClient) InferBatch(ctx context.Context, imgs []gocv.Mat) ([]*tensor.Dense, []*tensor.Dense, error) {
+	return c.model.infer(ctx, imgs, c.decode)
+}
+
+// decode turns the outputs of the image at batchIdx into detections. The outputs hold the scores of every stride,
+// then their bbox distances and then their keypoint offsets, each a (cells*NumAnchors, 1|4|10) matrix, with a
+// leading batch dimension when the model is exported with one. Anchor k of a height x width map is centered on the
+// cell (k/NumAnchors) % width, (k/NumAnchors) / width, and the distances are in units of the stride.
+func (c *SCRFDDetectionClient) decode(netOut []*tensor.Dense, batchIdx int, detScale float64) (*tensor.Dense, *tensor.Dense, error) {
+	numStrides := len(c.ModelParams.Strides)
+	if len(netOut) != 3*numStrides {
+		return nil, nil, fmt.Errorf("expected %d outputs, got %d", 3*numStrides, len(netOut))
+	}
+	A := c.ModelParams.NumAnchors
+	imageSize := c.ModelParams.ImageSize
+
+	// The candidates above the confidence threshold, in stride then anchor order.
+	proposals := make([]float32, 0)
+	scores := make([]float32, 0)
+	landmarks := make([]float32, 0)
+
+	for idx, stride := range c.ModelParams.Strides {
+		height, width := imageSize[1]/stride, imageSize[0]/stride
+		numAnchors := height * width * A
+
+		var maps [3][]float32
+		for mapIdx, columns := range []int{1, 4, 10} {
+			data, err := scrfdOutput(netOut[idx+mapIdx*numStrides], batchIdx, numAnchors, columns)
+			if err != nil {
+				return nil, nil, fmt.Errorf("stride %d: %w", stride, err)
+			}
+			maps[mapIdx] = data
+		}
+		scoreMap, bboxMap, kpsMap := maps[0], maps[1], maps[2]
+
+		s := float32(stride)
+		for k, score := range scoreMap {
+			if !(score >= c.ModelParams.ConfidenceThreshold) {
+				continue
+			}
+			pos := k / A
+			centerX := float32(pos%width) * s
+			centerY := float32(pos/width) * s
+
+			// The products are rounded by conversions so that they are not fused with the following addition.
+			distances := bboxMap[4*k : 4*k+4]
+			proposals = append(proposals,
+				centerX-float32(distances[0]*s),
+				centerY-float32(distances[1]*s),
+				centerX+float32(distances[2]*s),
+				centerY+float32(distances[3]*s),
+			)
+			scores = append(scores, score)
+
+			offsets := kpsMap[10*k : 10*k+10]
+			for p := range 5 {
+				landmarks = append(landmarks, centerX+float32(offsets[2*p]*s), centerY+float32(offsets[2*p+1]*s))
+			}
+		}
+	}
+
+	det, kpss := selectDetections(proposals, scores, landmarks, c.ModelParams.IOUThreshold, detScale, true)
+	return det, kpss, nil
+}
+
+// scrfdOutput returns the (rows, columns) matrix of the batch element batchIdx of out.
+func scrfdOutput(out *tensor.Dense, batchIdx, rows, columns int) ([]float32, error) {
+	if out == nil {
+		return nil, errors.New("missing output")
+	}
+	shape := out.Shape()
+	switch {
+	case len(shape) == 2 && batchIdx == 0 && shape[0] == rows && shape[1] == columns:
+		return out.Float32s(), nil
+	case len(shape) == 3 && shape[0] > batchIdx && shape[1] == rows && shape[2] == columns:
+		return out.Float32s()[batchIdx*rows*columns : (batchIdx+1)*rows*columns], nil
+	default:
+		return nil, fmt.Errorf("output has shape %v, expected (%d, %d) for batch element %d", shape, rows, columns, batchIdx)
+	}
+}
+
+// Ready returns an error unless the detection model is ready on the backend.
+func (c *SCRFDDetectionClient) Ready() error {
+	return modelReady(c.backend, c.ModelParams.Timeout, c.ModelParams.ModelName, c.ModelParams.ModelVersion)
+}
+
+// Validate checks that the model takes batches of MaxBatchSize 3 channel images of ImageSize and returns the score,
+// bbox and keypoint matrices of every stride.
+func (c *SCRFDDetectionClient) Validate() error {
+	err := validateImageInput(c.ModelConfig, max(c.ModelParams.MaxBatchSize, 1), c.ModelParams.ImageSize)
+	if err != nil {
+		return err
+	}
+	numStrides := len(c.ModelParams.Strides)
+	err = validateOutputs(c.ModelConfig, 3*numStrides, 0, true)
+	if err != nil {
+		return err
+	}
+
+	imageSize := c.ModelParams.ImageSize
+	for idx, output := range c.ModelConfig.Config.Output {
+		stride := c.ModelParams.Strides[idx%numStrides]
+		expected := []int64{
+			int64(imageSize[1] / stride * (imageSize[0] / stride) * c.ModelParams.NumAnchors),
+			[]int64{1, 4, 10}[idx/numStrides],
+		}
+		dims := output.Dims
+		if len(dims) == 3 {
+			dims = dims[1:]
+		}
+		if !dimsMatch(dims, expected) {
+			return fmt.Errorf("model %s: output %s has dims %v, stride %d expects %v", c.ModelConfig.Config.Name, output.Name, output.Dims, stride, expected)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package modules
+
+import (
+	"context"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/tritontest"
+	"github.com/stretchr/testify/assert"
+	"gocv.io/x/gocv"
+	"image"
+	"testing"
+)
+
+func newSCRFDTestBackend(t *testing.T, models ...*tritontest.Model) (*tritontest.Server, inference.Backend) {
+	server := tritontest.NewServer(models...)
+	t.Cleanup(server.Close)
+
+	backend, err := server.Backend()
+	assert.NoError(t, err)
+	return server, backend
+}
+
+func TestSCRFDDetectionClient_Infer(t *testing.T) {
+	server, backend := newSCRFDTestBackend(t, tritontest.SCRFDModel(image.Pt(10, 10)))
+
+	client, err := NewSCRFDDetectionClient(backend, config.DefaultSCRFDDetectionParams)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Ready())
+	assert.NoError(t, client.Validate())
+
+	img := newTestImage(1280, 1280)
+	defer img.Close()
+
+	// The 512x512 box centered on (320, 320) in the model input, the second anchor is removed by NMS.
+	det, kpss, err := client.Infer(context.Background(), img)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 5}, []int(det.Shape()))
+	assert.InDeltaSlice(t, []float32{128, 128, 1152, 1152, 0.9}, det.Float32s(), 1e-3)
+	assert.Equal(t, []int{1, 5, 2}, []int(kpss.Shape()))
+	assert.InDeltaSlice(t, []float32{128 + 38.2946/112*1024, 128 + 51.6963/112*1024}, kpss.Float32s()[:2], 1e-2)
+
+	requests := server.Requests()
+	assert.Len(t, requests, 1)
+	assert.Equal(t, []int64{1, 3, 640, 640}, requests[0].Inputs[0].Shape)
+	assert.Zero(t, matPool.Outstanding())
+}
+
+func TestSCRFDDetectionClient_InferBatch(t *testing.T) {
+	server, backend := newSCRFDTestBackend(t, tritontest.SCRFDModel(image.Pt(10, 10)).DynamicBatch())
+
+	cfg := *config.DefaultSCRFDDetectionParams
+	cfg.MaxBatchSize = 2
+	client, err := NewSCRFDDetectionClient(backend, &cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Validate())
+
+	imgs := []gocv.Mat{newTestImage(1280, 1280), newTestImage(640, 640), newTestImage(800, 600)}
+	for _, img := range imgs {
+		defer img.Close()
+	}
+
+	dets, kpss, err := client.InferBatch(context.Background(), imgs)
+	assert.NoError(t, err)
+	assert.Len(t, dets, len(imgs))
+	assert.Len(t, kpss, len(imgs))
+	for idx, scale := range []float32{0.5, 1, 0.8} {
+		assert.InDeltaSlice(t, []float32{64 / scale, 64 / scale, 576 / scale, 576 / scale, 0.9}, dets[idx].Float32s(), 1e-3)
+		assert.Equal(t, 10, kpss[idx].DataSize())
+	}
+
+	batches := make([]int64, 0)
+	for _, req := range server.Requests() {
+		batches = append(batches, req.Inputs[0].Shape[0])
+	}
+	assert.Equal(t, []int64{2, 1}, batches)
+}
+
+func TestSCRFDDetectionClient_InferNoFace(t *testing.T) {
+	_, backend := newSCRFDTestBackend(t, tritontest.SCRFDModel())
+
+	client, err := NewSCRFDDetectionClient(backend, config.DefaultSCRFDDetectionParams)
+	assert.NoError(t, err)
+
+	img := newTestImage(640, 480)
+	defer img.Close()
+
+	det, kpss, err := client.Infer(context.Background(), img)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, det.Shape()[0])
+	assert.Equal(t, 0, kpss.Shape()[0])
+}
+
+func TestSCRFDDetectionClient_Contract(t *testing.T) {
+	_, backend := newSCRFDTestBackend(t, tritontest.SCRFDModel(), tritontest.RetinaFaceModel())
+
+	// The 9 RetinaFace outputs do not match the strides of an SCRFD model with 4 strides.
+	cfg := *config.DefaultSCRFDDetectionParams
+	cfg.ModelName = config.DefaultRetinaFaceDetectionParams.ModelName
+	cfg.Strides = []int{8, 16, 32, 64}
+	_, err := NewSCRFDDetectionClient(backend, &cfg)
+	assert.ErrorContains(t, err, "has 9 outputs, the score, bbox and keypoint outputs of 4 strides need 12")
+
+	cfg = *config.DefaultSCRFDDetectionParams
+	cfg.NumAnchors = 1
+	client, err := NewSCRFDDetectionClient(backend, &cfg)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, client.Validate(), "output score_8 has dims [1 12800 1], stride 8 expects [6400 1]")
+
+	cfg.NumAnchors = 0
+	_, err = NewSCRFDDetectionClient(backend, &cfg)
+	assert.ErrorContains(t, err, "positive number of anchors")
+}
@@ -0,0 +1,91 @@
+package modules
+
+import (
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"gorgonia.org/tensor"
+)
+
+// isRawPixelInput reports whether the model takes raw UINT8 pixels and normalizes them server-side.
+func isRawPixelInput(modelConfig *triton_proto.ModelConfigResponse) bool {
+	inputs := modelConfig.GetConfig().GetInput()
+	return len(inputs) > 0 && inputs[0].DataType == triton_proto.DataType_TYPE_UINT8
+}
+
+// batchShape returns dims with a dynamic (-1) batch dimension set to batchSize.
+func batchShape(dims []int64, batchSize int) []int64 {
+	if len(dims) == 0 || dims[0] != -1 {
+		return dims
+	}
+	shape := append([]int64(nil), dims...)
+	shape[0] = int64(batchSize)
+	return shape
+}
+
+// encodeInput builds the input tensor description and its raw little-endian contents,
+// converting data to the datatype declared in the model configuration. FP32 contents share the memory of data,
+// converted contents are taken from buffers.
+func encodeInput(inputCfg *triton_proto.ModelInput, shape []int64, data []float32, buffers *scratch) (*triton_proto.ModelInferRequest_InferInputTensor, []byte, error) {
+	var raw []byte
+
+	switch inputCfg.DataType {
+	case triton_proto.DataType_TYPE_FP32:
+		raw = utils.TToBytes(data)
+	case triton_proto.DataType_TYPE_FP16:
+		raw = buffers.byteBuffer(2 * len(data))
+		for i, v := range data {
+			half := utils.Float32ToFloat16(v)
+			raw[2*i] = byte(half)
+			raw[2*i+1] = byte(half >> 8)
+		}
+	case triton_proto.DataType_TYPE_UINT8:
+		raw = buffers.byteBuffer(len(data))
+		for i, v := range data {
+			raw[i] = uint8(v)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported input data type %s for %s", inputCfg.DataType.String(), inputCfg.Name)
+	}
+
+	input := &triton_proto.ModelInferRequest_InferInputTensor{
+		Name:     inputCfg.Name,
+		Datatype: inputCfg.DataType.String()[5:],
+		Shape:    shape,
+	}
+	return input, raw, nil
+}
+
+// decodeOutput converts a raw output tensor into a float32 tensor. FP32 tensors share the memory of raw, converted
+// tensors are backed by buffers.
+func decodeOutput(out *triton_proto.ModelInferResponse_InferOutputTensor, raw []byte, buffers *scratch) (*tensor.Dense, error) {
+	outShape := make([]int, 0, len(out.Shape))
+	for _, shape := range out.Shape {
+		outShape = append(outShape, int(shape))
+	}
+
+	var data []float32
+	switch out.Datatype {
+	case "FP32":
+		data = utils.BytesToT32[float32](raw)
+	case "FP16":
+		data = buffers.float32Buffer(len(raw) / 2)
+		for i := range data {
+			data[i] = utils.Float16ToFloat32(uint16(raw[2*i]) | uint16(raw[2*i+1])<<8)
+		}
+	case "FP64":
+		f64 := utils.BytesToT64[float64](raw)
+		data = buffers.float32Buffer(len(f64))
+		for i, v := range f64 {
+			data[i] = float32(v)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported output data type %s for %s", out.Datatype, out.Name)
+	}
+
+	return tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(outShape...),
+		tensor.WithBacking(data),
+	), nil
+}
@@ -0,0 +1,35 @@
+package modules
+
+import (
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncodeInput(t *testing.T) {
+	data := []float32{0, 1.5, 255}
+
+	input, raw, err := encodeInput(&triton_proto.ModelInput{Name: "data", DataType: triton_proto.DataType_TYPE_FP32}, []int64{1, 3}, data, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "FP32", input.Datatype)
+	assert.Equal(t, data, utils.BytesToT32[float32](raw))
+
+	input, raw, err = encodeInput(&triton_proto.ModelInput{Name: "data", DataType: triton_proto.DataType_TYPE_UINT8}, []int64{1, 3}, data, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "UINT8", input.Datatype)
+	assert.Equal(t, []byte{0, 1, 255}, raw)
+
+	input, raw, err = encodeInput(&triton_proto.ModelInput{Name: "data", DataType: triton_proto.DataType_TYPE_FP16}, []int64{1, 3}, data, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "FP16", input.Datatype)
+	assert.Len(t, raw, 6)
+
+	out, err := decodeOutput(&triton_proto.ModelInferResponse_InferOutputTensor{Name: "out", Datatype: "FP16", Shape: []int64{1, 3}}, raw, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, []int(out.Shape()))
+	assert.Equal(t, data, out.Float32s())
+
+	_, _, err = encodeInput(&triton_proto.ModelInput{Name: "data", DataType: triton_proto.DataType_TYPE_STRING}, []int64{1, 3}, data, nil)
+	assert.Error(t, err)
+}
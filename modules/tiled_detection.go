@@ -0,0 +1,153 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+	"image"
+)
+
+// seamTolerance is the distance in pixels from a tile seam under which a detection is considered cut by the seam.
+const seamTolerance = 2
+
+// TiledFaceDetector runs a FaceDetector on overlapping full resolution tiles of large images, and optionally on the
+// whole image, then maps the detections back to image coordinates and merges the duplicates with NMS. It is safe
+// for concurrent use when the wrapped detector is.
+type TiledFaceDetector struct {
+	detector FaceDetector
+	params   *config.TilingParams
+}
+
+var _ FaceDetector = (*TiledFaceDetector)(nil)
+
+func NewTiledFaceDetector(detector FaceDetector, cfg *config.TilingParams) (*TiledFaceDetector, error) {
+	if cfg.TileSize[0] <= 0 || cfg.TileSize[1] <= 0 {
+		return nil, errors.New("tile size must be positive")
+	}
+	if cfg.Overlap < 0 || cfg.Overlap >= min(cfg.TileSize[0], cfg.TileSize[1]) {
+		return nil, errors.New("tile overlap must not be negative and must be smaller than the tiles")
+	}
+	return &TiledFaceDetector{
+		detector: detector,
+		params:   cfg,
+	}, nil
+}
+
+// Infer detects the faces of img on its tiles and returns their (x1, y1, x2, y2, score) rows sorted by score and
+// their landmarks, in the coordinates of img. The tiles are sent to the wrapped detector in batches.
+func (d *TiledFaceDetector) Infer(ctx context.Context, img gocv.Mat) (*tensor.Dense, *tensor.Dense, error) {
+	imgShape := img.Size()
+	height, width := imgShape[0], imgShape[1]
+	if width <= d.params.TileSize[0] && height <= d.params.TileSize[1] {
+		return d.detector.Infer(ctx, img)
+	}
+
+	rects := make([]image.Rectangle, 0)
+	for _, y := range tileStarts(height, d.params.TileSize[1], d.params.Overlap) {
+		for _, x := range tileStarts(width, d.params.TileSize[0], d.params.Overlap) {
+			rects = append(rects, image.Rect(x, y, min(x+d.params.TileSize[0], width), min(y+d.params.TileSize[1], height)))
+		}
+	}
+	tiles := make([]gocv.Mat, len(rects))
+	for idx, rect := range rects {
+		tiles[idx] = img.Region(rect)
+	}
+	defer func() {
+		for _, tile := range tiles {
+			_ = tile.Close()
+		}
+	}()
+
+	dets, kpss, err := d.detector.InferBatch(ctx, tiles)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proposals := make([]float32, 0)
+	scores := make([]float32, 0)
+	landmarks := make([]float32, 0)
+	for idx, rect := range rects {
+		offsetX, offsetY := float32(rect.Min.X), float32(rect.Min.Y)
+		det, kps := dets[idx].Float32s(), kpss[idx].Float32s()
+		for row := range dets[idx].Shape()[0] {
+			box := det[5*row : 5*row+5]
+			if cutBySeam(box, rect, width, height) {
+				continue
+			}
+			proposals = append(proposals, box[0]+offsetX, box[1]+offsetY, box[2]+offsetX, box[3]+offsetY)
+			scores = append(scores, box[4])
+			for p := range 5 {
+				landmarks = append(landmarks, kps[10*row+2*p]+offsetX, kps[10*row+2*p+1]+offsetY)
+			}
+		}
+	}
+
+	if d.params.GlobalPass {
+		det, kps, err := d.detector.Infer(ctx, img)
+		if err != nil {
+			return nil, nil, err
+		}
+		for row := range det.Shape()[0] {
+			box := det.Float32s()[5*row : 5*row+5]
+			proposals = append(proposals, box[:4]...)
+			scores = append(scores, box[4])
+		}
+		landmarks = append(landmarks, kps.Float32s()...)
+	}
+
+	det, kps := selectDetections(proposals, scores, landmarks, d.params.IOUThreshold, 1, true)
+	return det, kps, nil
+}
+
+// InferBatch detects the faces of every image of imgs like Infer and returns their detections and landmarks in
+// input order.
+func (d *TiledFaceDetector) InferBatch(ctx context.Context, imgs []gocv.Mat) ([]*tensor.Dense, []*tensor.Dense, error) {
+	dets := make([]*tensor.Dense, 0, len(imgs))
+	kpss := make([]*tensor.Dense, 0, len(imgs))
+	for _, img := range imgs {
+		det, kps, err := d.Infer(ctx, img)
+		if err != nil {
+			return nil, nil, err
+		}
+		dets = append(dets, det)
+		kpss = append(kpss, kps)
+	}
+	return dets, kpss, nil
+}
+
+// Ready returns an error unless the wrapped detector is ready.
+func (d *TiledFaceDetector) Ready() error {
+	return d.detector.Ready()
+}
+
+// Validate checks the wrapped detector.
+func (d *TiledFaceDetector) Validate() error {
+	return d.detector.Validate()
+}
+
+// tileStarts returns the offsets of the tiles of size tile covering length, spread evenly so that neighboring
+// tiles share at least overlap pixels.
+func tileStarts(length, tile, overlap int) []int {
+	if length <= tile {
+		return []int{0}
+	}
+	n := (length - overlap + tile - overlap - 1) / (tile - overlap)
+	starts := make([]int, n)
+	for i := range n {
+		starts[i] = i * (length - tile) / (n - 1)
+	}
+	return starts
+}
+
+// cutBySeam reports whether box, in the coordinates of the tile rect, reaches a side of the tile that is not a side
+// of the width x height image. Such a face is cut by the seam and is entirely inside a neighboring tile when it is
+// smaller than the overlap.
+func cutBySeam(box []float32, rect image.Rectangle, width, height int) bool {
+	tileW, tileH := float32(rect.Dx()), float32(rect.Dy())
+	return (rect.Min.X > 0 && box[0] <= seamTolerance) ||
+		(rect.Min.Y > 0 && box[1] <= seamTolerance) ||
+		(rect.Max.X < width && box[2] >= tileW-1-seamTolerance) ||
+		(rect.Max.Y < height && box[3] >= tileH-1-seamTolerance)
+}
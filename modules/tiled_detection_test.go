@@ -0,0 +1,182 @@
+package modules
+
+import (
+	"context"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/stretchr/testify/assert"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+)
+
+// brightDetector is a FaceDetector reporting every white rectangle of an image as a face, with its corners and
+// center as landmarks. It records the number of images of each call.
+type brightDetector struct {
+	mu      sync.Mutex
+	batches []int
+}
+
+func (d *brightDetector) Infer(ctx context.Context, img gocv.Mat) (*tensor.Dense, *tensor.Dense, error) {
+	dets, kpss, err := d.InferBatch(ctx, []gocv.Mat{img})
+	if err != nil {
+		return nil, nil, err
+	}
+	return dets[0], kpss[0], nil
+}
+
+func (d *brightDetector) InferBatch(_ context.Context, imgs []gocv.Mat) ([]*tensor.Dense, []*tensor.Dense, error) {
+	d.mu.Lock()
+	d.batches = append(d.batches, len(imgs))
+	d.mu.Unlock()
+
+	dets := make([]*tensor.Dense, len(imgs))
+	kpss := make([]*tensor.Dense, len(imgs))
+	for idx, img := range imgs {
+		white := func(x, y int) bool {
+			return x < img.Cols() && y < img.Rows() && img.GetVecbAt(y, x)[0] == 255
+		}
+
+		// The first white pixel of a rectangle met in scan order is its top left corner.
+		rects := make([]image.Rectangle, 0)
+		det := make([]float32, 0)
+		kps := make([]float32, 0)
+		for y := range img.Rows() {
+		scan:
+			for x := range img.Cols() {
+				for _, rect := range rects {
+					if image.Pt(x, y).In(rect) {
+						continue scan
+					}
+				}
+				if !white(x, y) {
+					continue
+				}
+				x2, y2 := x, y
+				for white(x2+1, y) {
+					x2++
+				}
+				for white(x, y2+1) {
+					y2++
+				}
+				rects = append(rects, image.Rect(x, y, x2+1, y2+1))
+
+				x1, y1 := float32(x), float32(y)
+				right, bottom := float32(x2), float32(y2)
+				det = append(det, x1, y1, right, bottom, 0.9)
+				kps = append(kps, x1, y1, right, y1, (x1+right)/2, (y1+bottom)/2, x1, bottom, right, bottom)
+			}
+		}
+		dets[idx] = tensor.New(tensor.WithShape(len(rects), 5), tensor.WithBacking(det))
+		kpss[idx] = tensor.New(tensor.WithShape(len(rects), 5, 2), tensor.WithBacking(kps))
+	}
+	return dets, kpss, nil
+}
+
+func (d *brightDetector) Ready() error {
+	return nil
+}
+
+func (d *brightDetector) Validate() error {
+	return nil
+}
+
+func TestTileStarts(t *testing.T) {
+	assert.Equal(t, []int{0}, tileStarts(640, 640, 160))
+	assert.Equal(t, []int{0, 360}, tileStarts(1000, 640, 160))
+	assert.Equal(t, []int{0, 320, 640}, tileStarts(1280, 640, 160))
+
+	// Neighboring tiles always share at least the overlap and the last one ends on the image side.
+	for length := 641; length < 5000; length += 37 {
+		starts := tileStarts(length, 640, 160)
+		for i := 1; i < len(starts); i++ {
+			assert.LessOrEqual(t, starts[i]-starts[i-1], 640-160)
+		}
+		assert.Equal(t, length-640, starts[len(starts)-1])
+	}
+}
+
+func TestTiledFaceDetector_Infer(t *testing.T) {
+	// The tiles start at x 0, 320 and 640 and at y 0 and 360.
+	img := newTestImage(1280, 1000)
+	defer img.Close()
+	white := color.RGBA{R: 255, G: 255, B: 255}
+	// A face inside a single tile and a face in the overlap of four tiles.
+	gocv.Rectangle(&img, image.Rect(100, 100, 140, 140), white, -1)
+	gocv.Rectangle(&img, image.Rect(400, 400, 440, 440), white, -1)
+
+	for _, tc := range []struct {
+		name       string
+		globalPass bool
+		batches    []int
+	}{
+		{name: "tiles", globalPass: false, batches: []int{6}},
+		{name: "tiles and global pass", globalPass: true, batches: []int{6, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			detector := &brightDetector{}
+			tiled, err := NewTiledFaceDetector(detector, config.NewTilingParams([2]int{640, 640}, 160, tc.globalPass, 0.45))
+			assert.NoError(t, err)
+			assert.NoError(t, tiled.Ready())
+			assert.NoError(t, tiled.Validate())
+
+			det, kpss, err := tiled.Infer(context.Background(), img)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.batches, detector.batches)
+
+			// Each face is reported once, in image coordinates, although the second one is found by four tiles.
+			assert.Equal(t, []int{2, 5}, []int(det.Shape()))
+			assert.Equal(t, []int{2, 5, 2}, []int(kpss.Shape()))
+			boxes := [][]float32{det.Float32s()[:5], det.Float32s()[5:]}
+			assert.ElementsMatch(t, [][]float32{{100, 100, 139, 139, 0.9}, {400, 400, 439, 439, 0.9}}, boxes)
+			for row, box := range boxes {
+				assert.Equal(t, []float32{box[0], box[1]}, kpss.Float32s()[10*row:10*row+2])
+				assert.Equal(t, []float32{box[2], box[3]}, kpss.Float32s()[10*row+8:10*row+10])
+			}
+		})
+	}
+}
+
+func TestTiledFaceDetector_Seams(t *testing.T) {
+	detector := &brightDetector{}
+	tiled, err := NewTiledFaceDetector(detector, config.NewTilingParams([2]int{640, 640}, 160, false, 0.45))
+	assert.NoError(t, err)
+
+	img := newTestImage(1000, 640)
+	defer img.Close()
+	// The tiles start at x 0 and 360, the face crosses the seam of the first tile at x 639 and lies inside the
+	// second one. The part seen by the first tile is discarded.
+	gocv.Rectangle(&img, image.Rect(600, 300, 700, 400), color.RGBA{R: 255, G: 255, B: 255}, -1)
+
+	det, _, err := tiled.Infer(context.Background(), img)
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{600, 300, 699, 399, 0.9}, det.Float32s())
+
+	// A face larger than the overlap crossing the seam is cut in both tiles and needs the global pass.
+	large := newTestImage(1000, 640)
+	defer large.Close()
+	gocv.Rectangle(&large, image.Rect(300, 100, 700, 500), color.RGBA{R: 255, G: 255, B: 255}, -1)
+
+	det, _, err = tiled.Infer(context.Background(), large)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, det.Shape()[0])
+
+	tiled, err = NewTiledFaceDetector(detector, config.NewTilingParams([2]int{640, 640}, 160, true, 0.45))
+	assert.NoError(t, err)
+	det, _, err = tiled.Infer(context.Background(), large)
+	assert.NoError(t, err)
+	assert.Equal(t, []float32{300, 100, 699, 499, 0.9}, det.Float32s())
+
+	// Images fitting in a tile are detected as a whole.
+	small := newTestImage(640, 480)
+	defer small.Close()
+	detector.batches = nil
+	_, _, err = tiled.Infer(context.Background(), small)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, detector.batches)
+
+	_, err = NewTiledFaceDetector(detector, config.NewTilingParams([2]int{640, 640}, 640, false, 0.45))
+	assert.ErrorContains(t, err, "must be smaller than the tiles")
+}
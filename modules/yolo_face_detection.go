@@ -0,0 +1,180 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/processing"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+)
+
+// yoloNumKeypoints is the number of keypoints of a YOLO face model, the five landmarks taken by face alignment.
+const yoloNumKeypoints = 5
+
+// YOLOFaceDetectionClient detects faces with a YOLOv8-face style model. Its detections and landmarks have the same
+// shapes as those of FaceDetectionClient. It is safe for concurrent use.
+type YOLOFaceDetectionClient struct {
+	backend     inference.Backend
+	ModelParams *config.YOLOFaceDetectionParams
+	ModelConfig *triton_proto.ModelConfigResponse
+	model       *detectionModel
+	// attributes is the number of values of each prediction: the box, the confidence and the keypoints.
+	attributes int
+}
+
+func NewYOLOFaceDetectionClient(backend inference.Backend, cfg *config.YOLOFaceDetectionParams) (*YOLOFaceDetectionClient, error) {
+	if cfg.KeypointDims != 2 && cfg.KeypointDims != 3 {
+		return nil, fmt.Errorf("model %s: keypoint dims must be 2 or 3, got %d", cfg.ModelName, cfg.KeypointDims)
+	}
+
+	client := &YOLOFaceDetectionClient{}
+	client.ModelParams = cfg
+
+	inferenceConfig, err := backend.GetModelConfiguration(cfg.Timeout, cfg.ModelName, cfg.ModelVersion)
+	if err != nil {
+		return nil, err
+	}
+	numOutputs := len(inferenceConfig.GetConfig().GetOutput())
+	if numOutputs != 1 {
+		return nil, fmt.Errorf("model %s has %d outputs, expected a single prediction tensor", cfg.ModelName, numOutputs)
+	}
+	client.backend = backend
+	client.ModelConfig = inferenceConfig
+	client.attributes = 5 + yoloNumKeypoints*cfg.KeypointDims
+
+	blobParams := processing.BlobParams{
+		SwapRB: true,
+		Scale:  [3]float32{1.0 / 255, 1.0 / 255, 1.0 / 255},
+	}
+	if isRawPixelInput(inferenceConfig) {
+		blobParams = processing.RawBlobParams
+		blobParams.SwapRB = true
+	}
+	client.model = &detectionModel{
+		backend:      backend,
+		modelConfig:  inferenceConfig,
+		modelName:    cfg.ModelName,
+		modelVersion: cfg.ModelVersion,
+		timeout:      cfg.Timeout,
+		imageSize:    cfg.ImageSize,
+		maxBatchSize: cfg.MaxBatchSize,
+		blobParams:   blobParams,
+	}
+
+	return client, nil
+}
+
+// Infer detects the faces of img and returns their (x1, y1, x2, y2, score) rows sorted by score and their
+// landmarks, in the coordinates of img.
+func (c *YOLOFaceDetectionClient) Infer(ctx context.Context, img gocv.Mat) (*tensor.Dense, *tensor.Dense, error) {
+	dets, kpss, err := c.InferBatch(ctx, []gocv.Mat{img})
+	if err != nil {
+		return nil, nil, err
+	}
+	return dets[0], kpss[0], nil
+}
+
+// InferBatch detects the faces of every image of imgs, like Infer, and returns the detections and landmarks of each
+// image in input order. The images are batched like FaceDetectionClient.InferBatch.
+func (c *YOLOFaceDetectionClient) InferBatch(ctx context.Context, imgs []gocv.Mat) ([]*tensor.Dense, []*tensor.Dense, error) {
+	return c.model.infer(ctx, imgs, c.decode)
+}
+
+// decode turns the predictions of the image at batchIdx into detections. The output is either laid out as
+// (batch, attributes, predictions), as exported by ultralytics, or as (batch, predictions, attributes). Each
+// prediction holds cx, cy, w, h, the confidence and the x, y (and visibility) of every keypoint. The predictions
+// above the confidence threshold are filtered with processing.NMS.
+func (c *YOLOFaceDetectionClient) decode(netOut []*tensor.Dense, batchIdx int, detScale float64) (*tensor.Dense, *tensor.Dense, error) {
+	if len(netOut) != 1 || netOut[0] == nil {
+		return nil, nil, errors.New("missing prediction output")
+	}
+	shape := netOut[0].Shape()
+	if len(shape) != 3 || shape[0] <= batchIdx || (shape[1] != c.attributes && shape[2] != c.attributes) {
+		return nil, nil, fmt.Errorf("prediction output has shape %v, expected (%d or more, %d, predictions) or (%d or more, predictions, %d)", shape, batchIdx+1, c.attributes, batchIdx+1, c.attributes)
+	}
+	size := shape[1] * shape[2]
+	data := netOut[0].Float32s()[batchIdx*size : (batchIdx+1)*size]
+
+	// value returns the attribute attr of prediction i.
+	numPredictions := size / c.attributes
+	value := func(i, attr int) float32 {
+		return data[i*c.attributes+attr]
+	}
+	if shape[1] == c.attributes {
+		value = func(i, attr int) float32 {
+			return data[attr*numPredictions+i]
+		}
+	}
+
+	// candidates holds the (x1, y1, x2, y2, confidence) rows of the predictions above the confidence threshold.
+	candidates := make([]float32, 0)
+	landmarks := make([]float32, 0)
+	for i := range numPredictions {
+		score := value(i, 4)
+		if !(score >= c.ModelParams.ConfidenceThreshold) {
+			continue
+		}
+
+		centerX, centerY := value(i, 0), value(i, 1)
+		halfW, halfH := value(i, 2)/2, value(i, 3)/2
+		candidates = append(candidates, centerX-halfW, centerY-halfH, centerX+halfW, centerY+halfH, score)
+
+		for p := range yoloNumKeypoints {
+			attr := 5 + p*c.ModelParams.KeypointDims
+			landmarks = append(landmarks, value(i, attr), value(i, attr+1))
+		}
+	}
+
+	numCandidates := len(candidates) / 5
+	if numCandidates == 0 {
+		return tensor.New(tensor.Of(tensor.Float32), tensor.WithShape(0, 5)), tensor.New(tensor.Of(tensor.Float32), tensor.WithShape(0, 5, 2)), nil
+	}
+
+	// processing.NMS returns the kept candidates by descending confidence.
+	keep, err := processing.NMS(tensor.New(tensor.WithShape(numCandidates, 5), tensor.WithBacking(candidates)), c.ModelParams.IOUThreshold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scale := float32(detScale)
+	det := make([]float32, 0, 5*len(keep))
+	kpss := make([]float32, 0, 10*len(keep))
+	for _, idx := range keep {
+		row := candidates[5*idx : 5*idx+5]
+		det = append(det, row[0]/scale, row[1]/scale, row[2]/scale, row[3]/scale, row[4])
+		for _, v := range landmarks[10*idx : 10*idx+10] {
+			kpss = append(kpss, v/scale)
+		}
+	}
+	return tensor.New(tensor.WithShape(len(keep), 5), tensor.WithBacking(det)),
+		tensor.New(tensor.WithShape(len(keep), 5, 2), tensor.WithBacking(kpss)), nil
+}
+
+// Ready returns an error unless the detection model is ready on the backend.
+func (c *YOLOFaceDetectionClient) Ready() error {
+	return modelReady(c.backend, c.ModelParams.Timeout, c.ModelParams.ModelName, c.ModelParams.ModelVersion)
+}
+
+// Validate checks that the model takes batches of MaxBatchSize 3 channel images of ImageSize and returns a single
+// prediction tensor with the attributes of a face and its keypoints.
+func (c *YOLOFaceDetectionClient) Validate() error {
+	err := validateImageInput(c.ModelConfig, max(c.ModelParams.MaxBatchSize, 1), c.ModelParams.ImageSize)
+	if err != nil {
+		return err
+	}
+	err = validateOutputs(c.ModelConfig, 1, 3, true)
+	if err != nil {
+		return err
+	}
+
+	output := c.ModelConfig.Config.Output[0]
+	attributes := int64(c.attributes)
+	if output.Dims[1] != attributes && output.Dims[2] != attributes {
+		return fmt.Errorf("model %s: output %s has dims %v, expected %d attributes per prediction", c.ModelConfig.Config.Name, output.Name, output.Dims, attributes)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package modules
+
+import (
+	"context"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/processing"
+	"github.com/okieraised/go-faceid-pipeline/tritontest"
+	"github.com/stretchr/testify/assert"
+	"gorgonia.org/tensor"
+	"image"
+	"testing"
+)
+
+// transposePredictions lays the output of a YOLO face model out as (1, predictions, attributes).
+func transposePredictions(model *tritontest.Model) *tritontest.Model {
+	output := model.Config.Output[0]
+	attributes, numPredictions := int(output.Dims[1]), int(output.Dims[2])
+	data := model.Outputs[output.Name]
+	transposed := make([]float32, len(data))
+	for attr := range attributes {
+		for i := range numPredictions {
+			transposed[i*attributes+attr] = data[attr*numPredictions+i]
+		}
+	}
+	output.Dims[1], output.Dims[2] = output.Dims[2], output.Dims[1]
+	model.Outputs[output.Name] = transposed
+	return model
+}
+
+func TestYOLOFaceDetectionClient_Infer(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		model *tritontest.Model
+	}{
+		{name: "attributes first", model: tritontest.YOLOFaceModel(image.Pt(10, 10))},
+		{name: "predictions first", model: transposePredictions(tritontest.YOLOFaceModel(image.Pt(10, 10)))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := tritontest.NewServer(tc.model)
+			defer server.Close()
+			backend, err := server.Backend()
+			assert.NoError(t, err)
+
+			client, err := NewYOLOFaceDetectionClient(backend, config.DefaultYOLOFaceDetectionParams)
+			assert.NoError(t, err)
+			assert.NoError(t, client.Ready())
+			assert.NoError(t, client.Validate())
+
+			img := newTestImage(1280, 1280)
+			defer img.Close()
+
+			// The 512x512 box centered on (336, 336) in the model input, the stride 16 prediction is removed by NMS.
+			det, kpss, err := client.Infer(context.Background(), img)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{1, 5}, []int(det.Shape()))
+			assert.InDeltaSlice(t, []float32{160, 160, 1184, 1184, 0.9}, det.Float32s(), 1e-3)
+			assert.Equal(t, []int{1, 5, 2}, []int(kpss.Shape()))
+			assert.InDeltaSlice(t, []float32{160 + 38.2946/112*1024, 160 + 51.6963/112*1024}, kpss.Float32s()[:2], 1e-2)
+			assert.Zero(t, matPool.Outstanding())
+		})
+	}
+}
+
+func TestYOLOFaceDetectionClient_DecodeNMS(t *testing.T) {
+	server := tritontest.NewServer(tritontest.YOLOFaceModel())
+	defer server.Close()
+	backend, err := server.Backend()
+	assert.NoError(t, err)
+
+	client, err := NewYOLOFaceDetectionClient(backend, config.DefaultYOLOFaceDetectionParams)
+	assert.NoError(t, err)
+
+	// cx, cy, w, h and confidence of the predictions: two pairs of overlapping boxes, where the second box of the
+	// second pair has the higher confidence, a box barely overlapping the first one and one below the threshold.
+	predictions := [][5]float32{
+		{100, 100, 80, 80, 0.9},
+		{105, 102, 80, 80, 0.8},
+		{160, 100, 80, 80, 0.85},
+		{300, 300, 50, 50, 0.7},
+		{302, 300, 50, 50, 0.75},
+		{500, 500, 40, 40, 0.3},
+	}
+	data := make([]float32, 0, len(predictions)*client.attributes)
+	candidates := make([]float32, 0, 5*len(predictions))
+	for _, p := range predictions {
+		data = append(data, p[:]...)
+		for range yoloNumKeypoints {
+			data = append(data, p[0], p[1], 1)
+		}
+		if p[4] >= client.ModelParams.ConfidenceThreshold {
+			candidates = append(candidates, p[0]-p[2]/2, p[1]-p[3]/2, p[0]+p[2]/2, p[1]+p[3]/2, p[4])
+		}
+	}
+	netOut := tensor.New(tensor.WithShape(1, len(predictions), client.attributes), tensor.WithBacking(data))
+
+	det, kpss, err := client.decode([]*tensor.Dense{netOut}, 0, 1)
+	assert.NoError(t, err)
+
+	// The detections are the candidates kept by processing.NMS, by descending confidence.
+	keep, err := processing.NMS(tensor.New(tensor.WithShape(len(candidates)/5, 5), tensor.WithBacking(candidates)), client.ModelParams.IOUThreshold)
+	assert.NoError(t, err)
+	expected := make([]float32, 0, 5*len(keep))
+	for _, idx := range keep {
+		expected = append(expected, candidates[5*idx:5*idx+5]...)
+	}
+	assert.Len(t, keep, 3)
+	assert.Equal(t, []int{len(keep), 5}, []int(det.Shape()))
+	assert.InDeltaSlice(t, expected, det.Float32s(), 1e-5)
+
+	assert.Equal(t, []int{len(keep), 5, 2}, []int(kpss.Shape()))
+	for i := range keep {
+		row := expected[5*i : 5*i+5]
+		assert.InDeltaSlice(t, []float32{(row[0] + row[2]) / 2, (row[1] + row[3]) / 2}, kpss.Float32s()[10*i:10*i+2], 1e-5)
+	}
+
+	// No prediction above the confidence threshold.
+	netOut = tensor.New(tensor.WithShape(1, 1, client.attributes), tensor.WithBacking(data[5*client.attributes:]))
+	det, kpss, err = client.decode([]*tensor.Dense{netOut}, 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 5}, []int(det.Shape()))
+	assert.Equal(t, []int{0, 5, 2}, []int(kpss.Shape()))
+}
+
+func TestYOLOFaceDetectionClient_Contract(t *testing.T) {
+	server := tritontest.NewServer(tritontest.YOLOFaceModel(), tritontest.RetinaFaceModel())
+	defer server.Close()
+	backend, err := server.Backend()
+	assert.NoError(t, err)
+
+	cfg := *config.DefaultYOLOFaceDetectionParams
+	cfg.ModelName = config.DefaultRetinaFaceDetectionParams.ModelName
+	_, err = NewYOLOFaceDetectionClient(backend, &cfg)
+	assert.ErrorContains(t, err, "has 9 outputs, expected a single prediction tensor")
+
+	cfg = *config.DefaultYOLOFaceDetectionParams
+	cfg.KeypointDims = 4
+	_, err = NewYOLOFaceDetectionClient(backend, &cfg)
+	assert.ErrorContains(t, err, "keypoint dims must be 2 or 3")
+
+	// Keypoints without visibility need 15 attributes per prediction, the model has 20.
+	cfg.KeypointDims = 2
+	client, err := NewYOLOFaceDetectionClient(backend, &cfg)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, client.Validate(), "expected 15 attributes per prediction")
+}
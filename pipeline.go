@@ -1,12 +1,16 @@
 package go_faceid_pipeline
 
 import (
+	"context"
+	"errors"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
 	"github.com/okieraised/go-faceid-pipeline/modules"
 	"github.com/okieraised/go-faceid-pipeline/utils"
-	gotritonclient "github.com/okieraised/go-triton-client"
 	"gocv.io/x/gocv"
 	"gorgonia.org/tensor"
+	"sync"
+	"time"
 )
 
 type GeneralExtractionResult struct {
@@ -27,50 +31,262 @@ type AntiSpoofingExtractionResult struct {
 	QualityAssessmentClass config.FaceQualityClass `json:"quality_assessment_class"`
 }
 
+// newPipelineBackend wraps backend with the shared-memory transport, the micro-batching dispatcher and the model
+// admission control when cfg enables them. Admission control comes first so that queued requests do not wait in
+// the batching dispatcher.
+func newPipelineBackend(backend inference.Backend, cfg *config.PipelineParams) (inference.Backend, *inference.SharedMemoryBackend, *inference.AdmissionBackend, error) {
+	var sharedMemory *inference.SharedMemoryBackend
+	if cfg.SharedMemory != nil {
+		var err error
+		sharedMemory, err = inference.NewSharedMemoryBackend(backend, cfg.SharedMemory)
+		if err != nil {
+			return backend, nil, nil, err
+		}
+		backend = sharedMemory
+	}
+	if cfg.MicroBatching != nil {
+		models := []inference.BatchedModel{
+			detectionModel(cfg),
+			{
+				ModelName:    cfg.ArcFaceRecognition.ModelName,
+				ModelVersion: cfg.ArcFaceRecognition.ModelVersion,
+				MaxBatchSize: cfg.ArcFaceRecognition.BatchSize,
+			},
+		}
+		if cfg.ShadowArcFaceRecognition != nil {
+			models = append(models, inference.BatchedModel{
+				ModelName:    cfg.ShadowArcFaceRecognition.ModelName,
+				ModelVersion: cfg.ShadowArcFaceRecognition.ModelVersion,
+				MaxBatchSize: cfg.ShadowArcFaceRecognition.BatchSize,
+			})
+		}
+		backend = inference.NewBatchingBackend(backend, cfg.MicroBatching, models...)
+	}
+	var modelAdmission *inference.AdmissionBackend
+	if len(cfg.ModelAdmission) > 0 {
+		var err error
+		modelAdmission, err = inference.NewAdmissionBackend(backend, cfg.ModelAdmission)
+		if err != nil {
+			return backend, sharedMemory, nil, err
+		}
+		backend = modelAdmission
+	}
+	return backend, sharedMemory, modelAdmission, nil
+}
+
+// detectionModel returns the detection model of cfg: SCRFDDetection or YOLOFaceDetection when set and
+// RetinaFaceDetection otherwise.
+func detectionModel(cfg *config.PipelineParams) inference.BatchedModel {
+	switch {
+	case cfg.SCRFDDetection != nil:
+		return inference.BatchedModel{
+			ModelName:    cfg.SCRFDDetection.ModelName,
+			ModelVersion: cfg.SCRFDDetection.ModelVersion,
+			MaxBatchSize: cfg.SCRFDDetection.MaxBatchSize,
+		}
+	case cfg.YOLOFaceDetection != nil:
+		return inference.BatchedModel{
+			ModelName:    cfg.YOLOFaceDetection.ModelName,
+			ModelVersion: cfg.YOLOFaceDetection.ModelVersion,
+			MaxBatchSize: cfg.YOLOFaceDetection.MaxBatchSize,
+		}
+	}
+	return inference.BatchedModel{
+		ModelName:    cfg.RetinaFaceDetection.ModelName,
+		ModelVersion: cfg.RetinaFaceDetection.ModelVersion,
+		MaxBatchSize: cfg.RetinaFaceDetection.MaxBatchSize,
+	}
+}
+
+// newFaceDetector creates the face detector configured by cfg: SCRFDDetection or YOLOFaceDetection when set and
+// RetinaFaceDetection otherwise, run on tiles when Tiling is set.
+func newFaceDetector(backend inference.Backend, cfg *config.PipelineParams) (modules.FaceDetector, error) {
+	var detector modules.FaceDetector
+	var err error
+	switch {
+	case cfg.SCRFDDetection != nil && cfg.YOLOFaceDetection != nil:
+		return nil, errors.New("only one of SCRFDDetection and YOLOFaceDetection can be set")
+	case cfg.SCRFDDetection != nil:
+		detector, err = modules.NewSCRFDDetectionClient(backend, cfg.SCRFDDetection)
+	case cfg.YOLOFaceDetection != nil:
+		detector, err = modules.NewYOLOFaceDetectionClient(backend, cfg.YOLOFaceDetection)
+	default:
+		detector, err = modules.NewFaceDetectionClient(backend, cfg.RetinaFaceDetection)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Tiling == nil {
+		return detector, nil
+	}
+	return modules.NewTiledFaceDetector(detector, cfg.Tiling)
+}
+
+// serverLive returns an error unless the backend reports the server as live.
+// Backends that do not implement inference.HealthChecker are assumed live.
+func serverLive(backend inference.Backend, timeout time.Duration) error {
+	checker, ok := backend.(inference.HealthChecker)
+	if !ok {
+		return nil
+	}
+	live, err := checker.ServerLive(timeout)
+	if err != nil {
+		return err
+	}
+	if !live {
+		return errors.New("inference server is not live")
+	}
+	return nil
+}
+
+// GeneralExtractPipeline detects, selects, aligns and checks the quality of a face before extracting its features.
+// It is safe for concurrent use once created; SetShadowHandler must be called before any call.
 type GeneralExtractPipeline struct {
-	tritonClient   *gotritonclient.TritonGRPCClient
-	faceDetection  *modules.FaceDetectionClient
+	backend        inference.Backend
+	sharedMemory   *inference.SharedMemoryBackend
+	faceDetection  modules.FaceDetector
 	faceSelection  *modules.FaceSelectionClient
 	faceAlignment  *modules.FaceAlignmentClient
 	faceQuality    *modules.FaceQualityClient
 	faceExtraction *modules.FaceExtractionClient
+	shadow         *shadowEvaluator
+	deadlineBudget *config.DeadlineBudgetParams
+	admission      admission
 }
 
 // NewGeneralExtractPipeline initializes new faceid pipeline
-func NewGeneralExtractPipeline(tritonClient *gotritonclient.TritonGRPCClient) (*GeneralExtractPipeline, error) {
-	client := &GeneralExtractPipeline{}
+func NewGeneralExtractPipeline(backend inference.Backend, cfg *config.PipelineParams) (client *GeneralExtractPipeline, err error) {
+	client = &GeneralExtractPipeline{}
+
+	backend, sharedMemory, modelAdmission, err := newPipelineBackend(backend, cfg)
+	defer func() {
+		if err != nil && sharedMemory != nil {
+			_ = sharedMemory.Close()
+		}
+	}()
+	if err != nil {
+		return client, err
+	}
+	client.backend = backend
+	client.sharedMemory = sharedMemory
+	client.deadlineBudget = cfg.DeadlineBudget
+
+	client.admission, err = newAdmission(cfg, modelAdmission)
+	if err != nil {
+		return client, err
+	}
 
-	faceDetection, err := modules.NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	faceDetection, err := newFaceDetector(backend, cfg)
 	if err != nil {
 		return client, err
 	}
 	client.faceDetection = faceDetection
 
-	faceSelection := modules.NewFaceSelectionClient(config.DefaultFaceSelectionParams)
+	faceSelection := modules.NewFaceSelectionClient(cfg.FaceSelection)
 	client.faceSelection = faceSelection
 
-	faceAlignment := modules.NewFaceAlignmentClient(config.DefaultFaceAlignParams)
+	faceAlignment := modules.NewFaceAlignmentClient(cfg.FaceAlign)
 	client.faceAlignment = faceAlignment
-	faceQuality, err := modules.NewFaceQualityClient(tritonClient, config.DefaultFaceQualityParams)
+	faceQuality, err := modules.NewFaceQualityClient(backend, cfg.FaceQuality)
 	if err != nil {
 		return client, err
 	}
 	client.faceQuality = faceQuality
 
-	faceExtraction, err := modules.NewFaceExtractionClient(tritonClient, config.DefaultArcFaceRecognitionParams)
+	faceExtraction, err := modules.NewFaceExtractionClient(backend, cfg.ArcFaceRecognition)
 	if err != nil {
 		return client, err
 	}
 	client.faceExtraction = faceExtraction
 
+	shadow, err := newShadowEvaluator(backend, cfg)
+	if err != nil {
+		return client, err
+	}
+	client.shadow = shadow
+
 	return client, nil
 }
 
-func (c *GeneralExtractPipeline) ExtractFaceFeatures(img gocv.Mat, isEnroll bool) (*GeneralExtractionResult, error) {
+// Ready returns an error unless the server is live and every model used by the pipeline is ready.
+func (c *GeneralExtractPipeline) Ready() error {
+	err := serverLive(c.backend, c.faceExtraction.ModelParams.Timeout)
+	if err != nil {
+		return err
+	}
+	return errors.Join(
+		c.faceDetection.Ready(),
+		c.faceQuality.Ready(),
+		c.faceExtraction.Ready(),
+	)
+}
+
+// Validate checks Ready and that the inputs and outputs of every model match what its module expects.
+// The shadow model is not checked.
+func (c *GeneralExtractPipeline) Validate() error {
+	err := c.Ready()
+	if err != nil {
+		return err
+	}
+	return errors.Join(
+		c.faceDetection.Validate(),
+		c.faceQuality.Validate(),
+		c.faceExtraction.Validate(),
+	)
+}
+
+// SetShadowHandler replaces the handler receiving shadow model results, LogShadowResult by default.
+// It must be called before the pipeline is used.
+func (c *GeneralExtractPipeline) SetShadowHandler(handler ShadowHandler) {
+	if c.shadow != nil {
+		c.shadow.handler = handler
+	}
+}
+
+// AdmissionStats returns the admission counters of the pipeline and of its limited models.
+func (c *GeneralExtractPipeline) AdmissionStats() AdmissionStats {
+	return c.admission.stats()
+}
+
+// ShadowStats returns the shadow evaluation counters of the pipeline, zero without a shadow model.
+func (c *GeneralExtractPipeline) ShadowStats() ShadowStats {
+	return c.shadow.stats()
+}
+
+// Close waits for running shadow evaluations and releases the resources owned by the pipeline, such as the
+// shared-memory region registered with Triton. The backend passed to the constructor is not closed.
+func (c *GeneralExtractPipeline) Close() error {
+	c.shadow.wait()
+	if c.sharedMemory != nil {
+		return c.sharedMemory.Close()
+	}
+	return nil
+}
+
+// ExtractFaceFeatures detects the faces of img and extracts the features of the selected one. It stops at the
+// first stage that fails or finds ctx done; the deadline of ctx is split across the stages when the pipeline
+// has a deadline budget.
+func (c *GeneralExtractPipeline) ExtractFaceFeatures(ctx context.Context, img gocv.Mat, isEnroll bool) (*GeneralExtractionResult, error) {
 	var err error
 	resp := &GeneralExtractionResult{}
 
-	detections, keyPoints, err := c.faceDetection.Infer(img)
+	var budget *deadlineBudget
+	if c.deadlineBudget != nil {
+		var cancel context.CancelFunc
+		ctx, cancel, budget = newDeadlineBudget(ctx, c.deadlineBudget,
+			c.deadlineBudget.DetectionWeight, c.deadlineBudget.QualityWeight, c.deadlineBudget.ExtractionWeight)
+		defer cancel()
+	}
+
+	release, err := c.admission.acquire(ctx)
+	if err != nil {
+		return resp, err
+	}
+	defer release()
+
+	stageCtx, stageCancel := budget.stage(ctx)
+	detections, keyPoints, err := c.faceDetection.Infer(stageCtx, img)
+	stageCancel()
 	if err != nil {
 		return resp, err
 	}
@@ -98,64 +314,106 @@ func (c *GeneralExtractPipeline) ExtractFaceFeatures(img gocv.Mat, isEnroll bool
 			}
 		}(alignedFaceImages)
 
-		qualityScores, qualityClasses, err := c.faceQuality.Infer([]gocv.Mat{*alignedFaceImages})
+		stageCtx, stageCancel := budget.stage(ctx)
+		qualityScores, qualityClasses, err := c.faceQuality.Infer(stageCtx, []gocv.Mat{*alignedFaceImages})
+		stageCancel()
 		if err != nil {
 			return resp, err
 		}
 		resp.QualityScore = qualityScores[0]
 		resp.FaceQuality = config.FaceQualityClass(qualityClasses[0])
 
-		facialFeatures, err := c.faceExtraction.Infer([]gocv.Mat{*alignedFaceImages})
+		stageCtx, stageCancel = budget.stage(ctx)
+		facialFeatures, err := c.faceExtraction.Infer(stageCtx, []gocv.Mat{*alignedFaceImages})
+		stageCancel()
 		if err != nil {
 			return resp, err
 		}
 		resp.FacialFeatures = facialFeatures[0]
+		c.shadow.evaluate(*alignedFaceImages, facialFeatures[0])
 	}
 
 	return resp, nil
 }
 
+// AntiSpoofingExtractPipeline extends GeneralExtractPipeline with anti-spoofing and quality assessment. It is safe
+// for concurrent use once created; SetShadowHandler must be called before any call.
 type AntiSpoofingExtractPipeline struct {
-	tritonClient          *gotritonclient.TritonGRPCClient
-	faceDetection         *modules.FaceDetectionClient
+	backend               inference.Backend
+	sharedMemory          *inference.SharedMemoryBackend
+	faceDetection         modules.FaceDetector
 	faceSelection         *modules.FaceSelectionClient
 	faceAlignment         *modules.FaceAlignmentClient
 	faceQuality           *modules.FaceQualityClient
 	faceExtraction        *modules.FaceExtractionClient
 	faceAntiSpoofing      *modules.FaceAntiSpoofingClient
 	faceQualityAssessment *modules.FaceQualityAssessmentClient
+	shadow                *shadowEvaluator
+	deadlineBudget        *config.DeadlineBudgetParams
+	admission             admission
+	parallelStages        bool
+	// stages tracks the canceled parallel stages still running after their call returned.
+	stages sync.WaitGroup
 }
 
-func NewAntiSpoofingExtractPipeline(tritonClient *gotritonclient.TritonGRPCClient) (*AntiSpoofingExtractPipeline, error) {
-	client := &AntiSpoofingExtractPipeline{}
+func NewAntiSpoofingExtractPipeline(backend inference.Backend, cfg *config.PipelineParams) (client *AntiSpoofingExtractPipeline, err error) {
+	client = &AntiSpoofingExtractPipeline{}
+	client.parallelStages = cfg.ParallelStages
+
+	backend, sharedMemory, modelAdmission, err := newPipelineBackend(backend, cfg)
+	defer func() {
+		if err != nil && sharedMemory != nil {
+			_ = sharedMemory.Close()
+		}
+	}()
+	if err != nil {
+		return client, err
+	}
+	client.backend = backend
+	client.sharedMemory = sharedMemory
+	client.deadlineBudget = cfg.DeadlineBudget
+
+	client.admission, err = newAdmission(cfg, modelAdmission)
+	if err != nil {
+		return client, err
+	}
 
-	faceDetection, err := modules.NewFaceDetectionClient(tritonClient, config.DefaultRetinaFaceDetectionParams)
+	faceDetection, err := newFaceDetector(backend, cfg)
 	if err != nil {
 		return client, err
 	}
 	client.faceDetection = faceDetection
 
-	faceSelection := modules.NewFaceSelectionClient(config.DefaultFaceSelectionParams)
+	faceSelection := modules.NewFaceSelectionClient(cfg.FaceSelection)
 	client.faceSelection = faceSelection
 
-	faceAlignment := modules.NewFaceAlignmentClient(config.DefaultFaceAlignParams)
+	faceAlignment := modules.NewFaceAlignmentClient(cfg.FaceAlign)
 	client.faceAlignment = faceAlignment
-	faceQuality, err := modules.NewFaceQualityClient(tritonClient, config.DefaultFaceQualityParams)
+	faceQuality, err := modules.NewFaceQualityClient(backend, cfg.FaceQuality)
 	if err != nil {
 		return client, err
 	}
 	client.faceQuality = faceQuality
 
-	faceExtraction, err := modules.NewFaceExtractionClient(tritonClient, config.DefaultArcFaceRecognitionParams)
+	faceExtraction, err := modules.NewFaceExtractionClient(backend, cfg.ArcFaceRecognition)
 	if err != nil {
 		return client, err
 	}
 	client.faceExtraction = faceExtraction
 
-	faceAntiSpoofing := modules.NewFaceAntiSpoofingClient(tritonClient, config.DefaultFaceAntiSpoofingParam)
+	shadow, err := newShadowEvaluator(backend, cfg)
+	if err != nil {
+		return client, err
+	}
+	client.shadow = shadow
+
+	faceAntiSpoofing, err := modules.NewFaceAntiSpoofingClient(backend, cfg.FaceAntiSpoofing)
+	if err != nil {
+		return client, err
+	}
 	client.faceAntiSpoofing = faceAntiSpoofing
 
-	faceQualityAssessment, err := modules.NewFaceQualityAssessmentClient(tritonClient, config.DefaultFaceQualityAssessmentParams)
+	faceQualityAssessment, err := modules.NewFaceQualityAssessmentClient(backend, cfg.FaceQualityAssessment)
 	if err != nil {
 		return client, err
 	}
@@ -164,11 +422,104 @@ func NewAntiSpoofingExtractPipeline(tritonClient *gotritonclient.TritonGRPCClien
 	return client, nil
 }
 
-func (c *AntiSpoofingExtractPipeline) ExtractFaceFeatures(img gocv.Mat, isEnroll, spoofingControl bool) (*AntiSpoofingExtractionResult, error) {
+// Ready returns an error unless the server is live and every model used by the pipeline is ready.
+func (c *AntiSpoofingExtractPipeline) Ready() error {
+	err := serverLive(c.backend, c.faceExtraction.ModelParams.Timeout)
+	if err != nil {
+		return err
+	}
+	return errors.Join(
+		c.faceDetection.Ready(),
+		c.faceQuality.Ready(),
+		c.faceExtraction.Ready(),
+		c.faceAntiSpoofing.Ready(),
+		c.faceQualityAssessment.Ready(),
+	)
+}
+
+// Validate checks Ready and that the inputs and outputs of every model match what its module expects.
+// The shadow model is not checked.
+func (c *AntiSpoofingExtractPipeline) Validate() error {
+	err := c.Ready()
+	if err != nil {
+		return err
+	}
+	return errors.Join(
+		c.faceDetection.Validate(),
+		c.faceQuality.Validate(),
+		c.faceExtraction.Validate(),
+		c.faceAntiSpoofing.Validate(),
+		c.faceQualityAssessment.Validate(),
+	)
+}
+
+// SetShadowHandler replaces the handler receiving shadow model results, LogShadowResult by default.
+// It must be called before the pipeline is used.
+func (c *AntiSpoofingExtractPipeline) SetShadowHandler(handler ShadowHandler) {
+	if c.shadow != nil {
+		c.shadow.handler = handler
+	}
+}
+
+// AdmissionStats returns the admission counters of the pipeline and of its limited models.
+func (c *AntiSpoofingExtractPipeline) AdmissionStats() AdmissionStats {
+	return c.admission.stats()
+}
+
+// ShadowStats returns the shadow evaluation counters of the pipeline, zero without a shadow model.
+func (c *AntiSpoofingExtractPipeline) ShadowStats() ShadowStats {
+	return c.shadow.stats()
+}
+
+// Close waits for running shadow evaluations and canceled parallel stages, and releases the resources owned by the
+// pipeline, such as the shared-memory region registered with Triton. The backend passed to the constructor is not
+// closed.
+func (c *AntiSpoofingExtractPipeline) Close() error {
+	c.stages.Wait()
+	c.shadow.wait()
+	if c.sharedMemory != nil {
+		return c.sharedMemory.Close()
+	}
+	return nil
+}
+
+// ExtractFaceFeatures detects the faces of img, checks the selected one for spoofing when spoofingControl is set
+// and assesses its quality before extracting its features. It stops at the first stage that fails or finds ctx
+// done; the deadline of ctx is split across the stages when the pipeline has a deadline budget. With parallel
+// stages, the stages following detection share the rest of the budget.
+func (c *AntiSpoofingExtractPipeline) ExtractFaceFeatures(ctx context.Context, img gocv.Mat, isEnroll, spoofingControl bool) (*AntiSpoofingExtractionResult, error) {
 	var err error
 	resp := &AntiSpoofingExtractionResult{}
 
-	detections, keyPoints, err := c.faceDetection.Infer(img)
+	var budget *deadlineBudget
+	if c.deadlineBudget != nil {
+		weights := []float64{c.deadlineBudget.DetectionWeight}
+		if spoofingControl {
+			weights = append(weights, c.deadlineBudget.AntiSpoofingWeight)
+		}
+		weights = append(weights, c.deadlineBudget.QualityWeight, c.deadlineBudget.ExtractionWeight)
+		if c.parallelStages {
+			rest := 0.0
+			for _, w := range weights[1:] {
+				rest += w
+			}
+			weights = []float64{weights[0], rest}
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel, budget = newDeadlineBudget(ctx, c.deadlineBudget, weights...)
+		defer cancel()
+	}
+
+	release, err := c.admission.acquire(ctx)
+	if err != nil {
+		return resp, err
+	}
+	defer release()
+
+	stageCtx, stageCancel := budget.stage(ctx)
+	detections, keyPoints, err := c.faceDetection.Infer(stageCtx, img)
+	stageCancel()
 	if err != nil {
 		return resp, err
 	}
@@ -182,6 +533,10 @@ func (c *AntiSpoofingExtractPipeline) ExtractFaceFeatures(img gocv.Mat, isEnroll
 		return resp, err
 	}
 
+	if selectedFaceBox != nil && c.parallelStages {
+		return c.extractParallel(ctx, budget, resp, img, selectedFaceBox, selectedFacePoint, isEnroll, spoofingControl)
+	}
+
 	if selectedFaceBox != nil {
 
 		if spoofingControl {
@@ -194,7 +549,9 @@ func (c *AntiSpoofingExtractPipeline) ExtractFaceFeatures(img gocv.Mat, isEnroll
 			if err != nil {
 				return resp, err
 			}
-			spoofingCheck, err := c.faceAntiSpoofing.Infer([]gocv.Mat{img}, []*tensor.Dense{faceBoxes})
+			stageCtx, stageCancel := budget.stage(ctx)
+			spoofingCheck, err := c.faceAntiSpoofing.Infer(stageCtx, []gocv.Mat{img}, []*tensor.Dense{faceBoxes})
+			stageCancel()
 			if err != nil {
 				return resp, err
 			}
@@ -215,14 +572,17 @@ func (c *AntiSpoofingExtractPipeline) ExtractFaceFeatures(img gocv.Mat, isEnroll
 			}
 		}(alignedFaceImages)
 
-		qualityScores, qualityClasses, err := c.faceQuality.Infer([]gocv.Mat{*alignedFaceImages})
+		stageCtx, stageCancel := budget.stage(ctx)
+		defer stageCancel()
+		qualityScores, qualityClasses, err := c.faceQuality.Infer(stageCtx, []gocv.Mat{*alignedFaceImages})
 		if err != nil {
 			return resp, err
 		}
 		resp.QualityScore = qualityScores[0]
 		resp.FaceQuality = config.FaceQualityClass(qualityClasses[0])
 
-		_, qualityAssessmentClasses, err := c.faceQualityAssessment.Infer([]gocv.Mat{*alignedFaceImages})
+		_, qualityAssessmentClasses, err := c.faceQualityAssessment.Infer(stageCtx, []gocv.Mat{*alignedFaceImages})
+		stageCancel()
 		if err != nil {
 			return resp, err
 		}
@@ -232,18 +592,24 @@ func (c *AntiSpoofingExtractPipeline) ExtractFaceFeatures(img gocv.Mat, isEnroll
 			if config.FaceQualityClass(qualityClasses[0]) == config.FaceQualityClassWearingMask {
 				return resp, nil
 			}
-			facialFeatures, err := c.faceExtraction.Infer([]gocv.Mat{*alignedFaceImages})
+			stageCtx, stageCancel := budget.stage(ctx)
+			facialFeatures, err := c.faceExtraction.Infer(stageCtx, []gocv.Mat{*alignedFaceImages})
+			stageCancel()
 			if err != nil {
 				return resp, err
 			}
 			resp.FacialFeatures = facialFeatures[0]
+			c.shadow.evaluate(*alignedFaceImages, facialFeatures[0])
 		} else {
 			if config.FaceQualityClass(qualityClasses[0]) == config.FaceQualityClassGood && config.FaceQualityClass(qualityAssessmentClasses[0]) == config.FaceQualityClassGood {
-				facialFeatures, err := c.faceExtraction.Infer([]gocv.Mat{*alignedFaceImages})
+				stageCtx, stageCancel := budget.stage(ctx)
+				facialFeatures, err := c.faceExtraction.Infer(stageCtx, []gocv.Mat{*alignedFaceImages})
+				stageCancel()
 				if err != nil {
 					return resp, err
 				}
 				resp.FacialFeatures = facialFeatures[0]
+				c.shadow.evaluate(*alignedFaceImages, facialFeatures[0])
 			} else {
 				resp.QualityAssessmentClass = config.FaceQualityClassBad
 			}
@@ -251,3 +617,133 @@ func (c *AntiSpoofingExtractPipeline) ExtractFaceFeatures(img gocv.Mat, isEnroll
 	}
 	return resp, nil
 }
+
+// The stages following face selection, in the order the serial path runs them.
+const (
+	stageAntiSpoofing = iota
+	stageQuality
+	stageQualityAssessment
+	stageExtraction
+	stageCount
+)
+
+// extractParallel runs the anti-spoofing, quality, quality assessment and extraction stages of ExtractFaceFeatures
+// concurrently on the selected face. The stage results are applied to resp in the serial order, so resp and the
+// returned error are those of the serial path. Extraction starts speculatively and is canceled as soon as a quality
+// result rules it out.
+func (c *AntiSpoofingExtractPipeline) extractParallel(ctx context.Context, budget *deadlineBudget, resp *AntiSpoofingExtractionResult, img gocv.Mat, selectedFaceBox, selectedFacePoint *tensor.Dense, isEnroll, spoofingControl bool) (*AntiSpoofingExtractionResult, error) {
+	var faceBoxes *tensor.Dense
+	if spoofingControl {
+		faceBoxesS, err := selectedFaceBox.Slice(tensor.S(0, 4))
+		if err != nil {
+			return resp, err
+		}
+		faceBoxes = tensor.New(tensor.Of(tensor.Float32), tensor.WithShape(selectedFaceBox.Shape()...))
+		err = tensor.Copy(faceBoxes, faceBoxesS)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	stageCtx, stageCancel := budget.stage(ctx)
+	stages := newParallelStages(stageCtx, stageCount)
+
+	var alignedFaceImages *gocv.Mat
+	defer func() {
+		stages.stop(&c.stages, func() {
+			stageCancel()
+			if alignedFaceImages != nil {
+				_ = alignedFaceImages.Close()
+			}
+		})
+	}()
+
+	var spoofing int
+	if spoofingControl {
+		stages.run(stageAntiSpoofing, func(ctx context.Context) error {
+			spoofingCheck, err := c.faceAntiSpoofing.Infer(ctx, []gocv.Mat{img}, []*tensor.Dense{faceBoxes})
+			if err != nil {
+				return err
+			}
+			spoofing = spoofingCheck[0].Ints()[0]
+			return nil
+		})
+	}
+
+	var qualityScore float32
+	var qualityClass, qualityAssessmentClass config.FaceQualityClass
+	var facialFeatures []*tensor.Dense
+	var alignErr error
+	alignedFaceImages, alignErr = c.faceAlignment.Infer(img, selectedFaceBox, selectedFacePoint)
+	if alignErr == nil {
+		alignedFace := *alignedFaceImages
+		stages.run(stageQuality, func(ctx context.Context) error {
+			qualityScores, qualityClasses, err := c.faceQuality.Infer(ctx, []gocv.Mat{alignedFace})
+			if err != nil {
+				return err
+			}
+			qualityScore, qualityClass = qualityScores[0], config.FaceQualityClass(qualityClasses[0])
+			if (!isEnroll && qualityClass == config.FaceQualityClassWearingMask) || (isEnroll && qualityClass != config.FaceQualityClassGood) {
+				stages.cancel(stageExtraction)
+			}
+			return nil
+		})
+		stages.run(stageQualityAssessment, func(ctx context.Context) error {
+			_, qualityAssessmentClasses, err := c.faceQualityAssessment.Infer(ctx, []gocv.Mat{alignedFace})
+			if err != nil {
+				return err
+			}
+			qualityAssessmentClass = config.FaceQualityClass(qualityAssessmentClasses[0])
+			if isEnroll && qualityAssessmentClass != config.FaceQualityClassGood {
+				stages.cancel(stageExtraction)
+			}
+			return nil
+		})
+		stages.run(stageExtraction, func(ctx context.Context) error {
+			var err error
+			facialFeatures, err = c.faceExtraction.Infer(ctx, []gocv.Mat{alignedFace})
+			return err
+		})
+	}
+
+	err := stages.wait(stageAntiSpoofing)
+	if err != nil {
+		return resp, err
+	}
+	if spoofingControl {
+		resp.SpoofingCheck = spoofing
+	}
+	resp.SelectedFaceBox = selectedFaceBox
+	if alignErr != nil {
+		return resp, alignErr
+	}
+
+	err = stages.wait(stageQuality)
+	if err != nil {
+		return resp, err
+	}
+	resp.QualityScore = qualityScore
+	resp.FaceQuality = qualityClass
+
+	err = stages.wait(stageQualityAssessment)
+	if err != nil {
+		return resp, err
+	}
+	resp.QualityAssessmentClass = qualityAssessmentClass
+
+	if !isEnroll && qualityClass == config.FaceQualityClassWearingMask {
+		return resp, nil
+	}
+	if isEnroll && (qualityClass != config.FaceQualityClassGood || qualityAssessmentClass != config.FaceQualityClassGood) {
+		resp.QualityAssessmentClass = config.FaceQualityClassBad
+		return resp, nil
+	}
+
+	err = stages.wait(stageExtraction)
+	if err != nil {
+		return resp, err
+	}
+	resp.FacialFeatures = facialFeatures[0]
+	c.shadow.evaluate(*alignedFaceImages, facialFeatures[0])
+	return resp, nil
+}
@@ -1,24 +1,43 @@
 package go_faceid_pipeline
 
 import (
+	"context"
 	"fmt"
 	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/tritontest"
 	"github.com/okieraised/go-faceid-pipeline/utils"
 	gotritonclient "github.com/okieraised/go-triton-client"
+	"github.com/okieraised/go-triton-client/triton_proto"
 	"github.com/stretchr/testify/assert"
 	"gocv.io/x/gocv"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
+	"image"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
-	tritonTestURL = "10.124.68.173:8603"
+	onnxTestModelRepository = "./models"
 )
 
+// tritonTestURL points the integration tests at a live Triton server. They are skipped when TRITON_TEST_URL is unset,
+// the hermetic tests use the in-process tritontest server instead.
+var tritonTestURL = os.Getenv("TRITON_TEST_URL")
+
+func skipWithoutTriton(t *testing.T) {
+	if tritonTestURL == "" {
+		t.Skip("TRITON_TEST_URL is not set")
+	}
+}
+
 func genTestDataSingleFace() (*gocv.Mat, error) {
 	f, err := os.Open("./test_data/single.jpg")
 	if err != nil {
@@ -77,6 +96,8 @@ func genTestDataNoFace() (*gocv.Mat, error) {
 }
 
 func TestNewGeneralExtractPipeline_Single(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -88,10 +109,10 @@ func TestNewGeneralExtractPipeline_Single(t *testing.T) {
 	assert.NoError(t, err)
 	defer img.Close()
 
-	client, err := NewGeneralExtractPipeline(tritonClient)
+	client, err := NewGeneralExtractPipeline(inference.NewTritonGRPCBackend(tritonClient), config.DefaultPipelineParams)
 	assert.NoError(t, err)
 
-	resp, err := client.ExtractFaceFeatures(*img, false)
+	resp, err := client.ExtractFaceFeatures(context.Background(), *img, false)
 	assert.NoError(t, err)
 	assert.Equal(t, config.FaceQualityClassGood, resp.FaceQuality)
 
@@ -99,6 +120,8 @@ func TestNewGeneralExtractPipeline_Single(t *testing.T) {
 }
 
 func TestNewGeneralExtractPipeline_Multiple(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -110,10 +133,10 @@ func TestNewGeneralExtractPipeline_Multiple(t *testing.T) {
 	assert.NoError(t, err)
 	defer img.Close()
 
-	client, err := NewGeneralExtractPipeline(tritonClient)
+	client, err := NewGeneralExtractPipeline(inference.NewTritonGRPCBackend(tritonClient), config.DefaultPipelineParams)
 	assert.NoError(t, err)
 
-	resp, err := client.ExtractFaceFeatures(*img, false)
+	resp, err := client.ExtractFaceFeatures(context.Background(), *img, false)
 	assert.NoError(t, err)
 	assert.Equal(t, config.FaceQualityClassGood, resp.FaceQuality)
 	assert.Equal(t, 10, resp.FaceCount)
@@ -123,6 +146,8 @@ func TestNewGeneralExtractPipeline_Multiple(t *testing.T) {
 }
 
 func TestNewGeneralExtractPipeline_NoFace(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -134,16 +159,18 @@ func TestNewGeneralExtractPipeline_NoFace(t *testing.T) {
 	assert.NoError(t, err)
 	defer img.Close()
 
-	client, err := NewGeneralExtractPipeline(tritonClient)
+	client, err := NewGeneralExtractPipeline(inference.NewTritonGRPCBackend(tritonClient), config.DefaultPipelineParams)
 	assert.NoError(t, err)
 
-	resp, err := client.ExtractFaceFeatures(*img, false)
+	resp, err := client.ExtractFaceFeatures(context.Background(), *img, false)
 	assert.NoError(t, err)
 	assert.Equal(t, config.FaceQualityClassBad, resp.FaceQuality)
 	assert.Equal(t, 0, resp.FaceCount)
 }
 
 func TestNewAntiSpoofingExtractPipeline_Single(t *testing.T) {
+	skipWithoutTriton(t)
+
 	tritonClient, err := gotritonclient.NewTritonGRPCClient(
 		tritonTestURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -155,13 +182,633 @@ func TestNewAntiSpoofingExtractPipeline_Single(t *testing.T) {
 	assert.NoError(t, err)
 	defer img.Close()
 
-	client, err := NewAntiSpoofingExtractPipeline(tritonClient)
+	client, err := NewAntiSpoofingExtractPipeline(inference.NewTritonGRPCBackend(tritonClient), config.DefaultPipelineParams)
 	assert.NoError(t, err)
 
-	resp, err := client.ExtractFaceFeatures(*img, false, false)
+	resp, err := client.ExtractFaceFeatures(context.Background(), *img, false, false)
 	assert.NoError(t, err)
 	assert.Equal(t, config.FaceQualityClassGood, resp.FaceQuality)
 	assert.Equal(t, 1, resp.FaceCount)
 
 	fmt.Println("resp", resp)
 }
+
+func TestNewAntiSpoofingExtractPipeline_Validate(t *testing.T) {
+	skipWithoutTriton(t)
+
+	tritonClient, err := gotritonclient.NewTritonGRPCClient(
+		tritonTestURL,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{PermitWithoutStream: true}),
+	)
+	assert.NoError(t, err)
+
+	client, err := NewAntiSpoofingExtractPipeline(inference.NewTritonGRPCBackend(tritonClient), config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Validate())
+}
+
+func TestNewGeneralExtractPipeline_ONNX(t *testing.T) {
+	if _, err := os.Stat(onnxTestModelRepository); err != nil {
+		t.Skipf("onnx model repository %s not available", onnxTestModelRepository)
+	}
+
+	backend, err := inference.NewONNXBackend(config.NewONNXRuntimeParams(onnxTestModelRepository, config.DefaultONNXRuntimeParams.SharedLibraryPath, 0, 0))
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	img, err := genTestDataSingleFace()
+	assert.NoError(t, err)
+	defer img.Close()
+
+	client, err := NewGeneralExtractPipeline(backend, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+
+	resp, err := client.ExtractFaceFeatures(context.Background(), *img, false)
+	assert.NoError(t, err)
+	assert.Equal(t, config.FaceQualityClassGood, resp.FaceQuality)
+	assert.Equal(t, 1, resp.FaceCount)
+}
+
+// newTestBackend starts an in-process Triton server serving models.
+func newTestBackend(t *testing.T, models []*tritontest.Model) (*tritontest.Server, inference.Backend) {
+	server := tritontest.NewServer(models...)
+	t.Cleanup(server.Close)
+
+	backend, err := server.Backend()
+	assert.NoError(t, err)
+	return server, backend
+}
+
+func newTestImage(width, height int) gocv.Mat {
+	return gocv.NewMatWithSizesWithScalar([]int{height, width}, gocv.MatTypeCV8UC3, gocv.NewScalar(0, 0, 0, 0))
+}
+
+func TestGeneralExtractPipeline_ExtractFaceFeatures(t *testing.T) {
+	_, backend := newTestBackend(t, tritontest.FaceIDModels(image.Pt(10, 10)))
+
+	client, err := NewGeneralExtractPipeline(backend, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.NoError(t, client.Validate())
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	resp, err := client.ExtractFaceFeatures(context.Background(), img, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resp.FaceCount)
+	assert.Equal(t, config.FaceQualityClassGood, resp.FaceQuality)
+	assert.InDelta(t, 0.9, resp.QualityScore, 1e-6)
+	assert.Equal(t, 512, resp.FacialFeatures.DataSize())
+	assert.InDeltaSlice(t, []float32{72, 72, 583, 583}, resp.SelectedFaceBox.Float32s()[:4], 1e-3)
+}
+
+func TestPipelines_Detectors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		model  *tritontest.Model
+		update func(cfg *config.PipelineParams)
+		box    []float32
+	}{
+		{
+			name:   "scrfd",
+			model:  tritontest.SCRFDModel(image.Pt(10, 10)),
+			update: func(cfg *config.PipelineParams) { cfg.SCRFDDetection = config.DefaultSCRFDDetectionParams },
+			box:    []float32{64, 64, 576, 576},
+		},
+		{
+			name:   "yolo",
+			model:  tritontest.YOLOFaceModel(image.Pt(10, 10)),
+			update: func(cfg *config.PipelineParams) { cfg.YOLOFaceDetection = config.DefaultYOLOFaceDetectionParams },
+			box:    []float32{80, 80, 592, 592},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, backend := newTestBackend(t, append(tritontest.FaceIDModels(), tc.model))
+
+			cfg := *config.DefaultPipelineParams
+			tc.update(&cfg)
+
+			img := newTestImage(640, 640)
+			defer img.Close()
+
+			general, err := NewGeneralExtractPipeline(backend, &cfg)
+			assert.NoError(t, err)
+			defer general.Close()
+			assert.NoError(t, general.Validate())
+
+			resp, err := general.ExtractFaceFeatures(context.Background(), img, false)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, resp.FaceCount)
+			assert.Equal(t, 512, resp.FacialFeatures.DataSize())
+			assert.InDeltaSlice(t, tc.box, resp.SelectedFaceBox.Float32s()[:4], 1e-3)
+
+			antiSpoofing, err := NewAntiSpoofingExtractPipeline(backend, &cfg)
+			assert.NoError(t, err)
+			defer antiSpoofing.Close()
+			assert.NoError(t, antiSpoofing.Validate())
+
+			antiSpoofingResp, err := antiSpoofing.ExtractFaceFeatures(context.Background(), img, true, true)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, antiSpoofingResp.FaceCount)
+			assert.Equal(t, 1, antiSpoofingResp.SpoofingCheck)
+			assert.Equal(t, 512, antiSpoofingResp.FacialFeatures.DataSize())
+
+			// The RetinaFace model is never used.
+			for _, req := range server.Requests() {
+				assert.NotEqual(t, config.DefaultRetinaFaceDetectionParams.ModelName, req.ModelName)
+			}
+		})
+	}
+
+	cfg := *config.DefaultPipelineParams
+	cfg.SCRFDDetection = config.DefaultSCRFDDetectionParams
+	cfg.YOLOFaceDetection = config.DefaultYOLOFaceDetectionParams
+	_, backend := newTestBackend(t, tritontest.FaceIDModels())
+	_, err := NewGeneralExtractPipeline(backend, &cfg)
+	assert.ErrorContains(t, err, "only one of SCRFDDetection and YOLOFaceDetection can be set")
+}
+
+func TestGeneralExtractPipeline_NoFace(t *testing.T) {
+	server, backend := newTestBackend(t, tritontest.FaceIDModels())
+
+	client, err := NewGeneralExtractPipeline(backend, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	img := newTestImage(640, 480)
+	defer img.Close()
+
+	resp, err := client.ExtractFaceFeatures(context.Background(), img, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, resp.FaceCount)
+	assert.Nil(t, resp.FacialFeatures)
+	assert.Len(t, server.Requests(), 1)
+}
+
+func TestGeneralExtractPipeline_Tiling(t *testing.T) {
+	server, backend := newTestBackend(t, tritontest.FaceIDModels())
+
+	cfg := *config.DefaultPipelineParams
+	cfg.Tiling = config.DefaultTilingParams
+	client, err := NewGeneralExtractPipeline(backend, &cfg)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.NoError(t, client.Validate())
+
+	img := newTestImage(1280, 1280)
+	defer img.Close()
+
+	resp, err := client.ExtractFaceFeatures(context.Background(), img, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, resp.FaceCount)
+
+	// The 3 x 3 tiles are sent one by one with a MaxBatchSize of 1, then the whole image.
+	detections := 0
+	for _, req := range server.Requests() {
+		if req.ModelName == config.DefaultRetinaFaceDetectionParams.ModelName {
+			detections++
+		}
+	}
+	assert.Equal(t, 10, detections)
+
+	cfg.Tiling = config.NewTilingParams([2]int{640, 640}, 640, true, 0.45)
+	_, err = NewGeneralExtractPipeline(backend, &cfg)
+	assert.ErrorContains(t, err, "must be smaller than the tiles")
+}
+
+func TestAntiSpoofingExtractPipeline_ExtractFaceFeatures(t *testing.T) {
+	_, backend := newTestBackend(t, tritontest.FaceIDModels(image.Pt(10, 10)))
+
+	client, err := NewAntiSpoofingExtractPipeline(backend, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.NoError(t, client.Validate())
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	resp, err := client.ExtractFaceFeatures(context.Background(), img, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resp.FaceCount)
+	assert.Equal(t, 1, resp.SpoofingCheck)
+	assert.Equal(t, config.FaceQualityClassGood, resp.FaceQuality)
+	assert.Equal(t, config.FaceQualityClassGood, resp.QualityAssessmentClass)
+	assert.Equal(t, 512, resp.FacialFeatures.DataSize())
+}
+
+// faceIDModelsWith returns FaceIDModels with the model named name modified by update.
+func faceIDModelsWith(name string, update func(model *tritontest.Model)) []*tritontest.Model {
+	models := tritontest.FaceIDModels(image.Pt(10, 10))
+	for _, model := range models {
+		if model.Config.Name == name {
+			update(model)
+		}
+	}
+	return models
+}
+
+func failingModel(model *tritontest.Model) {
+	model.Infer = func(*triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+		return nil, fmt.Errorf("%s failed", model.Config.Name)
+	}
+}
+
+func TestAntiSpoofingExtractPipeline_ParallelStages(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		models []*tritontest.Model
+	}{
+		{name: "good", models: tritontest.FaceIDModels(image.Pt(10, 10))},
+		{name: "mask", models: faceIDModelsWith(config.DefaultFaceQualityParams.ModelName, func(model *tritontest.Model) {
+			model.Outputs = map[string][]float32{"output": {0.05, 0.03, 0.9, 0.02}}
+		})},
+		{name: "bad_assessment", models: faceIDModelsWith(config.DefaultFaceQualityAssessmentParams.ModelName, func(model *tritontest.Model) {
+			model.Outputs = map[string][]float32{"output": {10}}
+		})},
+		{name: "quality_error", models: faceIDModelsWith(config.DefaultFaceQualityParams.ModelName, failingModel)},
+		{name: "assessment_error", models: faceIDModelsWith(config.DefaultFaceQualityAssessmentParams.ModelName, failingModel)},
+		{name: "extraction_error", models: faceIDModelsWith(config.DefaultArcFaceRecognitionParams.ModelName, failingModel)},
+		{name: "anti_spoofing_error", models: faceIDModelsWith(config.DefaultFaceAntiSpoofingParam.ModelNames[0], failingModel)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, backend := newTestBackend(t, tc.models)
+
+			serial, err := NewAntiSpoofingExtractPipeline(backend, config.DefaultPipelineParams)
+			assert.NoError(t, err)
+			defer serial.Close()
+
+			cfg := *config.DefaultPipelineParams
+			cfg.ParallelStages = true
+			parallel, err := NewAntiSpoofingExtractPipeline(backend, &cfg)
+			assert.NoError(t, err)
+			defer parallel.Close()
+
+			img := newTestImage(640, 640)
+			defer img.Close()
+
+			for _, isEnroll := range []bool{false, true} {
+				for _, spoofingControl := range []bool{false, true} {
+					expected, expectedErr := serial.ExtractFaceFeatures(context.Background(), img, isEnroll, spoofingControl)
+					actual, err := parallel.ExtractFaceFeatures(context.Background(), img, isEnroll, spoofingControl)
+
+					msg := fmt.Sprintf("isEnroll=%v spoofingControl=%v", isEnroll, spoofingControl)
+					if expectedErr != nil {
+						assert.EqualError(t, err, expectedErr.Error(), msg)
+					} else {
+						assert.NoError(t, err, msg)
+					}
+					assert.Equal(t, expected.FaceCount, actual.FaceCount, msg)
+					assert.Equal(t, expected.SpoofingCheck, actual.SpoofingCheck, msg)
+					assert.Equal(t, expected.FaceQuality, actual.FaceQuality, msg)
+					assert.Equal(t, expected.QualityScore, actual.QualityScore, msg)
+					assert.Equal(t, expected.QualityAssessmentClass, actual.QualityAssessmentClass, msg)
+					assert.Equal(t, expected.SelectedFaceBox == nil, actual.SelectedFaceBox == nil, msg)
+					if expected.SelectedFaceBox != nil && actual.SelectedFaceBox != nil {
+						assert.Equal(t, expected.SelectedFaceBox.Float32s(), actual.SelectedFaceBox.Float32s(), msg)
+					}
+					assert.Equal(t, expected.FacialFeatures == nil, actual.FacialFeatures == nil, msg)
+					if expected.FacialFeatures != nil && actual.FacialFeatures != nil {
+						assert.Equal(t, expected.FacialFeatures.Float32s(), actual.FacialFeatures.Float32s(), msg)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAntiSpoofingExtractPipeline_ParallelStagesCancel(t *testing.T) {
+	models := faceIDModelsWith(config.DefaultFaceQualityParams.ModelName, func(model *tritontest.Model) {
+		model.Outputs = map[string][]float32{"output": {0.05, 0.03, 0.9, 0.02}}
+	})
+	extracting := make(chan struct{})
+	for _, model := range models {
+		if model.Config.Name == config.DefaultArcFaceRecognitionParams.ModelName {
+			model.Infer = func(*triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+				<-extracting
+				return nil, fmt.Errorf("canceled extraction")
+			}
+		}
+	}
+	_, backend := newTestBackend(t, models)
+
+	cfg := *config.DefaultPipelineParams
+	cfg.ParallelStages = true
+	client, err := NewAntiSpoofingExtractPipeline(backend, &cfg)
+	assert.NoError(t, err)
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	// The masked face rules out the extraction, the call returns without waiting for it.
+	resp, err := client.ExtractFaceFeatures(context.Background(), img, false, true)
+	assert.NoError(t, err)
+	assert.Equal(t, config.FaceQualityClassWearingMask, resp.FaceQuality)
+	assert.Nil(t, resp.FacialFeatures)
+
+	close(extracting)
+	assert.NoError(t, client.Close())
+}
+
+func TestAntiSpoofingExtractPipeline_Ready(t *testing.T) {
+	models := tritontest.FaceIDModels()
+	models[len(models)-1].NotReady = true
+	server, backend := newTestBackend(t, models)
+
+	client, err := NewAntiSpoofingExtractPipeline(backend, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.ErrorContains(t, client.Ready(), "miniFAS_1")
+
+	server.SetLive(false)
+	assert.ErrorContains(t, client.Validate(), "not live")
+}
+
+func TestAntiSpoofingExtractPipeline_Replay(t *testing.T) {
+	_, backend := newTestBackend(t, tritontest.FaceIDModels(image.Pt(10, 10)))
+	recorder := inference.NewRecordingBackend(backend)
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	client, err := NewAntiSpoofingExtractPipeline(recorder, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	expected, err := client.ExtractFaceFeatures(context.Background(), img, true, true)
+	assert.NoError(t, err)
+	client.Close()
+
+	path := filepath.Join(t.TempDir(), "anti_spoofing.json.gz")
+	assert.NoError(t, recorder.Save(path))
+	fixture, err := inference.LoadFixture(path)
+	assert.NoError(t, err)
+
+	replay, err := inference.NewReplayBackend(fixture, 0)
+	assert.NoError(t, err)
+
+	client, err = NewAntiSpoofingExtractPipeline(replay, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.NoError(t, client.Validate())
+
+	actual, err := client.ExtractFaceFeatures(context.Background(), img, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replay.Pending())
+	assert.Equal(t, expected.SpoofingCheck, actual.SpoofingCheck)
+	assert.Equal(t, expected.FaceQuality, actual.FaceQuality)
+	assert.Equal(t, expected.SelectedFaceBox.Float32s(), actual.SelectedFaceBox.Float32s())
+	assert.Equal(t, expected.FacialFeatures.Float32s(), actual.FacialFeatures.Float32s())
+}
+
+func TestGeneralExtractPipeline_Canceled(t *testing.T) {
+	server, backend := newTestBackend(t, tritontest.FaceIDModels(image.Pt(10, 10)))
+
+	client, err := NewGeneralExtractPipeline(backend, config.DefaultPipelineParams)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.ExtractFaceFeatures(ctx, img, false)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, server.Requests())
+}
+
+func TestGeneralExtractPipeline_DeadlineBudget(t *testing.T) {
+	models := tritontest.FaceIDModels(image.Pt(10, 10))
+	models[0].Delay = time.Second
+	_, backend := newTestBackend(t, models)
+
+	cfg := *config.DefaultPipelineParams
+	cfg.DeadlineBudget = config.NewDeadlineBudgetParams(3*time.Second, 0.2, 0.4, 0, 0.4)
+	client, err := NewGeneralExtractPipeline(backend, &cfg)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	// Detection only gets a fifth of the overall deadline.
+	start := time.Now()
+	_, err = client.ExtractFaceFeatures(context.Background(), img, false)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, config.DefaultRetinaFaceDetectionParams.ModelName)
+	assert.Less(t, time.Since(start), time.Second)
+
+	cfg.DeadlineBudget = config.NewDeadlineBudgetParams(3*time.Second, 0.6, 0.2, 0, 0.2)
+	client, err = NewGeneralExtractPipeline(backend, &cfg)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	resp, err := client.ExtractFaceFeatures(context.Background(), img, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 512, resp.FacialFeatures.DataSize())
+	}
+}
+
+func TestGeneralExtractPipeline_MicroBatching(t *testing.T) {
+	models := tritontest.FaceIDModels(image.Pt(10, 10))
+	models[0].DynamicBatch()
+	models[1].DynamicBatch()
+	server, backend := newTestBackend(t, models)
+
+	cfg := *config.DefaultPipelineParams
+	detection := *cfg.RetinaFaceDetection
+	detection.MaxBatchSize = 4
+	recognition := *cfg.ArcFaceRecognition
+	recognition.BatchSize = 4
+	cfg.RetinaFaceDetection = &detection
+	cfg.ArcFaceRecognition = &recognition
+	cfg.MicroBatching = config.NewMicroBatchingParams(time.Second)
+	client, err := NewGeneralExtractPipeline(backend, &cfg)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.NoError(t, client.Validate())
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.ExtractFaceFeatures(context.Background(), img, false)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, 1, resp.FaceCount)
+			assert.Equal(t, 512, resp.FacialFeatures.DataSize())
+			assert.InDeltaSlice(t, []float32{72, 72, 583, 583}, resp.SelectedFaceBox.Float32s()[:4], 1e-3)
+		}()
+	}
+	wg.Wait()
+
+	// The four calls share one detection and one recognition request, quality is not batched.
+	batches := make(map[string][]int64)
+	for _, req := range server.Requests() {
+		batches[req.ModelName] = append(batches[req.ModelName], req.Inputs[0].Shape[0])
+	}
+	assert.Equal(t, []int64{4}, batches[detection.ModelName])
+	assert.Equal(t, []int64{4}, batches[recognition.ModelName])
+	assert.Equal(t, []int64{1, 1, 1, 1}, batches[cfg.FaceQuality.ModelName])
+}
+
+func BenchmarkGeneralExtractPipeline_ExtractFaceFeatures(b *testing.B) {
+	server := tritontest.NewServer(tritontest.FaceIDModels(image.Pt(10, 10))...)
+	defer server.Close()
+	backend, err := server.Backend()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	client, err := NewGeneralExtractPipeline(backend, config.DefaultPipelineParams)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	img := newTestImage(1280, 720)
+	defer img.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		_, err := client.ExtractFaceFeatures(context.Background(), img, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestPipelines_Concurrent shares each pipeline across goroutines under every execution mode and checks that each
+// call returns the result of a serial call. Run it with -race.
+func TestPipelines_Concurrent(t *testing.T) {
+	const goroutines, iterations = 16, 4
+
+	models := tritontest.FaceIDModels(image.Pt(10, 10))
+	models[0].DynamicBatch()
+	models[1].DynamicBatch()
+	_, backend := newTestBackend(t, models)
+
+	serial := *config.DefaultPipelineParams
+	parallel := serial
+	parallel.ParallelStages = true
+	parallel.ShadowArcFaceRecognition = config.DefaultArcFaceRecognitionParams
+	batching := serial
+	detection := *serial.RetinaFaceDetection
+	detection.MaxBatchSize = 4
+	recognition := *serial.ArcFaceRecognition
+	recognition.BatchSize = 4
+	batching.RetinaFaceDetection = &detection
+	batching.ArcFaceRecognition = &recognition
+	batching.MicroBatching = config.NewMicroBatchingParams(time.Millisecond)
+
+	imgs := []gocv.Mat{newTestImage(640, 640), newTestImage(800, 600)}
+	for _, img := range imgs {
+		defer img.Close()
+	}
+
+	for name, cfg := range map[string]*config.PipelineParams{"serial": &serial, "parallel": &parallel, "batching": &batching} {
+		t.Run(name, func(t *testing.T) {
+			general, err := NewGeneralExtractPipeline(backend, cfg)
+			assert.NoError(t, err)
+			defer general.Close()
+			antiSpoofing, err := NewAntiSpoofingExtractPipeline(backend, cfg)
+			assert.NoError(t, err)
+			defer antiSpoofing.Close()
+			var shadowResults atomic.Int32
+			antiSpoofing.SetShadowHandler(func(result *ShadowResult) {
+				assert.NoError(t, result.Err)
+				shadowResults.Add(1)
+			})
+
+			expectedGeneral := make([]*GeneralExtractionResult, len(imgs))
+			expectedAntiSpoofing := make([]*AntiSpoofingExtractionResult, len(imgs))
+			for idx, img := range imgs {
+				expectedGeneral[idx], err = general.ExtractFaceFeatures(context.Background(), img, false)
+				assert.NoError(t, err)
+				expectedAntiSpoofing[idx], err = antiSpoofing.ExtractFaceFeatures(context.Background(), img, true, true)
+				assert.NoError(t, err)
+			}
+
+			var wg sync.WaitGroup
+			for g := range goroutines {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range iterations {
+						idx := (g + i) % len(imgs)
+						generalResp, err := general.ExtractFaceFeatures(context.Background(), imgs[idx], false)
+						if assert.NoError(t, err) {
+							assert.Equal(t, expectedGeneral[idx].FaceCount, generalResp.FaceCount)
+							assert.Equal(t, expectedGeneral[idx].QualityScore, generalResp.QualityScore)
+							assert.Equal(t, expectedGeneral[idx].SelectedFaceBox.Float32s(), generalResp.SelectedFaceBox.Float32s())
+							assert.InDeltaSlice(t, expectedGeneral[idx].FacialFeatures.Float32s(), generalResp.FacialFeatures.Float32s(), 1e-6)
+						}
+
+						antiSpoofingResp, err := antiSpoofing.ExtractFaceFeatures(context.Background(), imgs[idx], true, true)
+						if assert.NoError(t, err) {
+							assert.Equal(t, expectedAntiSpoofing[idx].SpoofingCheck, antiSpoofingResp.SpoofingCheck)
+							assert.Equal(t, expectedAntiSpoofing[idx].QualityAssessmentClass, antiSpoofingResp.QualityAssessmentClass)
+							assert.Equal(t, expectedAntiSpoofing[idx].SelectedFaceBox.Float32s(), antiSpoofingResp.SelectedFaceBox.Float32s())
+							assert.InDeltaSlice(t, expectedAntiSpoofing[idx].FacialFeatures.Float32s(), antiSpoofingResp.FacialFeatures.Float32s(), 1e-6)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			assert.NoError(t, antiSpoofing.Close())
+			if cfg.ShadowArcFaceRecognition != nil {
+				assert.Equal(t, int32(len(imgs)+goroutines*iterations), shadowResults.Load())
+			}
+		})
+	}
+}
+
+func TestGeneralExtractPipeline_Admission(t *testing.T) {
+	models := tritontest.FaceIDModels(image.Pt(10, 10))
+	models[0].Delay = 200 * time.Millisecond
+	_, backend := newTestBackend(t, models)
+
+	img := newTestImage(640, 640)
+	defer img.Close()
+
+	limits := config.NewAdmissionParams(1, 0, 0)
+	pipelineLimited := *config.DefaultPipelineParams
+	pipelineLimited.PipelineAdmission = limits
+	modelLimited := *config.DefaultPipelineParams
+	modelLimited.ModelAdmission = map[string]*config.AdmissionParams{config.DefaultRetinaFaceDetectionParams.ModelName: limits}
+
+	for name, cfg := range map[string]*config.PipelineParams{"pipeline": &pipelineLimited, "model": &modelLimited} {
+		t.Run(name, func(t *testing.T) {
+			client, err := NewGeneralExtractPipeline(backend, cfg)
+			assert.NoError(t, err)
+			defer client.Close()
+
+			inFlight := func() int {
+				stats := client.AdmissionStats()
+				return stats.Pipeline.InFlight + stats.Models[config.DefaultRetinaFaceDetectionParams.ModelName].InFlight
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := client.ExtractFaceFeatures(context.Background(), img, false)
+				done <- err
+			}()
+			assert.Eventually(t, func() bool { return inFlight() == 1 }, time.Second, time.Millisecond)
+
+			_, err = client.ExtractFaceFeatures(context.Background(), img, false)
+			assert.ErrorIs(t, err, inference.ErrOverloaded)
+			assert.NoError(t, <-done)
+
+			stats := client.AdmissionStats()
+			shed := stats.Pipeline.Shed() + stats.Models[config.DefaultRetinaFaceDetectionParams.ModelName].Shed()
+			assert.Equal(t, uint64(1), shed)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package processing
+
+import (
+	"fmt"
+	"gocv.io/x/gocv"
+)
+
+// Layout is the memory layout of an image tensor.
+type Layout int
+
+const (
+	// LayoutNCHW stores each channel as a separate plane.
+	LayoutNCHW Layout = iota
+	// LayoutNHWC stores the channels of each pixel together.
+	LayoutNHWC
+)
+
+// BlobParams describes the conversion of an 8-bit, 3 channel image into float32 model input. The value of
+// output channel c is (pixel - Mean[c]) * Scale[c], where the pixel is read from channel c of the image, or from
+// channel 2-c when SwapRB is set.
+type BlobParams struct {
+	// SwapRB reverses the channel order, e.g. to feed a BGR image to a model taking RGB input.
+	SwapRB bool
+	Mean   [3]float32
+	Scale  [3]float32
+	Layout Layout
+}
+
+// RawBlobParams passes the pixels through unchanged.
+var RawBlobParams = BlobParams{Scale: [3]float32{1, 1, 1}}
+
+// BlobFromImage converts img into dst, which must hold exactly 3 values per pixel. It reads the pixel buffer of
+// img directly rather than pixel by pixel, after copying it when it is not continuous.
+func BlobFromImage(img gocv.Mat, dst []float32, params BlobParams) error {
+	if img.Type() != gocv.MatTypeCV8UC3 {
+		return fmt.Errorf("expected an 8-bit, 3 channel image, got type %v", img.Type())
+	}
+	plane := img.Rows() * img.Cols()
+	if len(dst) != 3*plane {
+		return fmt.Errorf("expected %d values for a %dx%d image, got %d", 3*plane, img.Cols(), img.Rows(), len(dst))
+	}
+
+	// The rows of a non-continuous Mat, such as a Region, are apart in memory, a clone packs them together.
+	if !img.IsContinuous() {
+		img = img.Clone()
+		defer img.Close()
+	}
+	data, err := img.DataPtrUint8()
+	if err != nil {
+		return err
+	}
+	if len(data) < 3*plane {
+		return fmt.Errorf("image buffer holds %d bytes, expected %d", len(data), 3*plane)
+	}
+	data = data[:3*plane]
+
+	c0, c2 := 0, 2
+	if params.SwapRB {
+		c0, c2 = 2, 0
+	}
+	m0, m1, m2 := params.Mean[0], params.Mean[1], params.Mean[2]
+	s0, s1, s2 := params.Scale[0], params.Scale[1], params.Scale[2]
+
+	switch params.Layout {
+	case LayoutNCHW:
+		r, g, b := dst[:plane], dst[plane:2*plane], dst[2*plane:]
+		for i := range plane {
+			pixel := data[3*i : 3*i+3 : 3*i+3]
+			r[i] = (float32(pixel[c0]) - m0) * s0
+			g[i] = (float32(pixel[1]) - m1) * s1
+			b[i] = (float32(pixel[c2]) - m2) * s2
+		}
+	case LayoutNHWC:
+		for i := range plane {
+			pixel := data[3*i : 3*i+3 : 3*i+3]
+			out := dst[3*i : 3*i+3 : 3*i+3]
+			out[0] = (float32(pixel[c0]) - m0) * s0
+			out[1] = (float32(pixel[1]) - m1) * s1
+			out[2] = (float32(pixel[c2]) - m2) * s2
+		}
+	default:
+		return fmt.Errorf("unsupported layout %d", params.Layout)
+	}
+	return nil
+}
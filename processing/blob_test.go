@@ -0,0 +1,111 @@
+package processing
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+func newRandomImage(width, height int) gocv.Mat {
+	data := make([]byte, 3*width*height)
+	rand.New(rand.NewSource(1)).Read(data)
+	img, err := gocv.NewMatFromBytes(height, width, gocv.MatTypeCV8UC3, data)
+	if err != nil {
+		panic(err)
+	}
+	return img
+}
+
+// naiveBlobFromImage is the per-pixel conversion the modules used before BlobFromImage.
+func naiveBlobFromImage(img gocv.Mat, params BlobParams) (*tensor.Dense, error) {
+	imgShape := img.Size()
+	imgTensors := tensor.New(
+		tensor.Of(tensor.Float32),
+		tensor.WithShape(1, 3, imgShape[0], imgShape[1]),
+	)
+	for z := range 3 {
+		src := z
+		if params.SwapRB {
+			src = 2 - z
+		}
+		for y := range imgShape[0] {
+			for x := range imgShape[1] {
+				pixel := (float32(img.GetVecbAt(y, x)[src]) - params.Mean[z]) * params.Scale[z]
+				err := imgTensors.SetAt(pixel, 0, z, y, x)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return imgTensors, nil
+}
+
+func TestBlobFromImage(t *testing.T) {
+	img := newRandomImage(7, 5)
+	defer img.Close()
+	params := BlobParams{
+		SwapRB: true,
+		Mean:   [3]float32{123.675, 116.28, 103.53},
+		Scale:  [3]float32{0.01712475, 0.017507, 0.01742919},
+	}
+
+	expected, err := naiveBlobFromImage(img, params)
+	assert.NoError(t, err)
+	nchw := make([]float32, 3*7*5)
+	assert.NoError(t, BlobFromImage(img, nchw, params))
+	assert.Equal(t, expected.Float32s(), nchw)
+
+	params.Layout = LayoutNHWC
+	nhwc := make([]float32, 3*7*5)
+	assert.NoError(t, BlobFromImage(img, nhwc, params))
+	for i := range 7 * 5 {
+		for c := range 3 {
+			assert.Equal(t, nchw[c*7*5+i], nhwc[3*i+c])
+		}
+	}
+
+	// Regions are not continuous.
+	region := img.Region(image.Rect(1, 1, 4, 3))
+	defer region.Close()
+	assert.False(t, region.IsContinuous())
+	expected, err = naiveBlobFromImage(region, RawBlobParams)
+	assert.NoError(t, err)
+	actual := make([]float32, 3*3*2)
+	assert.NoError(t, BlobFromImage(region, actual, RawBlobParams))
+	assert.Equal(t, expected.Float32s(), actual)
+
+	assert.ErrorContains(t, BlobFromImage(img, make([]float32, 3), params), "expected 105 values")
+}
+
+// BenchmarkBlobFromImage compares the conversion to the per-pixel conversion at the input sizes of the default models.
+// The preprocessing of each module with its own parameters is benchmarked in the modules package.
+func BenchmarkBlobFromImage(b *testing.B) {
+	for _, size := range []int{80, 112, 256, 640} {
+		img := newRandomImage(size, size)
+		params := BlobParams{SwapRB: true, Mean: [3]float32{127.5, 127.5, 127.5}, Scale: [3]float32{0.0078125, 0.0078125, 0.0078125}}
+
+		b.Run(fmt.Sprintf("%d/per_pixel", size), func(b *testing.B) {
+			for range b.N {
+				_, err := naiveBlobFromImage(img, params)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d/blob", size), func(b *testing.B) {
+			dst := make([]float32, 3*size*size)
+			for range b.N {
+				err := BlobFromImage(img, dst, params)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		_ = img.Close()
+	}
+}
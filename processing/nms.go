@@ -95,6 +95,10 @@ func NMS(dets *tensor.Dense, threshold float32) ([]int, error) {
 	for len(order) > 0 {
 		i := order[0]
 		keep = append(keep, i)
+		// The tensor operations below do not accept an empty set of remaining boxes.
+		if len(order) == 1 {
+			break
+		}
 
 		x1i, err := x1Owned.Slice(tensor.S(i))
 		if err != nil {
@@ -228,3 +232,61 @@ func NMS(dets *tensor.Dense, threshold float32) ([]int, error) {
 
 	return keep, nil
 }
+
+// NMSFloat32s is NMS over the rows of (x1, y1, x2, y2, score) stored one after another in dets. It keeps the same
+// boxes, in the same order, without building intermediate tensors.
+func NMSFloat32s(dets []float32, threshold float32) []int {
+	n := len(dets) / 5
+	scores := make([]float32, n)
+	areas := make([]float32, n)
+	for i := range n {
+		det := dets[5*i : 5*i+5]
+		scores[i] = det[4]
+		areas[i] = (det[2] - det[0] + 1) * (det[3] - det[1] + 1)
+	}
+
+	order := utils.ArgSortDescendingFloat32s(scores)
+	keep := make([]int, 0)
+
+	for len(order) > 0 {
+		i := order[0]
+		keep = append(keep, i)
+		x1, y1, x2, y2 := dets[5*i], dets[5*i+1], dets[5*i+2], dets[5*i+3]
+
+		// The remaining boxes are filtered in place, each one is written at or before the position it is read from.
+		remaining := order[:0]
+		for _, j := range order[1:] {
+			xx1 := maxF32(x1, dets[5*j])
+			yy1 := maxF32(y1, dets[5*j+1])
+			xx2 := minF32(x2, dets[5*j+2])
+			yy2 := minF32(y2, dets[5*j+3])
+
+			w := maxF32(0, xx2-xx1+1)
+			h := maxF32(0, yy2-yy1+1)
+			// The conversion rounds the product so that it is not fused with the subtraction.
+			inter := float32(w * h)
+			ovr := inter / (areas[i] + areas[j] - inter)
+			if ovr <= threshold {
+				remaining = append(remaining, j)
+			}
+		}
+		order = remaining
+	}
+
+	return keep
+}
+
+// maxF32 and minF32 compare like the tensor operations used by NMS, in particular when a value is NaN.
+func maxF32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minF32(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
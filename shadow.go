@@ -0,0 +1,159 @@
+package go_faceid_pipeline
+
+import (
+	"context"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/modules"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// ShadowResult compares the features of the primary and the shadow recognition model on the same aligned face.
+type ShadowResult struct {
+	PrimaryModelName    string        `json:"primary_model_name"`
+	PrimaryModelVersion string        `json:"primary_model_version"`
+	ShadowModelName     string        `json:"shadow_model_name"`
+	ShadowModelVersion  string        `json:"shadow_model_version"`
+	PrimaryFeatures     *tensor.Dense `json:"primary_features"`
+	ShadowFeatures      *tensor.Dense `json:"shadow_features"`
+	// CosineSimilarity is only set when both models produce features of the same size.
+	CosineSimilarity *float32 `json:"cosine_similarity"`
+	Err              error    `json:"-"`
+}
+
+// ShadowHandler receives the result of every shadow evaluation. It is called from a separate goroutine.
+type ShadowHandler func(result *ShadowResult)
+
+// LogShadowResult is the default ShadowHandler, it writes the comparison to the standard logger.
+func LogShadowResult(result *ShadowResult) {
+	if result.Err != nil {
+		log.Printf("shadow model %s version %q failed: %v", result.ShadowModelName, result.ShadowModelVersion, result.Err)
+		return
+	}
+	if result.CosineSimilarity == nil {
+		log.Printf("shadow model %s version %q: features are not comparable with %s version %q",
+			result.ShadowModelName, result.ShadowModelVersion, result.PrimaryModelName, result.PrimaryModelVersion)
+		return
+	}
+	log.Printf("shadow model %s version %q vs %s version %q: cosine similarity %.4f",
+		result.ShadowModelName, result.ShadowModelVersion, result.PrimaryModelName, result.PrimaryModelVersion, *result.CosineSimilarity)
+}
+
+// ShadowStats holds the shadow evaluation counters of a pipeline. Dropped counts the faces that were not evaluated
+// because PipelineParams.MaxShadowEvaluations evaluations were already running.
+type ShadowStats struct {
+	InFlight  int
+	Evaluated uint64
+	Dropped   uint64
+}
+
+// shadowEvaluator runs the shadow recognition model asynchronously so it never affects the pipeline result or latency.
+// Evaluations are dropped rather than queued when the slots are all taken, which bounds the extra traffic to the
+// backend and the goroutines Close waits for.
+type shadowEvaluator struct {
+	primary *config.ArcFaceRecognitionParams
+	client  *modules.FaceExtractionClient
+	handler ShadowHandler
+	wg      sync.WaitGroup
+	// slots holds a token per evaluation in flight.
+	slots     chan struct{}
+	evaluated atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+func newShadowEvaluator(backend inference.Backend, cfg *config.PipelineParams) (*shadowEvaluator, error) {
+	if cfg.ShadowArcFaceRecognition == nil {
+		return nil, nil
+	}
+	maxEvaluations := cfg.MaxShadowEvaluations
+	if maxEvaluations == 0 {
+		maxEvaluations = config.DefaultMaxShadowEvaluations
+	}
+	if maxEvaluations < 0 {
+		return nil, fmt.Errorf("max shadow evaluations must not be negative, got %d", maxEvaluations)
+	}
+	client, err := modules.NewFaceExtractionClient(backend, cfg.ShadowArcFaceRecognition)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowEvaluator{
+		primary: cfg.ArcFaceRecognition,
+		client:  client,
+		handler: LogShadowResult,
+		slots:   make(chan struct{}, maxEvaluations),
+	}, nil
+}
+
+// evaluate runs the shadow model on a copy of alignedFace, within the Timeout of the shadow model. The evaluation is
+// dropped when all the slots are taken. It is a no-op on a nil evaluator.
+func (s *shadowEvaluator) evaluate(alignedFace gocv.Mat, primaryFeatures *tensor.Dense) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.dropped.Add(1)
+		return
+	}
+	s.evaluated.Add(1)
+
+	face := alignedFace.Clone()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.slots }()
+		defer face.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.client.ModelParams.Timeout)
+		defer cancel()
+
+		result := &ShadowResult{
+			PrimaryModelName:    s.primary.ModelName,
+			PrimaryModelVersion: s.primary.ModelVersion,
+			ShadowModelName:     s.client.ModelParams.ModelName,
+			ShadowModelVersion:  s.client.ModelParams.ModelVersion,
+			PrimaryFeatures:     primaryFeatures,
+		}
+
+		shadowFeatures, err := s.client.Infer(ctx, []gocv.Mat{face})
+		if err != nil {
+			result.Err = err
+			s.handler(result)
+			return
+		}
+		result.ShadowFeatures = shadowFeatures[0]
+
+		similarity, err := utils.CosineSimilarity(primaryFeatures, shadowFeatures[0])
+		if err == nil {
+			result.CosineSimilarity = &similarity
+		}
+		s.handler(result)
+	}()
+}
+
+// stats returns the counters of the evaluator, zero on a nil evaluator.
+func (s *shadowEvaluator) stats() ShadowStats {
+	if s == nil {
+		return ShadowStats{}
+	}
+	return ShadowStats{
+		InFlight:  len(s.slots),
+		Evaluated: s.evaluated.Load(),
+		Dropped:   s.dropped.Load(),
+	}
+}
+
+// wait blocks until all running shadow evaluations have been reported.
+func (s *shadowEvaluator) wait() {
+	if s == nil {
+		return
+	}
+	s.wg.Wait()
+}
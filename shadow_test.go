@@ -0,0 +1,133 @@
+package go_faceid_pipeline
+
+import (
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"gocv.io/x/gocv"
+	"gorgonia.org/tensor"
+	"sync"
+	"testing"
+	"time"
+)
+
+// versionedBackend serves a recognition model whose features depend on the requested version. When release is set,
+// inference requests wait for it to be closed.
+type versionedBackend struct {
+	release        chan struct{}
+	mu             sync.Mutex
+	configVersions []string
+	inferVersions  []string
+}
+
+func (b *versionedBackend) GetModelConfiguration(timeout time.Duration, modelName, modelVersion string) (*triton_proto.ModelConfigResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.configVersions = append(b.configVersions, modelVersion)
+	return &triton_proto.ModelConfigResponse{
+		Config: &triton_proto.ModelConfig{
+			Name:   modelName,
+			Input:  []*triton_proto.ModelInput{{Name: "data", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 3, 112, 112}}},
+			Output: []*triton_proto.ModelOutput{{Name: "fc1", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 2}}},
+		},
+	}, nil
+}
+
+func (b *versionedBackend) ModelInfer(timeout time.Duration, request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	if b.release != nil {
+		<-b.release
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inferVersions = append(b.inferVersions, request.ModelVersion)
+
+	features := []float32{1, 0}
+	if request.ModelVersion == "2" {
+		features = []float32{0.6, 0.8}
+	}
+	return &triton_proto.ModelInferResponse{
+		ModelName:         request.ModelName,
+		ModelVersion:      request.ModelVersion,
+		Outputs:           []*triton_proto.ModelInferResponse_InferOutputTensor{{Name: "fc1", Datatype: "FP32", Shape: []int64{1, 2}}},
+		RawOutputContents: [][]byte{utils.TToBytes(features)},
+	}, nil
+}
+
+func TestShadowEvaluator(t *testing.T) {
+	backend := &versionedBackend{}
+	primary := config.NewArcFaceRecognitionParams("face_identification", time.Second, [2]int{112, 112}, 1)
+	primary.ModelVersion = "1"
+	shadowParams := config.NewArcFaceRecognitionParams("face_identification", time.Second, [2]int{112, 112}, 1)
+	shadowParams.ModelVersion = "2"
+
+	shadow, err := newShadowEvaluator(backend, &config.PipelineParams{ArcFaceRecognition: primary, ShadowArcFaceRecognition: shadowParams})
+	assert.NoError(t, err)
+
+	results := make([]*ShadowResult, 0)
+	shadow.handler = func(result *ShadowResult) {
+		results = append(results, result)
+	}
+
+	face := gocv.NewMatWithSize(112, 112, gocv.MatTypeCV8UC3)
+	primaryFeatures := tensor.New(tensor.WithShape(2), tensor.WithBacking([]float32{1, 0}))
+	shadow.evaluate(face, primaryFeatures)
+	assert.NoError(t, face.Close())
+	shadow.wait()
+
+	assert.Equal(t, []string{"2"}, backend.configVersions)
+	assert.Equal(t, []string{"2"}, backend.inferVersions)
+	assert.Len(t, results, 1)
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, "1", results[0].PrimaryModelVersion)
+	assert.Equal(t, "2", results[0].ShadowModelVersion)
+	assert.InDelta(t, 0.6, *results[0].CosineSimilarity, 1e-6)
+
+	var disabled *shadowEvaluator
+	disabled.evaluate(face, primaryFeatures)
+	disabled.wait()
+	assert.Zero(t, disabled.stats())
+}
+
+func TestShadowEvaluator_Bounded(t *testing.T) {
+	backend := &versionedBackend{release: make(chan struct{})}
+	primary := config.NewArcFaceRecognitionParams("face_identification", time.Second, [2]int{112, 112}, 1)
+	shadowParams := config.NewArcFaceRecognitionParams("face_identification", time.Second, [2]int{112, 112}, 1)
+	shadowParams.ModelVersion = "2"
+
+	cfg := &config.PipelineParams{ArcFaceRecognition: primary, ShadowArcFaceRecognition: shadowParams, MaxShadowEvaluations: -1}
+	_, err := newShadowEvaluator(backend, cfg)
+	assert.ErrorContains(t, err, "max shadow evaluations must not be negative")
+
+	cfg.MaxShadowEvaluations = 2
+	shadow, err := newShadowEvaluator(backend, cfg)
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	results := make([]*ShadowResult, 0)
+	shadow.handler = func(result *ShadowResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result)
+	}
+
+	face := gocv.NewMatWithSize(112, 112, gocv.MatTypeCV8UC3)
+	defer face.Close()
+	primaryFeatures := tensor.New(tensor.WithShape(2), tensor.WithBacking([]float32{1, 0}))
+	// The backend holds the first evaluations, the ones beyond the limit are dropped.
+	for range 5 {
+		shadow.evaluate(face, primaryFeatures)
+	}
+	assert.Equal(t, ShadowStats{InFlight: 2, Evaluated: 2, Dropped: 3}, shadow.stats())
+
+	close(backend.release)
+	shadow.wait()
+	assert.Len(t, results, 2)
+	assert.Len(t, backend.inferVersions, 2)
+
+	// The slots are free again once the evaluations are done.
+	shadow.evaluate(face, primaryFeatures)
+	shadow.wait()
+	assert.Len(t, results, 3)
+	assert.Equal(t, ShadowStats{Evaluated: 3, Dropped: 3}, shadow.stats())
+}
@@ -0,0 +1,80 @@
+package go_faceid_pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// parallelStages runs the stages of a pipeline call concurrently. The stages are indexed in the order the serial
+// path runs them: when a stage fails, the stages after it are canceled since the serial path would not have run
+// them, while the stages before it keep running so that their errors take precedence.
+type parallelStages struct {
+	wg     sync.WaitGroup
+	stages []*parallelStage
+}
+
+type parallelStage struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	started bool
+	err     error
+}
+
+func newParallelStages(ctx context.Context, n int) *parallelStages {
+	p := &parallelStages{stages: make([]*parallelStage, n)}
+	for i := range p.stages {
+		stageCtx, cancel := context.WithCancel(ctx)
+		p.stages[i] = &parallelStage{ctx: stageCtx, cancel: cancel, done: make(chan struct{})}
+	}
+	return p
+}
+
+// run starts stage i. It must be called at most once per stage, from the goroutine calling wait.
+func (p *parallelStages) run(i int, fn func(ctx context.Context) error) {
+	stage := p.stages[i]
+	stage.started = true
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(stage.done)
+		stage.err = fn(stage.ctx)
+		if stage.err != nil {
+			p.cancelFrom(i + 1)
+		}
+	}()
+}
+
+// cancel cancels stage i, e.g. when a gating decision makes its result unnecessary.
+func (p *parallelStages) cancel(i int) {
+	p.stages[i].cancel()
+}
+
+func (p *parallelStages) cancelFrom(i int) {
+	for _, stage := range p.stages[i:] {
+		stage.cancel()
+	}
+}
+
+// wait returns the error of stage i once it is done. Stages that were never started succeed.
+func (p *parallelStages) wait(i int) error {
+	stage := p.stages[i]
+	if !stage.started {
+		return nil
+	}
+	<-stage.done
+	return stage.err
+}
+
+// stop cancels every stage and calls release once the running stages have returned. Backend calls in flight
+// cannot be aborted, so rather than delaying the caller, the stages still running are waited for in a goroutine
+// tracked by background.
+func (p *parallelStages) stop(background *sync.WaitGroup, release func()) {
+	p.cancelFrom(0)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		p.wg.Wait()
+		release()
+	}()
+}
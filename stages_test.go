@@ -0,0 +1,70 @@
+package go_faceid_pipeline
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestParallelStages(t *testing.T) {
+	stages := newParallelStages(context.Background(), 3)
+
+	firstDone := make(chan struct{})
+	stages.run(0, func(ctx context.Context) error {
+		<-firstDone
+		return ctx.Err()
+	})
+	stages.run(1, func(ctx context.Context) error {
+		return errors.New("second failed")
+	})
+
+	// The failure of the second stage cancels the third one only.
+	assert.EqualError(t, stages.wait(1), "second failed")
+	stages.run(2, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.ErrorIs(t, stages.wait(2), context.Canceled)
+	close(firstDone)
+	assert.NoError(t, stages.wait(0))
+
+	var background sync.WaitGroup
+	released := false
+	stages.stop(&background, func() { released = true })
+	background.Wait()
+	assert.True(t, released)
+}
+
+func TestParallelStages_Cancel(t *testing.T) {
+	stages := newParallelStages(context.Background(), 2)
+
+	// Stages that were never started succeed.
+	assert.NoError(t, stages.wait(0))
+
+	stages.run(1, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	stages.cancel(1)
+	assert.ErrorIs(t, stages.wait(1), context.Canceled)
+
+	// stop releases once the running stages return.
+	running := make(chan struct{})
+	stages.run(0, func(ctx context.Context) error {
+		<-running
+		return nil
+	})
+	var background sync.WaitGroup
+	released := make(chan struct{})
+	stages.stop(&background, func() { close(released) })
+	select {
+	case <-released:
+		t.Fatal("released while a stage is running")
+	default:
+	}
+	close(running)
+	background.Wait()
+	<-released
+}
@@ -0,0 +1,259 @@
+package tritontest
+
+import (
+	"github.com/okieraised/go-faceid-pipeline/config"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"image"
+	"strconv"
+)
+
+const (
+	retinaFaceStride     = 32
+	retinaFaceAnchorSize = 512
+	retinaFaceScore      = 0.99
+	retinaFaceNextScore  = 0.95
+	scrfdStride          = 32
+	scrfdAnchors         = 2
+	scrfdFaceSize        = 512
+	scrfdScore           = 0.9
+	scrfdSecondScore     = 0.8
+	yoloFaceSize         = 512
+	yoloScore            = 0.9
+	yoloSecondScore      = 0.75
+)
+
+// yoloStrides lists the strides of the predictions of the YOLO face model, in prediction order.
+var yoloStrides = []int{8, 16, 32}
+
+// retinaFaceStrides lists the feature map strides of the RetinaFace model in output order.
+var retinaFaceStrides = []int{32, 16, 8}
+
+// arcFaceLandmarks are the ArcFace template landmarks in 112x112 aligned face coordinates.
+var arcFaceLandmarks = [5][2]float32{
+	{38.2946, 51.6963},
+	{73.5318, 51.5014},
+	{56.0252, 71.7366},
+	{41.5493, 92.3655},
+	{70.7299, 92.2041},
+}
+
+// FaceIDModels returns every model used by the pipelines with the names and image sizes of the default
+// configuration. The canned outputs describe the faces of RetinaFaceModel as good quality, real faces.
+func FaceIDModels(faces ...image.Point) []*Model {
+	models := []*Model{
+		RetinaFaceModel(faces...),
+		imageModel(config.DefaultArcFaceRecognitionParams.ModelName, config.DefaultArcFaceRecognitionParams.ImageSize, "fc1", []int64{1, 512}, ArcFaceFeatures()),
+		imageModel(config.DefaultFaceQualityParams.ModelName, config.DefaultFaceQualityParams.ImageSize, "output", []int64{1, 4}, []float32{0.05, 0.9, 0.03, 0.02}),
+		imageModel(config.DefaultFaceQualityAssessmentParams.ModelName, config.DefaultFaceQualityAssessmentParams.ImageSize, "output", []int64{1, 1}, []float32{80}),
+	}
+	for idx, modelName := range config.DefaultFaceAntiSpoofingParam.ModelNames {
+		models = append(models, imageModel(modelName, config.DefaultFaceAntiSpoofingParam.ImageSizes[idx], "output", []int64{1, 3}, []float32{0.02, 0.97, 0.01}))
+	}
+	return models
+}
+
+// ArcFaceFeatures returns the canned, unnormalized embedding of the recognition model in FaceIDModels.
+func ArcFaceFeatures() []float32 {
+	features := make([]float32, 512)
+	for i := range features {
+		features[i] = float32(i%7) - 3
+	}
+	return features
+}
+
+// RetinaFaceModel returns the 640x640 RetinaFace detection model. Each face is reported at the stride 32 anchor
+// of the given feature map cell, which covers the 512x512 box centered on (32*X+7.5, 32*Y+7.5) in the
+// 640x640 model input, with landmarks placed like the ArcFace template. Like a real detector, the anchor of
+// the next cell also fires with a lower score and is removed by NMS, so cells must not be adjacent.
+func RetinaFaceModel(faces ...image.Point) *Model {
+	imageSize := config.DefaultRetinaFaceDetectionParams.ImageSize
+	modelConfig := &triton_proto.ModelConfig{
+		Name: config.DefaultRetinaFaceDetectionParams.ModelName,
+		Input: []*triton_proto.ModelInput{
+			{Name: "data", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 3, int64(imageSize[1]), int64(imageSize[0])}},
+		},
+	}
+
+	outputs := make(map[string][]float32)
+	for _, stride := range retinaFaceStrides {
+		h, w := int64(imageSize[1]/stride), int64(imageSize[0]/stride)
+		for _, out := range []struct {
+			name     string
+			channels int64
+		}{
+			{name: "face_rpn_cls_prob_reshape_stride", channels: 4},
+			{name: "face_rpn_bbox_pred_stride", channels: 8},
+			{name: "face_rpn_landmark_pred_stride", channels: 20},
+		} {
+			name := out.name + strconv.Itoa(stride)
+			modelConfig.Output = append(modelConfig.Output, &triton_proto.ModelOutput{
+				Name:     name,
+				DataType: triton_proto.DataType_TYPE_FP32,
+				Dims:     []int64{1, out.channels, h, w},
+			})
+			outputs[name] = make([]float32, out.channels*h*w)
+		}
+	}
+
+	w := imageSize[0] / retinaFaceStride
+	h := imageSize[1] / retinaFaceStride
+	scores := outputs["face_rpn_cls_prob_reshape_stride32"]
+	landmarks := outputs["face_rpn_landmark_pred_stride32"]
+	for _, face := range faces {
+		for _, cell := range []struct {
+			x, y  int
+			score float32
+		}{
+			{x: face.X, y: face.Y, score: retinaFaceScore},
+			{x: face.X + 1, y: face.Y, score: retinaFaceNextScore},
+		} {
+			// Channels [A, 2A) hold the foreground score of each anchor, the first anchor is the 512x512 one.
+			scores[(2*h+cell.y)*w+cell.x] = cell.score
+			for p, point := range arcFaceLandmarks {
+				for c := range 2 {
+					// The decoded landmark is delta * anchor size + anchor center.
+					landmarks[((2*p+c)*h+cell.y)*w+cell.x] = (point[c]/112*retinaFaceAnchorSize - 0.5*(retinaFaceAnchorSize-1)) / retinaFaceAnchorSize
+				}
+			}
+		}
+	}
+
+	return &Model{Config: modelConfig, Outputs: outputs}
+}
+
+// SCRFDModel returns the 640x640 SCRFD detection model of config.DefaultSCRFDDetectionParams, exported with a batch
+// dimension. Each face is reported by the first anchor of the given stride 32 feature map cell, as the 512x512 box
+// centered on (32*X, 32*Y) in the 640x640 model input with landmarks placed like the ArcFace template. The second
+// anchor of the cell fires on a slightly smaller box with a lower score and is removed by NMS.
+func SCRFDModel(faces ...image.Point) *Model {
+	params := config.DefaultSCRFDDetectionParams
+	modelConfig := &triton_proto.ModelConfig{
+		Name: params.ModelName,
+		Input: []*triton_proto.ModelInput{
+			{Name: "input.1", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 3, int64(params.ImageSize[1]), int64(params.ImageSize[0])}},
+		},
+	}
+
+	outputs := make(map[string][]float32)
+	for _, out := range []struct {
+		name    string
+		columns int64
+	}{
+		{name: "score_", columns: 1},
+		{name: "bbox_", columns: 4},
+		{name: "kps_", columns: 10},
+	} {
+		for _, stride := range params.Strides {
+			rows := int64(params.ImageSize[1]/stride*(params.ImageSize[0]/stride)) * scrfdAnchors
+			name := out.name + strconv.Itoa(stride)
+			modelConfig.Output = append(modelConfig.Output, &triton_proto.ModelOutput{
+				Name:     name,
+				DataType: triton_proto.DataType_TYPE_FP32,
+				Dims:     []int64{1, rows, out.columns},
+			})
+			outputs[name] = make([]float32, rows*out.columns)
+		}
+	}
+
+	w := params.ImageSize[0] / scrfdStride
+	suffix := strconv.Itoa(scrfdStride)
+	scores, bboxes, kps := outputs["score_"+suffix], outputs["bbox_"+suffix], outputs["kps_"+suffix]
+	for _, face := range faces {
+		for a, anchor := range []struct {
+			score float32
+			size  float32
+		}{
+			{score: scrfdScore, size: scrfdFaceSize},
+			{score: scrfdSecondScore, size: scrfdFaceSize - 32},
+		} {
+			k := (face.Y*w+face.X)*scrfdAnchors + a
+			scores[k] = anchor.score
+			// The distances from the anchor center to the box sides and the landmark offsets are in stride units.
+			for side := range 4 {
+				bboxes[4*k+side] = anchor.size / 2 / scrfdStride
+			}
+			for p, point := range arcFaceLandmarks {
+				for c := range 2 {
+					kps[10*k+2*p+c] = (point[c]/112*scrfdFaceSize - scrfdFaceSize/2) / scrfdStride
+				}
+			}
+		}
+	}
+
+	return &Model{Config: modelConfig, Outputs: outputs}
+}
+
+// YOLOFaceModel returns the 640x640 YOLO face model of config.DefaultYOLOFaceDetectionParams, whose single output
+// is laid out as (1, 20, predictions) like an ultralytics export. Each face is predicted at the given stride 32
+// cell as the 512x512 box centered on (32*X+16, 32*Y+16) in the 640x640 model input, with visible keypoints placed
+// like the ArcFace template. The stride 16 cell at the same center predicts a slightly smaller box with a lower
+// score, which is removed by NMS.
+func YOLOFaceModel(faces ...image.Point) *Model {
+	params := config.DefaultYOLOFaceDetectionParams
+	attributes := 5 + 5*params.KeypointDims
+
+	offsets := make(map[int]int)
+	numPredictions := 0
+	for _, stride := range yoloStrides {
+		offsets[stride] = numPredictions
+		numPredictions += params.ImageSize[1] / stride * (params.ImageSize[0] / stride)
+	}
+
+	modelConfig := &triton_proto.ModelConfig{
+		Name: params.ModelName,
+		Input: []*triton_proto.ModelInput{
+			{Name: "images", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 3, int64(params.ImageSize[1]), int64(params.ImageSize[0])}},
+		},
+		Output: []*triton_proto.ModelOutput{
+			{Name: "output0", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, int64(attributes), int64(numPredictions)}},
+		},
+	}
+
+	output := make([]float32, attributes*numPredictions)
+	for _, face := range faces {
+		centerX := float32(32*face.X + 16)
+		centerY := float32(32*face.Y + 16)
+		for _, prediction := range []struct {
+			stride int
+			score  float32
+			size   float32
+		}{
+			{stride: 32, score: yoloScore, size: yoloFaceSize},
+			{stride: 16, score: yoloSecondScore, size: yoloFaceSize - 32},
+		} {
+			w := params.ImageSize[0] / prediction.stride
+			cellX := int(centerX) / prediction.stride
+			cellY := int(centerY) / prediction.stride
+			i := offsets[prediction.stride] + cellY*w + cellX
+
+			values := []float32{centerX, centerY, prediction.size, prediction.size, prediction.score}
+			for _, point := range arcFaceLandmarks {
+				values = append(values,
+					centerX+point[0]/112*prediction.size-prediction.size/2,
+					centerY+point[1]/112*prediction.size-prediction.size/2,
+					1,
+				)
+			}
+			for attr, v := range values {
+				output[attr*numPredictions+i] = v
+			}
+		}
+	}
+
+	return &Model{Config: modelConfig, Outputs: map[string][]float32{"output0": output}}
+}
+
+func imageModel(name string, imageSize [2]int, outputName string, outputDims []int64, output []float32) *Model {
+	return &Model{
+		Config: &triton_proto.ModelConfig{
+			Name: name,
+			Input: []*triton_proto.ModelInput{
+				{Name: "data", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 3, int64(imageSize[1]), int64(imageSize[0])}},
+			},
+			Output: []*triton_proto.ModelOutput{
+				{Name: outputName, DataType: triton_proto.DataType_TYPE_FP32, Dims: outputDims},
+			},
+		},
+		Outputs: map[string][]float32{outputName: output},
+	}
+}
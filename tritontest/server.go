@@ -0,0 +1,382 @@
+// Package tritontest provides an in-process fake Triton gRPC server for hermetic tests.
+package tritontest
+
+import (
+	"context"
+	"fmt"
+	"github.com/okieraised/go-faceid-pipeline/inference"
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	gotritonclient "github.com/okieraised/go-triton-client"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	bufferSize = 16 << 20
+	// maxMessageSize fits a batch of four 640x640 FP32 images.
+	maxMessageSize = 64 << 20
+)
+
+// InferFunc computes the response of a scripted model.
+type InferFunc func(request *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error)
+
+// Model is a model served by the fake server.
+type Model struct {
+	// Config is returned by ModelConfig. Config.Name is the model name.
+	Config *triton_proto.ModelConfig
+	// Version is the version served, "1" when empty.
+	Version string
+	// Outputs holds canned FP32 output data by output name, shaped by the dims of Config. The data of an output
+	// with a dynamic (-1) batch dimension describes a single batch element and is repeated for every element of
+	// the request. Outputs missing from the map are zero filled.
+	Outputs map[string][]float32
+	// Infer, when set, replaces the canned outputs.
+	Infer InferFunc
+	// NotReady makes the model report as not ready while still serving requests.
+	NotReady bool
+	// Delay is added to every inference, the request fails with DeadlineExceeded when its deadline expires first.
+	Delay time.Duration
+}
+
+// DynamicBatch makes the first dimension of every input and output of the model dynamic (-1) and returns the model.
+func (m *Model) DynamicBatch() *Model {
+	for _, input := range m.Config.Input {
+		input.Dims[0] = -1
+	}
+	for _, output := range m.Config.Output {
+		output.Dims[0] = -1
+	}
+	return m
+}
+
+func (m *Model) version() string {
+	if m.Version == "" {
+		return "1"
+	}
+	return m.Version
+}
+
+// Server is an in-process implementation of the Triton GRPCInferenceService. It listens on an in-memory
+// connection so tests need no network.
+type Server struct {
+	triton_proto.UnimplementedGRPCInferenceServiceServer
+
+	mu       sync.Mutex
+	models   map[string][]*Model
+	requests []*triton_proto.ModelInferRequest
+	notLive  bool
+
+	listener   *bufconn.Listener
+	grpcServer *grpc.Server
+}
+
+// NewServer starts a fake server serving models.
+func NewServer(models ...*Model) *Server {
+	s := &Server{
+		models:     make(map[string][]*Model),
+		listener:   bufconn.Listen(bufferSize),
+		grpcServer: grpc.NewServer(grpc.MaxRecvMsgSize(maxMessageSize)),
+	}
+	for _, model := range models {
+		s.AddModel(model)
+	}
+
+	triton_proto.RegisterGRPCInferenceServiceServer(s.grpcServer, s)
+	go func() {
+		_ = s.grpcServer.Serve(s.listener)
+	}()
+	return s
+}
+
+// AddModel adds or replaces a model version.
+func (s *Server) AddModel(model *Model) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := model.Config.Name
+	versions := s.models[name]
+	for i, m := range versions {
+		if m.version() == model.version() {
+			versions[i] = model
+			return
+		}
+	}
+	s.models[name] = append(versions, model)
+}
+
+// SetLive changes the result of ServerLive.
+func (s *Server) SetLive(live bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notLive = !live
+}
+
+// Requests returns the inference requests received so far.
+func (s *Server) Requests() []*triton_proto.ModelInferRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*triton_proto.ModelInferRequest(nil), s.requests...)
+}
+
+// Dial returns a Triton gRPC client connected to the server.
+func (s *Server) Dial() (*gotritonclient.TritonGRPCClient, error) {
+	return gotritonclient.NewTritonGRPCClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return s.listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMessageSize), grpc.MaxCallSendMsgSize(maxMessageSize)),
+	)
+}
+
+// Backend returns an inference.Backend connected to the server.
+func (s *Server) Backend() (*inference.TritonGRPCBackend, error) {
+	client, err := s.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return inference.NewTritonGRPCBackend(client), nil
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.grpcServer.Stop()
+}
+
+// ServerLive implements triton_proto.GRPCInferenceServiceServer.
+func (s *Server) ServerLive(context.Context, *triton_proto.ServerLiveRequest) (*triton_proto.ServerLiveResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &triton_proto.ServerLiveResponse{Live: !s.notLive}, nil
+}
+
+// ServerReady implements triton_proto.GRPCInferenceServiceServer.
+func (s *Server) ServerReady(context.Context, *triton_proto.ServerReadyRequest) (*triton_proto.ServerReadyResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &triton_proto.ServerReadyResponse{Ready: !s.notLive}, nil
+}
+
+// ModelReady implements triton_proto.GRPCInferenceServiceServer.
+func (s *Server) ModelReady(_ context.Context, req *triton_proto.ModelReadyRequest) (*triton_proto.ModelReadyResponse, error) {
+	model, err := s.model(req.Name, req.Version)
+	if err != nil {
+		return &triton_proto.ModelReadyResponse{}, nil
+	}
+	return &triton_proto.ModelReadyResponse{Ready: !model.NotReady}, nil
+}
+
+// RepositoryIndex implements triton_proto.GRPCInferenceServiceServer.
+func (s *Server) RepositoryIndex(_ context.Context, req *triton_proto.RepositoryIndexRequest) (*triton_proto.RepositoryIndexResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &triton_proto.RepositoryIndexResponse{}
+	for name, versions := range s.models {
+		for _, model := range versions {
+			state := "READY"
+			if model.NotReady {
+				state = "UNAVAILABLE"
+				if req.Ready {
+					continue
+				}
+			}
+			resp.Models = append(resp.Models, &triton_proto.RepositoryIndexResponse_ModelIndex{
+				Name:    name,
+				Version: model.version(),
+				State:   state,
+			})
+		}
+	}
+	return resp, nil
+}
+
+// ModelConfig implements triton_proto.GRPCInferenceServiceServer.
+func (s *Server) ModelConfig(_ context.Context, req *triton_proto.ModelConfigRequest) (*triton_proto.ModelConfigResponse, error) {
+	model, err := s.model(req.Name, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &triton_proto.ModelConfigResponse{Config: model.Config}, nil
+}
+
+// ModelInfer implements triton_proto.GRPCInferenceServiceServer. Inputs must match the model configuration
+// and carry raw contents of the size implied by their shape and datatype.
+func (s *Server) ModelInfer(ctx context.Context, req *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	model, err := s.model(req.ModelName, req.ModelVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateInputs(model.Config, req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if model.Delay > 0 {
+		select {
+		case <-time.After(model.Delay):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	var resp *triton_proto.ModelInferResponse
+	if model.Infer != nil {
+		resp, err = model.Infer(req)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		resp, err = cannedResponse(model, req)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	resp.ModelName = req.ModelName
+	resp.ModelVersion = model.version()
+	resp.Id = req.Id
+	return resp, nil
+}
+
+func (s *Server) model(name, version string) (*Model, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions, ok := s.models[name]
+	if !ok || len(versions) == 0 {
+		return nil, status.Errorf(codes.NotFound, "Request for unknown model: '%s' is not found", name)
+	}
+	if version == "" {
+		latest := versions[0]
+		for _, m := range versions[1:] {
+			if m.version() > latest.version() {
+				latest = m
+			}
+		}
+		return latest, nil
+	}
+	for _, m := range versions {
+		if m.version() == version {
+			return m, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "Request for unknown model: '%s' version %s is not found", name, version)
+}
+
+func validateInputs(modelConfig *triton_proto.ModelConfig, req *triton_proto.ModelInferRequest) error {
+	if len(req.Inputs) != len(modelConfig.Input) {
+		return fmt.Errorf("expected %d inputs, got %d", len(modelConfig.Input), len(req.Inputs))
+	}
+	if len(req.RawInputContents) != len(req.Inputs) {
+		return fmt.Errorf("expected raw contents for %d inputs, got %d", len(req.Inputs), len(req.RawInputContents))
+	}
+
+	for idx, input := range req.Inputs {
+		var inputCfg *triton_proto.ModelInput
+		for _, cfg := range modelConfig.Input {
+			if cfg.Name == input.Name {
+				inputCfg = cfg
+			}
+		}
+		if inputCfg == nil {
+			return fmt.Errorf("unexpected input %s", input.Name)
+		}
+		if input.Datatype != inputCfg.DataType.String()[5:] {
+			return fmt.Errorf("input %s: expected datatype %s, got %s", input.Name, inputCfg.DataType.String()[5:], input.Datatype)
+		}
+
+		if !shapeMatches(input.Shape, inputCfg.Dims) {
+			return fmt.Errorf("input %s: unexpected shape %v, expected %v", input.Name, input.Shape, inputCfg.Dims)
+		}
+
+		elements := int64(1)
+		for _, d := range input.Shape {
+			elements *= d
+		}
+		expected := elements * int64(dataTypeSize(inputCfg.DataType))
+		if int64(len(req.RawInputContents[idx])) != expected {
+			return fmt.Errorf("input %s: expected %d bytes for shape %v, got %d", input.Name, expected, input.Shape, len(req.RawInputContents[idx]))
+		}
+	}
+	return nil
+}
+
+// shapeMatches reports whether shape matches the configured dims, where -1 matches any size.
+func shapeMatches(shape, dims []int64) bool {
+	if len(shape) != len(dims) {
+		return false
+	}
+	for i := range shape {
+		if dims[i] != -1 && dims[i] != shape[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func cannedResponse(model *Model, req *triton_proto.ModelInferRequest) (*triton_proto.ModelInferResponse, error) {
+	resp := &triton_proto.ModelInferResponse{}
+	for _, outputCfg := range model.Config.Output {
+		shape := append([]int64(nil), outputCfg.Dims...)
+		batchSize := int64(1)
+		dynamic := len(shape) > 0 && shape[0] == -1
+		if dynamic {
+			shape[0] = 1
+		}
+		elements := int64(1)
+		for _, d := range shape {
+			elements *= d
+		}
+		if dynamic {
+			batchSize = req.Inputs[0].Shape[0]
+			shape[0] = batchSize
+		}
+
+		data, ok := model.Outputs[outputCfg.Name]
+		if !ok {
+			data = make([]float32, elements)
+		}
+		if int64(len(data)) != elements {
+			return nil, fmt.Errorf("canned output %s has %d elements, expected %d", outputCfg.Name, len(data), elements)
+		}
+		raw := make([]byte, 0, batchSize*elements*4)
+		for range batchSize {
+			raw = append(raw, utils.TToBytes(data)...)
+		}
+
+		resp.Outputs = append(resp.Outputs, &triton_proto.ModelInferResponse_InferOutputTensor{
+			Name:     outputCfg.Name,
+			Datatype: "FP32",
+			Shape:    shape,
+		})
+		resp.RawOutputContents = append(resp.RawOutputContents, raw)
+	}
+	return resp, nil
+}
+
+func dataTypeSize(dataType triton_proto.DataType) int {
+	switch dataType {
+	case triton_proto.DataType_TYPE_BOOL, triton_proto.DataType_TYPE_UINT8, triton_proto.DataType_TYPE_INT8:
+		return 1
+	case triton_proto.DataType_TYPE_UINT16, triton_proto.DataType_TYPE_INT16, triton_proto.DataType_TYPE_FP16, triton_proto.DataType_TYPE_BF16:
+		return 2
+	case triton_proto.DataType_TYPE_UINT64, triton_proto.DataType_TYPE_INT64, triton_proto.DataType_TYPE_FP64:
+		return 8
+	default:
+		return 4
+	}
+}
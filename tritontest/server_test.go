@@ -0,0 +1,104 @@
+package tritontest
+
+import (
+	"github.com/okieraised/go-faceid-pipeline/utils"
+	"github.com/okieraised/go-triton-client/triton_proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func testModel(version string, output []float32) *Model {
+	return &Model{
+		Config: &triton_proto.ModelConfig{
+			Name: "test_model",
+			Input: []*triton_proto.ModelInput{
+				{Name: "data", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 2}},
+			},
+			Output: []*triton_proto.ModelOutput{
+				{Name: "output", DataType: triton_proto.DataType_TYPE_FP32, Dims: []int64{1, 2}},
+			},
+		},
+		Version: version,
+		Outputs: map[string][]float32{"output": output},
+	}
+}
+
+func testRequest(version string, data []float32) *triton_proto.ModelInferRequest {
+	return &triton_proto.ModelInferRequest{
+		ModelName:    "test_model",
+		ModelVersion: version,
+		Inputs: []*triton_proto.ModelInferRequest_InferInputTensor{
+			{Name: "data", Datatype: "FP32", Shape: []int64{1, int64(len(data))}},
+		},
+		RawInputContents: [][]byte{utils.TToBytes(data)},
+	}
+}
+
+func TestServer_ModelInfer(t *testing.T) {
+	server := NewServer(testModel("1", []float32{1, 2}), testModel("2", []float32{3, 4}))
+	defer server.Close()
+
+	client, err := server.Dial()
+	assert.NoError(t, err)
+
+	resp, err := client.ModelGRPCInfer(time.Second, testRequest("1", []float32{0, 0}))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", resp.ModelVersion)
+	assert.Equal(t, utils.TToBytes([]float32{1, 2}), resp.RawOutputContents[0])
+
+	resp, err = client.ModelGRPCInfer(time.Second, testRequest("", []float32{0, 0}))
+	assert.NoError(t, err)
+	assert.Equal(t, "2", resp.ModelVersion)
+
+	_, err = client.ModelGRPCInfer(time.Second, testRequest("3", []float32{0, 0}))
+	assert.ErrorContains(t, err, "version 3 is not found")
+
+	_, err = client.ModelGRPCInfer(time.Second, testRequest("1", []float32{0, 0, 0}))
+	assert.ErrorContains(t, err, "unexpected shape [1 3]")
+
+	assert.Len(t, server.Requests(), 4)
+}
+
+func TestServer_Health(t *testing.T) {
+	notReady := testModel("2", nil)
+	notReady.NotReady = true
+	server := NewServer(testModel("1", nil), notReady)
+	defer server.Close()
+
+	backend, err := server.Backend()
+	assert.NoError(t, err)
+
+	live, err := backend.ServerLive(time.Second)
+	assert.NoError(t, err)
+	assert.True(t, live)
+
+	ready, err := backend.ModelReady(time.Second, "test_model", "1")
+	assert.NoError(t, err)
+	assert.True(t, ready)
+
+	ready, err = backend.ModelReady(time.Second, "test_model", "2")
+	assert.NoError(t, err)
+	assert.False(t, ready)
+
+	server.SetLive(false)
+	live, err = backend.ServerLive(time.Second)
+	assert.NoError(t, err)
+	assert.False(t, live)
+}
+
+func TestServer_Delay(t *testing.T) {
+	model := testModel("1", []float32{1, 2})
+	model.Delay = 100 * time.Millisecond
+	server := NewServer(model)
+	defer server.Close()
+
+	client, err := server.Dial()
+	assert.NoError(t, err)
+
+	_, err = client.ModelGRPCInfer(20*time.Millisecond, testRequest("1", []float32{0, 0}))
+	assert.ErrorContains(t, err, "DeadlineExceeded")
+
+	_, err = client.ModelGRPCInfer(time.Second, testRequest("1", []float32{0, 0}))
+	assert.NoError(t, err)
+}
@@ -21,3 +21,11 @@ func BytesToT64[T int64 | float64](arr []byte) []T {
 	ptr := unsafe.Pointer(&arr[0])
 	return (*[1 << 26]T)(ptr)[:l:l]
 }
+
+func TToBytes[T int32 | uint32 | float32 | int64 | float64 | uint8 | uint16 | int16 | int8 | uint64](arr []T) []byte {
+	if len(arr) == 0 {
+		return nil
+	}
+
+	return unsafe.Slice((*byte)(unsafe.Pointer(&arr[0])), len(arr)*int(unsafe.Sizeof(arr[0])))
+}
@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestFloat16RoundTrip(t *testing.T) {
+	for _, v := range []float32{0, 1, -1, 0.5, 127.5, -0.0078125, 65504, 6.1035156e-05, 5.9604645e-08} {
+		assert.Equal(t, v, Float16ToFloat32(Float32ToFloat16(v)))
+	}
+
+	assert.Equal(t, uint16(0x3c00), Float32ToFloat16(1))
+	assert.Equal(t, uint16(0x7c00), Float32ToFloat16(1e6))
+	assert.True(t, math.IsNaN(float64(Float16ToFloat32(Float32ToFloat16(float32(math.NaN()))))))
+	assert.InDelta(t, 0.1, Float16ToFloat32(Float32ToFloat16(0.1)), 1e-4)
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"container/list"
+	"gocv.io/x/gocv"
+	"sync"
+)
+
+// BufferPool reuses slices by length. It is safe for concurrent use.
+type BufferPool[T any] struct {
+	pools sync.Map
+}
+
+func NewBufferPool[T any]() *BufferPool[T] {
+	return &BufferPool[T]{}
+}
+
+// Get returns a slice of length n with undefined contents. The caller owns it until it is passed to Put.
+func (p *BufferPool[T]) Get(n int) []T {
+	pool, ok := p.pools.Load(n)
+	if ok {
+		buf, ok := pool.(*sync.Pool).Get().(*[]T)
+		if ok {
+			return *buf
+		}
+	}
+	return make([]T, n)
+}
+
+// Put returns buf to the pool. The caller must not use buf, or any slice sharing its memory, afterwards.
+func (p *BufferPool[T]) Put(buf []T) {
+	if cap(buf) == 0 {
+		return
+	}
+	buf = buf[:cap(buf)]
+	pool, _ := p.pools.LoadOrStore(len(buf), &sync.Pool{})
+	pool.(*sync.Pool).Put(&buf)
+}
+
+type matKey struct {
+	rows    int
+	cols    int
+	matType gocv.MatType
+}
+
+// idleMat is a Mat waiting in a MatPool.
+type idleMat struct {
+	key   matKey
+	mat   gocv.Mat
+	bytes int
+}
+
+// MatPool reuses Mats by size and type. Unlike slices, Mats hold native memory that the garbage collector does not
+// release, so the pool keeps at most maxIdle Mats per shape and maxIdleBytes of idle Mats overall. When a Mat put
+// back would exceed maxIdleBytes, the Mats idle for the longest time are closed to make room, so that the memory
+// pinned by shapes that stop being used, such as the sizes of input photos, is released. It is safe for concurrent
+// use.
+//
+// A Mat returned by Get is owned by the caller, which must pass it to Put exactly once and must not use or close it
+// afterwards. Views of a pooled Mat, such as regions, must be closed before the Mat is put back.
+type MatPool struct {
+	maxIdle      int
+	maxIdleBytes int
+
+	mu sync.Mutex
+	// idle holds the idle Mats of each shape, oldest first, as elements of order.
+	idle map[matKey][]*list.Element
+	// order holds every idle Mat, least recently put back first.
+	order       *list.List
+	idleBytes   int
+	outstanding int
+	closed      bool
+}
+
+func NewMatPool(maxIdle, maxIdleBytes int) *MatPool {
+	return &MatPool{
+		maxIdle:      maxIdle,
+		maxIdleBytes: maxIdleBytes,
+		idle:         make(map[matKey][]*list.Element),
+		order:        list.New(),
+	}
+}
+
+// Get returns a Mat of rows x cols of matType with undefined contents.
+func (p *MatPool) Get(rows, cols int, matType gocv.MatType) gocv.Mat {
+	key := matKey{rows: rows, cols: cols, matType: matType}
+
+	p.mu.Lock()
+	p.outstanding++
+	elems := p.idle[key]
+	if len(elems) > 0 {
+		entry := p.remove(elems[len(elems)-1])
+		p.mu.Unlock()
+		return entry.mat
+	}
+	p.mu.Unlock()
+
+	return gocv.NewMatWithSize(rows, cols, matType)
+}
+
+// Put takes back a Mat returned by Get. Mats that were resized to another shape are kept under their new shape.
+// Mats larger than maxIdleBytes are closed.
+func (p *MatPool) Put(mat gocv.Mat) {
+	p.mu.Lock()
+	p.outstanding--
+	if p.closed || mat.Empty() {
+		p.mu.Unlock()
+		_ = mat.Close()
+		return
+	}
+	key := matKey{rows: mat.Rows(), cols: mat.Cols(), matType: mat.Type()}
+	bytes := mat.Total() * mat.ElemSize()
+	if len(p.idle[key]) >= p.maxIdle || bytes > p.maxIdleBytes {
+		p.mu.Unlock()
+		_ = mat.Close()
+		return
+	}
+
+	evicted := make([]gocv.Mat, 0)
+	for p.idleBytes+bytes > p.maxIdleBytes {
+		evicted = append(evicted, p.remove(p.order.Front()).mat)
+	}
+	p.idle[key] = append(p.idle[key], p.order.PushBack(&idleMat{key: key, mat: mat, bytes: bytes}))
+	p.idleBytes += bytes
+	p.mu.Unlock()
+
+	for _, mat := range evicted {
+		_ = mat.Close()
+	}
+}
+
+// remove takes the idle Mat of elem out of the pool. The oldest idle Mat of a shape is the first of its elements, so
+// elem is either the first or the last one. p.mu must be held.
+func (p *MatPool) remove(elem *list.Element) *idleMat {
+	entry := p.order.Remove(elem).(*idleMat)
+	elems := p.idle[entry.key]
+	if elems[0] == elem {
+		elems = elems[1:]
+	} else {
+		elems = elems[:len(elems)-1]
+	}
+	if len(elems) == 0 {
+		delete(p.idle, entry.key)
+	} else {
+		p.idle[entry.key] = elems
+	}
+	p.idleBytes -= entry.bytes
+	return entry
+}
+
+// Outstanding returns the number of Mats returned by Get that were not put back yet.
+func (p *MatPool) Outstanding() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.outstanding
+}
+
+// IdleBytes returns the size of the data of the idle Mats.
+func (p *MatPool) IdleBytes() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.idleBytes
+}
+
+// Close closes the idle Mats. Mats put back afterwards are closed right away.
+func (p *MatPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for elem := p.order.Front(); elem != nil; elem = elem.Next() {
+		_ = elem.Value.(*idleMat).mat.Close()
+	}
+	p.idle = make(map[matKey][]*list.Element)
+	p.order.Init()
+	p.idleBytes = 0
+	return nil
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gocv.io/x/gocv"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool[float32]()
+
+	buf := pool.Get(4)
+	assert.Len(t, buf, 4)
+	pool.Put(buf)
+	assert.Len(t, pool.Get(4), 4)
+	assert.Len(t, pool.Get(8), 8)
+
+	// Empty buffers are not pooled.
+	pool.Put(nil)
+	assert.Len(t, pool.Get(0), 0)
+}
+
+func TestMatPool(t *testing.T) {
+	pool := NewMatPool(1, 1<<20)
+
+	first := pool.Get(2, 3, gocv.MatTypeCV8UC3)
+	second := pool.Get(2, 3, gocv.MatTypeCV8UC3)
+	assert.Equal(t, 2, first.Rows())
+	assert.Equal(t, 3, first.Cols())
+	assert.Equal(t, gocv.MatTypeCV8UC3, first.Type())
+	assert.Equal(t, 2, pool.Outstanding())
+
+	pool.Put(first)
+	// The pool is full, second is closed.
+	pool.Put(second)
+	assert.Equal(t, 0, pool.Outstanding())
+	assert.Len(t, pool.idle[matKey{rows: 2, cols: 3, matType: gocv.MatTypeCV8UC3}], 1)
+
+	reused := pool.Get(2, 3, gocv.MatTypeCV8UC3)
+	assert.Empty(t, pool.idle[matKey{rows: 2, cols: 3, matType: gocv.MatTypeCV8UC3}])
+	pool.Put(reused)
+
+	other := pool.Get(3, 2, gocv.MatTypeCV8UC3)
+	assert.NoError(t, pool.Close())
+	assert.Empty(t, pool.idle)
+	pool.Put(other)
+	assert.Empty(t, pool.idle)
+	assert.Equal(t, 0, pool.Outstanding())
+}
+
+func TestMatPool_IdleBytes(t *testing.T) {
+	// Room for four 100 x 100 3 channel Mats.
+	pool := NewMatPool(16, 4*100*100*3)
+	defer pool.Close()
+
+	// The Mats sized after input images, one shape per image, never pin more than the limit.
+	for size := 100; size < 150; size++ {
+		mat := pool.Get(size, 100, gocv.MatTypeCV8UC3)
+		pool.Put(mat)
+		assert.LessOrEqual(t, pool.IdleBytes(), 4*100*100*3)
+	}
+	assert.Equal(t, 0, pool.Outstanding())
+	// The shapes put back last are kept.
+	assert.Len(t, pool.idle[matKey{rows: 149, cols: 100, matType: gocv.MatTypeCV8UC3}], 1)
+	assert.Empty(t, pool.idle[matKey{rows: 100, cols: 100, matType: gocv.MatTypeCV8UC3}])
+
+	// A shape in use is reused while the others are evicted.
+	for size := 150; size < 200; size++ {
+		input := pool.Get(100, 100, gocv.MatTypeCV8UC3)
+		mat := pool.Get(size, 100, gocv.MatTypeCV8UC3)
+		pool.Put(mat)
+		pool.Put(input)
+		assert.LessOrEqual(t, pool.IdleBytes(), 4*100*100*3)
+	}
+	assert.Len(t, pool.idle[matKey{rows: 100, cols: 100, matType: gocv.MatTypeCV8UC3}], 1)
+
+	// Mats larger than the limit are closed.
+	large := pool.Get(1000, 1000, gocv.MatTypeCV8UC3)
+	pool.Put(large)
+	assert.Empty(t, pool.idle[matKey{rows: 1000, cols: 1000, matType: gocv.MatTypeCV8UC3}])
+	assert.LessOrEqual(t, pool.IdleBytes(), 4*100*100*3)
+
+	assert.NoError(t, pool.Close())
+	assert.Equal(t, 0, pool.IdleBytes())
+	assert.Empty(t, pool.idle)
+}
@@ -56,8 +56,12 @@ func ArgSortDescending(t *tensor.Dense) ([]int, error) {
 		return nil, fmt.Errorf("expected a 1D tensor, got shape %v", shape)
 	}
 
-	data := t.Data().([]float32)
+	return ArgSortDescendingFloat32s(t.Data().([]float32)), nil
+}
 
+// ArgSortDescendingFloat32s returns the indices of data ordered by decreasing value. The order of equal values is
+// the same as with ArgSortDescending.
+func ArgSortDescendingFloat32s(data []float32) []int {
 	indices := make([]int, len(data))
 	for i := range indices {
 		indices[i] = i
@@ -67,7 +71,7 @@ func ArgSortDescending(t *tensor.Dense) ([]int, error) {
 		return data[indices[i]] > data[indices[j]]
 	})
 
-	return indices, nil
+	return indices
 }
 
 func SelectRows1D(t *tensor.Dense, indices []int) (*tensor.Dense, error) {
@@ -241,3 +245,28 @@ func L2Norm(t *tensor.Dense) (float64, error) {
 
 	return math.Sqrt(sumSquares), nil
 }
+
+func CosineSimilarity(a, b *tensor.Dense) (float32, error) {
+	aData, bData := a.Float32s(), b.Float32s()
+	if len(aData) != len(bData) {
+		return 0, fmt.Errorf("tensor sizes differ: %d and %d", len(aData), len(bData))
+	}
+
+	aNorm, err := L2Norm(a)
+	if err != nil {
+		return 0, err
+	}
+	bNorm, err := L2Norm(b)
+	if err != nil {
+		return 0, err
+	}
+	if aNorm == 0 || bNorm == 0 {
+		return 0, fmt.Errorf("tensor has zero norm")
+	}
+
+	dot := float64(0)
+	for i := range aData {
+		dot += float64(aData[i]) * float64(bData[i])
+	}
+	return float32(dot / (aNorm * bNorm)), nil
+}